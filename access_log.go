@@ -0,0 +1,368 @@
+// Copyright 2021-2024 The Connect Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package connect
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+
+	"google.golang.org/protobuf/proto"
+)
+
+// AccessLogFormat is the output format of the interceptor returned by
+// [NewAccessLogInterceptor].
+type AccessLogFormat int
+
+const (
+	// AccessLogJSON writes each entry as a JSON object on its own line.
+	AccessLogJSON AccessLogFormat = iota + 1
+	// AccessLogLogfmt writes each entry as a line of space-separated key=value
+	// pairs.
+	AccessLogLogfmt
+)
+
+const accessLogRedacted = "REDACTED"
+
+// An AccessLogOption configures the interceptor returned by
+// [NewAccessLogInterceptor].
+type AccessLogOption interface {
+	applyToAccessLog(*accessLogConfig)
+}
+
+// WithAccessLogHeaders includes the values of the named request headers in
+// each entry. Headers missing from a request are omitted.
+func WithAccessLogHeaders(keys ...string) AccessLogOption {
+	return &accessLogHeadersOption{Keys: keys}
+}
+
+// WithAccessLogRedactedHeaders includes the named request headers in each
+// entry, but replaces their values with "REDACTED". This records whether
+// sensitive headers, like Authorization, were sent without logging their
+// contents. Redaction takes precedence over [WithAccessLogHeaders].
+func WithAccessLogRedactedHeaders(keys ...string) AccessLogOption {
+	return &accessLogHeadersOption{Keys: keys, Redact: true}
+}
+
+// NewAccessLogInterceptor constructs a handler interceptor that writes an
+// access log entry to w for each completed call. Entries are written in the
+// supplied format with a fixed set of fields, in this order:
+//
+//   - time: when the call started, in RFC 3339 format with nanoseconds (UTC)
+//   - procedure: the procedure's full path, like "/acme.foo.v1.FooService/Bar"
+//   - protocol: the RPC protocol, like "connect" or "grpc"
+//   - code: the call's [Code], or "ok" if it succeeded
+//   - duration_ms: the call's latency in milliseconds, including streams'
+//     whole lifetimes
+//   - peer: the client's address
+//   - request_bytes and response_bytes: the total size of the messages
+//     received and sent, measured as binary Protobuf regardless of the codec
+//     in use (non-Protobuf messages count as zero)
+//   - header: request headers configured with [WithAccessLogHeaders] and
+//     [WithAccessLogRedactedHeaders], in JSON as an object and in logfmt as
+//     "header.<key>" fields
+//
+// Entries are formatted without reflection, and each one is written to w with
+// a single call to Write; the interceptor serializes writes, so w needn't be
+// safe for concurrent use. Write errors are ignored. The interceptor has no
+// effect on clients.
+func NewAccessLogInterceptor(w io.Writer, format AccessLogFormat, options ...AccessLogOption) Interceptor {
+	config := accessLogConfig{}
+	for _, opt := range options {
+		opt.applyToAccessLog(&config)
+	}
+	return &accessLogInterceptor{writer: w, format: format, config: config}
+}
+
+type accessLogConfig struct {
+	Headers []accessLogHeader
+}
+
+type accessLogHeader struct {
+	Key    string
+	Redact bool
+}
+
+type accessLogHeadersOption struct {
+	Keys   []string
+	Redact bool
+}
+
+func (o *accessLogHeadersOption) applyToAccessLog(config *accessLogConfig) {
+	for _, key := range o.Keys {
+		replaced := false
+		for i := range config.Headers {
+			if http.CanonicalHeaderKey(config.Headers[i].Key) == http.CanonicalHeaderKey(key) {
+				config.Headers[i].Redact = config.Headers[i].Redact || o.Redact
+				replaced = true
+			}
+		}
+		if !replaced {
+			config.Headers = append(config.Headers, accessLogHeader{Key: key, Redact: o.Redact})
+		}
+	}
+}
+
+type accessLogInterceptor struct {
+	writer io.Writer
+	format AccessLogFormat
+	config accessLogConfig
+
+	mu sync.Mutex // serializes writes
+}
+
+func (i *accessLogInterceptor) WrapUnary(next UnaryFunc) UnaryFunc {
+	return func(ctx context.Context, request AnyRequest) (AnyResponse, error) {
+		if request.Spec().IsClient {
+			return next(ctx, request)
+		}
+		start := time.Now()
+		response, err := next(ctx, request)
+		entry := accessLogEntry{
+			start:        start,
+			duration:     time.Since(start),
+			spec:         request.Spec(),
+			peer:         request.Peer(),
+			header:       request.Header(),
+			requestBytes: messageSize(request.Any()),
+			err:          err,
+		}
+		if err == nil {
+			entry.responseBytes = messageSize(response.Any())
+		}
+		i.log(&entry)
+		return response, err
+	}
+}
+
+func (i *accessLogInterceptor) WrapStreamingClient(next StreamingClientFunc) StreamingClientFunc {
+	return next
+}
+
+func (i *accessLogInterceptor) WrapStreamingHandler(next StreamingHandlerFunc) StreamingHandlerFunc {
+	return func(ctx context.Context, conn StreamingHandlerConn) error {
+		start := time.Now()
+		counted := &accessLogHandlerConn{StreamingHandlerConn: conn}
+		err := next(ctx, counted)
+		i.log(&accessLogEntry{
+			start:         start,
+			duration:      time.Since(start),
+			spec:          conn.Spec(),
+			peer:          conn.Peer(),
+			header:        conn.RequestHeader(),
+			requestBytes:  counted.received.Load(),
+			responseBytes: counted.sent.Load(),
+			err:           err,
+		})
+		return err
+	}
+}
+
+func (i *accessLogInterceptor) log(entry *accessLogEntry) {
+	var line []byte
+	if i.format == AccessLogLogfmt {
+		line = entry.appendLogfmt(make([]byte, 0, 256), i.config.Headers)
+	} else {
+		line = entry.appendJSON(make([]byte, 0, 256), i.config.Headers)
+	}
+	line = append(line, '\n')
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	_, _ = i.writer.Write(line)
+}
+
+type accessLogEntry struct {
+	start         time.Time
+	duration      time.Duration
+	spec          Spec
+	peer          Peer
+	header        http.Header
+	requestBytes  int64
+	responseBytes int64
+	err           error
+}
+
+func (e *accessLogEntry) code() string {
+	if e.err == nil {
+		return "ok"
+	}
+	return CodeOf(e.err).String()
+}
+
+func (e *accessLogEntry) durationMillis() string {
+	return strconv.FormatFloat(float64(e.duration)/float64(time.Millisecond), 'f', 3, 64)
+}
+
+func (e *accessLogEntry) appendJSON(dst []byte, headers []accessLogHeader) []byte {
+	dst = append(dst, `{"time":`...)
+	dst = appendJSONString(dst, e.start.UTC().Format(time.RFC3339Nano))
+	dst = append(dst, `,"procedure":`...)
+	dst = appendJSONString(dst, e.spec.Procedure)
+	dst = append(dst, `,"protocol":`...)
+	dst = appendJSONString(dst, e.peer.Protocol)
+	dst = append(dst, `,"code":`...)
+	dst = appendJSONString(dst, e.code())
+	dst = append(dst, `,"duration_ms":`...)
+	dst = append(dst, e.durationMillis()...)
+	dst = append(dst, `,"peer":`...)
+	dst = appendJSONString(dst, e.peer.Addr)
+	dst = append(dst, `,"request_bytes":`...)
+	dst = strconv.AppendInt(dst, e.requestBytes, 10)
+	dst = append(dst, `,"response_bytes":`...)
+	dst = strconv.AppendInt(dst, e.responseBytes, 10)
+	dst = append(dst, `,"header":{`...)
+	first := true
+	for _, header := range headers {
+		value, ok := e.headerValue(header)
+		if !ok {
+			continue
+		}
+		if !first {
+			dst = append(dst, ',')
+		}
+		first = false
+		dst = appendJSONString(dst, http.CanonicalHeaderKey(header.Key))
+		dst = append(dst, ':')
+		dst = appendJSONString(dst, value)
+	}
+	return append(dst, "}}"...)
+}
+
+func (e *accessLogEntry) appendLogfmt(dst []byte, headers []accessLogHeader) []byte {
+	dst = append(dst, "time="...)
+	dst = appendLogfmtValue(dst, e.start.UTC().Format(time.RFC3339Nano))
+	dst = append(dst, " procedure="...)
+	dst = appendLogfmtValue(dst, e.spec.Procedure)
+	dst = append(dst, " protocol="...)
+	dst = appendLogfmtValue(dst, e.peer.Protocol)
+	dst = append(dst, " code="...)
+	dst = appendLogfmtValue(dst, e.code())
+	dst = append(dst, " duration_ms="...)
+	dst = append(dst, e.durationMillis()...)
+	dst = append(dst, " peer="...)
+	dst = appendLogfmtValue(dst, e.peer.Addr)
+	dst = append(dst, " request_bytes="...)
+	dst = strconv.AppendInt(dst, e.requestBytes, 10)
+	dst = append(dst, " response_bytes="...)
+	dst = strconv.AppendInt(dst, e.responseBytes, 10)
+	for _, header := range headers {
+		value, ok := e.headerValue(header)
+		if !ok {
+			continue
+		}
+		dst = append(dst, " header."...)
+		dst = append(dst, http.CanonicalHeaderKey(header.Key)...)
+		dst = append(dst, '=')
+		dst = appendLogfmtValue(dst, value)
+	}
+	return dst
+}
+
+func (e *accessLogEntry) headerValue(header accessLogHeader) (string, bool) {
+	values := e.header.Values(header.Key)
+	if len(values) == 0 {
+		return "", false
+	}
+	if header.Redact {
+		return accessLogRedacted, true
+	}
+	return strings.Join(values, ", "), true
+}
+
+// accessLogHandlerConn totals the size of the messages a stream sends and
+// receives.
+type accessLogHandlerConn struct {
+	StreamingHandlerConn
+
+	received atomic.Int64
+	sent     atomic.Int64
+}
+
+func (c *accessLogHandlerConn) Receive(msg any) error {
+	if err := c.StreamingHandlerConn.Receive(msg); err != nil {
+		return err
+	}
+	c.received.Add(messageSize(msg))
+	return nil
+}
+
+func (c *accessLogHandlerConn) Send(msg any) error {
+	if err := c.StreamingHandlerConn.Send(msg); err != nil {
+		return err
+	}
+	c.sent.Add(messageSize(msg))
+	return nil
+}
+
+func messageSize(msg any) int64 {
+	if protoMessage, ok := msg.(proto.Message); ok {
+		return int64(proto.Size(protoMessage))
+	}
+	return 0
+}
+
+// appendJSONString appends s to dst as a quoted JSON string.
+func appendJSONString(dst []byte, s string) []byte {
+	const hex = "0123456789abcdef"
+	dst = append(dst, '"')
+	for i := 0; i < len(s); {
+		char := s[i]
+		if char < utf8.RuneSelf {
+			switch {
+			case char == '"' || char == '\\':
+				dst = append(dst, '\\', char)
+			case char == '\n':
+				dst = append(dst, '\\', 'n')
+			case char == '\r':
+				dst = append(dst, '\\', 'r')
+			case char == '\t':
+				dst = append(dst, '\\', 't')
+			case char < 0x20:
+				dst = append(dst, '\\', 'u', '0', '0', hex[char>>4], hex[char&0xF])
+			default:
+				dst = append(dst, char)
+			}
+			i++
+			continue
+		}
+		r, size := utf8.DecodeRuneInString(s[i:])
+		if r == utf8.RuneError && size == 1 {
+			dst = append(dst, "\ufffd"...)
+		} else {
+			dst = append(dst, s[i:i+size]...)
+		}
+		i += size
+	}
+	return append(dst, '"')
+}
+
+// appendLogfmtValue appends s to dst, quoting it if necessary.
+func appendLogfmtValue(dst []byte, s string) []byte {
+	if s == "" {
+		return append(dst, `""`...)
+	}
+	for i := 0; i < len(s); i++ {
+		if char := s[i]; char <= ' ' || char == '=' || char == '"' || char >= utf8.RuneSelf {
+			return strconv.AppendQuote(dst, s)
+		}
+	}
+	return append(dst, s...)
+}
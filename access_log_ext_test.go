@@ -0,0 +1,173 @@
+// Copyright 2021-2024 The Connect Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package connect_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	connect "connectrpc.com/connect"
+	"connectrpc.com/connect/internal/assert"
+	pingv1 "connectrpc.com/connect/internal/gen/connect/ping/v1"
+	"connectrpc.com/connect/internal/gen/connect/ping/v1/pingv1connect"
+	"connectrpc.com/connect/internal/memhttp/memhttptest"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestAccessLogInterceptor(t *testing.T) {
+	t.Parallel()
+	newClient := func(t *testing.T, format connect.AccessLogFormat) (pingv1connect.PingServiceClient, *accessLogBuffer) {
+		t.Helper()
+		logs := &accessLogBuffer{}
+		mux := http.NewServeMux()
+		mux.Handle(pingv1connect.NewPingServiceHandler(
+			pingServer{},
+			connect.WithInterceptors(connect.NewAccessLogInterceptor(
+				logs,
+				format,
+				connect.WithAccessLogHeaders("X-Request-Id", "Authorization"),
+				connect.WithAccessLogRedactedHeaders("authorization"),
+			)),
+		))
+		server := memhttptest.NewServer(t, mux)
+		return pingv1connect.NewPingServiceClient(server.Client(), server.URL()), logs
+	}
+	newRequest := func(msg *pingv1.PingRequest) *connect.Request[pingv1.PingRequest] {
+		request := connect.NewRequest(msg)
+		request.Header().Set("X-Request-Id", "abc \"123\"")
+		request.Header().Set("Authorization", "Bearer secret")
+		return request
+	}
+
+	t.Run("json", func(t *testing.T) {
+		t.Parallel()
+		client, logs := newClient(t, connect.AccessLogJSON)
+		msg := &pingv1.PingRequest{Number: 42, Text: "hello"}
+		_, err := client.Ping(context.Background(), newRequest(msg))
+		assert.Nil(t, err)
+		_, err = client.Fail(context.Background(), connect.NewRequest(&pingv1.FailRequest{Code: int32(connect.CodeResourceExhausted)}))
+		assert.NotNil(t, err)
+		stream, err := client.CountUp(context.Background(), connect.NewRequest(&pingv1.CountUpRequest{Number: 3}))
+		assert.Nil(t, err)
+		for stream.Receive() {
+		}
+		assert.Nil(t, stream.Close())
+
+		lines := logs.Lines(t, 3)
+		assert.Equal(t, len(lines), 3)
+		entries := make([]map[string]any, len(lines))
+		for i, line := range lines {
+			assert.Nil(t, json.Unmarshal([]byte(line), &entries[i]))
+		}
+		keys := make([]string, 0, len(entries[0]))
+		for key := range entries[0] {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		assert.Equal(t, keys, []string{
+			"code", "duration_ms", "header", "peer", "procedure", "protocol",
+			"request_bytes", "response_bytes", "time",
+		})
+
+		ping := entries[0]
+		start, err := time.Parse(time.RFC3339Nano, ping["time"].(string)) //nolint:forcetypeassert
+		assert.Nil(t, err)
+		assert.True(t, time.Since(start) < time.Minute)
+		assert.Equal(t, ping["procedure"], any(pingv1connect.PingServicePingProcedure))
+		assert.Equal(t, ping["protocol"], any(connect.ProtocolConnect))
+		assert.Equal(t, ping["code"], any("ok"))
+		assert.NotZero(t, ping["peer"])
+		assert.Equal(t, ping["request_bytes"], any(float64(proto.Size(msg))))
+		assert.Equal(t, ping["response_bytes"], any(float64(proto.Size(&pingv1.PingResponse{Number: 42, Text: "hello"}))))
+		assert.Equal(t, ping["header"], any(map[string]any{
+			"X-Request-Id":  `abc "123"`,
+			"Authorization": "REDACTED",
+		}))
+
+		fail := entries[1]
+		assert.Equal(t, fail["code"], any(connect.CodeResourceExhausted.String()))
+		assert.Equal(t, fail["header"], any(map[string]any{}))
+
+		countUp := entries[2]
+		assert.Equal(t, countUp["procedure"], any(pingv1connect.PingServiceCountUpProcedure))
+		var sent int
+		for i := int64(1); i <= 3; i++ {
+			sent += proto.Size(&pingv1.CountUpResponse{Number: i})
+		}
+		assert.Equal(t, countUp["response_bytes"], any(float64(sent)))
+	})
+	t.Run("logfmt", func(t *testing.T) {
+		t.Parallel()
+		client, logs := newClient(t, connect.AccessLogLogfmt)
+		_, err := client.Ping(context.Background(), newRequest(&pingv1.PingRequest{Number: 42}))
+		assert.Nil(t, err)
+		line := logs.Lines(t, 1)[0] + "\n"
+		assert.True(t, strings.HasPrefix(line, "time="))
+		assert.True(t, strings.HasSuffix(line, "\n"))
+		for _, field := range []string{
+			" procedure=" + pingv1connect.PingServicePingProcedure + " ",
+			" protocol=connect ",
+			" code=ok ",
+			" request_bytes=2 ",
+			" response_bytes=2 ",
+			` header.X-Request-Id="abc \"123\""`,
+			" header.Authorization=REDACTED",
+		} {
+			assert.True(t, strings.Contains(line, field), assert.Sprintf("missing %q in %q", field, line))
+		}
+	})
+}
+
+// accessLogBuffer collects access log lines. Handlers write their entries
+// after the response is complete, so readers wait for the lines they expect.
+type accessLogBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *accessLogBuffer) Write(data []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(data)
+}
+
+func (b *accessLogBuffer) Lines(tb testing.TB, want int) []string {
+	tb.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		b.mu.Lock()
+		logs := b.buf.String()
+		b.mu.Unlock()
+		lines := strings.SplitAfter(logs, "\n")
+		if len(lines) > want || time.Now().After(deadline) {
+			lines = lines[:len(lines)-1]
+			for i := range lines {
+				lines[i] = strings.TrimSuffix(lines[i], "\n")
+			}
+			if len(lines) != want {
+				tb.Fatalf("got %d access log lines, want %d: %q", len(lines), want, logs)
+			}
+			return lines
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
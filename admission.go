@@ -0,0 +1,69 @@
+// Copyright 2021-2024 The Connect Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package connect
+
+import (
+	"context"
+	"time"
+)
+
+type admissionWaitContextKey struct{}
+
+// AdmissionWait returns how long the current call waited for a slot from a
+// concurrency limit configured with [WithMaxConcurrent] before the handler
+// began executing. Interceptors may use it to report queueing latency
+// separately from execution time.
+//
+// If no limit is configured, or the context doesn't belong to a handler
+// invocation, AdmissionWait returns zero.
+func AdmissionWait(ctx context.Context) time.Duration {
+	wait, _ := ctx.Value(admissionWaitContextKey{}).(time.Duration)
+	return wait
+}
+
+// admissionLimiter is a counting semaphore shared by all the handlers
+// configured with the same WithMaxConcurrent option.
+type admissionLimiter struct {
+	slots chan struct{}
+}
+
+func newAdmissionLimiter(limit int) *admissionLimiter {
+	if limit <= 0 {
+		return nil
+	}
+	return &admissionLimiter{slots: make(chan struct{}, limit)}
+}
+
+// Acquire blocks until a slot is available or the context is done. On
+// success, it returns a context carrying the time spent waiting.
+func (l *admissionLimiter) Acquire(ctx context.Context) (context.Context, error) {
+	start := time.Now()
+	select {
+	case l.slots <- struct{}{}:
+		return context.WithValue(ctx, admissionWaitContextKey{}, time.Since(start)), nil
+	case <-ctx.Done():
+		err := ctx.Err()
+		return ctx, errorf(
+			CodeOf(wrapIfContextError(err)),
+			"waited %v for one of %d concurrent call slots: %w",
+			time.Since(start).Round(time.Millisecond), cap(l.slots), err,
+		)
+	}
+}
+
+// Release frees a slot acquired with Acquire.
+func (l *admissionLimiter) Release() {
+	<-l.slots
+}
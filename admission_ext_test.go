@@ -0,0 +1,98 @@
+// Copyright 2021-2024 The Connect Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package connect_test
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	connect "connectrpc.com/connect"
+	"connectrpc.com/connect/internal/assert"
+	pingv1 "connectrpc.com/connect/internal/gen/connect/ping/v1"
+	"connectrpc.com/connect/internal/gen/connect/ping/v1/pingv1connect"
+	"connectrpc.com/connect/internal/memhttp/memhttptest"
+)
+
+func TestMaxConcurrent(t *testing.T) {
+	t.Parallel()
+	const holdFor = 50 * time.Millisecond
+	newClient := func(t *testing.T, waits chan<- time.Duration, opts ...connect.HandlerOption) pingv1connect.PingServiceClient {
+		t.Helper()
+		recordWait := connect.UnaryInterceptorFunc(func(next connect.UnaryFunc) connect.UnaryFunc {
+			return func(ctx context.Context, request connect.AnyRequest) (connect.AnyResponse, error) {
+				waits <- connect.AdmissionWait(ctx)
+				return next(ctx, request)
+			}
+		})
+		opts = append(opts, connect.WithInterceptors(recordWait))
+		mux := http.NewServeMux()
+		mux.Handle(pingv1connect.NewPingServiceHandler(&pluggablePingServer{
+			ping: func(context.Context, *connect.Request[pingv1.PingRequest]) (*connect.Response[pingv1.PingResponse], error) {
+				time.Sleep(holdFor)
+				return connect.NewResponse(&pingv1.PingResponse{}), nil
+			},
+		}, opts...))
+		server := memhttptest.NewServer(t, mux)
+		return pingv1connect.NewPingServiceClient(server.Client(), server.URL())
+	}
+	t.Run("queued", func(t *testing.T) {
+		t.Parallel()
+		waits := make(chan time.Duration, 2)
+		client := newClient(t, waits, connect.WithMaxConcurrent(1))
+		var wg sync.WaitGroup
+		for i := 0; i < 2; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				_, err := client.Ping(context.Background(), connect.NewRequest(&pingv1.PingRequest{}))
+				assert.Nil(t, err)
+			}()
+		}
+		wg.Wait()
+		close(waits)
+		var longest time.Duration
+		for wait := range waits {
+			longest = max(longest, wait)
+		}
+		assert.True(t, longest >= holdFor/2, assert.Sprintf("longest wait %v", longest))
+	})
+	t.Run("shed", func(t *testing.T) {
+		t.Parallel()
+		client := newClient(t, make(chan time.Duration, 2), connect.WithMaxConcurrent(1))
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			_, err := client.Ping(context.Background(), connect.NewRequest(&pingv1.PingRequest{}))
+			assert.Nil(t, err)
+		}()
+		time.Sleep(holdFor / 5)
+		ctx, cancel := context.WithTimeout(context.Background(), holdFor/5)
+		defer cancel()
+		_, err := client.Ping(ctx, connect.NewRequest(&pingv1.PingRequest{}))
+		assert.Equal(t, connect.CodeOf(err), connect.CodeDeadlineExceeded)
+		<-done
+	})
+	t.Run("unlimited", func(t *testing.T) {
+		t.Parallel()
+		waits := make(chan time.Duration, 1)
+		client := newClient(t, waits)
+		_, err := client.Ping(context.Background(), connect.NewRequest(&pingv1.PingRequest{}))
+		assert.Nil(t, err)
+		assert.Zero(t, <-waits)
+	})
+}
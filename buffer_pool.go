@@ -17,6 +17,7 @@ package connect
 import (
 	"bytes"
 	"sync"
+	"sync/atomic"
 )
 
 const (
@@ -52,3 +53,44 @@ func (b *bufferPool) Put(buffer *bytes.Buffer) {
 	buffer.Reset()
 	b.Pool.Put(buffer)
 }
+
+// bufferBudget limits the total number of bytes buffered by the handlers
+// configured with the same WithGlobalBufferBudget option. Its methods are
+// no-ops on a nil receiver, so callers needn't check whether a budget is
+// configured.
+type bufferBudget struct {
+	limit int64
+	used  atomic.Int64
+}
+
+func newBufferBudget(limit int64) *bufferBudget {
+	if limit <= 0 {
+		return nil
+	}
+	return &bufferBudget{limit: limit}
+}
+
+// acquire reserves size bytes, failing with CodeResourceExhausted if that
+// would exceed the budget. Successful calls must be paired with a call to
+// release.
+func (b *bufferBudget) acquire(size int64) *Error {
+	if b == nil || size <= 0 {
+		return nil
+	}
+	if used := b.used.Add(size); used > b.limit {
+		b.used.Add(-size)
+		return errorf(
+			CodeResourceExhausted,
+			"buffering %d byte message would exceed global buffer budget of %d bytes (%d in use)",
+			size, b.limit, used-size,
+		)
+	}
+	return nil
+}
+
+func (b *bufferBudget) release(size int64) {
+	if b == nil || size <= 0 {
+		return
+	}
+	b.used.Add(-size)
+}
@@ -0,0 +1,291 @@
+// Copyright 2021-2024 The Connect Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package connect
+
+import (
+	"container/list"
+	"context"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	defaultCacheMaxEntries = 1024
+	defaultCacheTTL        = time.Minute
+)
+
+// A CacheOption configures the interceptor returned by [NewCacheInterceptor].
+type CacheOption interface {
+	applyToCache(*cacheConfig)
+}
+
+// WithCacheMaxEntries sets the maximum number of responses the cache holds.
+// When the cache is full, the least recently used response is evicted.
+//
+// The default is 1024 entries. Values less than one are ignored.
+func WithCacheMaxEntries(maxEntries int) CacheOption {
+	return &cacheMaxEntriesOption{Max: maxEntries}
+}
+
+// WithCacheTTL sets how long a cached response may be served after it was
+// received from the server.
+//
+// The default is one minute. Values less than or equal to zero are ignored.
+func WithCacheTTL(ttl time.Duration) CacheOption {
+	return &cacheTTLOption{TTL: ttl}
+}
+
+// WithCacheProcedures marks procedures as cacheable. Procedures are identified
+// by their fully-qualified name, as exposed by [Spec.Procedure] (for example,
+// "/acme.foo.v1.FooService/Bar").
+//
+// By default, only procedures declared as free of side effects (see
+// [WithIdempotency]) are cached. Once any procedures are marked with
+// WithCacheProcedures, only the marked procedures are cached.
+func WithCacheProcedures(procedures ...string) CacheOption {
+	return &cacheProceduresOption{Procedures: procedures}
+}
+
+// WithCacheKey partitions the cache by an additional key derived from each
+// request, such as the user or tenant the request is made for. Requests share
+// cache entries only if key returns the same string for both, in addition to
+// having the same server, procedure, and message. If key returns false, the
+// request isn't cached.
+//
+// By default, requests carrying credentials (the Authorization, Cookie, or
+// Proxy-Authorization headers) aren't cached, since their responses may be
+// specific to the caller. With WithCacheKey, they're cached and key is
+// responsible for keeping different callers' responses apart.
+func WithCacheKey(key func(AnyRequest) (string, bool)) CacheOption {
+	return &cacheKeyOption{Key: key}
+}
+
+// NewCacheInterceptor constructs a client interceptor that caches successful
+// responses to unary RPCs. While a response is cached, identical requests to
+// the same procedure are served from the cache without contacting the server.
+//
+// Requests are considered identical if they're sent to the same server and
+// procedure and their messages have the same deterministic binary Protobuf
+// encoding, so the cache is unaffected by the codec and compression used on
+// the wire. Other request headers are ignored, so requests with credentials
+// aren't cached unless [WithCacheKey] tells the cache how to partition them.
+// Messages that aren't Protobuf messages are never cached. Errors and
+// streaming RPCs are never cached, and the interceptor has no effect on
+// handlers. Each cache hit returns a copy of the cached response, so callers
+// may safely mutate it.
+//
+// The returned interceptor is safe to use concurrently. Clients sharing it
+// share cached responses, subject to the rules above.
+func NewCacheInterceptor(options ...CacheOption) Interceptor {
+	config := cacheConfig{
+		MaxEntries: defaultCacheMaxEntries,
+		TTL:        defaultCacheTTL,
+	}
+	for _, opt := range options {
+		opt.applyToCache(&config)
+	}
+	return &cacheInterceptor{
+		config:  config,
+		entries: make(map[string]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+type cacheConfig struct {
+	MaxEntries int
+	TTL        time.Duration
+	Procedures map[string]struct{}
+	Key        func(AnyRequest) (string, bool)
+}
+
+func (c *cacheConfig) isCacheable(spec Spec) bool {
+	if spec.StreamType != StreamTypeUnary || !spec.IsClient {
+		return false
+	}
+	if c.Procedures == nil {
+		return spec.IdempotencyLevel == IdempotencyNoSideEffects
+	}
+	_, ok := c.Procedures[spec.Procedure]
+	return ok
+}
+
+type cacheMaxEntriesOption struct {
+	Max int
+}
+
+func (o *cacheMaxEntriesOption) applyToCache(config *cacheConfig) {
+	if o.Max > 0 {
+		config.MaxEntries = o.Max
+	}
+}
+
+type cacheTTLOption struct {
+	TTL time.Duration
+}
+
+func (o *cacheTTLOption) applyToCache(config *cacheConfig) {
+	if o.TTL > 0 {
+		config.TTL = o.TTL
+	}
+}
+
+type cacheProceduresOption struct {
+	Procedures []string
+}
+
+func (o *cacheProceduresOption) applyToCache(config *cacheConfig) {
+	if config.Procedures == nil {
+		config.Procedures = make(map[string]struct{}, len(o.Procedures))
+	}
+	for _, procedure := range o.Procedures {
+		config.Procedures[procedure] = struct{}{}
+	}
+}
+
+type cacheKeyOption struct {
+	Key func(AnyRequest) (string, bool)
+}
+
+func (o *cacheKeyOption) applyToCache(config *cacheConfig) {
+	config.Key = o.Key
+}
+
+type cacheEntry struct {
+	key      string
+	response AnyResponse
+	expires  time.Time
+}
+
+type cacheInterceptor struct {
+	config cacheConfig
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List // front is most recently used
+}
+
+func (i *cacheInterceptor) WrapUnary(next UnaryFunc) UnaryFunc {
+	return func(ctx context.Context, request AnyRequest) (AnyResponse, error) {
+		if !i.config.isCacheable(request.Spec()) {
+			return next(ctx, request)
+		}
+		key, ok := i.config.cacheKey(request)
+		if !ok {
+			return next(ctx, request)
+		}
+		if err := ctx.Err(); err != nil {
+			return nil, wrapIfContextError(err)
+		}
+		if response, ok := i.get(key); ok {
+			return response, nil
+		}
+		response, err := next(ctx, request)
+		if err != nil {
+			return nil, err
+		}
+		i.set(key, response)
+		return response, nil
+	}
+}
+
+func (i *cacheInterceptor) WrapStreamingClient(next StreamingClientFunc) StreamingClientFunc {
+	return next
+}
+
+func (i *cacheInterceptor) WrapStreamingHandler(next StreamingHandlerFunc) StreamingHandlerFunc {
+	return next
+}
+
+func (i *cacheInterceptor) get(key string) (AnyResponse, bool) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	elem, ok := i.entries[key]
+	if !ok {
+		return nil, false
+	}
+	entry, ok := elem.Value.(*cacheEntry)
+	if !ok || time.Now().After(entry.expires) {
+		i.lru.Remove(elem)
+		delete(i.entries, key)
+		return nil, false
+	}
+	i.lru.MoveToFront(elem)
+	return entry.response.clone(), true
+}
+
+func (i *cacheInterceptor) set(key string, response AnyResponse) {
+	// Store a copy, so that callers mutating the response they received don't
+	// corrupt the cache.
+	entry := &cacheEntry{
+		key:      key,
+		response: response.clone(),
+		expires:  time.Now().Add(i.config.TTL),
+	}
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if elem, ok := i.entries[key]; ok {
+		elem.Value = entry
+		i.lru.MoveToFront(elem)
+		return
+	}
+	i.entries[key] = i.lru.PushFront(entry)
+	for i.lru.Len() > i.config.MaxEntries {
+		oldest := i.lru.Back()
+		i.lru.Remove(oldest)
+		if evicted, ok := oldest.Value.(*cacheEntry); ok {
+			delete(i.entries, evicted.key)
+		}
+	}
+}
+
+// cacheKey derives a cache key from the server, the procedure, the decoded
+// request message, and any caller-supplied partition, so that it's
+// independent of the codec and compression in use.
+func (c *cacheConfig) cacheKey(request AnyRequest) (string, bool) {
+	var partition string
+	if c.Key != nil {
+		var ok bool
+		if partition, ok = c.Key(request); !ok {
+			return "", false
+		}
+	} else if hasCredentials(request.Header()) {
+		return "", false
+	}
+	msg, ok := request.Any().(proto.Message)
+	if !ok {
+		return "", false
+	}
+	data, err := proto.MarshalOptions{Deterministic: true}.Marshal(msg)
+	if err != nil {
+		return "", false
+	}
+	// Only the message is unbounded, so it goes last. Length-prefix the
+	// partition, since it may contain anything.
+	return request.Peer().Addr + "\x00" + request.Spec().Procedure + "\x00" +
+		strconv.Itoa(len(partition)) + "\x00" + partition + string(data), true
+}
+
+func hasCredentials(header http.Header) bool {
+	for _, key := range []string{"Authorization", "Cookie", "Proxy-Authorization"} {
+		if _, ok := header[key]; ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,154 @@
+// Copyright 2021-2024 The Connect Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package connect_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync/atomic"
+	"testing"
+
+	connect "connectrpc.com/connect"
+	"connectrpc.com/connect/internal/assert"
+	pingv1 "connectrpc.com/connect/internal/gen/connect/ping/v1"
+	"connectrpc.com/connect/internal/gen/connect/ping/v1/pingv1connect"
+	"connectrpc.com/connect/internal/memhttp/memhttptest"
+)
+
+func TestCacheInterceptor(t *testing.T) {
+	t.Parallel()
+	var calls atomic.Int64
+	mux := http.NewServeMux()
+	mux.Handle(pingv1connect.NewPingServiceHandler(&pluggablePingServer{
+		ping: func(_ context.Context, request *connect.Request[pingv1.PingRequest]) (*connect.Response[pingv1.PingResponse], error) {
+			calls.Add(1)
+			if request.Msg.GetNumber() < 0 {
+				return nil, connect.NewError(connect.CodeInvalidArgument, errors.New("negative"))
+			}
+			return connect.NewResponse(&pingv1.PingResponse{Number: request.Msg.GetNumber()}), nil
+		},
+	}))
+	server := memhttptest.NewServer(t, mux)
+	newClient := func(opts ...connect.ClientOption) pingv1connect.PingServiceClient {
+		return pingv1connect.NewPingServiceClient(
+			server.Client(),
+			server.URL(),
+			append([]connect.ClientOption{connect.WithInterceptors(connect.NewCacheInterceptor())}, opts...)...,
+		)
+	}
+	ping := func(t *testing.T, client pingv1connect.PingServiceClient, number int64) (*connect.Response[pingv1.PingResponse], error) {
+		t.Helper()
+		return client.Ping(context.Background(), connect.NewRequest(&pingv1.PingRequest{Number: number}))
+	}
+	t.Run("hit", func(t *testing.T) {
+		client := newClient()
+		calls.Store(0)
+		res, err := ping(t, client, 42)
+		assert.Nil(t, err)
+		res.Msg.Number = 0 // mutating the response mustn't corrupt the cache
+		res, err = ping(t, client, 42)
+		assert.Nil(t, err)
+		assert.Equal(t, res.Msg.GetNumber(), 42)
+		assert.Equal(t, calls.Load(), 1)
+		_, err = ping(t, client, 43)
+		assert.Nil(t, err)
+		assert.Equal(t, calls.Load(), 2)
+	})
+	t.Run("codec_independent", func(t *testing.T) {
+		interceptor := connect.NewCacheInterceptor()
+		calls.Store(0)
+		for _, opts := range [][]connect.ClientOption{nil, {connect.WithProtoJSON()}, {connect.WithGRPC()}} {
+			opts = append(opts, connect.WithInterceptors(interceptor))
+			client := pingv1connect.NewPingServiceClient(server.Client(), server.URL(), opts...)
+			_, err := ping(t, client, 7)
+			assert.Nil(t, err)
+		}
+		assert.Equal(t, calls.Load(), 1)
+	})
+	t.Run("errors_not_cached", func(t *testing.T) {
+		client := newClient()
+		calls.Store(0)
+		for i := 0; i < 2; i++ {
+			_, err := ping(t, client, -1)
+			assert.Equal(t, connect.CodeOf(err), connect.CodeInvalidArgument)
+		}
+		assert.Equal(t, calls.Load(), 2)
+	})
+	t.Run("eviction", func(t *testing.T) {
+		client := pingv1connect.NewPingServiceClient(
+			server.Client(),
+			server.URL(),
+			connect.WithInterceptors(connect.NewCacheInterceptor(connect.WithCacheMaxEntries(1))),
+		)
+		calls.Store(0)
+		for _, number := range []int64{1, 2, 1} {
+			_, err := ping(t, client, number)
+			assert.Nil(t, err)
+		}
+		assert.Equal(t, calls.Load(), 3)
+	})
+	t.Run("canceled", func(t *testing.T) {
+		client := newClient()
+		_, err := ping(t, client, 5)
+		assert.Nil(t, err)
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		_, err = client.Ping(ctx, connect.NewRequest(&pingv1.PingRequest{Number: 5}))
+		assert.Equal(t, connect.CodeOf(err), connect.CodeCanceled)
+	})
+	pingAs := func(t *testing.T, client pingv1connect.PingServiceClient, authorization string) {
+		t.Helper()
+		request := connect.NewRequest(&pingv1.PingRequest{Number: 9})
+		request.Header().Set("Authorization", authorization)
+		_, err := client.Ping(context.Background(), request)
+		assert.Nil(t, err)
+	}
+	t.Run("credentials_not_cached", func(t *testing.T) {
+		client := newClient()
+		calls.Store(0)
+		pingAs(t, client, "Bearer alice")
+		pingAs(t, client, "Bearer bob")
+		pingAs(t, client, "Bearer alice")
+		assert.Equal(t, calls.Load(), 3)
+	})
+	t.Run("custom_key", func(t *testing.T) {
+		client := pingv1connect.NewPingServiceClient(
+			server.Client(),
+			server.URL(),
+			connect.WithInterceptors(connect.NewCacheInterceptor(connect.WithCacheKey(func(request connect.AnyRequest) (string, bool) {
+				return request.Header().Get("Authorization"), true
+			}))),
+		)
+		calls.Store(0)
+		pingAs(t, client, "Bearer alice")
+		pingAs(t, client, "Bearer bob")
+		pingAs(t, client, "Bearer alice")
+		pingAs(t, client, "Bearer bob")
+		assert.Equal(t, calls.Load(), 2) // one entry per caller
+	})
+	t.Run("servers_not_shared", func(t *testing.T) {
+		// The in-memory transport reaches the same server under any host, but
+		// the cache can't know that.
+		interceptor := connect.WithInterceptors(connect.NewCacheInterceptor())
+		calls.Store(0)
+		for _, baseURL := range []string{server.URL(), "http://other.example.com"} {
+			client := pingv1connect.NewPingServiceClient(server.Client(), baseURL, interceptor)
+			_, err := ping(t, client, 11)
+			assert.Nil(t, err)
+		}
+		assert.Equal(t, calls.Load(), 2)
+	})
+}
@@ -0,0 +1,462 @@
+// Copyright 2021-2024 The Connect Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package connect
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	defaultCircuitBreakerFailures = 5
+	defaultCircuitBreakerWindow   = 10
+	defaultCircuitBreakerCooldown = 10 * time.Second
+	defaultCircuitBreakerIdle     = time.Minute
+)
+
+// CircuitState is the state of a circuit breaker created by
+// [NewCircuitBreakerInterceptor].
+type CircuitState int
+
+const (
+	// CircuitClosed is the normal state: calls proceed, and their outcomes are
+	// recorded.
+	CircuitClosed CircuitState = iota
+	// CircuitOpen fails calls immediately with [CodeUnavailable].
+	CircuitOpen
+	// CircuitHalfOpen allows a single probe call through. If it succeeds, the
+	// circuit closes; otherwise, it opens again.
+	CircuitHalfOpen
+)
+
+func (s CircuitState) String() string {
+	switch s {
+	case CircuitClosed:
+		return "closed"
+	case CircuitOpen:
+		return "open"
+	case CircuitHalfOpen:
+		return "half_open"
+	}
+	return fmt.Sprintf("circuit_state_%d", int(s))
+}
+
+// A CircuitBreakerOption configures the interceptor returned by
+// [NewCircuitBreakerInterceptor].
+type CircuitBreakerOption interface {
+	applyToCircuitBreaker(*circuitBreakerConfig)
+}
+
+// WithCircuitBreakerThreshold opens the circuit once at least failures of the
+// last window calls have failed. Setting failures equal to window opens the
+// circuit after that many consecutive failures; smaller values trip on a
+// failure ratio.
+//
+// The default is 5 failures in a window of 10 calls. Values less than one are
+// ignored, and failures is capped at window.
+func WithCircuitBreakerThreshold(failures, window int) CircuitBreakerOption {
+	return &circuitBreakerThresholdOption{Failures: failures, Window: window}
+}
+
+// WithCircuitBreakerCooldown sets how long the circuit stays open before
+// allowing a probe call through.
+//
+// The default is ten seconds. Values less than or equal to zero are ignored.
+func WithCircuitBreakerCooldown(cooldown time.Duration) CircuitBreakerOption {
+	return &circuitBreakerCooldownOption{Cooldown: cooldown}
+}
+
+// WithCircuitBreakerIdleTimeout sets how long a circuit may go unused before
+// it's discarded, which bounds memory use when keys come and go (for example,
+// when keying on hosts from a service discovery system). A discarded circuit
+// starts over, closed and without failures, the next time its key is used.
+// Open circuits are kept at least until their cooldown elapses.
+//
+// The default is one minute. Values less than or equal to zero are ignored.
+func WithCircuitBreakerIdleTimeout(timeout time.Duration) CircuitBreakerOption {
+	return &circuitBreakerIdleTimeoutOption{Timeout: timeout}
+}
+
+// WithCircuitBreakerKey sets the function that assigns calls to circuits.
+// Calls with the same key share a circuit. For example, keying on
+// [Peer.Addr] gives each target host its own circuit.
+//
+// By default, each procedure has its own circuit.
+func WithCircuitBreakerKey(key func(Spec, Peer) string) CircuitBreakerOption {
+	return &circuitBreakerKeyOption{Key: key}
+}
+
+// WithCircuitBreakerStateChange registers a callback for circuit state
+// transitions, which is useful for metrics and logging. The callback runs
+// synchronously on the goroutine making the call, so it should be fast, and it
+// must be safe to call concurrently.
+func WithCircuitBreakerStateChange(onChange func(key string, from, to CircuitState)) CircuitBreakerOption {
+	return &circuitBreakerStateChangeOption{OnChange: onChange}
+}
+
+// NewCircuitBreakerInterceptor constructs a client interceptor that stops
+// sending calls to failing servers. Calls failing with [CodeUnavailable] or
+// [CodeDeadlineExceeded] count as failures; other errors mean the server is
+// reachable, so they count as successes. Once enough calls fail, the circuit
+// opens and subsequent calls fail immediately with [CodeUnavailable] without
+// contacting the server. After a cooldown, the circuit half-opens and lets a
+// single probe call through to decide whether to close again.
+//
+// The interceptor applies to both unary and streaming calls, and has no effect
+// on handlers. It only keeps state for circuits with recent failures, and
+// discards circuits that haven't been used recently (see
+// [WithCircuitBreakerIdleTimeout]), so it's safe to use with clients calling
+// many procedures or hosts.
+func NewCircuitBreakerInterceptor(options ...CircuitBreakerOption) Interceptor {
+	config := circuitBreakerConfig{
+		Failures: defaultCircuitBreakerFailures,
+		Window:   defaultCircuitBreakerWindow,
+		Cooldown: defaultCircuitBreakerCooldown,
+		Idle:     defaultCircuitBreakerIdle,
+		Key: func(spec Spec, _ Peer) string {
+			return spec.Procedure
+		},
+	}
+	for _, opt := range options {
+		opt.applyToCircuitBreaker(&config)
+	}
+	return &circuitBreakerInterceptor{
+		config:   config,
+		circuits: make(map[string]*circuit),
+	}
+}
+
+type circuitBreakerConfig struct {
+	Failures int
+	Window   int
+	Cooldown time.Duration
+	Idle     time.Duration
+	Key      func(Spec, Peer) string
+	OnChange func(string, CircuitState, CircuitState)
+}
+
+type circuitBreakerThresholdOption struct {
+	Failures int
+	Window   int
+}
+
+func (o *circuitBreakerThresholdOption) applyToCircuitBreaker(config *circuitBreakerConfig) {
+	if o.Failures < 1 || o.Window < 1 {
+		return
+	}
+	config.Failures = min(o.Failures, o.Window)
+	config.Window = o.Window
+}
+
+type circuitBreakerCooldownOption struct {
+	Cooldown time.Duration
+}
+
+func (o *circuitBreakerCooldownOption) applyToCircuitBreaker(config *circuitBreakerConfig) {
+	if o.Cooldown > 0 {
+		config.Cooldown = o.Cooldown
+	}
+}
+
+type circuitBreakerIdleTimeoutOption struct {
+	Timeout time.Duration
+}
+
+func (o *circuitBreakerIdleTimeoutOption) applyToCircuitBreaker(config *circuitBreakerConfig) {
+	if o.Timeout > 0 {
+		config.Idle = o.Timeout
+	}
+}
+
+type circuitBreakerKeyOption struct {
+	Key func(Spec, Peer) string
+}
+
+func (o *circuitBreakerKeyOption) applyToCircuitBreaker(config *circuitBreakerConfig) {
+	if o.Key != nil {
+		config.Key = o.Key
+	}
+}
+
+type circuitBreakerStateChangeOption struct {
+	OnChange func(string, CircuitState, CircuitState)
+}
+
+func (o *circuitBreakerStateChangeOption) applyToCircuitBreaker(config *circuitBreakerConfig) {
+	config.OnChange = o.OnChange
+}
+
+// circuit is the state of a single key. Closed circuits without failures in
+// their window are deleted, so they're indistinguishable from missing ones.
+type circuit struct {
+	state    CircuitState
+	outcomes []bool // ring buffer of recent outcomes, true for failures
+	next     int
+	failures int
+	changed  time.Time // when the circuit last opened or half-opened
+	used     time.Time // when a call last used the circuit
+}
+
+func (c *circuit) push(failed bool) {
+	if c.outcomes[c.next] {
+		c.failures--
+	}
+	c.outcomes[c.next] = failed
+	if failed {
+		c.failures++
+	}
+	c.next = (c.next + 1) % len(c.outcomes)
+}
+
+type circuitTransition struct {
+	key      string
+	from, to CircuitState
+}
+
+type circuitBreakerInterceptor struct {
+	config circuitBreakerConfig
+
+	mu        sync.Mutex
+	circuits  map[string]*circuit
+	lastSweep time.Time
+}
+
+func (i *circuitBreakerInterceptor) WrapUnary(next UnaryFunc) UnaryFunc {
+	return func(ctx context.Context, request AnyRequest) (AnyResponse, error) {
+		spec := request.Spec()
+		if !spec.IsClient {
+			return next(ctx, request)
+		}
+		key := i.config.Key(spec, request.Peer())
+		probe, err := i.admit(key)
+		if err != nil {
+			return nil, err
+		}
+		response, err := next(ctx, request)
+		i.record(key, probe, err)
+		return response, err
+	}
+}
+
+func (i *circuitBreakerInterceptor) WrapStreamingClient(next StreamingClientFunc) StreamingClientFunc {
+	return func(ctx context.Context, spec Spec) StreamingClientConn {
+		conn := next(ctx, spec)
+		key := i.config.Key(spec, conn.Peer())
+		probe, err := i.admit(key)
+		if err != nil {
+			// The conn was only needed for its peer, and it hasn't sent anything
+			// yet. Closing its response releases it without sending the request.
+			_ = conn.CloseResponse()
+			return &errorClientConn{spec: spec, peer: conn.Peer(), header: conn.RequestHeader(), err: err}
+		}
+		return &circuitBreakerClientConn{
+			StreamingClientConn: conn,
+			interceptor:         i,
+			key:                 key,
+			probe:               probe,
+		}
+	}
+}
+
+func (i *circuitBreakerInterceptor) WrapStreamingHandler(next StreamingHandlerFunc) StreamingHandlerFunc {
+	return next
+}
+
+// admit decides whether a call may proceed. It reports whether the call is a
+// half-open probe.
+func (i *circuitBreakerInterceptor) admit(key string) (bool, error) {
+	var (
+		transition *circuitTransition
+		evicted    []circuitTransition
+	)
+	defer func() {
+		for j := range evicted {
+			i.notify(&evicted[j])
+		}
+		i.notify(transition)
+	}()
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	now := time.Now()
+	evicted = i.sweep(now)
+	circ, ok := i.circuits[key]
+	if !ok {
+		return false, nil
+	}
+	circ.used = now
+	switch circ.state {
+	case CircuitClosed:
+		return false, nil
+	case CircuitOpen:
+		if time.Since(circ.changed) < i.config.Cooldown {
+			return false, errorf(CodeUnavailable, "circuit breaker for %q is open", key)
+		}
+		circ.state = CircuitHalfOpen
+		circ.changed = time.Now()
+		transition = &circuitTransition{key: key, from: CircuitOpen, to: CircuitHalfOpen}
+		return true, nil
+	case CircuitHalfOpen:
+		// A probe is in flight. If it hasn't finished within a cooldown (for
+		// example, because a stream was never closed), allow another.
+		if time.Since(circ.changed) < i.config.Cooldown {
+			return false, errorf(CodeUnavailable, "circuit breaker for %q is half-open", key)
+		}
+		circ.changed = time.Now()
+		return true, nil
+	}
+	return false, nil
+}
+
+// record updates the circuit with the outcome of an admitted call.
+func (i *circuitBreakerInterceptor) record(key string, probe bool, err error) {
+	code := CodeOf(err)
+	failed := err != nil && (code == CodeUnavailable || code == CodeDeadlineExceeded)
+	var transition *circuitTransition
+	defer func() { i.notify(transition) }()
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	circ, ok := i.circuits[key]
+	if probe {
+		if !ok || circ.state != CircuitHalfOpen {
+			return
+		}
+		if failed {
+			circ.state = CircuitOpen
+			circ.changed = time.Now()
+			transition = &circuitTransition{key: key, from: CircuitHalfOpen, to: CircuitOpen}
+			return
+		}
+		delete(i.circuits, key)
+		transition = &circuitTransition{key: key, from: CircuitHalfOpen, to: CircuitClosed}
+		return
+	}
+	if !ok {
+		if !failed {
+			return
+		}
+		circ = &circuit{outcomes: make([]bool, i.config.Window)}
+		i.circuits[key] = circ
+	}
+	circ.used = time.Now()
+	if circ.state != CircuitClosed {
+		// The call started before the circuit opened.
+		return
+	}
+	circ.push(failed)
+	switch {
+	case circ.failures >= i.config.Failures:
+		circ.state = CircuitOpen
+		circ.changed = time.Now()
+		transition = &circuitTransition{key: key, from: CircuitClosed, to: CircuitOpen}
+	case circ.failures == 0:
+		delete(i.circuits, key)
+	}
+}
+
+// sweep deletes circuits that haven't been used within the idle timeout, so
+// that keys which are never called again don't accumulate. Open circuits are
+// kept until their cooldown has elapsed. It returns the transitions of
+// circuits that weren't closed. The caller must hold i.mu.
+func (i *circuitBreakerInterceptor) sweep(now time.Time) []circuitTransition {
+	if now.Sub(i.lastSweep) < i.config.Idle {
+		return nil
+	}
+	i.lastSweep = now
+	var evicted []circuitTransition
+	for key, circ := range i.circuits {
+		if now.Sub(circ.used) < i.config.Idle {
+			continue
+		}
+		if circ.state == CircuitOpen && now.Sub(circ.changed) < i.config.Cooldown {
+			continue
+		}
+		delete(i.circuits, key)
+		if circ.state != CircuitClosed {
+			evicted = append(evicted, circuitTransition{key: key, from: circ.state, to: CircuitClosed})
+		}
+	}
+	return evicted
+}
+
+func (i *circuitBreakerInterceptor) notify(transition *circuitTransition) {
+	if transition != nil && i.config.OnChange != nil {
+		i.config.OnChange(transition.key, transition.from, transition.to)
+	}
+}
+
+// circuitBreakerClientConn records the outcome of a stream once the response
+// is closed. The first error received decides the outcome.
+type circuitBreakerClientConn struct {
+	StreamingClientConn
+
+	interceptor *circuitBreakerInterceptor
+	key         string
+	probe       bool
+
+	mu  sync.Mutex
+	err error
+
+	recordOnce sync.Once
+}
+
+func (c *circuitBreakerClientConn) Receive(msg any) error {
+	err := c.StreamingClientConn.Receive(msg)
+	if err != nil && !errors.Is(err, io.EOF) {
+		c.mu.Lock()
+		if c.err == nil {
+			c.err = err
+		}
+		c.mu.Unlock()
+	}
+	return err
+}
+
+func (c *circuitBreakerClientConn) CloseResponse() error {
+	closeErr := c.StreamingClientConn.CloseResponse()
+	c.recordOnce.Do(func() {
+		c.mu.Lock()
+		err := c.err
+		c.mu.Unlock()
+		if err == nil {
+			err = closeErr
+		}
+		c.interceptor.record(c.key, c.probe, err)
+	})
+	return closeErr
+}
+
+// errorClientConn fails every operation with err. Interceptors return it in
+// place of a conn they've decided not to use, such as when a circuit is open.
+type errorClientConn struct {
+	spec   Spec
+	peer   Peer
+	header http.Header
+	err    error
+}
+
+func (c *errorClientConn) Spec() Spec                   { return c.spec }
+func (c *errorClientConn) Peer() Peer                   { return c.peer }
+func (c *errorClientConn) Send(any) error               { return c.err }
+func (c *errorClientConn) RequestHeader() http.Header   { return c.header }
+func (c *errorClientConn) CloseRequest() error          { return nil }
+func (c *errorClientConn) Receive(any) error            { return c.err }
+func (c *errorClientConn) ResponseHeader() http.Header  { return make(http.Header) }
+func (c *errorClientConn) ResponseTrailer() http.Header { return make(http.Header) }
+func (c *errorClientConn) CloseResponse() error         { return nil }
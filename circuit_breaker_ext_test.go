@@ -0,0 +1,185 @@
+// Copyright 2021-2024 The Connect Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package connect_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	connect "connectrpc.com/connect"
+	"connectrpc.com/connect/internal/assert"
+	pingv1 "connectrpc.com/connect/internal/gen/connect/ping/v1"
+	"connectrpc.com/connect/internal/gen/connect/ping/v1/pingv1connect"
+	"connectrpc.com/connect/internal/memhttp/memhttptest"
+)
+
+func TestCircuitBreakerInterceptor(t *testing.T) {
+	t.Parallel()
+	const cooldown = 20 * time.Millisecond
+	var (
+		calls     atomic.Int64
+		failCode  atomic.Int64 // zero means succeed
+		mu        sync.Mutex
+		stateLogs []string
+	)
+	mux := http.NewServeMux()
+	mux.Handle(pingv1connect.NewPingServiceHandler(&pluggablePingServer{
+		ping: func(context.Context, *connect.Request[pingv1.PingRequest]) (*connect.Response[pingv1.PingResponse], error) {
+			calls.Add(1)
+			if code := connect.Code(failCode.Load()); code != 0 {
+				return nil, connect.NewError(code, errors.New("oops"))
+			}
+			return connect.NewResponse(&pingv1.PingResponse{}), nil
+		},
+		countUp: func(_ context.Context, _ *connect.Request[pingv1.CountUpRequest], stream *connect.ServerStream[pingv1.CountUpResponse]) error {
+			calls.Add(1)
+			if code := connect.Code(failCode.Load()); code != 0 {
+				return connect.NewError(code, errors.New("oops"))
+			}
+			return stream.Send(&pingv1.CountUpResponse{Number: 1})
+		},
+	}))
+	server := memhttptest.NewServer(t, mux)
+	closes := &closeRecordingInterceptor{}
+	client := pingv1connect.NewPingServiceClient(
+		server.Client(),
+		server.URL(),
+		connect.WithStreamIdleTimeout(time.Minute),
+		connect.WithInterceptors(connect.NewCircuitBreakerInterceptor(
+			connect.WithCircuitBreakerThreshold(2, 2),
+			connect.WithCircuitBreakerCooldown(cooldown),
+			connect.WithCircuitBreakerStateChange(func(key string, from, to connect.CircuitState) {
+				mu.Lock()
+				defer mu.Unlock()
+				stateLogs = append(stateLogs, from.String()+"->"+to.String())
+			}),
+		), closes),
+	)
+	ping := func() error {
+		_, err := client.Ping(context.Background(), connect.NewRequest(&pingv1.PingRequest{}))
+		return err
+	}
+	countUp := func() error {
+		stream, err := client.CountUp(context.Background(), connect.NewRequest(&pingv1.CountUpRequest{Number: 1}))
+		if err != nil {
+			return err
+		}
+		for stream.Receive() {
+		}
+		_ = stream.Close()
+		return stream.Err()
+	}
+	transitions := func() string {
+		mu.Lock()
+		defer mu.Unlock()
+		logs := strings.Join(stateLogs, ",")
+		stateLogs = nil
+		return logs
+	}
+
+	// Errors other than Unavailable and DeadlineExceeded don't count.
+	failCode.Store(int64(connect.CodeInvalidArgument))
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, connect.CodeOf(ping()), connect.CodeInvalidArgument)
+	}
+	assert.Equal(t, calls.Load(), 3)
+	assert.Equal(t, transitions(), "")
+
+	// Two failures open the circuit, and later calls fail fast.
+	failCode.Store(int64(connect.CodeUnavailable))
+	calls.Store(0)
+	for i := 0; i < 2; i++ {
+		assert.Equal(t, connect.CodeOf(ping()), connect.CodeUnavailable)
+	}
+	assert.Equal(t, transitions(), "closed->open")
+	err := ping()
+	assert.Equal(t, connect.CodeOf(err), connect.CodeUnavailable)
+	assert.True(t, strings.Contains(err.Error(), "circuit breaker"))
+	assert.Equal(t, calls.Load(), 2)
+
+	// Each procedure has its own circuit, and streams count too.
+	failCode.Store(0)
+	assert.Nil(t, countUp())
+	failCode.Store(int64(connect.CodeUnavailable))
+	for i := 0; i < 2; i++ {
+		assert.Equal(t, connect.CodeOf(countUp()), connect.CodeUnavailable)
+	}
+	assert.Equal(t, transitions(), "closed->open")
+	calls.Store(0)
+	closed := closes.closed.Load()
+	err = countUp()
+	assert.True(t, strings.Contains(err.Error(), "circuit breaker"))
+	assert.Equal(t, calls.Load(), 0)
+	// The rejected stream's conn is released without sending the request.
+	assert.Equal(t, closes.closed.Load(), closed+1)
+
+	// A failed probe reopens the circuit.
+	time.Sleep(cooldown)
+	assert.Equal(t, connect.CodeOf(ping()), connect.CodeUnavailable)
+	assert.Equal(t, transitions(), "open->half_open,half_open->open")
+	assert.True(t, strings.Contains(ping().Error(), "circuit breaker"))
+
+	// A successful probe closes it.
+	failCode.Store(0)
+	time.Sleep(cooldown)
+	assert.Nil(t, ping())
+	assert.Nil(t, ping())
+	assert.Equal(t, transitions(), "open->half_open,half_open->closed")
+}
+
+func TestCircuitBreakerIdleTimeout(t *testing.T) {
+	t.Parallel()
+	const idle = 20 * time.Millisecond
+	var calls atomic.Int64
+	mux := http.NewServeMux()
+	mux.Handle(pingv1connect.NewPingServiceHandler(&pluggablePingServer{
+		ping: func(context.Context, *connect.Request[pingv1.PingRequest]) (*connect.Response[pingv1.PingResponse], error) {
+			calls.Add(1)
+			return nil, connect.NewError(connect.CodeUnavailable, errors.New("oops"))
+		},
+	}))
+	server := memhttptest.NewServer(t, mux)
+	client := pingv1connect.NewPingServiceClient(
+		server.Client(),
+		server.URL(),
+		connect.WithInterceptors(connect.NewCircuitBreakerInterceptor(
+			connect.WithCircuitBreakerThreshold(2, 2),
+			connect.WithCircuitBreakerIdleTimeout(idle),
+		)),
+	)
+	ping := func() error {
+		_, err := client.Ping(context.Background(), connect.NewRequest(&pingv1.PingRequest{}))
+		return err
+	}
+
+	assert.NotNil(t, ping())
+	// The circuit with one failure goes unused, so it's discarded and the next
+	// failure starts a fresh window instead of opening the circuit.
+	time.Sleep(2 * idle)
+	assert.NotNil(t, ping())
+	assert.NotNil(t, ping())
+	assert.Equal(t, calls.Load(), 3)
+	// Two failures in quick succession still open the circuit.
+	err := ping()
+	assert.Equal(t, connect.CodeOf(err), connect.CodeUnavailable)
+	assert.True(t, strings.Contains(err.Error(), "circuit breaker"))
+	assert.Equal(t, calls.Load(), 3)
+}
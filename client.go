@@ -22,6 +22,7 @@ import (
 	"net/http"
 	"net/url"
 	"strings"
+	"time"
 )
 
 // Client is a reusable, concurrency-safe client for a single procedure.
@@ -35,6 +36,7 @@ type Client[Req, Res any] struct {
 	config         *clientConfig
 	callUnary      func(context.Context, *Request[Req]) (*Response[Res], error)
 	protocolClient protocolClient
+	protocolParams protocolClientParams // for clients with endpoint resolvers
 	err            error
 }
 
@@ -47,26 +49,39 @@ func NewClient[Req, Res any](httpClient HTTPClient, url string, options ...Clien
 		return client
 	}
 	client.config = config
-	protocolClient, protocolErr := client.config.Protocol.NewClient(
-		&protocolClientParams{
-			CompressionName: config.RequestCompressionName,
-			CompressionPools: newReadOnlyCompressionPools(
-				config.CompressionPools,
-				config.CompressionNames,
-			),
-			Codec:            config.Codec,
-			Protobuf:         config.protobuf(),
-			CompressMinBytes: config.CompressMinBytes,
-			HTTPClient:       httpClient,
-			URL:              config.URL,
-			BufferPool:       config.BufferPool,
-			ReadMaxBytes:     config.ReadMaxBytes,
-			SendMaxBytes:     config.SendMaxBytes,
-			EnableGet:        config.EnableGet,
-			GetURLMaxBytes:   config.GetURLMaxBytes,
-			GetUseFallback:   config.GetUseFallback,
-		},
-	)
+	if config.HTTPClient != nil {
+		if httpClient != nil && httpClient != HTTPClient(http.DefaultClient) {
+			client.err = errorf(CodeUnknown, "WithTLSConfig and WithDialer can't be used with a custom HTTPClient")
+			return client
+		}
+		httpClient = config.HTTPClient
+	}
+	client.protocolParams = protocolClientParams{
+		CompressionName: config.RequestCompressionName,
+		CompressionPools: newReadOnlyCompressionPools(
+			config.CompressionPools,
+			config.CompressionNames,
+		),
+		Codec:                 config.Codec,
+		Protobuf:              config.protobuf(),
+		CompressMinBytes:      config.CompressMinBytes,
+		HTTPClient:            httpClient,
+		URL:                   config.URL,
+		BufferPool:            config.BufferPool,
+		ReadMaxBytes:          config.ReadMaxBytes,
+		ReadMaxMessages:       config.ReadMaxMessages,
+		ReadMaxEmpty:          config.ReadMaxEmpty,
+		SendMaxBytes:          config.SendMaxBytes,
+		EnableGet:             config.EnableGet,
+		GetURLMaxBytes:        config.GetURLMaxBytes,
+		GetUseFallback:        config.GetUseFallback,
+		Authority:             config.Authority,
+		ClientName:            config.ClientName,
+		ClientVersion:         config.ClientVersion,
+		ResponseHeaderTimeout: config.ResponseHeaderTimeout,
+		TooManyRequestsCode:   config.TooManyRequestsCode,
+	}
+	protocolClient, protocolErr := client.config.Protocol.NewClient(&client.protocolParams)
 	if protocolErr != nil {
 		client.err = protocolErr
 		return client
@@ -76,28 +91,33 @@ func NewClient[Req, Res any](httpClient HTTPClient, url string, options ...Clien
 	// once at client creation.
 	unarySpec := config.newSpec(StreamTypeUnary)
 	unaryFunc := UnaryFunc(func(ctx context.Context, request AnyRequest) (AnyResponse, error) {
-		conn := client.protocolClient.NewConn(ctx, unarySpec, request.Header())
-		conn.onRequestSend(func(r *http.Request) {
-			request.setRequestMethod(r.Method)
-		})
-		// Send always returns an io.EOF unless the error is from the client-side.
-		// We want the user to continue to call Receive in those cases to get the
-		// full error from the server-side.
-		if err := conn.Send(request.Any()); err != nil && !errors.Is(err, io.EOF) {
-			_ = conn.CloseRequest()
-			_ = conn.CloseResponse()
+		resolved, resolvedURL, err := client.resolveProtocolClient(ctx)
+		if err != nil {
 			return nil, err
 		}
-		if err := conn.CloseRequest(); err != nil {
-			_ = conn.CloseResponse()
-			return nil, err
+		if config.MaxRelocations <= 0 {
+			return callUnaryConn[Res](ctx, resolved, unarySpec, request, request.Header(), config.Initializer)
 		}
-		response, err := receiveUnaryResponse[Res](conn, config.Initializer)
-		if err != nil {
-			_ = conn.CloseResponse()
-			return nil, err
+		// The protocol adds headers as it sends the request, so relocated calls
+		// start over from a copy of the caller's headers.
+		original := request.Header().Clone()
+		header := request.Header()
+		current := resolvedURL
+		for hops := 0; ; hops++ {
+			response, err := callUnaryConn[Res](ctx, resolved, unarySpec, request, header, config.Initializer)
+			if err == nil || hops >= config.MaxRelocations {
+				return response, err
+			}
+			relocated, relocatedURL, ok := client.relocate(current, err)
+			if !ok {
+				return nil, err
+			}
+			resolved, current = relocated, relocatedURL
+			header = original.Clone()
+			if relocatedURL.Host != resolvedURL.Host {
+				stripCredentials(header)
+			}
 		}
-		return response, conn.CloseResponse()
 	})
 	if interceptor := config.Interceptor; interceptor != nil {
 		unaryFunc = interceptor.WrapUnary(unaryFunc)
@@ -151,7 +171,15 @@ func (c *Client[Req, Res]) CallServerStream(ctx context.Context, request *Reques
 	})
 	request.spec = conn.Spec()
 	request.peer = conn.Peer()
-	mergeHeaders(conn.RequestHeader(), request.header)
+	header := conn.RequestHeader()
+	// The defaults from WithClientMetadata are already in the header, but
+	// values set on the request should replace them rather than add to them.
+	for _, key := range []string{headerClientName, headerClientVersion} {
+		if getHeaderCanonical(request.header, key) != "" {
+			delete(header, key)
+		}
+	}
+	mergeHeaders(header, request.header)
 	// Send always returns an io.EOF unless the error is from the client-side.
 	// We want the user to continue to call Receive in those cases to get the
 	// full error from the server-side.
@@ -184,9 +212,24 @@ func (c *Client[Req, Res]) newConn(ctx context.Context, streamType StreamType, o
 	newConn := func(ctx context.Context, spec Spec) StreamingClientConn {
 		header := make(http.Header, 8) // arbitrary power of two, prevent immediate resizing
 		c.protocolClient.WriteRequestHeader(streamType, header)
-		conn := c.protocolClient.NewConn(ctx, spec, header)
+		resolved, _, err := c.resolveProtocolClient(ctx)
+		if err != nil {
+			return &errorClientConn{spec: spec, peer: c.protocolClient.Peer(), header: header, err: err}
+		}
+		idleTimeout := c.config.StreamIdleTimeout
+		if idleTimeout <= 0 || streamType&StreamTypeServer == 0 {
+			conn := resolved.NewConn(ctx, spec, header)
+			conn.onRequestSend(onRequestSend)
+			return conn
+		}
+		ctx, cancel := context.WithCancel(ctx)
+		conn := resolved.NewConn(ctx, spec, header)
 		conn.onRequestSend(onRequestSend)
-		return conn
+		return &idleClientConn{
+			StreamingClientConn: conn,
+			idle:                newIdleTimer(idleTimeout, cancel),
+			cancel:              cancel,
+		}
 	}
 	if interceptor := c.config.Interceptor; interceptor != nil {
 		newConn = interceptor.WrapStreamingClient(newConn)
@@ -194,6 +237,69 @@ func (c *Client[Req, Res]) newConn(ctx context.Context, streamType StreamType, o
 	return newConn(ctx, c.config.newSpec(streamType))
 }
 
+// callUnaryConn makes a single unary call with resolved, sending header as
+// the request headers.
+func callUnaryConn[Res any](
+	ctx context.Context,
+	resolved protocolClient,
+	spec Spec,
+	request AnyRequest,
+	header http.Header,
+	initializer maybeInitializer,
+) (AnyResponse, error) {
+	conn := resolved.NewConn(ctx, spec, header)
+	conn.onRequestSend(func(r *http.Request) {
+		request.setRequestMethod(r.Method)
+	})
+	// Send always returns an io.EOF unless the error is from the client-side.
+	// We want the user to continue to call Receive in those cases to get the
+	// full error from the server-side.
+	if err := conn.Send(request.Any()); err != nil && !errors.Is(err, io.EOF) {
+		_ = conn.CloseRequest()
+		_ = conn.CloseResponse()
+		return nil, err
+	}
+	if err := conn.CloseRequest(); err != nil {
+		_ = conn.CloseResponse()
+		return nil, err
+	}
+	response, err := receiveUnaryResponse[Res](conn, initializer)
+	if err != nil {
+		_ = conn.CloseResponse()
+		return nil, err
+	}
+	return response, conn.CloseResponse()
+}
+
+// resolveProtocolClient returns the protocol client to use for a single call,
+// along with the procedure's URL. If the client has an endpoint resolver, it
+// builds a protocol client for the resolved URL; otherwise, it returns the
+// client's fixed protocol client.
+func (c *Client[Req, Res]) resolveProtocolClient(ctx context.Context) (protocolClient, *url.URL, error) {
+	resolve := c.config.EndpointResolver
+	if resolve == nil {
+		return c.protocolClient, c.config.URL, nil
+	}
+	baseURL, err := resolve(ctx)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, nil, wrapIfContextError(err)
+		}
+		return nil, nil, errorf(CodeUnavailable, "resolve endpoint: %w", err)
+	}
+	url, urlErr := parseRequestURL(strings.TrimSuffix(baseURL, "/") + c.config.Procedure)
+	if urlErr != nil {
+		return nil, nil, urlErr
+	}
+	params := c.protocolParams
+	params.URL = url
+	resolved, protocolErr := c.config.Protocol.NewClient(&params)
+	if protocolErr != nil {
+		return nil, nil, protocolErr
+	}
+	return resolved, url, nil
+}
+
 type clientConfig struct {
 	URL                    *url.URL
 	Protocol               protocol
@@ -208,11 +314,28 @@ type clientConfig struct {
 	RequestCompressionName string
 	BufferPool             *bufferPool
 	ReadMaxBytes           int
+	ReadMaxMessages        int
+	ReadMaxEmpty           int
 	SendMaxBytes           int
 	EnableGet              bool
 	GetURLMaxBytes         int
 	GetUseFallback         bool
 	IdempotencyLevel       IdempotencyLevel
+	HTTPClient             HTTPClient // from WithTLSConfig or WithDialer; replaces the HTTPClient passed to NewClient
+	TLSConfig              *tlsConfigOption
+	Dialer                 *dialerOption
+	StreamIdleTimeout      time.Duration
+	EndpointResolver       func(context.Context) (string, error)
+	MaxRelocations         int
+	RelocationHosts        []string // hosts other than the current one that relocations may move to
+	Authority              string
+	InterceptorTimeout     time.Duration
+	ResponseHeaderTimeout  time.Duration
+	TooManyRequestsCode    Code
+	JSONDiscardUnknown     *bool
+	ClientName             string
+	ClientVersion          string
+	ValidateConstruction   bool
 }
 
 func newClientConfig(rawURL string, options []ClientOption) (*clientConfig, *Error) {
@@ -233,7 +356,19 @@ func newClientConfig(rawURL string, options []ClientOption) (*clientConfig, *Err
 	for _, opt := range options {
 		opt.applyToClient(&config)
 	}
+	if httpClient := newTransportClient(config.TLSConfig, config.Dialer); httpClient != nil {
+		config.HTTPClient = httpClient
+	}
+	if discard := config.JSONDiscardUnknown; discard != nil && config.Codec != nil {
+		config.Codec = withJSONDiscardUnknown(config.Codec, *discard)
+	}
+	if config.InterceptorTimeout > 0 && config.Interceptor != nil {
+		config.Interceptor = withInterceptorTimeout(config.Interceptor, config.InterceptorTimeout)
+	}
 	if err := config.validate(); err != nil {
+		if config.ValidateConstruction {
+			panic(fmt.Sprintf("connect: invalid client configuration for %s: %v", rawURL, err)) //nolint:forbidigo
+		}
 		return nil, err
 	}
 	return &config, nil
@@ -18,16 +18,21 @@ import (
 	"bytes"
 	"context"
 	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
 	"errors"
 	"fmt"
 	"io"
 	"log"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"runtime"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
+	"syscall"
 	"testing"
 	"time"
 
@@ -35,6 +40,7 @@ import (
 	"connectrpc.com/connect/internal/assert"
 	pingv1 "connectrpc.com/connect/internal/gen/connect/ping/v1"
 	"connectrpc.com/connect/internal/gen/connect/ping/v1/pingv1connect"
+	"connectrpc.com/connect/internal/memhttp"
 	"connectrpc.com/connect/internal/memhttp/memhttptest"
 	"google.golang.org/protobuf/encoding/protowire"
 	"google.golang.org/protobuf/proto"
@@ -279,6 +285,440 @@ func TestConnectionDropped(t *testing.T) {
 	}
 }
 
+func TestWithTLSConfig(t *testing.T) {
+	t.Parallel()
+	mux := http.NewServeMux()
+	mux.Handle(pingv1connect.NewPingServiceHandler(pingServer{}))
+	server := httptest.NewUnstartedServer(mux)
+	server.EnableHTTP2 = true
+	server.StartTLS()
+	t.Cleanup(server.Close)
+	roots := x509.NewCertPool()
+	roots.AddCert(server.Certificate())
+	tlsConfig := connect.WithTLSConfig(&tls.Config{RootCAs: roots, MinVersion: tls.VersionTLS12})
+
+	t.Run("trusted", func(t *testing.T) {
+		t.Parallel()
+		client := pingv1connect.NewPingServiceClient(nil, server.URL, tlsConfig)
+		_, err := client.Ping(context.Background(), connect.NewRequest(&pingv1.PingRequest{}))
+		assert.Nil(t, err)
+		// Bidirectional streaming requires HTTP/2.
+		stream := client.CumSum(context.Background())
+		assert.Nil(t, stream.Send(&pingv1.CumSumRequest{Number: 1}))
+		res, err := stream.Receive()
+		assert.Nil(t, err)
+		assert.Equal(t, res.GetSum(), 1)
+		assert.Nil(t, stream.CloseRequest())
+		assert.Nil(t, stream.CloseResponse())
+	})
+	t.Run("untrusted", func(t *testing.T) {
+		t.Parallel()
+		client := pingv1connect.NewPingServiceClient(http.DefaultClient, server.URL)
+		_, err := client.Ping(context.Background(), connect.NewRequest(&pingv1.PingRequest{}))
+		assert.Equal(t, connect.CodeOf(err), connect.CodeUnavailable)
+	})
+	t.Run("custom_http_client", func(t *testing.T) {
+		t.Parallel()
+		client := pingv1connect.NewPingServiceClient(server.Client(), server.URL, tlsConfig)
+		_, err := client.Ping(context.Background(), connect.NewRequest(&pingv1.PingRequest{}))
+		assert.Equal(t, connect.CodeOf(err), connect.CodeUnknown)
+		assert.True(t, strings.Contains(err.Error(), "WithTLSConfig"))
+	})
+	t.Run("with_dialer", func(t *testing.T) {
+		t.Parallel()
+		var dials atomic.Int64
+		dialer := connect.WithDialer(&net.Dialer{
+			Control: func(string, string, syscall.RawConn) error {
+				dials.Add(1)
+				return nil
+			},
+		})
+		// The options combine regardless of order, and clients with the same
+		// options share connections.
+		for _, options := range [][]connect.ClientOption{
+			{tlsConfig, dialer},
+			{dialer, tlsConfig},
+		} {
+			client := pingv1connect.NewPingServiceClient(nil, server.URL, options...)
+			_, err := client.Ping(context.Background(), connect.NewRequest(&pingv1.PingRequest{}))
+			assert.Nil(t, err)
+		}
+		assert.Equal(t, dials.Load(), 1)
+	})
+}
+
+func TestWithDialer(t *testing.T) {
+	t.Parallel()
+	mux := http.NewServeMux()
+	mux.Handle(pingv1connect.NewPingServiceHandler(pingServer{}))
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	var dials atomic.Int64
+	dialer := connect.WithDialer(&net.Dialer{
+		Control: func(string, string, syscall.RawConn) error {
+			dials.Add(1)
+			return nil
+		},
+	})
+
+	client := pingv1connect.NewPingServiceClient(nil, server.URL, dialer)
+	_, err := client.Ping(context.Background(), connect.NewRequest(&pingv1.PingRequest{}))
+	assert.Nil(t, err)
+	_, err = client.Ping(context.Background(), connect.NewRequest(&pingv1.PingRequest{}))
+	assert.Nil(t, err)
+	assert.Equal(t, dials.Load(), 1) // the second call reuses the connection
+
+	client = pingv1connect.NewPingServiceClient(server.Client(), server.URL, dialer)
+	_, err = client.Ping(context.Background(), connect.NewRequest(&pingv1.PingRequest{}))
+	assert.Equal(t, connect.CodeOf(err), connect.CodeUnknown)
+	assert.True(t, strings.Contains(err.Error(), "WithDialer"))
+}
+
+func TestWithResponseHeaderTimeout(t *testing.T) {
+	t.Parallel()
+	const timeout = 50 * time.Millisecond
+	mux := http.NewServeMux()
+	mux.Handle(pingv1connect.NewPingServiceHandler(&pluggablePingServer{
+		countUp: func(ctx context.Context, request *connect.Request[pingv1.CountUpRequest], stream *connect.ServerStream[pingv1.CountUpResponse]) error {
+			// Send headers promptly, then take longer than the timeout to
+			// send each message.
+			if err := stream.Send(nil); err != nil {
+				return err
+			}
+			for i := int64(1); i <= request.Msg.GetNumber(); i++ {
+				time.Sleep(2 * timeout)
+				if err := stream.Send(&pingv1.CountUpResponse{Number: i}); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	}))
+	stalled := http.HandlerFunc(func(_ http.ResponseWriter, request *http.Request) {
+		// Accept the request, then hang without sending headers.
+		<-request.Context().Done()
+	})
+	mux.Handle(pingv1connect.PingServicePingProcedure, stalled)
+	mux.Handle(pingv1connect.PingServiceSumProcedure, stalled)
+	server := memhttptest.NewServer(t, mux)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	t.Cleanup(cancel)
+
+	for _, protocol := range []struct {
+		name   string
+		option connect.ClientOption
+	}{
+		{name: "connect", option: connect.WithClientOptions()},
+		{name: "grpc", option: connect.WithGRPC()},
+	} {
+		protocol := protocol
+		t.Run(protocol.name, func(t *testing.T) {
+			t.Parallel()
+			client := pingv1connect.NewPingServiceClient(
+				server.Client(),
+				server.URL(),
+				protocol.option,
+				connect.WithResponseHeaderTimeout(timeout),
+			)
+			start := time.Now()
+			_, err := client.Ping(ctx, connect.NewRequest(&pingv1.PingRequest{}))
+			assert.Equal(t, connect.CodeOf(err), connect.CodeUnavailable)
+			assert.True(t, strings.Contains(err.Error(), "no response headers within 50ms"), assert.Sprintf("error: %v", err))
+			assert.True(t, time.Since(start) < 10*time.Second)
+
+			sum := client.Sum(ctx)
+			assert.Nil(t, sum.Send(&pingv1.SumRequest{Number: 1}))
+			_, err = sum.CloseAndReceive()
+			assert.Equal(t, connect.CodeOf(err), connect.CodeUnavailable)
+
+			// Once headers arrive, slow messages don't trip the timeout.
+			stream, err := client.CountUp(ctx, connect.NewRequest(&pingv1.CountUpRequest{Number: 2}))
+			assert.Nil(t, err)
+			var received int
+			for stream.Receive() {
+				received++
+			}
+			assert.Nil(t, stream.Err())
+			assert.Equal(t, received, 2)
+			assert.Nil(t, stream.Close())
+		})
+	}
+	t.Run("slow_dial", func(t *testing.T) {
+		t.Parallel()
+		// The timer starts once the request is written, so slow connection
+		// setup doesn't count against it.
+		transport := server.TransportHTTP1()
+		dial := transport.DialContext
+		transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			time.Sleep(4 * timeout)
+			return dial(ctx, network, addr)
+		}
+		client := pingv1connect.NewPingServiceClient(
+			&http.Client{Transport: transport},
+			server.URL(),
+			connect.WithResponseHeaderTimeout(timeout),
+		)
+		stream, err := client.CountUp(ctx, connect.NewRequest(&pingv1.CountUpRequest{}))
+		assert.Nil(t, err)
+		for stream.Receive() {
+		}
+		assert.Nil(t, stream.Err())
+		assert.Nil(t, stream.Close())
+	})
+}
+
+func TestClientTransportErrorsVisibleToInterceptors(t *testing.T) {
+	t.Parallel()
+	var (
+		mu    sync.Mutex
+		codes []connect.Code
+	)
+	record := func(err error) {
+		if err == nil || errors.Is(err, io.EOF) {
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		codes = append(codes, connect.CodeOf(err))
+	}
+	lastCode := func() connect.Code {
+		mu.Lock()
+		defer mu.Unlock()
+		assert.True(t, len(codes) > 0, assert.Sprintf("interceptor didn't see an error"))
+		code := codes[len(codes)-1]
+		codes = nil
+		return code
+	}
+	interceptor := &recordErrorsInterceptor{record: record}
+
+	t.Run("dial", func(t *testing.T) {
+		httpClient := &http.Client{Transport: &http.Transport{
+			DialContext: func(context.Context, string, string) (net.Conn, error) {
+				return nil, &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}
+			},
+		}}
+		client := pingv1connect.NewPingServiceClient(httpClient, "http://127.0.0.1:1", connect.WithInterceptors(interceptor))
+		_, err := client.Ping(context.Background(), connect.NewRequest(&pingv1.PingRequest{}))
+		assert.Equal(t, connect.CodeOf(err), connect.CodeUnavailable)
+		assert.Equal(t, lastCode(), connect.CodeUnavailable)
+		stream, err := client.CountUp(context.Background(), connect.NewRequest(&pingv1.CountUpRequest{Number: 1}))
+		if err == nil {
+			for stream.Receive() {
+			}
+			err = stream.Err()
+			_ = stream.Close()
+		}
+		assert.Equal(t, connect.CodeOf(err), connect.CodeUnavailable)
+		assert.Equal(t, lastCode(), connect.CodeUnavailable)
+	})
+	t.Run("reset_mid_response", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+			w.Header().Set("Content-Type", "application/connect+proto")
+			w.WriteHeader(http.StatusOK)
+			// Write part of an envelope prefix, then drop the connection.
+			_, _ = w.Write([]byte{0, 0, 0})
+			if flusher, ok := w.(http.Flusher); ok {
+				flusher.Flush()
+			}
+			panic(http.ErrAbortHandler) //nolint:forbidigo
+		}))
+		t.Cleanup(server.Close)
+		client := pingv1connect.NewPingServiceClient(server.Client(), server.URL, connect.WithInterceptors(interceptor))
+		stream, err := client.CountUp(context.Background(), connect.NewRequest(&pingv1.CountUpRequest{Number: 1}))
+		assert.Nil(t, err)
+		for stream.Receive() {
+		}
+		assert.Equal(t, connect.CodeOf(stream.Err()), connect.CodeUnavailable)
+		_ = stream.Close()
+		assert.Equal(t, lastCode(), connect.CodeUnavailable)
+	})
+}
+
+func TestGRPCClientRequiredHeaders(t *testing.T) {
+	t.Parallel()
+	mux := http.NewServeMux()
+	mux.Handle(pingv1connect.NewPingServiceHandler(pingServer{}))
+	// strict behaves like gRPC servers that refuse requests missing any of the
+	// headers required by the gRPC-HTTP2 specification.
+	strict := http.HandlerFunc(func(responseWriter http.ResponseWriter, request *http.Request) {
+		var problems []string
+		for _, required := range []struct {
+			key, want string
+		}{
+			{key: "Te", want: "trailers"},
+			{key: "Content-Type", want: "application/grpc"},
+		} {
+			if got := request.Header.Values(required.key); len(got) != 1 || got[0] != required.want {
+				problems = append(problems, fmt.Sprintf("%s: got %q, want %q", required.key, got, required.want))
+			}
+		}
+		for _, key := range []string{"Grpc-Accept-Encoding", "User-Agent"} {
+			if request.Header.Get(key) == "" {
+				problems = append(problems, key+" missing")
+			}
+		}
+		if !strings.HasPrefix(request.Header.Get("User-Agent"), "grpc-go-connect/") {
+			problems = append(problems, "User-Agent doesn't identify a gRPC client")
+		}
+		if request.Header.Get("Connect-Protocol-Version") != "" {
+			problems = append(problems, "unexpected Connect-Protocol-Version")
+		}
+		if len(problems) > 0 {
+			responseWriter.Header().Set("Content-Type", "application/grpc")
+			responseWriter.Header().Set("Grpc-Status", "3") // InvalidArgument
+			responseWriter.Header().Set("Grpc-Message", strings.Join(problems, "; "))
+			responseWriter.WriteHeader(http.StatusOK)
+			return
+		}
+		mux.ServeHTTP(responseWriter, request)
+	})
+	server := memhttptest.NewServer(t, strict)
+	for _, testCase := range []struct {
+		name    string
+		options []connect.ClientOption
+	}{
+		{name: "default", options: []connect.ClientOption{connect.WithGRPC()}},
+		{name: "gzip", options: []connect.ClientOption{connect.WithGRPC(), connect.WithSendGzip()}},
+		{
+			name: "no_compression",
+			options: []connect.ClientOption{
+				connect.WithGRPC(),
+				connect.WithAcceptCompression("gzip", nil, nil),
+			},
+		},
+	} {
+		testCase := testCase
+		t.Run(testCase.name, func(t *testing.T) {
+			t.Parallel()
+			client := pingv1connect.NewPingServiceClient(server.Client(), server.URL(), testCase.options...)
+			_, err := client.Ping(context.Background(), connect.NewRequest(&pingv1.PingRequest{Number: 1}))
+			assert.Nil(t, err)
+			stream := client.CumSum(context.Background())
+			assert.Nil(t, stream.Send(&pingv1.CumSumRequest{Number: 1}))
+			_, err = stream.Receive()
+			assert.Nil(t, err)
+			assert.Nil(t, stream.CloseRequest())
+			assert.Nil(t, stream.CloseResponse())
+		})
+	}
+}
+
+func TestWithEndpointResolver(t *testing.T) {
+	t.Parallel()
+	newServer := func(name string) *httptest.Server {
+		mux := http.NewServeMux()
+		mux.Handle(pingv1connect.NewPingServiceHandler(&pluggablePingServer{
+			ping: func(context.Context, *connect.Request[pingv1.PingRequest]) (*connect.Response[pingv1.PingResponse], error) {
+				return connect.NewResponse(&pingv1.PingResponse{Text: name}), nil
+			},
+			countUp: func(_ context.Context, _ *connect.Request[pingv1.CountUpRequest], stream *connect.ServerStream[pingv1.CountUpResponse]) error {
+				stream.ResponseHeader().Set("Server-Name", name)
+				return stream.Send(&pingv1.CountUpResponse{Number: 1})
+			},
+		}))
+		server := httptest.NewServer(mux)
+		t.Cleanup(server.Close)
+		return server
+	}
+	servers := []*httptest.Server{newServer("a"), newServer("b")}
+	var (
+		resolutions atomic.Int64
+		resolveErr  atomic.Value
+	)
+	resolve := func(context.Context) (string, error) {
+		if err, ok := resolveErr.Load().(error); ok {
+			return "", err
+		}
+		next := resolutions.Add(1)
+		return servers[next%2].URL + "/", nil
+	}
+	client := pingv1connect.NewPingServiceClient(
+		http.DefaultClient,
+		"http://service.invalid",
+		connect.WithEndpointResolver(resolve),
+	)
+	var names []string
+	for i := 0; i < 2; i++ {
+		res, err := client.Ping(context.Background(), connect.NewRequest(&pingv1.PingRequest{}))
+		assert.Nil(t, err)
+		names = append(names, res.Msg.GetText())
+		stream, err := client.CountUp(context.Background(), connect.NewRequest(&pingv1.CountUpRequest{Number: 1}))
+		assert.Nil(t, err)
+		for stream.Receive() {
+		}
+		assert.Nil(t, stream.Err())
+		names = append(names, stream.ResponseHeader().Get("Server-Name"))
+		assert.Nil(t, stream.Close())
+	}
+	assert.Equal(t, names, []string{"b", "a", "b", "a"})
+
+	resolveErr.Store(errors.New("no healthy instances"))
+	_, err := client.Ping(context.Background(), connect.NewRequest(&pingv1.PingRequest{}))
+	assert.Equal(t, connect.CodeOf(err), connect.CodeUnavailable)
+	assert.True(t, strings.Contains(err.Error(), "no healthy instances"))
+	_, err = client.CountUp(context.Background(), connect.NewRequest(&pingv1.CountUpRequest{Number: 1}))
+	assert.Equal(t, connect.CodeOf(err), connect.CodeUnavailable)
+}
+
+func TestWithAuthority(t *testing.T) {
+	t.Parallel()
+	const authority = "ping.example.com"
+	mux := http.NewServeMux()
+	mux.Handle(pingv1connect.NewPingServiceHandler(&pluggablePingServer{
+		ping: func(_ context.Context, request *connect.Request[pingv1.PingRequest]) (*connect.Response[pingv1.PingResponse], error) {
+			return connect.NewResponse(&pingv1.PingResponse{Text: request.Header().Get("Host")}), nil
+		},
+		countUp: func(_ context.Context, request *connect.Request[pingv1.CountUpRequest], stream *connect.ServerStream[pingv1.CountUpResponse]) error {
+			stream.ResponseHeader().Set("Received-Host", request.Header().Get("Host"))
+			return stream.Send(&pingv1.CountUpResponse{Number: 1})
+		},
+	}))
+	http1 := httptest.NewServer(mux)
+	t.Cleanup(http1.Close)
+	http2 := memhttptest.NewServer(t, mux)
+	testCases := []struct {
+		name       string
+		httpClient connect.HTTPClient
+		url        string
+		options    []connect.ClientOption
+	}{
+		{name: "http1", httpClient: http1.Client(), url: http1.URL},
+		{name: "http2", httpClient: http2.Client(), url: http2.URL()},
+		{name: "http2_grpc", httpClient: http2.Client(), url: http2.URL(), options: []connect.ClientOption{connect.WithGRPC()}},
+	}
+	for _, testCase := range testCases {
+		testCase := testCase
+		t.Run(testCase.name, func(t *testing.T) {
+			t.Parallel()
+			client := pingv1connect.NewPingServiceClient(
+				testCase.httpClient,
+				testCase.url,
+				append(testCase.options, connect.WithAuthority(authority))...,
+			)
+			// The call reaches the server at the URL, which sees the configured
+			// authority.
+			response, err := client.Ping(context.Background(), connect.NewRequest(&pingv1.PingRequest{}))
+			assert.Nil(t, err)
+			assert.Equal(t, response.Msg.GetText(), authority)
+
+			stream, err := client.CountUp(context.Background(), connect.NewRequest(&pingv1.CountUpRequest{Number: 1}))
+			assert.Nil(t, err)
+			for stream.Receive() {
+			}
+			assert.Nil(t, stream.Err())
+			assert.Equal(t, stream.ResponseHeader().Get("Received-Host"), authority)
+			assert.Nil(t, stream.Close())
+
+			// Per-request Host headers take precedence.
+			request := connect.NewRequest(&pingv1.PingRequest{})
+			request.Header().Set("Host", "other.example.com")
+			response, err = client.Ping(context.Background(), request)
+			assert.Nil(t, err)
+			assert.Equal(t, response.Msg.GetText(), "other.example.com")
+		})
+	}
+}
+
 func TestSpecSchema(t *testing.T) {
 	t.Parallel()
 	mux := http.NewServeMux()
@@ -756,6 +1196,45 @@ func (a *assertPeerInterceptor) WrapStreamingHandler(next connect.StreamingHandl
 	}
 }
 
+// recordErrorsInterceptor passes every error a client sees to record.
+type recordErrorsInterceptor struct {
+	connect.Interceptor
+
+	record func(error)
+}
+
+func (i *recordErrorsInterceptor) WrapUnary(next connect.UnaryFunc) connect.UnaryFunc {
+	return func(ctx context.Context, req connect.AnyRequest) (connect.AnyResponse, error) {
+		res, err := next(ctx, req)
+		i.record(err)
+		return res, err
+	}
+}
+
+func (i *recordErrorsInterceptor) WrapStreamingClient(next connect.StreamingClientFunc) connect.StreamingClientFunc {
+	return func(ctx context.Context, spec connect.Spec) connect.StreamingClientConn {
+		return &recordErrorsClientConn{StreamingClientConn: next(ctx, spec), record: i.record}
+	}
+}
+
+type recordErrorsClientConn struct {
+	connect.StreamingClientConn
+
+	record func(error)
+}
+
+func (c *recordErrorsClientConn) Send(msg any) error {
+	err := c.StreamingClientConn.Send(msg)
+	c.record(err)
+	return err
+}
+
+func (c *recordErrorsClientConn) Receive(msg any) error {
+	err := c.StreamingClientConn.Receive(msg)
+	c.record(err)
+	return err
+}
+
 type assertSchemaInterceptor struct {
 	tb testing.TB
 }
@@ -820,3 +1299,268 @@ type httpClientFunc func(*http.Request) (*http.Response, error)
 func (fn httpClientFunc) Do(req *http.Request) (*http.Response, error) {
 	return fn(req)
 }
+
+func TestClientErrorEncoding(t *testing.T) {
+	t.Parallel()
+	// The server responds with a body that no codec can decode.
+	garbage := func(contentType, contentEncoding string) *memhttp.Server {
+		return memhttptest.NewServer(t, http.HandlerFunc(func(responseWriter http.ResponseWriter, _ *http.Request) {
+			responseWriter.Header().Set("Content-Type", contentType)
+			if contentEncoding != "" {
+				responseWriter.Header().Set("Content-Encoding", contentEncoding)
+			}
+			_, _ = responseWriter.Write([]byte{0xff, 0xff, 0xff})
+		}))
+	}
+	ping := func(t *testing.T, server *memhttp.Server, options ...connect.ClientOption) *connect.Error {
+		t.Helper()
+		client := pingv1connect.NewPingServiceClient(server.Client(), server.URL(), options...)
+		_, err := client.Ping(context.Background(), connect.NewRequest(&pingv1.PingRequest{}))
+		var connectErr *connect.Error
+		assert.True(t, errors.As(err, &connectErr))
+		return connectErr
+	}
+
+	t.Run("proto", func(t *testing.T) {
+		t.Parallel()
+		err := ping(t, garbage("application/proto", ""))
+		assert.Equal(t, err.CodecName(), "proto")
+		assert.Equal(t, err.CompressionName(), "")
+	})
+	t.Run("json", func(t *testing.T) {
+		t.Parallel()
+		err := ping(t, garbage("application/json", ""), connect.WithProtoJSON())
+		assert.Equal(t, err.CodecName(), "json")
+	})
+	t.Run("gzip", func(t *testing.T) {
+		t.Parallel()
+		err := ping(t, garbage("application/proto", "gzip"))
+		assert.Equal(t, err.CodecName(), "proto")
+		assert.Equal(t, err.CompressionName(), "gzip")
+	})
+	t.Run("stream", func(t *testing.T) {
+		t.Parallel()
+		server := memhttptest.NewServer(t, http.HandlerFunc(func(responseWriter http.ResponseWriter, _ *http.Request) {
+			responseWriter.Header().Set("Content-Type", "application/grpc")
+			_, _ = responseWriter.Write([]byte{0, 0, 0, 0, 3, 0xff, 0xff, 0xff})
+		}))
+		err := ping(t, server, connect.WithGRPC())
+		assert.Equal(t, err.CodecName(), "proto")
+	})
+	t.Run("wire_error", func(t *testing.T) {
+		t.Parallel()
+		mux := http.NewServeMux()
+		mux.Handle(pingv1connect.NewPingServiceHandler(pingServer{}))
+		server := memhttptest.NewServer(t, mux)
+		client := pingv1connect.NewPingServiceClient(server.Client(), server.URL())
+		_, err := client.Fail(context.Background(), connect.NewRequest(&pingv1.FailRequest{Code: int32(connect.CodeInternal)}))
+		var connectErr *connect.Error
+		assert.True(t, errors.As(err, &connectErr))
+		assert.Equal(t, connectErr.CodecName(), "")
+		assert.Equal(t, connectErr.CompressionName(), "")
+	})
+}
+
+func TestUnaryRequestContentLength(t *testing.T) {
+	t.Parallel()
+	type observed struct {
+		contentLength    int64
+		header           string
+		transferEncoding []string
+	}
+	requests := make(chan observed, 1)
+	mux := http.NewServeMux()
+	pingRoute, pingHandler := pingv1connect.NewPingServiceHandler(pingServer{})
+	mux.Handle(pingRoute, http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		requests <- observed{
+			contentLength:    request.ContentLength,
+			header:           request.Header.Get("Content-Length"),
+			transferEncoding: request.TransferEncoding,
+		}
+		pingHandler.ServeHTTP(response, request)
+	}))
+	// Over HTTP/1.1, the handler sees the framing the client chose.
+	server := memhttptest.NewServer(t, mux)
+	httpClient := &http.Client{Transport: server.TransportHTTP1()}
+
+	for _, testCase := range []struct {
+		name    string
+		request *pingv1.PingRequest
+		options []connect.ClientOption
+	}{
+		{name: "proto", request: &pingv1.PingRequest{Number: 42, Text: "hello"}},
+		{name: "json", request: &pingv1.PingRequest{Number: 42}, options: []connect.ClientOption{connect.WithProtoJSON()}},
+		{name: "gzip", request: &pingv1.PingRequest{Text: strings.Repeat("a", 1024)}, options: []connect.ClientOption{connect.WithSendGzip()}},
+		{name: "empty", request: &pingv1.PingRequest{}},
+	} {
+		client := pingv1connect.NewPingServiceClient(httpClient, server.URL(), testCase.options...)
+		_, err := client.Ping(context.Background(), connect.NewRequest(testCase.request))
+		assert.Nil(t, err, assert.Sprintf(testCase.name))
+		got := <-requests
+		assert.True(t, got.contentLength >= 0, assert.Sprintf("%s: Content-Length %d", testCase.name, got.contentLength))
+		assert.Equal(t, len(got.transferEncoding), 0, assert.Sprintf(testCase.name))
+		assert.NotZero(t, got.header, assert.Sprintf(testCase.name))
+	}
+
+	// Client streams can't know their length up front, so they're chunked.
+	client := pingv1connect.NewPingServiceClient(httpClient, server.URL())
+	stream := client.Sum(context.Background())
+	assert.Nil(t, stream.Send(&pingv1.SumRequest{Number: 1}))
+	_, err := stream.CloseAndReceive()
+	assert.Nil(t, err)
+	got := <-requests
+	assert.Equal(t, got.contentLength, -1)
+	assert.Equal(t, got.header, "")
+	assert.Equal(t, got.transferEncoding, []string{"chunked"})
+}
+
+func TestClientHTTPStatusFromIntermediary(t *testing.T) {
+	t.Parallel()
+	// A proxy in front of the server responds with a bare HTTP error, which
+	// isn't a Connect or gRPC error.
+	newProxy := func(t *testing.T, status int) *memhttp.Server {
+		t.Helper()
+		return memhttptest.NewServer(t, http.HandlerFunc(func(responseWriter http.ResponseWriter, request *http.Request) {
+			_, _ = io.Copy(io.Discard, request.Body)
+			http.Error(responseWriter, "upstream connect error", status)
+		}))
+	}
+	statuses := []struct {
+		status int
+		code   connect.Code
+	}{
+		{http.StatusBadGateway, connect.CodeUnavailable},
+		{http.StatusServiceUnavailable, connect.CodeUnavailable},
+		{http.StatusGatewayTimeout, connect.CodeUnavailable},
+		{http.StatusTooManyRequests, connect.CodeUnavailable},
+		{http.StatusUnauthorized, connect.CodeUnauthenticated},
+		{http.StatusForbidden, connect.CodePermissionDenied},
+	}
+	protocols := []struct {
+		name    string
+		options []connect.ClientOption
+	}{
+		{name: "connect"},
+		{name: "grpc", options: []connect.ClientOption{connect.WithGRPC()}},
+		{name: "grpcweb", options: []connect.ClientOption{connect.WithGRPCWeb()}},
+	}
+	for _, status := range statuses {
+		status := status
+		t.Run(strconv.Itoa(status.status), func(t *testing.T) {
+			t.Parallel()
+			server := newProxy(t, status.status)
+			for _, protocol := range protocols {
+				client := pingv1connect.NewPingServiceClient(server.Client(), server.URL(), protocol.options...)
+				_, err := client.Ping(context.Background(), connect.NewRequest(&pingv1.PingRequest{}))
+				assert.Equal(t, connect.CodeOf(err), status.code, assert.Sprintf("%s unary: %v", protocol.name, err))
+				assert.True(t, strings.Contains(err.Error(), strconv.Itoa(status.status)), assert.Sprintf("%s unary: %v", protocol.name, err))
+
+				stream, err := client.CountUp(context.Background(), connect.NewRequest(&pingv1.CountUpRequest{Number: 1}))
+				if err == nil {
+					assert.False(t, stream.Receive())
+					err = stream.Err()
+				}
+				assert.Equal(t, connect.CodeOf(err), status.code, assert.Sprintf("%s stream: %v", protocol.name, err))
+				assert.True(t, strings.Contains(err.Error(), strconv.Itoa(status.status)), assert.Sprintf("%s stream: %v", protocol.name, err))
+			}
+		})
+	}
+	t.Run("429_resource_exhausted", func(t *testing.T) {
+		t.Parallel()
+		server := newProxy(t, http.StatusTooManyRequests)
+		for _, protocol := range protocols {
+			options := append([]connect.ClientOption{connect.WithTooManyRequestsAsResourceExhausted()}, protocol.options...)
+			client := pingv1connect.NewPingServiceClient(server.Client(), server.URL(), options...)
+			_, err := client.Ping(context.Background(), connect.NewRequest(&pingv1.PingRequest{}))
+			assert.Equal(t, connect.CodeOf(err), connect.CodeResourceExhausted, assert.Sprintf("%s unary: %v", protocol.name, err))
+
+			stream, err := client.CountUp(context.Background(), connect.NewRequest(&pingv1.CountUpRequest{Number: 1}))
+			if err == nil {
+				assert.False(t, stream.Receive())
+				err = stream.Err()
+			}
+			assert.Equal(t, connect.CodeOf(err), connect.CodeResourceExhausted, assert.Sprintf("%s stream: %v", protocol.name, err))
+		}
+	})
+}
+
+func TestWithClientMetadata(t *testing.T) {
+	t.Parallel()
+	type metadata struct{ Name, Version string }
+	received := make(chan metadata, 1)
+	mux := http.NewServeMux()
+	pingRoute, pingHandler := pingv1connect.NewPingServiceHandler(pingServer{})
+	mux.Handle(pingRoute, http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		received <- metadata{
+			Name:    request.Header.Get("X-Client-Name"),
+			Version: request.Header.Get("X-Client-Version"),
+		}
+		pingHandler.ServeHTTP(response, request)
+	}))
+	server := memhttptest.NewServer(t, mux)
+	for _, protocol := range []struct {
+		name    string
+		options []connect.ClientOption
+	}{
+		{name: "connect"},
+		{name: "grpc", options: []connect.ClientOption{connect.WithGRPC()}},
+		{name: "grpcweb", options: []connect.ClientOption{connect.WithGRPCWeb()}},
+	} {
+		client := pingv1connect.NewPingServiceClient(
+			server.Client(),
+			server.URL(),
+			append(protocol.options, connect.WithClientMetadata("billing", "v1.2.3"))...,
+		)
+		_, err := client.Ping(context.Background(), connect.NewRequest(&pingv1.PingRequest{}))
+		assert.Nil(t, err)
+		assert.Equal(t, <-received, metadata{"billing", "v1.2.3"}, assert.Sprintf(protocol.name))
+
+		// Values set on the request win.
+		request := connect.NewRequest(&pingv1.PingRequest{})
+		request.Header().Set("X-Client-Version", "v1.2.4-canary")
+		_, err = client.Ping(context.Background(), request)
+		assert.Nil(t, err)
+		assert.Equal(t, <-received, metadata{"billing", "v1.2.4-canary"}, assert.Sprintf(protocol.name))
+
+		stream := client.CumSum(context.Background())
+		stream.RequestHeader().Set("X-Client-Name", "billing-worker")
+		assert.Nil(t, stream.Send(&pingv1.CumSumRequest{Number: 1}))
+		_, err = stream.Receive()
+		assert.Nil(t, err)
+		assert.Nil(t, stream.CloseRequest())
+		assert.Nil(t, stream.CloseResponse())
+		assert.Equal(t, <-received, metadata{"billing-worker", "v1.2.3"}, assert.Sprintf(protocol.name))
+
+		countUp := connect.NewRequest(&pingv1.CountUpRequest{Number: 1})
+		countUp.Header().Set("X-Client-Version", "v1.2.4-canary")
+		serverStream, err := client.CountUp(context.Background(), countUp)
+		assert.Nil(t, err)
+		for serverStream.Receive() {
+		}
+		assert.Nil(t, serverStream.Err())
+		assert.Nil(t, serverStream.Close())
+		assert.Equal(t, <-received, metadata{"billing", "v1.2.4-canary"}, assert.Sprintf(protocol.name))
+	}
+
+	// Without the option, no metadata is sent.
+	client := pingv1connect.NewPingServiceClient(server.Client(), server.URL())
+	_, err := client.Ping(context.Background(), connect.NewRequest(&pingv1.PingRequest{}))
+	assert.Nil(t, err)
+	assert.Equal(t, <-received, metadata{})
+}
+
+func TestClientConstructValidation(t *testing.T) {
+	t.Parallel()
+	newClient := func(options ...connect.ClientOption) (panicked any) {
+		defer func() { panicked = recover() }()
+		pingv1connect.NewPingServiceClient(http.DefaultClient, "https://example.com", options...)
+		return nil
+	}
+	// Without validation, the unknown compression fails each call instead.
+	assert.Nil(t, newClient(connect.WithSendCompression("zstd")))
+	panicked := newClient(connect.WithSendCompression("zstd"), connect.WithConstructValidation())
+	message, ok := panicked.(string)
+	assert.True(t, ok, assert.Sprintf("panicked with %v", panicked))
+	assert.True(t, strings.Contains(message, `unknown compression "zstd"`), assert.Sprintf("message: %s", message))
+	assert.Nil(t, newClient(connect.WithConstructValidation()))
+}
@@ -19,6 +19,7 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 
 	"google.golang.org/protobuf/encoding/protojson"
 	"google.golang.org/protobuf/proto"
@@ -65,6 +66,36 @@ type marshalAppender interface {
 	MarshalAppend([]byte, any) ([]byte, error)
 }
 
+// marshalWriter is an extension to Codec for marshaling directly to an
+// io.Writer. Handlers use it for unary Connect responses, so large messages
+// can be written to the network incrementally rather than buffered in memory.
+type marshalWriter interface {
+	Codec
+
+	// MarshalTo marshals the given message and writes it to the given writer.
+	//
+	// MarshalTo may expect a specific type of message, and will error if this
+	// type is not given. If it fails after writing any data, the response has
+	// already started and can't be replaced with an error, so implementations
+	// should validate the message before writing.
+	MarshalTo(io.Writer, any) error
+}
+
+// unmarshalReader is an extension to Codec for unmarshaling directly from an
+// io.Reader. Handlers and clients use it for compressed messages in enveloped
+// streams, and clients also use it for Connect unary responses, so large
+// messages can be decoded incrementally rather than buffered in memory.
+type unmarshalReader interface {
+	Codec
+
+	// UnmarshalFrom unmarshals a message from the given reader, which returns
+	// io.EOF once the message's data is exhausted.
+	//
+	// UnmarshalFrom may expect a specific type of message, and will error if
+	// this type is not given.
+	UnmarshalFrom(io.Reader, any) error
+}
+
 // stableCodec is an extension to Codec for serializing with stable output.
 type stableCodec interface {
 	Codec
@@ -144,7 +175,9 @@ func (c *protoBinaryCodec) IsBinary() bool {
 }
 
 type protoJSONCodec struct {
-	name string
+	name   string
+	strict bool // reject unknown fields
+	pretty bool // indent output
 }
 
 var _ Codec = (*protoJSONCodec)(nil)
@@ -156,7 +189,7 @@ func (c *protoJSONCodec) Marshal(message any) ([]byte, error) {
 	if !ok {
 		return nil, errNotProto(message)
 	}
-	return protojson.MarshalOptions{}.Marshal(protoMessage)
+	return c.marshalOptions().Marshal(protoMessage)
 }
 
 func (c *protoJSONCodec) MarshalAppend(dst []byte, message any) ([]byte, error) {
@@ -164,7 +197,14 @@ func (c *protoJSONCodec) MarshalAppend(dst []byte, message any) ([]byte, error)
 	if !ok {
 		return nil, errNotProto(message)
 	}
-	return protojson.MarshalOptions{}.MarshalAppend(dst, protoMessage)
+	return c.marshalOptions().MarshalAppend(dst, protoMessage)
+}
+
+func (c *protoJSONCodec) marshalOptions() protojson.MarshalOptions {
+	if c.pretty {
+		return protojson.MarshalOptions{Multiline: true, Indent: "  "}
+	}
+	return protojson.MarshalOptions{}
 }
 
 func (c *protoJSONCodec) Unmarshal(binary []byte, message any) error {
@@ -175,9 +215,10 @@ func (c *protoJSONCodec) Unmarshal(binary []byte, message any) error {
 	if len(binary) == 0 {
 		return errors.New("zero-length payload is not a valid JSON object")
 	}
-	// Discard unknown fields so clients and servers aren't forced to always use
-	// exactly the same version of the schema.
-	options := protojson.UnmarshalOptions{DiscardUnknown: true}
+	// Unless configured to be strict, discard unknown fields so clients and
+	// servers aren't forced to always use exactly the same version of the
+	// schema.
+	options := protojson.UnmarshalOptions{DiscardUnknown: !c.strict}
 	err := options.Unmarshal(binary, protoMessage)
 	if err != nil {
 		return fmt.Errorf("unmarshal into %T: %w", message, err)
@@ -206,6 +247,18 @@ func (c *protoJSONCodec) IsBinary() bool {
 	return false
 }
 
+// withJSONDiscardUnknown configures whether the default JSON codec discards
+// unknown fields. Other codecs are returned unchanged.
+func withJSONDiscardUnknown(codec Codec, discard bool) Codec {
+	jsonCodec, ok := codec.(*protoJSONCodec)
+	if !ok {
+		return codec
+	}
+	configured := *jsonCodec
+	configured.strict = !discard
+	return &configured
+}
+
 // readOnlyCodecs is a read-only interface to a map of named codecs.
 type readOnlyCodecs interface {
 	// Get gets the Codec with the given name.
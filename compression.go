@@ -57,19 +57,80 @@ type Compressor interface {
 	Reset(io.Writer)
 }
 
+// A StreamCompressor is a Compressor that carries state, such as a dictionary
+// or a sliding window, across the messages of a stream. If an algorithm's
+// Compressor implements StreamCompressor, streaming calls use a single
+// Compressor for all the messages they send: after writing each message, they
+// call EndMessage rather than Close, and they only Close the Compressor once
+// the stream ends. Connect unary calls, which have just one message, and
+// algorithms like the default gzip whose Compressor doesn't implement
+// StreamCompressor compress each message independently.
+//
+// Since each message depends on the ones before it, both the client and the
+// server must use stateful implementations of the algorithm. Register them
+// under a different name than any stateless version of the algorithm, so
+// that peers never mix the two.
+type StreamCompressor interface {
+	Compressor
+
+	// EndMessage writes everything written so far to the underlying sink, so
+	// that the peer can decompress the message, without discarding the
+	// Compressor's state. Implementations wrapping a compressor with a Flush
+	// method, like [*flate.Writer], typically call it here. (Flush itself isn't
+	// enough to opt in, since [*gzip.Writer] has one too.)
+	EndMessage() error
+}
+
+// A StreamDecompressor is a Decompressor that carries state across the
+// messages of a stream. It's the counterpart to StreamCompressor: streaming
+// calls Reset the StreamDecompressor for the first compressed message in a
+// stream and call Continue for each later one. Each message's compressed data
+// ends where the peer's StreamCompressor called EndMessage rather than at the
+// end of a complete compressed stream, and Read must return io.EOF once it has
+// returned all of the message's data.
+type StreamDecompressor interface {
+	Decompressor
+
+	// Continue prepares the StreamDecompressor to read the next message's
+	// compressed data from the supplied reader, keeping the state built up
+	// from earlier messages.
+	Continue(io.Reader) error
+}
+
+// compressionOverride records a handler's decision, made with
+// Response.SetCompression, to compress or skip compressing a single response
+// regardless of WithCompressMinBytes and WithResponseCompressionPredicate.
+type compressionOverride uint8
+
+const (
+	compressionOverrideNone compressionOverride = iota
+	compressionOverrideForce
+	compressionOverrideSkip
+)
+
 type compressionPool struct {
+	name          string
 	decompressors sync.Pool
 	compressors   sync.Pool
+	// Whether the pooled values implement StreamCompressor and
+	// StreamDecompressor, respectively. They're detected on first use, so
+	// algorithms that are registered but never used are never constructed.
+	streamCompressorOnce   sync.Once
+	streamCompressor       bool
+	streamDecompressorOnce sync.Once
+	streamDecompressor     bool
 }
 
 func newCompressionPool(
+	name string,
 	newDecompressor func() Decompressor,
 	newCompressor func() Compressor,
 ) *compressionPool {
 	if newDecompressor == nil && newCompressor == nil {
 		return nil
 	}
-	return &compressionPool{
+	pool := &compressionPool{
+		name: name,
 		decompressors: sync.Pool{
 			New: func() any { return newDecompressor() },
 		},
@@ -77,6 +138,31 @@ func newCompressionPool(
 			New: func() any { return newCompressor() },
 		},
 	}
+	return pool
+}
+
+// isStreamCompressor reports whether the algorithm's Compressor implements
+// StreamCompressor. The instance used to check is returned to the pool, so
+// it's not wasted.
+func (c *compressionPool) isStreamCompressor() bool {
+	c.streamCompressorOnce.Do(func() {
+		compressor := c.compressors.Get()
+		_, c.streamCompressor = compressor.(StreamCompressor)
+		c.compressors.Put(compressor)
+	})
+	return c.streamCompressor
+}
+
+// isStreamDecompressor reports whether the algorithm's Decompressor
+// implements StreamDecompressor. Like isStreamCompressor, it returns the
+// instance used to check to the pool.
+func (c *compressionPool) isStreamDecompressor() bool {
+	c.streamDecompressorOnce.Do(func() {
+		decompressor := c.decompressors.Get()
+		_, c.streamDecompressor = decompressor.(StreamDecompressor)
+		c.decompressors.Put(decompressor)
+	})
+	return c.streamDecompressor
 }
 
 func (c *compressionPool) Decompress(dst *bytes.Buffer, src *bytes.Buffer, readMaxBytes int64) *Error {
@@ -84,13 +170,25 @@ func (c *compressionPool) Decompress(dst *bytes.Buffer, src *bytes.Buffer, readM
 	if err != nil {
 		return errorf(CodeInvalidArgument, "get decompressor: %w", err)
 	}
+	if err := c.readDecompressed(dst, decompressor, readMaxBytes); err != nil {
+		_ = c.putDecompressor(decompressor)
+		return err
+	}
+	if err := c.putDecompressor(decompressor); err != nil {
+		return errorf(CodeUnknown, "recycle decompressor: %w", err)
+	}
+	return nil
+}
+
+// readDecompressed reads all of the decompressor's output into dst, enforcing
+// readMaxBytes.
+func (c *compressionPool) readDecompressed(dst *bytes.Buffer, decompressor Decompressor, readMaxBytes int64) *Error {
 	reader := io.Reader(decompressor)
 	if readMaxBytes > 0 && readMaxBytes < math.MaxInt64 {
 		reader = io.LimitReader(decompressor, readMaxBytes+1)
 	}
 	bytesRead, err := dst.ReadFrom(reader)
 	if err != nil {
-		_ = c.putDecompressor(decompressor)
 		err = wrapIfContextError(err)
 		if connectErr, ok := asError(err); ok {
 			return connectErr
@@ -98,16 +196,56 @@ func (c *compressionPool) Decompress(dst *bytes.Buffer, src *bytes.Buffer, readM
 		return errorf(CodeInvalidArgument, "decompress: %w", err)
 	}
 	if readMaxBytes > 0 && bytesRead > readMaxBytes {
+		discardedBytes, err := io.Copy(io.Discard, decompressor)
+		// Name the algorithm, so that it's clear to clients that the limit applies
+		// to the decompressed message.
+		if err != nil {
+			return errorf(CodeResourceExhausted, "message is larger than configured max %d after %s decompression - unable to determine message size: %w", readMaxBytes, c.name, err)
+		}
+		return errorf(CodeResourceExhausted, "message size %d after %s decompression is larger than configured max %d", bytesRead+discardedBytes, c.name, readMaxBytes)
+	}
+	return nil
+}
+
+// DecompressInto decompresses src directly into the codec, so the decompressed
+// message is never buffered in full. Like Decompress, it enforces
+// readMaxBytes on the decompressed size.
+func (c *compressionPool) DecompressInto(codec unmarshalReader, message any, src io.Reader, readMaxBytes int64) *Error {
+	decompressor, err := c.getDecompressor(src)
+	if err != nil {
+		return errorf(CodeInvalidArgument, "get decompressor: %w", err)
+	}
+	reader := &meteredReader{reader: decompressor}
+	limited := io.Reader(reader)
+	if readMaxBytes > 0 && readMaxBytes < math.MaxInt64 {
+		limited = io.LimitReader(reader, readMaxBytes+1)
+	}
+	unmarshalErr := codec.UnmarshalFrom(limited, message)
+	// Codecs may stop reading before EOF. Read the rest of the message to
+	// enforce readMaxBytes and let the decompressor verify its checksum.
+	_, _ = io.Copy(io.Discard, limited)
+	if readMaxBytes > 0 && reader.bytesRead > readMaxBytes {
 		discardedBytes, err := io.Copy(io.Discard, decompressor)
 		_ = c.putDecompressor(decompressor)
 		if err != nil {
-			return errorf(CodeResourceExhausted, "message is larger than configured max %d - unable to determine message size: %w", readMaxBytes, err)
+			return errorf(CodeResourceExhausted, "message is larger than configured max %d after %s decompression - unable to determine message size: %w", readMaxBytes, c.name, err)
 		}
-		return errorf(CodeResourceExhausted, "message size %d is larger than configured max %d", bytesRead+discardedBytes, readMaxBytes)
+		return errorf(CodeResourceExhausted, "message size %d after %s decompression is larger than configured max %d", reader.bytesRead+discardedBytes, c.name, readMaxBytes)
+	}
+	if reader.err != nil {
+		_ = c.putDecompressor(decompressor)
+		err := wrapIfContextError(reader.err)
+		if connectErr, ok := asError(err); ok {
+			return connectErr
+		}
+		return errorf(CodeInvalidArgument, "decompress: %w", err)
 	}
 	if err := c.putDecompressor(decompressor); err != nil {
 		return errorf(CodeUnknown, "recycle decompressor: %w", err)
 	}
+	if unmarshalErr != nil {
+		return errorf(CodeInvalidArgument, "unmarshal message: %w", unmarshalErr)
+	}
 	return nil
 }
 
@@ -171,6 +309,109 @@ func (c *compressionPool) putCompressor(compressor Compressor) error {
 	return nil
 }
 
+// streamCompression compresses the messages sent on a single stream with one
+// StreamCompressor, carrying state from message to message.
+type streamCompression struct {
+	pool       *compressionPool
+	compressor StreamCompressor // nil until the first compressed message
+	sink       bufferSink
+}
+
+func (s *streamCompression) Compress(dst *bytes.Buffer, src *bytes.Buffer) *Error {
+	if s.compressor == nil {
+		compressor, err := s.pool.getCompressor(&s.sink)
+		if err != nil {
+			return errorf(CodeUnknown, "get compressor: %w", err)
+		}
+		stream, ok := compressor.(StreamCompressor)
+		if !ok {
+			_ = s.pool.putCompressor(compressor)
+			return errorf(CodeInternal, "expected StreamCompressor, got %T from pool", compressor)
+		}
+		s.compressor = stream
+	}
+	s.sink.buffer = dst
+	defer func() { s.sink.buffer = nil }()
+	if _, err := src.WriteTo(s.compressor); err != nil {
+		s.Release()
+		err = wrapIfContextError(err)
+		if connectErr, ok := asError(err); ok {
+			return connectErr
+		}
+		return errorf(CodeInternal, "compress: %w", err)
+	}
+	if err := s.compressor.EndMessage(); err != nil {
+		s.Release()
+		return errorf(CodeInternal, "compress: end message: %w", err)
+	}
+	return nil
+}
+
+// Release returns the stream's Compressor, if any, to the pool. It's safe to
+// call on a nil receiver and more than once.
+func (s *streamCompression) Release() {
+	if s == nil || s.compressor == nil {
+		return
+	}
+	// Anything written by Close goes nowhere, since the sink has no buffer.
+	_ = s.pool.putCompressor(s.compressor)
+	s.compressor = nil
+}
+
+// streamDecompression is the counterpart to streamCompression: it decompresses
+// the messages received on a single stream.
+type streamDecompression struct {
+	pool         *compressionPool
+	decompressor StreamDecompressor // nil until the first compressed message
+}
+
+func (s *streamDecompression) Decompress(dst *bytes.Buffer, src *bytes.Buffer, readMaxBytes int64) *Error {
+	if s.decompressor == nil {
+		decompressor, err := s.pool.getDecompressor(src)
+		if err != nil {
+			return errorf(CodeInvalidArgument, "get decompressor: %w", err)
+		}
+		stream, ok := decompressor.(StreamDecompressor)
+		if !ok {
+			_ = s.pool.putDecompressor(decompressor)
+			return errorf(CodeInternal, "expected StreamDecompressor, got %T from pool", decompressor)
+		}
+		s.decompressor = stream
+	} else if err := s.decompressor.Continue(src); err != nil {
+		s.Release()
+		return errorf(CodeInvalidArgument, "continue decompressing: %w", err)
+	}
+	if err := s.pool.readDecompressed(dst, s.decompressor, readMaxBytes); err != nil {
+		s.Release()
+		return err
+	}
+	return nil
+}
+
+// Release returns the stream's Decompressor, if any, to the pool. It's safe
+// to call on a nil receiver and more than once.
+func (s *streamDecompression) Release() {
+	if s == nil || s.decompressor == nil {
+		return
+	}
+	// The stream may have ended early, so ignore errors from Close.
+	_ = s.pool.putDecompressor(s.decompressor)
+	s.decompressor = nil
+}
+
+// bufferSink is an io.Writer that appends to a swappable buffer, discarding
+// writes when the buffer is nil.
+type bufferSink struct {
+	buffer *bytes.Buffer
+}
+
+func (s *bufferSink) Write(data []byte) (int, error) {
+	if s.buffer == nil {
+		return len(data), nil
+	}
+	return s.buffer.Write(data)
+}
+
 // readOnlyCompressionPools is a read-only interface to a map of named
 // compressionPools.
 type readOnlyCompressionPools interface {
@@ -222,3 +463,21 @@ func (m *namedCompressionPools) Contains(name string) bool {
 func (m *namedCompressionPools) CommaSeparatedNames() string {
 	return m.commaSeparatedNames
 }
+
+// meteredReader counts the bytes read from a reader and records its first
+// error, so that read and decompression failures can be told apart from
+// unmarshaling failures.
+type meteredReader struct {
+	reader    io.Reader
+	bytesRead int64
+	err       error
+}
+
+func (r *meteredReader) Read(data []byte) (int, error) {
+	n, err := r.reader.Read(data)
+	r.bytesRead += int64(n)
+	if err != nil && !errors.Is(err, io.EOF) && r.err == nil {
+		r.err = err
+	}
+	return n, err
+}
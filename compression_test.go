@@ -15,8 +15,10 @@
 package connect
 
 import (
+	"compress/gzip"
 	"context"
 	"net/http"
+	"sync/atomic"
 	"testing"
 
 	"connectrpc.com/connect/internal/assert"
@@ -159,3 +161,29 @@ func TestHandlerCompressionOptionTest(t *testing.T) {
 		checkPools(t, config)
 	})
 }
+
+func TestCompressionPoolConstructsLazily(t *testing.T) {
+	t.Parallel()
+	var compressors, decompressors atomic.Int64
+	pool := newCompressionPool(
+		"counted",
+		func() Decompressor {
+			decompressors.Add(1)
+			return &gzip.Reader{}
+		},
+		func() Compressor {
+			compressors.Add(1)
+			return gzip.NewWriter(nil)
+		},
+	)
+	// Registering an algorithm mustn't construct any instances.
+	assert.Equal(t, compressors.Load(), 0)
+	assert.Equal(t, decompressors.Load(), 0)
+	assert.False(t, pool.isStreamCompressor())
+	assert.False(t, pool.isStreamDecompressor())
+	assert.Equal(t, compressors.Load(), 1)
+	assert.Equal(t, decompressors.Load(), 1)
+	// Detection happens once.
+	assert.False(t, pool.isStreamCompressor())
+	assert.Equal(t, compressors.Load(), 1)
+}
@@ -30,6 +30,8 @@ import (
 	"io"
 	"net/http"
 	"net/url"
+
+	"google.golang.org/protobuf/proto"
 )
 
 // Version is the semantic version of the connect module.
@@ -110,7 +112,9 @@ type StreamingHandlerConn interface {
 // standard library's [errors.Is]. If the server encounters an error during
 // processing, subsequent calls to the StreamingClientConn's Send method will
 // return an error wrapping [io.EOF]; clients may then call Receive to unmarshal
-// the error.
+// the error. By the time Receive returns an error, the response trailers have
+// been read for every protocol, so interceptors wrapping a StreamingClientConn
+// may inspect ResponseTrailer as soon as they see [io.EOF].
 //
 // Headers and trailers beginning with "Connect-" and "Grpc-" are reserved for
 // use by the gRPC and Connect protocols: applications may read them but
@@ -238,8 +242,9 @@ type AnyRequest interface {
 type Response[T any] struct {
 	Msg *T
 
-	header  http.Header
-	trailer http.Header
+	header      http.Header
+	trailer     http.Header
+	compression compressionOverride
 }
 
 // NewResponse wraps a generated response message.
@@ -282,9 +287,50 @@ func (r *Response[_]) Trailer() http.Header {
 	return r.trailer
 }
 
+// SetCompression overrides whether a handler compresses this response. If
+// compress is false, the response is sent uncompressed even if the client and
+// handler negotiated compression, which avoids wasting CPU on messages that are
+// already compressed. If compress is true, the response is compressed with the
+// negotiated algorithm even if it's smaller than the [WithCompressMinBytes]
+// threshold or [WithResponseCompressionPredicate] would skip it; it's still
+// sent uncompressed if no algorithm was negotiated.
+//
+// SetCompression only affects responses returned by unary handlers. It has no
+// effect on clients. To choose compression for each message of a stream, use
+// [WithResponseCompressionPredicate].
+func (r *Response[_]) SetCompression(compress bool) {
+	if compress {
+		r.compression = compressionOverrideForce
+	} else {
+		r.compression = compressionOverrideSkip
+	}
+}
+
 // internalOnly implements AnyResponse.
 func (r *Response[_]) internalOnly() {}
 
+// compressionOverride implements AnyResponse.
+func (r *Response[_]) compressionOverride() compressionOverride {
+	return r.compression
+}
+
+// clone implements AnyResponse. Protobuf messages are deep-copied; other
+// message types are shared with the original response.
+func (r *Response[T]) clone() AnyResponse {
+	res := &Response[T]{
+		Msg:         r.Msg,
+		header:      r.header.Clone(),
+		trailer:     r.trailer.Clone(),
+		compression: r.compression,
+	}
+	if msg, ok := any(r.Msg).(proto.Message); ok && r.Msg != nil {
+		if cloned, ok := any(proto.Clone(msg)).(*T); ok {
+			res.Msg = cloned
+		}
+	}
+	return res
+}
+
 // AnyResponse is the common method set of every [Response], regardless of type
 // parameter. It's used in unary interceptors.
 //
@@ -301,6 +347,8 @@ type AnyResponse interface {
 	Trailer() http.Header
 
 	internalOnly()
+	clone() AnyResponse
+	compressionOverride() compressionOverride
 }
 
 // HTTPClient is the interface connect expects HTTP clients to implement. The
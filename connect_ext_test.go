@@ -20,7 +20,9 @@ import (
 	"compress/gzip"
 	"context"
 	"crypto/tls"
+	"encoding/base64"
 	"encoding/binary"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
@@ -31,6 +33,7 @@ import (
 	"runtime"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -674,6 +677,57 @@ func TestErrorHeaderPropagation(t *testing.T) {
 	})
 }
 
+func TestErrorDetailsParity(t *testing.T) {
+	t.Parallel()
+	mux := http.NewServeMux()
+	mux.Handle(pingv1connect.NewPingServiceHandler(pingServer{includeErrorDetails: true}))
+	server := memhttptest.NewServer(t, mux)
+	const code = connect.CodeInvalidArgument
+	want := &pingv1.FailRequest{Code: int32(code)}
+
+	t.Run("connect_wire_format", func(t *testing.T) {
+		t.Parallel()
+		request, err := http.NewRequestWithContext(
+			context.Background(),
+			http.MethodPost,
+			server.URL()+pingv1connect.PingServiceFailProcedure,
+			strings.NewReader(`{"code": 3}`),
+		)
+		assert.Nil(t, err)
+		request.Header.Set("Content-Type", "application/json")
+		response, err := server.Client().Do(request)
+		assert.Nil(t, err)
+		defer response.Body.Close()
+		var wire struct {
+			Details []struct {
+				Type  string `json:"type"`
+				Value string `json:"value"`
+			} `json:"details"`
+		}
+		assert.Nil(t, json.NewDecoder(response.Body).Decode(&wire))
+		assert.Equal(t, len(wire.Details), 1)
+		assert.Equal(t, wire.Details[0].Type, string(want.ProtoReflect().Descriptor().FullName()))
+		// Values are base64-encoded binary Protobuf, with or without padding.
+		value, err := base64.RawStdEncoding.DecodeString(strings.TrimRight(wire.Details[0].Value, "="))
+		assert.Nil(t, err)
+		got := &pingv1.FailRequest{}
+		assert.Nil(t, proto.Unmarshal(value, got))
+		assert.Equal(t, got, want)
+	})
+	for _, protocol := range []connect.ClientOption{connect.WithProtoJSON(), connect.WithGRPC(), connect.WithGRPCWeb()} {
+		client := pingv1connect.NewPingServiceClient(server.Client(), server.URL(), protocol)
+		_, err := client.Fail(context.Background(), connect.NewRequest(&pingv1.FailRequest{Code: int32(code)}))
+		var connectErr *connect.Error
+		assert.True(t, errors.As(err, &connectErr))
+		assert.Equal(t, connectErr.Code(), code)
+		details := connectErr.Details()
+		assert.Equal(t, len(details), 1)
+		detail, err := details[0].Value()
+		assert.Nil(t, err)
+		assert.Equal(t, detail, proto.Message(want))
+	}
+}
+
 func TestHeaderBasic(t *testing.T) {
 	t.Parallel()
 	const (
@@ -1054,6 +1108,83 @@ func TestCompressMinBytes(t *testing.T) {
 	})
 }
 
+func TestCompressMinBytesZero(t *testing.T) {
+	t.Parallel()
+	// A number of at least 2^56 is varint-encoded in 9 bytes, so the message
+	// is 10 bytes on the wire.
+	const tenBytes = int64(1) << 56
+	mux := http.NewServeMux()
+	mux.Handle(pingv1connect.NewPingServiceHandler(
+		&pluggablePingServer{
+			ping: func(_ context.Context, request *connect.Request[pingv1.PingRequest]) (*connect.Response[pingv1.PingResponse], error) {
+				return connect.NewResponse(&pingv1.PingResponse{Number: request.Msg.GetNumber()}), nil
+			},
+			countUp: func(_ context.Context, _ *connect.Request[pingv1.CountUpRequest], stream *connect.ServerStream[pingv1.CountUpResponse]) error {
+				if err := stream.Send(&pingv1.CountUpResponse{Number: tenBytes}); err != nil {
+					return err
+				}
+				return stream.Send(&pingv1.CountUpResponse{})
+			},
+		},
+		connect.WithCompressMinBytes(0),
+	))
+	server := memhttptest.NewServer(t, mux)
+
+	t.Run("envelope_flags", func(t *testing.T) {
+		t.Parallel()
+		requestBytes, err := proto.Marshal(&pingv1.CountUpRequest{Number: 1})
+		assert.Nil(t, err)
+		body := binary.BigEndian.AppendUint32([]byte{0}, uint32(len(requestBytes)))
+		body = append(body, requestBytes...)
+		request, err := http.NewRequestWithContext(
+			context.Background(),
+			http.MethodPost,
+			server.URL()+pingv1connect.PingServiceCountUpProcedure,
+			bytes.NewReader(body),
+		)
+		assert.Nil(t, err)
+		request.Header.Set("Content-Type", "application/connect+proto")
+		request.Header.Set("Connect-Accept-Encoding", "gzip")
+		response, err := server.Client().Do(request)
+		assert.Nil(t, err)
+		defer response.Body.Close()
+		assert.Equal(t, response.Header.Get("Connect-Content-Encoding"), "gzip")
+		for _, wantLen := range []int{10, 0} {
+			prefix := make([]byte, 5)
+			_, err := io.ReadFull(response.Body, prefix)
+			assert.Nil(t, err)
+			assert.Equal(t, prefix[0], 1) // compressed
+			compressed := make([]byte, binary.BigEndian.Uint32(prefix[1:]))
+			_, err = io.ReadFull(response.Body, compressed)
+			assert.Nil(t, err)
+			reader, err := gzip.NewReader(bytes.NewReader(compressed))
+			assert.Nil(t, err)
+			decompressed, err := io.ReadAll(reader)
+			assert.Nil(t, err)
+			assert.Equal(t, len(decompressed), wantLen)
+		}
+	})
+	t.Run("client", func(t *testing.T) {
+		t.Parallel()
+		for _, protocol := range []connect.ClientOption{connect.WithProtoJSON(), connect.WithGRPC(), connect.WithGRPCWeb()} {
+			client := pingv1connect.NewPingServiceClient(server.Client(), server.URL(), protocol, connect.WithSendGzip())
+			// Empty unary messages are compressed too.
+			response, err := client.Ping(context.Background(), connect.NewRequest(&pingv1.PingRequest{}))
+			assert.Nil(t, err)
+			assert.Equal(t, response.Msg.GetNumber(), 0)
+			stream, err := client.CountUp(context.Background(), connect.NewRequest(&pingv1.CountUpRequest{Number: 1}))
+			assert.Nil(t, err)
+			var got []int64
+			for stream.Receive() {
+				got = append(got, stream.Msg().GetNumber())
+			}
+			assert.Nil(t, stream.Err())
+			assert.Equal(t, got, []int64{tenBytes, 0})
+			assert.Nil(t, stream.Close())
+		}
+	})
+}
+
 func TestCustomCompression(t *testing.T) {
 	t.Parallel()
 	mux := http.NewServeMux()
@@ -1085,6 +1216,195 @@ func TestCustomCompression(t *testing.T) {
 	assert.Equal(t, response.Msg, &pingv1.PingResponse{Text: request.GetText()})
 }
 
+func TestStreamCompression(t *testing.T) {
+	t.Parallel()
+	const compressionName = "deflate-stream"
+	var continued atomic.Int64
+	decompressor := func() connect.Decompressor {
+		return &streamInflater{continued: &continued}
+	}
+	compressor := func() connect.Compressor {
+		w, err := flate.NewWriter(io.Discard, flate.DefaultCompression)
+		if err != nil {
+			t.Fatalf("failed to create flate writer: %v", err)
+		}
+		return &streamDeflater{w}
+	}
+	mux := http.NewServeMux()
+	mux.Handle(pingv1connect.NewPingServiceHandler(
+		pingServer{},
+		connect.WithCompression(compressionName, decompressor, compressor),
+	))
+	server := memhttptest.NewServer(t, mux)
+	for _, protocol := range []connect.ClientOption{connect.WithProtoJSON(), connect.WithGRPC()} {
+		continued.Store(0)
+		client := pingv1connect.NewPingServiceClient(
+			server.Client(),
+			server.URL(),
+			protocol,
+			connect.WithAcceptCompression(compressionName, decompressor, compressor),
+			connect.WithSendCompression(compressionName),
+		)
+		stream := client.CumSum(context.Background())
+		var want int64
+		for i := int64(1); i <= 5; i++ {
+			want += i
+			assert.Nil(t, stream.Send(&pingv1.CumSumRequest{Number: i}))
+			response, err := stream.Receive()
+			assert.Nil(t, err)
+			assert.Equal(t, response.GetSum(), want)
+		}
+		assert.Nil(t, stream.CloseRequest())
+		_, err := stream.Receive()
+		assert.ErrorIs(t, err, io.EOF)
+		assert.Nil(t, stream.CloseResponse())
+		// Both the handler and the client decompressed later messages using the
+		// state left over from earlier ones.
+		assert.True(t, continued.Load() >= 8)
+
+		// Unary calls work too.
+		request := &pingv1.PingRequest{Text: "testing 1..2..3.."}
+		response, err := client.Ping(context.Background(), connect.NewRequest(request))
+		assert.Nil(t, err)
+		assert.Equal(t, response.Msg.GetText(), request.GetText())
+	}
+}
+
+func TestResponseCompressionPredicate(t *testing.T) {
+	t.Parallel()
+	mux := http.NewServeMux()
+	mux.Handle(pingv1connect.NewPingServiceHandler(
+		pingServer{},
+		connect.WithResponseCompressionPredicate(func(message any) bool {
+			switch msg := message.(type) {
+			case *pingv1.CountUpResponse:
+				return msg.GetNumber()%2 == 0
+			case *pingv1.PingResponse:
+				return msg.GetText() != "precompressed"
+			}
+			return true
+		}),
+	))
+	server := memhttptest.NewServer(t, mux)
+	testCases := []struct {
+		name     string
+		protocol connect.ClientOption
+		// Compressed end-of-stream messages, in addition to the data messages.
+		streamTrailer, unaryTrailer int64
+	}{
+		{name: "connect", protocol: connect.WithProtoJSON(), streamTrailer: 1},
+		{name: "grpc", protocol: connect.WithGRPC()},
+		{name: "grpcweb", protocol: connect.WithGRPCWeb(), streamTrailer: 1, unaryTrailer: 1},
+	}
+	for _, testCase := range testCases {
+		testCase := testCase
+		t.Run(testCase.name, func(t *testing.T) {
+			t.Parallel()
+			// Count the compressed messages the client receives.
+			var decompressed atomic.Int64
+			decompressor := func() connect.Decompressor {
+				return &countingDecompressor{Reader: &gzip.Reader{}, count: &decompressed}
+			}
+			compressor := func() connect.Compressor { return gzip.NewWriter(io.Discard) }
+			client := pingv1connect.NewPingServiceClient(
+				server.Client(),
+				server.URL(),
+				testCase.protocol,
+				connect.WithAcceptCompression("gzip", decompressor, compressor),
+			)
+			stream, err := client.CountUp(context.Background(), connect.NewRequest(&pingv1.CountUpRequest{Number: 6}))
+			assert.Nil(t, err)
+			var got []int64
+			for stream.Receive() {
+				got = append(got, stream.Msg().GetNumber())
+			}
+			assert.Nil(t, stream.Err())
+			assert.Nil(t, stream.Close())
+			assert.Equal(t, got, []int64{1, 2, 3, 4, 5, 6})
+			assert.Equal(t, decompressed.Load(), 3+testCase.streamTrailer)
+
+			for _, text := range []string{"precompressed", "compressible"} {
+				decompressed.Store(0)
+				response, err := client.Ping(context.Background(), connect.NewRequest(&pingv1.PingRequest{Text: text}))
+				assert.Nil(t, err)
+				assert.Equal(t, response.Msg.GetText(), text)
+				if text == "precompressed" {
+					assert.Equal(t, decompressed.Load(), testCase.unaryTrailer)
+				} else {
+					assert.Equal(t, decompressed.Load(), 1+testCase.unaryTrailer)
+				}
+			}
+		})
+	}
+}
+
+func TestResponseSetCompression(t *testing.T) {
+	t.Parallel()
+	mux := http.NewServeMux()
+	mux.Handle(pingv1connect.NewPingServiceHandler(
+		&pluggablePingServer{
+			ping: func(_ context.Context, request *connect.Request[pingv1.PingRequest]) (*connect.Response[pingv1.PingResponse], error) {
+				response := connect.NewResponse(&pingv1.PingResponse{Text: request.Msg.GetText()})
+				switch text := request.Msg.GetText(); {
+				case strings.HasPrefix(text, "skip"):
+					response.SetCompression(false)
+				case text == "force":
+					response.SetCompression(true)
+				}
+				return response, nil
+			},
+		},
+		// Small responses are uncompressed by default, and the predicate would
+		// compress everything else.
+		connect.WithCompressMinBytes(1024),
+		connect.WithResponseCompressionPredicate(func(any) bool { return true }),
+	))
+	server := memhttptest.NewServer(t, mux)
+	large := strings.Repeat("a", 2048)
+	testCases := []struct {
+		name     string
+		protocol connect.ClientOption
+		// Forcing compression compresses gRPC-Web's in-body trailers too.
+		forcedTrailer int64
+	}{
+		{name: "connect", protocol: connect.WithProtoJSON()},
+		{name: "grpc", protocol: connect.WithGRPC()},
+		{name: "grpcweb", protocol: connect.WithGRPCWeb(), forcedTrailer: 1},
+	}
+	for _, testCase := range testCases {
+		testCase := testCase
+		t.Run(testCase.name, func(t *testing.T) {
+			t.Parallel()
+			var decompressed atomic.Int64
+			decompressor := func() connect.Decompressor {
+				return &countingDecompressor{Reader: &gzip.Reader{}, count: &decompressed}
+			}
+			compressor := func() connect.Compressor { return gzip.NewWriter(io.Discard) }
+			client := pingv1connect.NewPingServiceClient(
+				server.Client(),
+				server.URL(),
+				testCase.protocol,
+				connect.WithAcceptCompression("gzip", decompressor, compressor),
+			)
+			for _, call := range []struct {
+				text string
+				want int64
+			}{
+				{text: "small", want: 0},
+				{text: "force", want: 1 + testCase.forcedTrailer},
+				{text: large, want: 1},
+				{text: "skip" + large, want: 0},
+			} {
+				decompressed.Store(0)
+				response, err := client.Ping(context.Background(), connect.NewRequest(&pingv1.PingRequest{Text: call.text}))
+				assert.Nil(t, err)
+				assert.Equal(t, response.Msg.GetText(), call.text)
+				assert.Equal(t, decompressed.Load(), call.want, assert.Sprintf("text %.10q", call.text))
+			}
+		})
+	}
+}
+
 func TestClientWithoutGzipSupport(t *testing.T) {
 	// See https://connectrpc.com/connect/pull/349 for why we want to
 	// support this. TL;DR is that Microsoft's dapr sidecar can't handle
@@ -1197,7 +1517,11 @@ func TestHandlerWithReadMaxBytes(t *testing.T) {
 			_, err := client.Ping(context.Background(), connect.NewRequest(pingRequest))
 			assert.NotNil(t, err, assert.Sprintf("expected non-nil error for large message"))
 			assert.Equal(t, connect.CodeOf(err), connect.CodeResourceExhausted)
-			assert.True(t, strings.HasSuffix(err.Error(), fmt.Sprintf("message size %d is larger than configured max %d", proto.Size(pingRequest), readMaxBytes)))
+			expectedMessage := fmt.Sprintf("message size %d is larger than configured max %d", proto.Size(pingRequest), readMaxBytes)
+			if compressed {
+				expectedMessage = fmt.Sprintf("message size %d after gzip decompression is larger than configured max %d", proto.Size(pingRequest), readMaxBytes)
+			}
+			assert.True(t, strings.HasSuffix(err.Error(), expectedMessage), assert.Sprintf("got %q", err.Error()))
 		})
 		t.Run("read_max_large", func(t *testing.T) {
 			t.Parallel()
@@ -1378,7 +1702,11 @@ func TestClientWithReadMaxBytes(t *testing.T) {
 			_, err := client.Ping(context.Background(), connect.NewRequest(pingRequest))
 			assert.NotNil(t, err, assert.Sprintf("expected non-nil error for large message"))
 			assert.Equal(t, connect.CodeOf(err), connect.CodeResourceExhausted)
-			assert.True(t, strings.HasSuffix(err.Error(), fmt.Sprintf("message size %d is larger than configured max %d", proto.Size(pingRequest), readMaxBytes)))
+			expectedMessage := fmt.Sprintf("message size %d is larger than configured max %d", proto.Size(pingRequest), readMaxBytes)
+			if compressed {
+				expectedMessage = fmt.Sprintf("message size %d after gzip decompression is larger than configured max %d", proto.Size(pingRequest), readMaxBytes)
+			}
+			assert.True(t, strings.HasSuffix(err.Error(), expectedMessage), assert.Sprintf("got %q", err.Error()))
 		})
 		t.Run("read_max_large", func(t *testing.T) {
 			t.Parallel()
@@ -1540,6 +1868,106 @@ func TestHandlerWithSendMaxBytes(t *testing.T) {
 	})
 }
 
+func TestReadMaxMessages(t *testing.T) {
+	t.Parallel()
+	const readMaxMessages = 3
+	mux := http.NewServeMux()
+	mux.Handle(pingv1connect.NewPingServiceHandler(pingServer{}, connect.WithReadMaxMessages(readMaxMessages)))
+	server := memhttptest.NewServer(t, mux)
+	sum := func(t *testing.T, client pingv1connect.PingServiceClient, count int) error {
+		t.Helper()
+		stream := client.Sum(context.Background())
+		for i := 0; i < count; i++ {
+			if err := stream.Send(&pingv1.SumRequest{}); err != nil {
+				break
+			}
+		}
+		_, err := stream.CloseAndReceive()
+		return err
+	}
+	countUp := func(t *testing.T, client pingv1connect.PingServiceClient, number int64) error {
+		t.Helper()
+		stream, err := client.CountUp(context.Background(), connect.NewRequest(&pingv1.CountUpRequest{Number: number}))
+		assert.Nil(t, err)
+		for stream.Receive() {
+		}
+		assert.Nil(t, stream.Close())
+		return stream.Err()
+	}
+	for _, protocol := range []struct {
+		name string
+		opts []connect.ClientOption
+	}{
+		{name: "connect"},
+		{name: "grpc", opts: []connect.ClientOption{connect.WithGRPC()}},
+		{name: "grpcweb", opts: []connect.ClientOption{connect.WithGRPCWeb()}},
+	} {
+		protocol := protocol
+		t.Run(protocol.name, func(t *testing.T) {
+			t.Parallel()
+			client := pingv1connect.NewPingServiceClient(server.Client(), server.URL(), protocol.opts...)
+			assert.Nil(t, sum(t, client, readMaxMessages))
+			err := sum(t, client, readMaxMessages+1)
+			assert.Equal(t, connect.CodeOf(err), connect.CodeResourceExhausted)
+			assert.True(t, strings.HasSuffix(err.Error(), fmt.Sprintf("received more than the configured max of %d messages", readMaxMessages)))
+
+			limited := pingv1connect.NewPingServiceClient(
+				server.Client(),
+				server.URL(),
+				append(protocol.opts, connect.WithReadMaxMessages(readMaxMessages))...,
+			)
+			assert.Nil(t, countUp(t, limited, readMaxMessages))
+			assert.Equal(t, connect.CodeOf(countUp(t, limited, readMaxMessages+1)), connect.CodeResourceExhausted)
+			// The count resets for each call.
+			assert.Nil(t, countUp(t, limited, readMaxMessages))
+		})
+	}
+}
+
+func TestReadMaxEmptyMessages(t *testing.T) {
+	t.Parallel()
+	const readMaxEmpty = 3
+	mux := http.NewServeMux()
+	mux.Handle(pingv1connect.NewPingServiceHandler(pingServer{}, connect.WithReadMaxEmptyMessages(readMaxEmpty)))
+	server := memhttptest.NewServer(t, mux)
+	sum := func(t *testing.T, client pingv1connect.PingServiceClient, numbers []int64) (int64, error) {
+		t.Helper()
+		stream := client.Sum(context.Background())
+		for _, number := range numbers {
+			if err := stream.Send(&pingv1.SumRequest{Number: number}); err != nil {
+				break
+			}
+		}
+		res, err := stream.CloseAndReceive()
+		if err != nil {
+			return 0, err
+		}
+		return res.Msg.GetSum(), nil
+	}
+	for _, protocol := range []struct {
+		name string
+		opts []connect.ClientOption
+	}{
+		{name: "connect"},
+		{name: "grpc", opts: []connect.ClientOption{connect.WithGRPC()}},
+		{name: "grpcweb", opts: []connect.ClientOption{connect.WithGRPCWeb()}},
+	} {
+		protocol := protocol
+		t.Run(protocol.name, func(t *testing.T) {
+			t.Parallel()
+			client := pingv1connect.NewPingServiceClient(server.Client(), server.URL(), protocol.opts...)
+			// Occasional empty messages are fine.
+			total, err := sum(t, client, []int64{0, 0, 0, 5, 0, 0, 0, 1})
+			assert.Nil(t, err)
+			assert.Equal(t, total, 6)
+			// A flood of empty messages isn't.
+			_, err = sum(t, client, make([]int64, 100))
+			assert.Equal(t, connect.CodeOf(err), connect.CodeResourceExhausted)
+			assert.True(t, strings.HasSuffix(err.Error(), fmt.Sprintf("received more than the configured max of %d consecutive empty messages", readMaxEmpty)))
+		})
+	}
+}
+
 func TestClientWithSendMaxBytes(t *testing.T) {
 	t.Parallel()
 	mux := http.NewServeMux()
@@ -1840,6 +2268,67 @@ func TestStreamForServer(t *testing.T) {
 	})
 }
 
+func TestErrorDetailsOrder(t *testing.T) {
+	t.Parallel()
+	// A bulk handler rejecting its batch attaches one detail per invalid item.
+	mux := http.NewServeMux()
+	mux.Handle(pingv1connect.NewPingServiceHandler(&pluggablePingServer{
+		sum: func(_ context.Context, stream *connect.ClientStream[pingv1.SumRequest]) (*connect.Response[pingv1.SumResponse], error) {
+			err := connect.NewError(connect.CodeInvalidArgument, errors.New("invalid items"))
+			for stream.Receive() {
+				if stream.Msg().GetNumber() >= 0 {
+					continue
+				}
+				detail, detailErr := connect.NewErrorDetail(stream.Msg())
+				if detailErr != nil {
+					return nil, detailErr
+				}
+				err.AddDetail(detail)
+			}
+			if stream.Err() != nil {
+				return nil, stream.Err()
+			}
+			return nil, err
+		},
+	}))
+	server := memhttptest.NewServer(t, mux)
+	for _, testCase := range []struct {
+		name    string
+		options []connect.ClientOption
+	}{
+		{name: "connect", options: nil},
+		{name: "connect_json", options: []connect.ClientOption{connect.WithProtoJSON()}},
+		{name: "grpc", options: []connect.ClientOption{connect.WithGRPC()}},
+		{name: "grpcweb", options: []connect.ClientOption{connect.WithGRPCWeb()}},
+	} {
+		testCase := testCase
+		t.Run(testCase.name, func(t *testing.T) {
+			t.Parallel()
+			client := pingv1connect.NewPingServiceClient(server.Client(), server.URL(), testCase.options...)
+			stream := client.Sum(context.Background())
+			for _, number := range []int64{-3, 1, -1, 2, -2} {
+				assert.Nil(t, stream.Send(&pingv1.SumRequest{Number: number}))
+			}
+			_, err := stream.CloseAndReceive()
+			var connectErr *connect.Error
+			assert.True(t, errors.As(err, &connectErr))
+			assert.Equal(t, connectErr.Code(), connect.CodeInvalidArgument)
+			details := connectErr.Details()
+			assert.Equal(t, len(details), 3)
+			var numbers []int64
+			for _, detail := range details {
+				assert.Equal(t, detail.Type(), "connect.ping.v1.SumRequest")
+				value, err := detail.Value()
+				assert.Nil(t, err)
+				msg, ok := value.(*pingv1.SumRequest)
+				assert.True(t, ok)
+				numbers = append(numbers, msg.GetNumber())
+			}
+			assert.Equal(t, numbers, []int64{-3, -1, -2})
+		})
+	}
+}
+
 func TestConnectHTTPErrorCodes(t *testing.T) {
 	t.Parallel()
 	checkHTTPStatus := func(t *testing.T, connectCode connect.Code, wantHttpStatus int) {
@@ -2974,6 +3463,74 @@ func (d *deflateReader) Reset(reader io.Reader) error {
 
 var _ connect.Decompressor = (*deflateReader)(nil)
 
+// streamDeflater is a stateful flate compressor: it flushes after each message
+// rather than starting a new flate stream.
+type streamDeflater struct {
+	*flate.Writer
+}
+
+func (d *streamDeflater) EndMessage() error {
+	return d.Flush()
+}
+
+var _ connect.StreamCompressor = (*streamDeflater)(nil)
+
+// streamInflater is the counterpart to streamDeflater. Each message picks up
+// where the last one left off, using the data decompressed so far as the flate
+// dictionary.
+type streamInflater struct {
+	reader    io.ReadCloser
+	window    []byte
+	continued *atomic.Int64
+}
+
+func (i *streamInflater) Read(data []byte) (int, error) {
+	n, err := i.reader.Read(data)
+	i.window = append(i.window, data[:n]...)
+	if len(i.window) > 1<<15 {
+		i.window = i.window[len(i.window)-1<<15:]
+	}
+	if errors.Is(err, io.ErrUnexpectedEOF) {
+		// Messages end at a flush rather than at the end of the flate stream.
+		return n, io.EOF
+	}
+	return n, err
+}
+
+func (i *streamInflater) Close() error {
+	if i.reader == nil {
+		return nil
+	}
+	return i.reader.Close()
+}
+
+func (i *streamInflater) Reset(reader io.Reader) error {
+	i.window = nil
+	i.reader = flate.NewReader(reader)
+	return nil
+}
+
+func (i *streamInflater) Continue(reader io.Reader) error {
+	i.continued.Add(1)
+	i.reader = flate.NewReaderDict(reader, i.window)
+	return nil
+}
+
+var _ connect.StreamDecompressor = (*streamInflater)(nil)
+
+// countingDecompressor counts the messages it decompresses.
+type countingDecompressor struct {
+	*gzip.Reader
+	count *atomic.Int64
+}
+
+func (d *countingDecompressor) Reset(reader io.Reader) error {
+	if reader != http.NoBody {
+		d.count.Add(1)
+	}
+	return d.Reader.Reset(reader)
+}
+
 type trimTrailerWriter struct {
 	w http.ResponseWriter
 }
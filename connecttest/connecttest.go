@@ -0,0 +1,107 @@
+// Copyright 2021-2024 The Connect Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package connecttest provides utilities for testing Connect services
+// end-to-end. Calls made with its clients travel over in-memory pipes rather
+// than TCP, but are otherwise identical to production: requests and responses
+// are serialized, compressed, and sent over HTTP/2, so the tests exercise the
+// same codec and compression negotiation as real clients.
+package connecttest
+
+import (
+	"net/http"
+	"sync"
+
+	"connectrpc.com/connect"
+	"connectrpc.com/connect/internal/memhttp"
+)
+
+// An Option configures [NewServiceTester].
+type Option interface {
+	apply(*config)
+}
+
+// WithHandlerOptions passes options to the handler constructor.
+func WithHandlerOptions(options ...connect.HandlerOption) Option {
+	return optionFunc(func(config *config) {
+		config.HandlerOptions = append(config.HandlerOptions, options...)
+	})
+}
+
+// WithClientOptions passes options to the client constructor. For example,
+// use [connect.WithGRPC] to test the gRPC protocol or [connect.WithProtoJSON]
+// and [connect.WithSendGzip] to test codec and compression negotiation.
+func WithClientOptions(options ...connect.ClientOption) Option {
+	return optionFunc(func(config *config) {
+		config.ClientOptions = append(config.ClientOptions, options...)
+	})
+}
+
+// WithHTTP1 makes the client connect using HTTP/1.1 rather than HTTP/2.
+// Bidirectional streaming isn't supported over HTTP/1.1.
+func WithHTTP1() Option {
+	return optionFunc(func(config *config) {
+		config.HTTP1 = true
+	})
+}
+
+// NewServiceTester serves a handler over an in-memory network and returns a
+// client connected to it, along with a function that shuts the server down.
+// The constructors are usually generated: newHandler wraps the generated
+// handler constructor to supply the service implementation, and newClient is
+// the generated client constructor.
+//
+//	client, cleanup := connecttest.NewServiceTester(
+//		func(options ...connect.HandlerOption) (string, http.Handler) {
+//			return pingv1connect.NewPingServiceHandler(&pingServer{}, options...)
+//		},
+//		pingv1connect.NewPingServiceClient,
+//	)
+//	defer cleanup()
+//
+// The cleanup function waits for in-flight calls to finish before returning,
+// and is safe to call more than once. Tests using [testing.T] can pass it to
+// t.Cleanup.
+func NewServiceTester[Client any](
+	newHandler func(...connect.HandlerOption) (string, http.Handler),
+	newClient func(connect.HTTPClient, string, ...connect.ClientOption) Client,
+	options ...Option,
+) (Client, func()) {
+	var cfg config
+	for _, opt := range options {
+		opt.apply(&cfg)
+	}
+	mux := http.NewServeMux()
+	mux.Handle(newHandler(cfg.HandlerOptions...))
+	server := memhttp.NewServer(mux)
+	httpClient := server.Client()
+	if cfg.HTTP1 {
+		httpClient = &http.Client{Transport: server.TransportHTTP1()}
+	}
+	client := newClient(httpClient, server.URL(), cfg.ClientOptions...)
+	var once sync.Once
+	return client, func() {
+		once.Do(func() { _ = server.Cleanup() })
+	}
+}
+
+type config struct {
+	HandlerOptions []connect.HandlerOption
+	ClientOptions  []connect.ClientOption
+	HTTP1          bool
+}
+
+type optionFunc func(*config)
+
+func (f optionFunc) apply(config *config) { f(config) }
@@ -0,0 +1,100 @@
+// Copyright 2021-2024 The Connect Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package connecttest_test
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	connect "connectrpc.com/connect"
+	"connectrpc.com/connect/connecttest"
+	"connectrpc.com/connect/internal/assert"
+	pingv1 "connectrpc.com/connect/internal/gen/connect/ping/v1"
+	"connectrpc.com/connect/internal/gen/connect/ping/v1/pingv1connect"
+)
+
+type echoServer struct {
+	pingv1connect.UnimplementedPingServiceHandler
+}
+
+func (echoServer) Ping(_ context.Context, request *connect.Request[pingv1.PingRequest]) (*connect.Response[pingv1.PingResponse], error) {
+	response := connect.NewResponse(&pingv1.PingResponse{
+		Number: request.Msg.GetNumber(),
+		Text:   request.Msg.GetText(),
+	})
+	response.Header().Set("Echo-Content-Type", request.Header().Get("Content-Type"))
+	response.Header().Set("Echo-Content-Encoding", request.Header().Get("Content-Encoding"))
+	return response, nil
+}
+
+func newEchoHandler(options ...connect.HandlerOption) (string, http.Handler) {
+	return pingv1connect.NewPingServiceHandler(echoServer{}, options...)
+}
+
+func TestNewServiceTester(t *testing.T) {
+	t.Parallel()
+	testCases := []struct {
+		name            string
+		options         []connecttest.Option
+		wantContentType string
+		wantEncoding    string
+	}{
+		{
+			name:            "default",
+			wantContentType: "application/proto",
+		},
+		{
+			name: "json_gzip",
+			options: []connecttest.Option{
+				connecttest.WithClientOptions(connect.WithProtoJSON(), connect.WithSendGzip()),
+				connecttest.WithHandlerOptions(connect.WithCompressMinBytes(0)),
+			},
+			wantContentType: "application/json",
+			wantEncoding:    "gzip",
+		},
+		{
+			name: "grpc_web_http1",
+			options: []connecttest.Option{
+				connecttest.WithClientOptions(connect.WithGRPCWeb()),
+				connecttest.WithHTTP1(),
+			},
+			wantContentType: "application/grpc-web+proto",
+		},
+	}
+	for _, testCase := range testCases {
+		testCase := testCase
+		t.Run(testCase.name, func(t *testing.T) {
+			t.Parallel()
+			client, cleanup := connecttest.NewServiceTester(
+				newEchoHandler,
+				pingv1connect.NewPingServiceClient,
+				testCase.options...,
+			)
+			t.Cleanup(cleanup)
+			response, err := client.Ping(
+				context.Background(),
+				connect.NewRequest(&pingv1.PingRequest{Number: 42, Text: "echo"}),
+			)
+			assert.Nil(t, err)
+			assert.Equal(t, response.Msg.GetNumber(), 42)
+			assert.Equal(t, response.Msg.GetText(), "echo")
+			assert.Equal(t, response.Header().Get("Echo-Content-Type"), testCase.wantContentType)
+			if testCase.wantEncoding != "" {
+				assert.Equal(t, response.Header().Get("Echo-Content-Encoding"), testCase.wantEncoding)
+			}
+		})
+	}
+}
@@ -0,0 +1,64 @@
+// Copyright 2021-2024 The Connect Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package connect
+
+import "context"
+
+// correlationIDInterceptor tags the errors returned by handlers with a
+// correlation ID. See WithErrorCorrelationID.
+type correlationIDInterceptor struct {
+	header        string
+	correlationID func(context.Context) string
+}
+
+func (i *correlationIDInterceptor) WrapUnary(next UnaryFunc) UnaryFunc {
+	return func(ctx context.Context, request AnyRequest) (AnyResponse, error) {
+		response, err := next(ctx, request)
+		if err != nil && !request.Spec().IsClient {
+			err = i.correlate(ctx, err)
+		}
+		return response, err
+	}
+}
+
+func (i *correlationIDInterceptor) WrapStreamingClient(next StreamingClientFunc) StreamingClientFunc {
+	return next
+}
+
+func (i *correlationIDInterceptor) WrapStreamingHandler(next StreamingHandlerFunc) StreamingHandlerFunc {
+	return func(ctx context.Context, conn StreamingHandlerConn) error {
+		err := next(ctx, conn)
+		if err != nil {
+			err = i.correlate(ctx, err)
+		}
+		return err
+	}
+}
+
+func (i *correlationIDInterceptor) correlate(ctx context.Context, err error) error {
+	id := i.correlationID(ctx)
+	if id == "" {
+		return err
+	}
+	connectErr, ok := asError(err)
+	if ok {
+		connectErr = connectErr.clone()
+	} else {
+		connectErr = NewError(CodeUnknown, err)
+	}
+	connectErr.correlationID = id
+	connectErr.Meta().Set(i.header, id)
+	return connectErr
+}
@@ -0,0 +1,128 @@
+// Copyright 2021-2024 The Connect Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package connect_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	connect "connectrpc.com/connect"
+	"connectrpc.com/connect/internal/assert"
+	pingv1 "connectrpc.com/connect/internal/gen/connect/ping/v1"
+	"connectrpc.com/connect/internal/gen/connect/ping/v1/pingv1connect"
+	"connectrpc.com/connect/internal/memhttp/memhttptest"
+)
+
+type requestIDContextKey struct{}
+
+func TestErrorCorrelationID(t *testing.T) {
+	t.Parallel()
+	const header = "X-Correlation-Id"
+	// Handlers commonly return package-level errors, which must not be
+	// modified.
+	errNotFound := connect.NewError(connect.CodeNotFound, errors.New("not found"))
+	t.Cleanup(func() {
+		// Runs after the parallel subtests finish, since Meta isn't safe to
+		// call concurrently.
+		assert.Equal(t, len(errNotFound.Meta()), 0)
+	})
+	var requestIDs atomic.Int64
+	// Stands in for middleware or an interceptor that assigns request IDs.
+	assignRequestID := connect.UnaryInterceptorFunc(func(next connect.UnaryFunc) connect.UnaryFunc {
+		return func(ctx context.Context, request connect.AnyRequest) (connect.AnyResponse, error) {
+			id := fmt.Sprintf("req-%d", requestIDs.Add(1))
+			return next(context.WithValue(ctx, requestIDContextKey{}, id), request)
+		}
+	})
+	mux := http.NewServeMux()
+	mux.Handle(pingv1connect.NewPingServiceHandler(
+		&pluggablePingServer{
+			ping: func(context.Context, *connect.Request[pingv1.PingRequest]) (*connect.Response[pingv1.PingResponse], error) {
+				return nil, errNotFound
+			},
+			countUp: func(context.Context, *connect.Request[pingv1.CountUpRequest], *connect.ServerStream[pingv1.CountUpResponse]) error {
+				return errors.New("plain error")
+			},
+		},
+		connect.WithInterceptors(assignRequestID),
+		connect.WithErrorCorrelationID(header, func(ctx context.Context) string {
+			if id, ok := ctx.Value(requestIDContextKey{}).(string); ok {
+				return id
+			}
+			return "generated"
+		}),
+	))
+	server := memhttptest.NewServer(t, mux)
+
+	t.Run("connect_body", func(t *testing.T) {
+		t.Parallel()
+		request, err := http.NewRequestWithContext(
+			context.Background(),
+			http.MethodPost,
+			server.URL()+pingv1connect.PingServicePingProcedure,
+			bytes.NewReader([]byte("{}")),
+		)
+		assert.Nil(t, err)
+		request.Header.Set("Content-Type", "application/json")
+		response, err := server.Client().Do(request)
+		assert.Nil(t, err)
+		defer response.Body.Close()
+		var body struct {
+			Code          string `json:"code"`
+			Message       string `json:"message"`
+			CorrelationID string `json:"correlationId"`
+		}
+		assert.Nil(t, json.NewDecoder(response.Body).Decode(&body))
+		assert.Equal(t, body.Code, "not_found")
+		assert.Equal(t, body.Message, "not found")
+		assert.True(t, strings.HasPrefix(body.CorrelationID, "req-"))
+		assert.Equal(t, response.Header.Get(header), body.CorrelationID)
+	})
+	for _, protocol := range []struct {
+		name   string
+		option connect.ClientOption
+	}{
+		{name: "connect", option: connect.WithProtoJSON()},
+		{name: "grpc", option: connect.WithGRPC()},
+	} {
+		protocol := protocol
+		t.Run(protocol.name, func(t *testing.T) {
+			t.Parallel()
+			client := pingv1connect.NewPingServiceClient(server.Client(), server.URL(), protocol.option)
+			_, err := client.Ping(context.Background(), connect.NewRequest(&pingv1.PingRequest{}))
+			assert.Equal(t, connect.CodeOf(err), connect.CodeNotFound)
+			var connectErr *connect.Error
+			assert.True(t, errors.As(err, &connectErr))
+			assert.True(t, strings.HasPrefix(connectErr.Meta().Get(header), "req-"))
+
+			// The streaming interceptor path has no request ID to find.
+			stream, err := client.CountUp(context.Background(), connect.NewRequest(&pingv1.CountUpRequest{Number: 1}))
+			assert.Nil(t, err)
+			assert.False(t, stream.Receive())
+			assert.Equal(t, connect.CodeOf(stream.Err()), connect.CodeUnknown)
+			assert.True(t, errors.As(stream.Err(), &connectErr))
+			assert.Equal(t, connectErr.Meta().Get(header), "generated")
+			assert.Equal(t, connectErr.Message(), "plain error")
+			assert.Nil(t, stream.Close())
+		})
+	}
+}
@@ -19,9 +19,11 @@ import (
 	"errors"
 	"io"
 	"net/http"
+	"net/http/httptrace"
 	"net/url"
 	"sync"
 	"sync/atomic"
+	"time"
 )
 
 // duplexHTTPCall is a full-duplex stream between the client and server. The
@@ -50,6 +52,15 @@ type duplexHTTPCall struct {
 	responseReady chan struct{}
 	response      *http.Response
 	responseErr   error
+
+	// headerTimer bounds the wait for response headers. It's nil unless the
+	// client configured WithResponseHeaderTimeout.
+	headerTimer *responseHeaderTimer
+
+	// tooManyRequestsCode overrides the code used for bare HTTP 429
+	// responses. It's zero unless the client configured
+	// WithTooManyRequestsAsResourceExhausted.
+	tooManyRequestsCode Code
 }
 
 func newDuplexHTTPCall(
@@ -90,6 +101,33 @@ func newDuplexHTTPCall(
 	}
 }
 
+// httpToCode returns the Code for a response whose HTTP status indicates an
+// error but which doesn't carry a well-formed RPC error.
+func (d *duplexHTTPCall) httpToCode(httpCode int) Code {
+	if d.tooManyRequestsCode != 0 && httpCode == http.StatusTooManyRequests {
+		return d.tooManyRequestsCode
+	}
+	return httpToCode(httpCode)
+}
+
+// SetResponseHeaderTimeout bounds the time between sending the last of the
+// request and receiving the response headers. It must be called before the
+// request is sent.
+func (d *duplexHTTPCall) SetResponseHeaderTimeout(timeout time.Duration) {
+	if timeout <= 0 {
+		return
+	}
+	ctx, cancel := context.WithCancelCause(d.request.Context())
+	timer := &responseHeaderTimer{timeout: timeout, cancel: cancel}
+	// Start the timer once the transport has written the whole request, so
+	// dialing, TLS handshakes, and uploading the body don't count against it.
+	ctx = httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		WroteRequest: func(httptrace.WroteRequestInfo) { timer.Start() },
+	})
+	d.request = d.request.WithContext(ctx)
+	d.headerTimer = timer
+}
+
 // Send sends a message to the server.
 func (d *duplexHTTPCall) Send(payload messagePayload) (int64, error) {
 	if d.streamType&StreamTypeClient == 0 {
@@ -109,6 +147,10 @@ func (d *duplexHTTPCall) Send(payload messagePayload) (int64, error) {
 	if err := d.ctx.Err(); err != nil {
 		return 0, wrapIfContextError(err)
 	}
+	if d.requestBodyWriter == nil {
+		// CloseRead abandoned the call before the request was sent.
+		return 0, io.EOF
+	}
 	if isFirst && payload.Len() == 0 {
 		// On first write a nil Send is used to send request headers. Avoid
 		// writing a zero-length payload to avoid superfluous errors with close.
@@ -129,6 +171,8 @@ func (d *duplexHTTPCall) Send(payload messagePayload) (int64, error) {
 func (d *duplexHTTPCall) sendUnary(payload messagePayload) (int64, error) {
 	// Unary messages are sent as a single HTTP request. We don't need to use a
 	// pipe for the request body and we don't need to send headers separately.
+	// Since the whole body is buffered, requests always carry a Content-Length
+	// and are never chunked, which some proxies and firewalls require.
 	if !d.requestSent.CompareAndSwap(false, true) {
 		return 0, errors.New("request already sent")
 	}
@@ -230,12 +274,32 @@ func (d *duplexHTTPCall) Read(data []byte) (int, error) {
 	if err != nil && !errors.Is(err, io.EOF) {
 		err = wrapIfContextDone(d.ctx, err)
 		err = wrapIfRSTError(err)
+		if _, ok := asError(err); !ok {
+			// The connection failed mid-response (for example, it was reset).
+			// Like failures to establish the connection, that's retryable.
+			err = NewError(CodeUnavailable, err)
+		}
 	}
 	return n, err
 }
 
 func (d *duplexHTTPCall) CloseRead() error {
+	if d.requestSent.CompareAndSwap(false, true) {
+		// The request was never sent, so there's no response to wait for.
+		// Abandon the call without sending it: this lets interceptors that
+		// decide not to use a conn release it without contacting the server.
+		d.responseErr = errorf(CodeCanceled, "stream closed before the request was sent")
+		close(d.responseReady)
+		if d.headerTimer != nil {
+			d.headerTimer.cancel(nil)
+		}
+		return nil
+	}
 	_ = d.BlockUntilResponseReady()
+	if d.headerTimer != nil {
+		// Release the request's context.
+		defer d.headerTimer.cancel(nil)
+	}
 	if d.response == nil {
 		return nil
 	}
@@ -301,6 +365,14 @@ func (d *duplexHTTPCall) makeRequest() {
 	// This ensures HTTP2 streams receive an io.EOF from the Read side of the
 	// pipe. Write's check for io.ErrClosedPipe and will convert this to io.EOF.
 	response, err := d.httpClient.Do(d.request) //nolint:bodyclose
+	if d.headerTimer.Stop() && d.ctx.Err() == nil {
+		if response != nil {
+			_ = response.Body.Close()
+		}
+		d.responseErr = errorf(CodeUnavailable, "no response headers within %v", d.headerTimer.timeout)
+		_ = d.CloseWrite()
+		return
+	}
 	if err != nil {
 		if errors.Is(err, io.EOF) {
 			// We use io.EOF as a sentinel in many places and don't want this
@@ -380,15 +452,31 @@ type messageSender interface {
 }
 
 // writeSender is a sender that writes to an [io.Writer]. Useful for wrapping
-// [http.ResponseWriter].
+// [http.ResponseWriter]: errors caused by the client disconnecting are
+// reported with CodeCanceled. The context is the request's context, used to
+// detect disconnects.
 type writeSender struct {
+	ctx    context.Context //nolint:containedctx
 	writer io.Writer
 }
 
 var _ messageSender = writeSender{}
 
 func (w writeSender) Send(payload messagePayload) (int64, error) {
-	return payload.WriteTo(w.writer)
+	n, err := payload.WriteTo(w.writer)
+	return n, wrapIfClientDisconnected(w.ctx, err)
+}
+
+// countingWriter counts the bytes written to the underlying writer.
+type countingWriter struct {
+	writer io.Writer
+	n      int64
+}
+
+func (w *countingWriter) Write(data []byte) (int, error) {
+	n, err := w.writer.Write(data)
+	w.n += int64(n)
+	return n, err
 }
 
 // See: https://cs.opensource.google/go/go/+/refs/tags/go1.20.1:src/net/http/clone.go;l=22-33
@@ -466,3 +554,54 @@ func (p *payloadCloser) Release() {
 	p.payload = nil
 	p.mu.Unlock()
 }
+
+// responseHeaderTimer cancels a request if the response headers don't arrive
+// in time. Its methods are safe to call on a nil *responseHeaderTimer.
+type responseHeaderTimer struct {
+	timeout time.Duration
+	cancel  context.CancelCauseFunc
+
+	mu      sync.Mutex
+	timer   *time.Timer
+	stopped bool // response headers arrived or the request failed
+	fired   bool
+}
+
+// Start starts the timer. It's called from the WroteRequest trace hook, once
+// the transport has written the whole request. Repeated calls, and calls after
+// Stop, are no-ops.
+func (t *responseHeaderTimer) Start() {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.stopped || t.timer != nil {
+		return
+	}
+	t.timer = time.AfterFunc(t.timeout, func() {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		if t.stopped {
+			return
+		}
+		t.fired = true
+		t.cancel(errResponseHeaderTimeout)
+	})
+}
+
+// Stop stops the timer and reports whether it already canceled the request.
+func (t *responseHeaderTimer) Stop() bool {
+	if t == nil {
+		return false
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.stopped = true
+	if t.timer != nil {
+		t.timer.Stop()
+	}
+	return t.fired
+}
+
+var errResponseHeaderTimeout = errors.New("response header timeout")
@@ -24,6 +24,7 @@ import (
 	"net/url"
 	"sync"
 	"testing"
+	"time"
 
 	"connectrpc.com/connect/internal/assert"
 )
@@ -120,3 +121,31 @@ func TestHTTPCallGetBody(t *testing.T) {
 	close(workChan)
 	wg.Wait()
 }
+
+func TestHTTPCallCloseReadBeforeSend(t *testing.T) {
+	t.Parallel()
+	var requests int
+	handler := http.HandlerFunc(func(http.ResponseWriter, *http.Request) {
+		requests++
+	})
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	serverURL, _ := url.Parse(server.URL)
+	call := newDuplexHTTPCall(
+		context.Background(),
+		server.Client(),
+		serverURL,
+		Spec{StreamType: StreamTypeBidi},
+		http.Header{},
+	)
+	call.SetResponseHeaderTimeout(time.Minute)
+	// Closing the response of a call that was never sent abandons it without
+	// blocking or contacting the server.
+	assert.Nil(t, call.CloseRead())
+	_, err := call.Send(bytes.NewReader([]byte("ignored")))
+	assert.ErrorIs(t, err, io.EOF)
+	_, err = call.Read(make([]byte, 1))
+	assert.Equal(t, CodeOf(err), CodeCanceled)
+	assert.Nil(t, call.CloseWrite())
+	assert.Equal(t, requests, 0)
+}
@@ -123,8 +123,12 @@ type envelopeWriter struct {
 	codec            Codec
 	compressMinBytes int
 	compressionPool  *compressionPool
+	compressMessage  func(any) bool // nil compresses every message
+	override         compressionOverride
 	bufferPool       *bufferPool
 	sendMaxBytes     int
+	budget           *bufferBudget      // nil if unlimited
+	stream           *streamCompression // nil until the first compressed message
 }
 
 func (w *envelopeWriter) Marshal(message any) *Error {
@@ -139,18 +143,33 @@ func (w *envelopeWriter) Marshal(message any) *Error {
 		}
 		return nil
 	}
+	var compress bool
+	switch w.override {
+	case compressionOverrideForce:
+		compress = true
+	case compressionOverrideSkip:
+		compress = false
+	default:
+		compress = w.compressMessage == nil || w.compressMessage(message)
+	}
 	if appender, ok := w.codec.(marshalAppender); ok {
-		return w.marshalAppend(message, appender)
+		return w.marshalAppend(message, appender, compress)
 	}
-	return w.marshal(message)
+	return w.marshal(message, compress)
 }
 
 // Write writes the enveloped message, compressing as necessary. It doesn't
 // retain any references to the supplied envelope or its underlying data.
 func (w *envelopeWriter) Write(env *envelope) *Error {
-	if env.IsSet(flagEnvelopeCompressed) ||
+	return w.writeMessage(env, true /* compress */)
+}
+
+// writeMessage is Write, but compresses the message only if compress is true.
+func (w *envelopeWriter) writeMessage(env *envelope, compress bool) *Error {
+	if !compress ||
+		env.IsSet(flagEnvelopeCompressed) ||
 		w.compressionPool == nil ||
-		env.Data.Len() < w.compressMinBytes {
+		(env.Data.Len() < w.compressMinBytes && w.override != compressionOverrideForce) {
 		if w.sendMaxBytes > 0 && env.Data.Len() > w.sendMaxBytes {
 			return errorf(CodeResourceExhausted, "message size %d exceeds sendMaxBytes %d", env.Data.Len(), w.sendMaxBytes)
 		}
@@ -158,8 +177,8 @@ func (w *envelopeWriter) Write(env *envelope) *Error {
 	}
 	data := w.bufferPool.Get()
 	defer w.bufferPool.Put(data)
-	if err := w.compressionPool.Compress(data, env.Data); err != nil {
-		return err
+	if err := w.compress(data, env.Data); err != nil {
+		return err.withEncoding(w.codec, w.compressionPool)
 	}
 	if w.sendMaxBytes > 0 && data.Len() > w.sendMaxBytes {
 		return errorf(CodeResourceExhausted, "compressed message size %d exceeds sendMaxBytes %d", data.Len(), w.sendMaxBytes)
@@ -170,13 +189,29 @@ func (w *envelopeWriter) Write(env *envelope) *Error {
 	})
 }
 
-func (w *envelopeWriter) marshalAppend(message any, codec marshalAppender) *Error {
+func (w *envelopeWriter) compress(dst *bytes.Buffer, src *bytes.Buffer) *Error {
+	if !w.compressionPool.isStreamCompressor() {
+		return w.compressionPool.Compress(dst, src)
+	}
+	if w.stream == nil {
+		w.stream = &streamCompression{pool: w.compressionPool}
+	}
+	return w.stream.Compress(dst, src)
+}
+
+// releaseCompressor returns any Compressor held for the stream to its pool.
+// Call it once no more messages will be written.
+func (w *envelopeWriter) releaseCompressor() {
+	w.stream.Release()
+}
+
+func (w *envelopeWriter) marshalAppend(message any, codec marshalAppender, compress bool) *Error {
 	// Codec supports MarshalAppend; try to re-use a []byte from the pool.
 	buffer := w.bufferPool.Get()
 	defer w.bufferPool.Put(buffer)
 	raw, err := codec.MarshalAppend(buffer.Bytes(), message)
 	if err != nil {
-		return errorf(CodeInternal, "marshal message: %w", err)
+		return errorf(CodeInternal, "marshal message: %w", err).withEncoding(w.codec, w.compressionPool)
 	}
 	if cap(raw) > buffer.Cap() {
 		// The buffer from the pool was too small, so MarshalAppend grew the slice.
@@ -192,23 +227,30 @@ func (w *envelopeWriter) marshalAppend(message any, codec marshalAppender) *Erro
 		buffer.Write(raw)
 	}
 	envelope := &envelope{Data: buffer}
-	return w.Write(envelope)
+	return w.writeMessage(envelope, compress)
 }
 
-func (w *envelopeWriter) marshal(message any) *Error {
+func (w *envelopeWriter) marshal(message any, compress bool) *Error {
 	// Codec doesn't support MarshalAppend; let Marshal allocate a []byte.
 	raw, err := w.codec.Marshal(message)
 	if err != nil {
-		return errorf(CodeInternal, "marshal message: %w", err)
+		return errorf(CodeInternal, "marshal message: %w", err).withEncoding(w.codec, w.compressionPool)
 	}
 	buffer := bytes.NewBuffer(raw)
 	// Put our new []byte into the pool for later reuse.
 	defer w.bufferPool.Put(buffer)
 	envelope := &envelope{Data: buffer}
-	return w.Write(envelope)
+	return w.writeMessage(envelope, compress)
 }
 
 func (w *envelopeWriter) write(env *envelope) *Error {
+	// The buffer is held until the peer accepts the data, which may take a
+	// while if the peer is slow to read.
+	size := int64(env.Data.Len())
+	if err := w.budget.acquire(size); err != nil {
+		return err
+	}
+	defer w.budget.release(size)
 	if _, err := w.sender.Send(env); err != nil {
 		err = wrapIfContextDone(w.ctx, err)
 		if connectErr, ok := asError(err); ok {
@@ -228,6 +270,14 @@ type envelopeReader struct {
 	compressionPool *compressionPool
 	bufferPool      *bufferPool
 	readMaxBytes    int
+	readMaxMessages int
+	messagesRead    int
+	readMaxEmpty    int
+	emptyRead       int                  // consecutive empty messages
+	rawBytes        *rawRequestBytes     // nil unless retaining raw messages
+	budget          *bufferBudget        // nil if unlimited
+	budgeted        int64                // bytes of budget held for the current message
+	stream          *streamDecompression // nil until the first compressed message
 }
 
 func (r *envelopeReader) Unmarshal(message any) *Error {
@@ -237,31 +287,49 @@ func (r *envelopeReader) Unmarshal(message any) *Error {
 		if buffer != dontRelease {
 			r.bufferPool.Put(buffer)
 		}
+		r.budget.release(r.budgeted)
+		r.budgeted = 0
 	}()
 
 	env := &envelope{Data: buffer}
 	err := r.Read(env)
 	switch {
-	case err == nil && env.IsSet(flagEnvelopeCompressed) && r.compressionPool == nil:
-		return errorf(
-			CodeInternal,
-			"protocol error: sent compressed message without compression support",
-		)
 	case err == nil &&
 		(env.Flags == 0 || env.Flags == flagEnvelopeCompressed) &&
 		env.Data.Len() == 0:
 		// This is a standard message (because none of the top 7 bits are set) and
-		// there's no data, so the zero value of the message is correct.
-		return nil
+		// there's no data, so the zero value of the message is correct. Some
+		// peers set the compressed flag on empty messages, even if they didn't
+		// negotiate compression; there's nothing to decompress, so accept them.
+		r.rawBytes.record(nil)
+		r.emptyRead++
+		if r.readMaxEmpty > 0 && r.emptyRead > r.readMaxEmpty {
+			return errorf(CodeResourceExhausted, "received more than the configured max of %d consecutive empty messages", r.readMaxEmpty)
+		}
+		return r.countMessage()
+	case err == nil && env.IsSet(flagEnvelopeCompressed) && r.compressionPool == nil:
+		return errorf(
+			CodeInternal,
+			"protocol error: sent compressed message without compression support",
+		).withEncoding(r.codec, nil)
 	case err != nil && errors.Is(err, io.EOF):
 		// The stream has ended. Propagate the EOF to the caller.
+		r.stream.Release()
 		return err
 	case err != nil:
 		// Something's wrong.
+		r.stream.Release()
 		return err
 	}
 
 	data := env.Data
+	if codec, ok := r.codec.(unmarshalReader); ok && r.streamInto(env) {
+		r.emptyRead = 0
+		if err := r.compressionPool.DecompressInto(codec, message, data, int64(r.readMaxBytes)); err != nil {
+			return err.withEncoding(r.codec, r.compressionPool)
+		}
+		return r.countMessage()
+	}
 	if data.Len() > 0 && env.IsSet(flagEnvelopeCompressed) {
 		decompressed := r.bufferPool.Get()
 		defer func() {
@@ -269,8 +337,8 @@ func (r *envelopeReader) Unmarshal(message any) *Error {
 				r.bufferPool.Put(decompressed)
 			}
 		}()
-		if err := r.compressionPool.Decompress(decompressed, data, int64(r.readMaxBytes)); err != nil {
-			return err
+		if err := r.decompress(decompressed, data); err != nil {
+			return err.withEncoding(r.codec, r.compressionPool)
 		}
 		data = decompressed
 	}
@@ -297,11 +365,45 @@ func (r *envelopeReader) Unmarshal(message any) *Error {
 			Flags: env.Flags,
 		}
 		dontRelease = data
+		r.stream.Release()
 		return errSpecialEnvelope
 	}
 
+	r.emptyRead = 0
+	r.rawBytes.record(data.Bytes())
 	if err := r.codec.Unmarshal(data.Bytes(), message); err != nil {
-		return errorf(CodeInvalidArgument, "unmarshal message: %w", err)
+		return errorf(CodeInvalidArgument, "unmarshal message: %w", err).withEncoding(r.codec, r.compressionPool)
+	}
+	return r.countMessage()
+}
+
+// streamInto reports whether env can be decompressed directly into a codec
+// that supports it. Only ordinary compressed messages qualify: retaining raw
+// messages requires the decompressed bytes, and stateful decompressors carry
+// state across messages.
+func (r *envelopeReader) streamInto(env *envelope) bool {
+	return env.Flags == flagEnvelopeCompressed &&
+		env.Data.Len() > 0 &&
+		r.rawBytes == nil &&
+		!r.compressionPool.isStreamDecompressor()
+}
+
+func (r *envelopeReader) decompress(dst *bytes.Buffer, src *bytes.Buffer) *Error {
+	if !r.compressionPool.isStreamDecompressor() {
+		return r.compressionPool.Decompress(dst, src, int64(r.readMaxBytes))
+	}
+	if r.stream == nil {
+		r.stream = &streamDecompression{pool: r.compressionPool}
+	}
+	return r.stream.Decompress(dst, src, int64(r.readMaxBytes))
+}
+
+// countMessage enforces readMaxMessages. It's called after each message is
+// decoded, so empty messages count too.
+func (r *envelopeReader) countMessage() *Error {
+	r.messagesRead++
+	if r.readMaxMessages > 0 && r.messagesRead > r.readMaxMessages {
+		return errorf(CodeResourceExhausted, "received more than the configured max of %d messages", r.readMaxMessages)
 	}
 	return nil
 }
@@ -339,6 +441,10 @@ func (r *envelopeReader) Read(env *envelope) *Error {
 		}
 		return errorf(CodeResourceExhausted, "message size %d is larger than configured max %d", size, r.readMaxBytes)
 	}
+	if err := r.budget.acquire(size); err != nil {
+		return err
+	}
+	r.budgeted += size
 	// We've read the prefix, so we know how many bytes to expect.
 	// CopyN will return an error if it doesn't read the requested
 	// number of bytes.
@@ -17,10 +17,15 @@ package connect
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
 	"io"
+	"strings"
 	"testing"
 
 	"connectrpc.com/connect/internal/assert"
+	"google.golang.org/protobuf/types/known/wrapperspb"
 )
 
 func TestEnvelope(t *testing.T) {
@@ -54,6 +59,26 @@ func TestEnvelope(t *testing.T) {
 			assert.Equal(t, payload, env.Data.Bytes())
 		})
 	})
+	t.Run("empty_compressed", func(t *testing.T) {
+		t.Parallel()
+		head := makeEnvelopePrefix(flagEnvelopeCompressed, 0)
+		gzip, ok := withGzip().(*compressionOption)
+		assert.True(t, ok)
+		// Peers may set the flag whether or not they negotiated compression.
+		for _, pool := range []*compressionPool{nil, gzip.CompressionPool} {
+			rdr := envelopeReader{
+				ctx:             context.Background(),
+				reader:          bytes.NewReader(head[:]),
+				codec:           &protoBinaryCodec{},
+				compressionPool: pool,
+				bufferPool:      newBufferPool(),
+			}
+			message := &wrapperspb.StringValue{}
+			assert.Nil(t, rdr.Unmarshal(message))
+			assert.Equal(t, message.GetValue(), "")
+			assert.ErrorIs(t, rdr.Unmarshal(message), io.EOF)
+		}
+	})
 	t.Run("write", func(t *testing.T) {
 		t.Parallel()
 		t.Run("full", func(t *testing.T) {
@@ -102,6 +127,137 @@ func TestEnvelope(t *testing.T) {
 	})
 }
 
+func TestEnvelopeReaderUnmarshalFrom(t *testing.T) {
+	t.Parallel()
+	payload := bytes.Repeat([]byte("0123456789abcdef"), 1<<16) // 1 MiB
+	newReader := func(t *testing.T, codec Codec, compressed []byte, readMaxBytes int) *envelopeReader {
+		t.Helper()
+		head := makeEnvelopePrefix(flagEnvelopeCompressed, len(compressed))
+		gzip, ok := withGzip().(*compressionOption)
+		assert.True(t, ok)
+		return &envelopeReader{
+			ctx:             context.Background(),
+			reader:          io.MultiReader(bytes.NewReader(head[:]), bytes.NewReader(compressed)),
+			codec:           codec,
+			compressionPool: gzip.CompressionPool,
+			bufferPool:      newBufferPool(),
+			readMaxBytes:    readMaxBytes,
+		}
+	}
+	t.Run("streamed", func(t *testing.T) {
+		t.Parallel()
+		codec := &digestCodec{}
+		var digest [sha256.Size]byte
+		assert.Nil(t, newReader(t, codec, gzipBytes(t, payload), 0).Unmarshal(&digest))
+		assert.Equal(t, digest, sha256.Sum256(payload))
+		assert.Equal(t, codec.streamed, 1)
+	})
+	t.Run("buffered", func(t *testing.T) {
+		t.Parallel()
+		var digest [sha256.Size]byte
+		assert.Nil(t, newReader(t, bufferedCodec{&digestCodec{}}, gzipBytes(t, payload), 0).Unmarshal(&digest))
+		assert.Equal(t, digest, sha256.Sum256(payload))
+	})
+	t.Run("read_max_bytes", func(t *testing.T) {
+		t.Parallel()
+		compressed := gzipBytes(t, payload)
+		err := newReader(t, &digestCodec{}, compressed, len(payload)-1).Unmarshal(&[sha256.Size]byte{})
+		assert.NotNil(t, err)
+		assert.Equal(t, err.Code(), CodeResourceExhausted)
+		assert.True(t, strings.Contains(err.Message(), "after gzip decompression"), assert.Sprintf("message: %s", err.Message()))
+		var digest [sha256.Size]byte
+		assert.Nil(t, newReader(t, &digestCodec{}, compressed, len(payload)).Unmarshal(&digest))
+		assert.Equal(t, digest, sha256.Sum256(payload))
+	})
+	t.Run("corrupt", func(t *testing.T) {
+		t.Parallel()
+		compressed := gzipBytes(t, payload)
+		compressed[len(compressed)-5] ^= 0xff // corrupt the checksum
+		err := newReader(t, &digestCodec{}, compressed, 0).Unmarshal(&[sha256.Size]byte{})
+		assert.NotNil(t, err)
+		assert.Equal(t, err.Code(), CodeInvalidArgument)
+		assert.True(t, strings.HasPrefix(err.Message(), "decompress:"), assert.Sprintf("message: %s", err.Message()))
+	})
+}
+
+func BenchmarkEnvelopeReaderUnmarshalCompressed(b *testing.B) {
+	payload := bytes.Repeat([]byte("0123456789abcdef"), 1<<18) // 4 MiB
+	compressed := gzipBytes(b, payload)
+	head := makeEnvelopePrefix(flagEnvelopeCompressed, len(compressed))
+	gzip, ok := withGzip().(*compressionOption)
+	assert.True(b, ok)
+	for _, codec := range []Codec{bufferedCodec{&digestCodec{}}, &digestCodec{}} {
+		name := "streamed"
+		if _, ok := codec.(bufferedCodec); ok {
+			name = "buffered"
+		}
+		b.Run(name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				// A fresh buffer pool per message, so the benchmark reports the
+				// memory needed to decode one large message.
+				reader := &envelopeReader{
+					ctx:             context.Background(),
+					reader:          io.MultiReader(bytes.NewReader(head[:]), bytes.NewReader(compressed)),
+					codec:           codec,
+					compressionPool: gzip.CompressionPool,
+					bufferPool:      newBufferPool(),
+				}
+				var digest [sha256.Size]byte
+				if err := reader.Unmarshal(&digest); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func gzipBytes(tb testing.TB, data []byte) []byte {
+	tb.Helper()
+	gzip, ok := withGzip().(*compressionOption)
+	assert.True(tb, ok)
+	compressed := &bytes.Buffer{}
+	assert.Nil(tb, gzip.CompressionPool.Compress(compressed, bytes.NewBuffer(data)))
+	return compressed.Bytes()
+}
+
+// digestCodec "unmarshals" messages into their SHA-256 digests, which it can
+// compute incrementally.
+type digestCodec struct {
+	streamed int
+}
+
+func (c *digestCodec) Name() string { return "digest" }
+
+func (c *digestCodec) Marshal(any) ([]byte, error) {
+	return nil, errors.New("digestCodec can't marshal")
+}
+
+func (c *digestCodec) Unmarshal(data []byte, message any) error {
+	return c.UnmarshalFrom(bytes.NewReader(data), message)
+}
+
+func (c *digestCodec) UnmarshalFrom(reader io.Reader, message any) error {
+	digest, ok := message.(*[sha256.Size]byte)
+	if !ok {
+		return fmt.Errorf("unexpected message type %T", message)
+	}
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, reader); err != nil {
+		return err
+	}
+	copy(digest[:], hasher.Sum(nil))
+	if _, ok := reader.(*bytes.Reader); !ok {
+		c.streamed++
+	}
+	return nil
+}
+
+// bufferedCodec hides any extension methods of the wrapped Codec.
+type bufferedCodec struct {
+	Codec
+}
+
 // byteByByteReader is test reader that reads a single byte at a time.
 type byteByByteReader struct {
 	reader io.ByteReader
@@ -18,10 +18,14 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"io"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
+	"slices"
 	"strings"
+	"syscall"
 
 	"google.golang.org/protobuf/proto"
 	"google.golang.org/protobuf/types/known/anypb"
@@ -126,6 +130,12 @@ type Error struct {
 	details []*ErrorDetail
 	meta    http.Header
 	wireErr bool
+	// Set on errors from encoding, decoding, compressing, or decompressing
+	// messages. Never sent over the wire.
+	codecName       string
+	compressionName string
+	// Set by WithErrorCorrelationID and sent in Connect error bodies.
+	correlationID string
 }
 
 // NewError annotates any Go error with a status code.
@@ -220,7 +230,11 @@ func (e *Error) Details() []*ErrorDetail {
 	return e.details
 }
 
-// AddDetail appends to the error's details.
+// AddDetail appends to the error's details. Details reach clients in the
+// order they were added over every protocol, so a handler rejecting a batch
+// can attach one detail per invalid item. When some items of a batch succeed,
+// prefer returning per-item outcomes in the response message: an error always
+// replaces the response.
 func (e *Error) AddDetail(d *ErrorDetail) {
 	e.details = append(e.details, d)
 }
@@ -248,6 +262,52 @@ func (e *Error) Meta() http.Header {
 	return e.meta
 }
 
+// CodecName returns the name of the codec in use when the error occurred, like
+// "proto" or "json". It's only set on errors produced while encoding,
+// decoding, compressing, or decompressing messages on this side of the
+// connection, so it's empty for errors received from the other party. It's
+// purely diagnostic and is never sent over the wire.
+func (e *Error) CodecName() string {
+	return e.codecName
+}
+
+// CompressionName returns the name of the compression algorithm negotiated for
+// the call when the error occurred, like "gzip". Like [Error.CodecName], it's
+// only set on errors produced while processing messages locally and is never
+// sent over the wire. It's empty if the call doesn't use compression.
+func (e *Error) CompressionName() string {
+	return e.compressionName
+}
+
+// withEncoding records the supplied codec and compression as the ones in use
+// when the error occurred, unless they're already recorded. It's safe to call
+// with nil arguments.
+func (e *Error) withEncoding(codec Codec, pool *compressionPool) *Error {
+	if e == nil {
+		return nil
+	}
+	if codec != nil && e.codecName == "" {
+		e.codecName = codec.Name()
+	}
+	if pool != nil && e.compressionName == "" {
+		e.compressionName = pool.name
+	}
+	return e
+}
+
+// clone returns a copy of the error that can be modified without affecting
+// the original. Handlers often return package-level errors, so code that
+// annotates errors on their way out should work on a copy.
+func (e *Error) clone() *Error {
+	if e == nil {
+		return nil
+	}
+	clone := *e
+	clone.details = slices.Clone(e.details)
+	clone.meta = e.meta.Clone()
+	return &clone
+}
+
 func (e *Error) detailsAsAny() []*anypb.Any {
 	anys := make([]*anypb.Any, 0, len(e.details))
 	for _, detail := range e.details {
@@ -336,6 +396,34 @@ func wrapIfContextDone(ctx context.Context, err error) error {
 	return err
 }
 
+// wrapIfClientDisconnected applies CodeCanceled to errors writing a response
+// to a client that has gone away. The servers in net/http cancel the
+// request's context once the client disconnects, which is the primary signal.
+// Writes may fail slightly before that happens, so errors from the connection
+// itself also count.
+func wrapIfClientDisconnected(ctx context.Context, err error) error {
+	if err == nil {
+		return nil
+	}
+	err = wrapIfContextError(err)
+	if _, ok := asError(err); ok {
+		return err
+	}
+	if ctx.Err() != nil ||
+		errors.Is(err, http.ErrAbortHandler) ||
+		errors.Is(err, net.ErrClosed) ||
+		errors.Is(err, syscall.EPIPE) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, io.ErrClosedPipe) ||
+		// As a last resort, match the HTTP/2 server's unexported sentinel for
+		// writes to a connection that's gone away. It's returned as-is, so
+		// compare the whole message.
+		err.Error() == "client disconnected" {
+		return errorf(CodeCanceled, "client disconnected: %w", err)
+	}
+	return err
+}
+
 // wrapIfLikelyH2CNotConfiguredError adds a wrapping error that has a message
 // telling the caller that they likely need to use h2c but are using a raw http.Client{}.
 //
@@ -15,9 +15,14 @@
 package connect
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"io"
+	"net"
+	"net/http"
 	"strings"
+	"syscall"
 	"testing"
 	"time"
 
@@ -108,6 +113,33 @@ func TestErrorIs(t *testing.T) {
 	assert.True(t, errors.Is(connectErr, connectErr))
 }
 
+func TestWrapIfClientDisconnected(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	assert.Nil(t, wrapIfClientDisconnected(ctx, nil))
+	for _, err := range []error{
+		fmt.Errorf("write tcp 127.0.0.1:8080: %w", syscall.EPIPE),
+		fmt.Errorf("write tcp 127.0.0.1:8080: %w", syscall.ECONNRESET),
+		fmt.Errorf("write tcp 127.0.0.1:8080: %w", net.ErrClosed),
+		http.ErrAbortHandler,
+		io.ErrClosedPipe,
+		errors.New("client disconnected"),
+		context.Canceled,
+	} {
+		assert.Equal(t, CodeOf(wrapIfClientDisconnected(ctx, err)), CodeCanceled, assert.Sprintf("%v", err))
+	}
+	// Once the request's context is canceled, any write error is a disconnect.
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	assert.Equal(t, CodeOf(wrapIfClientDisconnected(canceled, errors.New("http2: stream closed"))), CodeCanceled)
+	// Errors that don't indicate a disconnect are left alone.
+	unrelated := errors.New("upstream stream closed unexpectedly")
+	assert.True(t, wrapIfClientDisconnected(ctx, unrelated) == unrelated)
+	assert.True(t, wrapIfClientDisconnected(ctx, http.ErrBodyNotAllowed) == http.ErrBodyNotAllowed)
+	coded := NewError(CodeResourceExhausted, errors.New("too big"))
+	assert.True(t, wrapIfClientDisconnected(ctx, coded) == error(coded))
+}
+
 func TestTypeNameFromURL(t *testing.T) {
 	t.Parallel()
 	testCases := []struct {
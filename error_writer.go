@@ -51,13 +51,7 @@ type ErrorWriter struct {
 // classify the request.
 // Options supplied via [WithConditionalHandlerOptions] are ignored.
 func NewErrorWriter(opts ...HandlerOption) *ErrorWriter {
-	config := newHandlerConfig("", StreamTypeUnary, opts)
-	codecs := newReadOnlyCodecs(config.Codecs)
-	return &ErrorWriter{
-		bufferPool:                   config.BufferPool,
-		protobuf:                     codecs.Protobuf(),
-		requireConnectProtocolHeader: config.RequireConnectProtocolHeader,
-	}
+	return newHandlerConfig("", StreamTypeUnary, opts).newErrorWriter()
 }
 
 func (w *ErrorWriter) classifyRequest(request *http.Request) protocolType {
@@ -108,7 +102,7 @@ func (w *ErrorWriter) Write(response http.ResponseWriter, request *http.Request,
 	switch protocolType := w.classifyRequest(request); protocolType {
 	case connectStreamProtocol:
 		setHeaderCanonical(response.Header(), headerContentType, ctype)
-		return w.writeConnectStreaming(response, err)
+		return w.writeConnectStreaming(response, request, err)
 	case grpcProtocol:
 		setHeaderCanonical(response.Header(), headerContentType, ctype)
 		return w.writeGRPC(response, err)
@@ -139,11 +133,11 @@ func (w *ErrorWriter) writeConnectUnary(response http.ResponseWriter, err error)
 	return writeErr
 }
 
-func (w *ErrorWriter) writeConnectStreaming(response http.ResponseWriter, err error) error {
+func (w *ErrorWriter) writeConnectStreaming(response http.ResponseWriter, request *http.Request, err error) error {
 	response.WriteHeader(http.StatusOK)
 	marshaler := &connectStreamingMarshaler{
 		envelopeWriter: envelopeWriter{
-			sender:     writeSender{writer: response},
+			sender:     writeSender{ctx: request.Context(), writer: response},
 			bufferPool: w.bufferPool,
 		},
 	}
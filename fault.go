@@ -0,0 +1,154 @@
+// Copyright 2021-2024 The Connect Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package connect
+
+import (
+	"context"
+	"math/rand"
+	"sync/atomic"
+	"time"
+)
+
+// FaultConfig describes the faults a [FaultInterceptor] injects.
+type FaultConfig struct {
+	// Probability is the fraction of matching calls that fail, from 0 (no
+	// calls) to 1 (every call).
+	Probability float64
+	// Procedures restricts faults to calls to these procedures, such as
+	// "/acme.foo.v1.FooService/Bar". If empty, every procedure is eligible.
+	Procedures []string
+	// Delay is added before each faulty call proceeds. Delays end early if
+	// the call's context is done.
+	Delay time.Duration
+	// Code is the error returned by faulty calls. If zero, faulty calls are
+	// delayed but otherwise succeed.
+	Code Code
+	// Rand returns a pseudo-random number in [0.0, 1.0) and decides which
+	// calls are faulty. Supplying a deterministic source makes chaos tests
+	// repeatable. If nil, the math/rand package's global source is used. Rand
+	// must be safe to call concurrently.
+	Rand func() float64
+}
+
+// A FaultInterceptor injects latency and errors into a fraction of calls,
+// which is useful for testing how systems behave when their dependencies
+// misbehave. It works for both clients and handlers: on the client side,
+// faulty calls never reach the network, and on the handler side, they never
+// reach the implementation.
+//
+// The configuration can be replaced at any time with SetConfig, so faults may
+// be dialed up and down without restarting the process.
+type FaultInterceptor struct {
+	config atomic.Pointer[FaultConfig]
+}
+
+// NewFaultInterceptor constructs a FaultInterceptor with the supplied initial
+// configuration. A zero FaultConfig injects no faults.
+func NewFaultInterceptor(config FaultConfig) *FaultInterceptor {
+	interceptor := &FaultInterceptor{}
+	interceptor.SetConfig(config)
+	return interceptor
+}
+
+// SetConfig atomically replaces the interceptor's configuration. Calls already
+// in progress aren't affected.
+func (f *FaultInterceptor) SetConfig(config FaultConfig) {
+	config.Procedures = append([]string(nil), config.Procedures...)
+	f.config.Store(&config)
+}
+
+// Config returns the interceptor's current configuration.
+func (f *FaultInterceptor) Config() FaultConfig {
+	return *f.config.Load()
+}
+
+// WrapUnary implements [Interceptor].
+func (f *FaultInterceptor) WrapUnary(next UnaryFunc) UnaryFunc {
+	return func(ctx context.Context, request AnyRequest) (AnyResponse, error) {
+		if err := f.inject(ctx, request.Spec()); err != nil {
+			return nil, err
+		}
+		return next(ctx, request)
+	}
+}
+
+// WrapStreamingClient implements [Interceptor].
+func (f *FaultInterceptor) WrapStreamingClient(next StreamingClientFunc) StreamingClientFunc {
+	return func(ctx context.Context, spec Spec) StreamingClientConn {
+		conn := next(ctx, spec)
+		if err := f.inject(ctx, spec); err != nil {
+			// The underlying conn hasn't sent anything yet. Closing its response
+			// releases it without sending the request; closing the request
+			// first would send it.
+			_ = conn.CloseResponse()
+			return &errorClientConn{spec: spec, peer: conn.Peer(), header: conn.RequestHeader(), err: err}
+		}
+		return conn
+	}
+}
+
+// WrapStreamingHandler implements [Interceptor].
+func (f *FaultInterceptor) WrapStreamingHandler(next StreamingHandlerFunc) StreamingHandlerFunc {
+	return func(ctx context.Context, conn StreamingHandlerConn) error {
+		if err := f.inject(ctx, conn.Spec()); err != nil {
+			return err
+		}
+		return next(ctx, conn)
+	}
+}
+
+// inject decides whether the call is faulty and, if it is, waits out the
+// configured delay and returns the configured error.
+func (f *FaultInterceptor) inject(ctx context.Context, spec Spec) error {
+	config := f.config.Load()
+	if !config.matches(spec.Procedure) {
+		return nil
+	}
+	random := config.Rand
+	if random == nil {
+		random = rand.Float64 //nolint:gosec // no need for a cryptographically secure source
+	}
+	if random() >= config.Probability {
+		return nil
+	}
+	if config.Delay > 0 {
+		timer := time.NewTimer(config.Delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return wrapIfContextError(ctx.Err())
+		}
+	}
+	if config.Code == 0 {
+		return nil
+	}
+	return errorf(config.Code, "injected fault")
+}
+
+func (c *FaultConfig) matches(procedure string) bool {
+	if c.Probability <= 0 {
+		return false
+	}
+	if len(c.Procedures) == 0 {
+		return true
+	}
+	for _, candidate := range c.Procedures {
+		if candidate == procedure {
+			return true
+		}
+	}
+	return false
+}
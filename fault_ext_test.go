@@ -0,0 +1,213 @@
+// Copyright 2021-2024 The Connect Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package connect_test
+
+import (
+	"context"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	connect "connectrpc.com/connect"
+	"connectrpc.com/connect/internal/assert"
+	pingv1 "connectrpc.com/connect/internal/gen/connect/ping/v1"
+	"connectrpc.com/connect/internal/gen/connect/ping/v1/pingv1connect"
+	"connectrpc.com/connect/internal/memhttp/memhttptest"
+)
+
+func TestFaultInterceptor(t *testing.T) {
+	t.Parallel()
+	// alternate makes every other call faulty.
+	alternate := func() func() float64 {
+		var calls atomic.Int64
+		return func() float64 {
+			if calls.Add(1)%2 == 0 {
+				return 0
+			}
+			return 0.99
+		}
+	}
+	newServer := func(t *testing.T, options ...connect.HandlerOption) pingv1connect.PingServiceClient {
+		t.Helper()
+		mux := http.NewServeMux()
+		mux.Handle(pingv1connect.NewPingServiceHandler(pingServer{}, options...))
+		server := memhttptest.NewServer(t, mux)
+		return pingv1connect.NewPingServiceClient(server.Client(), server.URL())
+	}
+	ping := func(ctx context.Context, client pingv1connect.PingServiceClient) error {
+		_, err := client.Ping(ctx, connect.NewRequest(&pingv1.PingRequest{}))
+		return err
+	}
+	t.Run("handler", func(t *testing.T) {
+		t.Parallel()
+		faults := connect.NewFaultInterceptor(connect.FaultConfig{
+			Probability: 0.5,
+			Code:        connect.CodeUnavailable,
+			Rand:        alternate(),
+		})
+		client := newServer(t, connect.WithInterceptors(faults))
+		var failed int
+		for i := 0; i < 10; i++ {
+			if err := ping(context.Background(), client); err != nil {
+				assert.Equal(t, connect.CodeOf(err), connect.CodeUnavailable)
+				assert.Equal(t, err.Error(), "unavailable: injected fault")
+				failed++
+			}
+		}
+		assert.Equal(t, failed, 5)
+
+		// Faults can be dialed down at runtime.
+		faults.SetConfig(connect.FaultConfig{})
+		for i := 0; i < 10; i++ {
+			assert.Nil(t, ping(context.Background(), client))
+		}
+	})
+	t.Run("client", func(t *testing.T) {
+		t.Parallel()
+		var handled atomic.Int64
+		mux := http.NewServeMux()
+		mux.Handle(pingv1connect.NewPingServiceHandler(
+			pingServer{},
+			connect.WithInterceptors(connect.UnaryInterceptorFunc(func(next connect.UnaryFunc) connect.UnaryFunc {
+				return func(ctx context.Context, request connect.AnyRequest) (connect.AnyResponse, error) {
+					handled.Add(1)
+					return next(ctx, request)
+				}
+			})),
+		))
+		server := memhttptest.NewServer(t, mux)
+		faults := connect.NewFaultInterceptor(connect.FaultConfig{
+			Probability: 1,
+			Procedures:  []string{pingv1connect.PingServicePingProcedure, pingv1connect.PingServiceCountUpProcedure},
+			Code:        connect.CodeResourceExhausted,
+		})
+		client := pingv1connect.NewPingServiceClient(
+			server.Client(),
+			server.URL(),
+			connect.WithInterceptors(faults),
+		)
+		// Faulty calls never reach the server.
+		assert.Equal(t, connect.CodeOf(ping(context.Background(), client)), connect.CodeResourceExhausted)
+		assert.Equal(t, handled.Load(), 0)
+		_, err := client.CountUp(context.Background(), connect.NewRequest(&pingv1.CountUpRequest{Number: 2}))
+		assert.Equal(t, connect.CodeOf(err), connect.CodeResourceExhausted)
+
+		// Other procedures aren't affected.
+		faults.SetConfig(connect.FaultConfig{
+			Probability: 1,
+			Procedures:  []string{pingv1connect.PingServiceCountUpProcedure},
+			Code:        connect.CodeResourceExhausted,
+		})
+		assert.Nil(t, ping(context.Background(), client))
+		assert.Equal(t, handled.Load(), 1)
+	})
+	t.Run("client_stream_released", func(t *testing.T) {
+		t.Parallel()
+		var handled atomic.Int64
+		mux := http.NewServeMux()
+		mux.Handle(pingv1connect.NewPingServiceHandler(
+			pingServer{},
+			connect.WithInterceptors(&countingHandlerInterceptor{count: &handled}),
+		))
+		server := memhttptest.NewServer(t, mux)
+		closes := &closeRecordingInterceptor{}
+		client := pingv1connect.NewPingServiceClient(
+			server.Client(),
+			server.URL(),
+			connect.WithStreamIdleTimeout(time.Minute),
+			connect.WithInterceptors(
+				connect.NewFaultInterceptor(connect.FaultConfig{Probability: 1, Code: connect.CodeUnavailable}),
+				closes,
+			),
+		)
+		// The conn the fault interceptor abandons is closed without sending
+		// the request.
+		_, err := client.CountUp(context.Background(), connect.NewRequest(&pingv1.CountUpRequest{Number: 2}))
+		assert.Equal(t, connect.CodeOf(err), connect.CodeUnavailable)
+		assert.Equal(t, closes.closed.Load(), 1)
+		assert.Equal(t, handled.Load(), 0)
+	})
+	t.Run("delay", func(t *testing.T) {
+		t.Parallel()
+		const delay = 20 * time.Millisecond
+		faults := connect.NewFaultInterceptor(connect.FaultConfig{
+			Probability: 1,
+			Delay:       delay,
+		})
+		client := newServer(t, connect.WithInterceptors(faults))
+		start := time.Now()
+		assert.Nil(t, ping(context.Background(), client))
+		assert.True(t, time.Since(start) >= delay)
+
+		// Delays respect the call's deadline.
+		faults.SetConfig(connect.FaultConfig{Probability: 1, Delay: time.Minute})
+		ctx, cancel := context.WithTimeout(context.Background(), delay)
+		defer cancel()
+		err := ping(ctx, client)
+		assert.Equal(t, connect.CodeOf(err), connect.CodeDeadlineExceeded)
+	})
+}
+
+// countingHandlerInterceptor counts the streaming calls handlers receive.
+type countingHandlerInterceptor struct {
+	count *atomic.Int64
+}
+
+func (i *countingHandlerInterceptor) WrapUnary(next connect.UnaryFunc) connect.UnaryFunc {
+	return next
+}
+
+func (i *countingHandlerInterceptor) WrapStreamingClient(next connect.StreamingClientFunc) connect.StreamingClientFunc {
+	return next
+}
+
+func (i *countingHandlerInterceptor) WrapStreamingHandler(next connect.StreamingHandlerFunc) connect.StreamingHandlerFunc {
+	return func(ctx context.Context, conn connect.StreamingHandlerConn) error {
+		i.count.Add(1)
+		return next(ctx, conn)
+	}
+}
+
+// closeRecordingInterceptor counts the client streams whose responses are
+// closed.
+type closeRecordingInterceptor struct {
+	closed atomic.Int64
+}
+
+func (i *closeRecordingInterceptor) WrapUnary(next connect.UnaryFunc) connect.UnaryFunc {
+	return next
+}
+
+func (i *closeRecordingInterceptor) WrapStreamingClient(next connect.StreamingClientFunc) connect.StreamingClientFunc {
+	return func(ctx context.Context, spec connect.Spec) connect.StreamingClientConn {
+		return &closeRecordingClientConn{StreamingClientConn: next(ctx, spec), closed: &i.closed}
+	}
+}
+
+func (i *closeRecordingInterceptor) WrapStreamingHandler(next connect.StreamingHandlerFunc) connect.StreamingHandlerFunc {
+	return next
+}
+
+type closeRecordingClientConn struct {
+	connect.StreamingClientConn
+
+	closed *atomic.Int64
+}
+
+func (c *closeRecordingClientConn) CloseResponse() error {
+	c.closed.Add(1)
+	return c.StreamingClientConn.CloseResponse()
+}
@@ -17,6 +17,8 @@ package connect
 import (
 	"context"
 	"net/http"
+	"strings"
+	"time"
 )
 
 // A Handler is the server-side implementation of a single RPC defined by a
@@ -26,11 +28,39 @@ import (
 // the binary Protobuf and JSON codecs. They support gzip compression using the
 // standard library's [compress/gzip].
 type Handler struct {
-	spec             Spec
-	implementation   StreamingHandlerFunc
-	protocolHandlers map[string][]protocolHandler // Method to protocol handlers
-	allowMethod      string                       // Allow header
-	acceptPost       string                       // Accept-Post header
+	spec              Spec
+	implementation    StreamingHandlerFunc
+	protocolHandlers  map[string][]protocolHandler // Method to protocol handlers
+	allowMethod       string                       // Allow header
+	acceptPost        string                       // Accept-Post header
+	limiter           *admissionLimiter            // nil if concurrency is unlimited
+	peerLimiter       *peerLimiter                 // nil if per-peer concurrency is unlimited
+	observeRejection  func(context.Context, *Rejection)
+	streamIdleTimeout time.Duration
+	rawRequestBytes   bool
+	validateRequest   func(context.Context, Spec, http.Header) error
+	errorWriter       *ErrorWriter // for errors sent before a protocol is negotiated
+	requireProtocol   string       // empty if every protocol is accepted
+}
+
+// A Rejection describes a call that a [Handler] rejected before running any
+// interceptors, for example because the client used an unsupported
+// Content-Type or compression algorithm. Use [WithRejectionObserver] to
+// observe rejections.
+type Rejection struct {
+	Spec Spec
+	// Protocol is the RPC protocol the client was using, if known. For calls
+	// rejected before a protocol was negotiated, it's inferred from the
+	// Content-Type, and it's empty if the Content-Type doesn't resemble any
+	// supported protocol.
+	Protocol string
+	// ContentType is the request's Content-Type, as sent by the client.
+	ContentType   string
+	RequestHeader http.Header
+	// Err explains why the call was rejected. Calls rejected at the HTTP
+	// level (for example, with 415 Unsupported Media Type) are described with
+	// synthesized errors.
+	Err error
 }
 
 // NewUnaryHandler constructs a [Handler] for a request-response procedure.
@@ -72,16 +102,29 @@ func NewUnaryHandler[Req, Res any](
 		}
 		mergeNonProtocolHeaders(conn.ResponseHeader(), response.Header())
 		mergeNonProtocolHeaders(conn.ResponseTrailer(), response.Trailer())
+		if override := response.compressionOverride(); override != compressionOverrideNone {
+			if overrider, ok := conn.(compressionOverrider); ok {
+				overrider.overrideCompression(override)
+			}
+		}
 		return conn.Send(response.Any())
 	}
 
 	protocolHandlers := config.newProtocolHandlers()
 	return &Handler{
-		spec:             config.newSpec(),
-		implementation:   implementation,
-		protocolHandlers: mappedMethodHandlers(protocolHandlers),
-		allowMethod:      sortedAllowMethodValue(protocolHandlers),
-		acceptPost:       sortedAcceptPostValue(protocolHandlers),
+		spec:              config.newSpec(),
+		implementation:    implementation,
+		protocolHandlers:  mappedMethodHandlers(protocolHandlers),
+		allowMethod:       sortedAllowMethodValue(protocolHandlers),
+		acceptPost:        sortedAcceptPostValue(protocolHandlers),
+		limiter:           config.Limiter,
+		peerLimiter:       config.PeerLimiter,
+		observeRejection:  config.ObserveRejection,
+		streamIdleTimeout: config.StreamIdleTimeout,
+		rawRequestBytes:   config.RawRequestBytes,
+		validateRequest:   config.ValidateRequest,
+		errorWriter:       config.newErrorWriter(),
+		requireProtocol:   config.RequireProtocol,
 	}
 }
 
@@ -168,6 +211,7 @@ func (h *Handler) ServeHTTP(responseWriter http.ResponseWriter, request *http.Re
 		// underlying TCP connection.
 		responseWriter.Header().Set("Connection", "close")
 		responseWriter.WriteHeader(http.StatusHTTPVersionNotSupported)
+		h.reject(request, "", errorf(CodeUnimplemented, "bidi streaming requires HTTP/2, got %s", request.Proto))
 		return
 	}
 
@@ -175,6 +219,7 @@ func (h *Handler) ServeHTTP(responseWriter http.ResponseWriter, request *http.Re
 	if len(protocolHandlers) == 0 {
 		responseWriter.Header().Set("Allow", h.allowMethod)
 		responseWriter.WriteHeader(http.StatusMethodNotAllowed)
+		h.reject(request, "", errorf(CodeUnimplemented, "method %s not allowed", request.Method))
 		return
 	}
 
@@ -189,8 +234,27 @@ func (h *Handler) ServeHTTP(responseWriter http.ResponseWriter, request *http.Re
 		}
 	}
 	if protocolHandler == nil {
+		if err := h.mismatchedStreamType(protocolHandlers, contentType); err != nil {
+			// The client is speaking Connect, so answer with an error in the
+			// framing it expects rather than an opaque 415.
+			_ = h.errorWriter.Write(responseWriter, request, err)
+			h.reject(request, ProtocolConnect, err)
+			return
+		}
 		responseWriter.Header().Set("Accept-Post", h.acceptPost)
 		responseWriter.WriteHeader(http.StatusUnsupportedMediaType)
+		h.reject(request, "", errorf(CodeUnimplemented, "unsupported content type %q", contentType))
+		return
+	}
+
+	if h.requireProtocol != "" && protocolHandler.Protocol() != h.requireProtocol {
+		err := errorf(
+			CodeUnimplemented,
+			"procedure %s requires the %s protocol, called with %s",
+			h.spec.Procedure, h.requireProtocol, protocolHandler.Protocol(),
+		)
+		_ = h.errorWriter.Write(responseWriter, request, err)
+		h.reject(request, protocolHandler.Protocol(), err)
 		return
 	}
 
@@ -206,6 +270,7 @@ func (h *Handler) ServeHTTP(responseWriter http.ResponseWriter, request *http.Re
 		}
 		if hasBody {
 			responseWriter.WriteHeader(http.StatusUnsupportedMediaType)
+			h.reject(request, ProtocolConnect, errorf(CodeInvalidArgument, "GET request must not have a body"))
 			return
 		}
 		_ = request.Body.Close()
@@ -221,26 +286,139 @@ func (h *Handler) ServeHTTP(responseWriter http.ResponseWriter, request *http.Re
 	if cancel != nil {
 		defer cancel()
 	}
-	connCloser, ok := protocolHandler.NewConn(
+	if h.rawRequestBytes {
+		ctx = context.WithValue(ctx, rawRequestBytesContextKey{}, &rawRequestBytes{})
+	}
+	connCloser, connErr := protocolHandler.NewConn(
 		responseWriter,
 		request.WithContext(ctx),
 	)
-	if !ok {
+	if connErr != nil {
 		// Failed to create stream, usually because client used an unknown
-		// compression algorithm. Nothing further to do.
+		// compression algorithm. The error has already been sent.
+		h.reject(request, "", connErr)
 		return
 	}
 	if timeoutErr != nil {
 		_ = connCloser.Close(timeoutErr)
+		h.reject(request, "", timeoutErr)
 		return
 	}
+	if h.validateRequest != nil {
+		// Reject invalid calls before reading any of the body. Closing the conn
+		// closes the body without draining it.
+		if err := h.validateRequest(ctx, h.spec, request.Header); err != nil {
+			_ = connCloser.Close(err)
+			h.reject(request, "", err)
+			return
+		}
+	}
+	if h.peerLimiter != nil {
+		// Check the per-peer limit first, so calls from a peer over its limit
+		// don't occupy global slots.
+		key, peerErr := h.peerLimiter.Acquire(connCloser.Peer(), request.Header)
+		if peerErr != nil {
+			_ = connCloser.Close(peerErr)
+			h.reject(request, "", peerErr)
+			return
+		}
+		defer h.peerLimiter.Release(key)
+	}
+	if h.limiter != nil {
+		var admissionErr error
+		ctx, admissionErr = h.limiter.Acquire(ctx)
+		if admissionErr != nil {
+			_ = connCloser.Close(admissionErr)
+			h.reject(request, "", admissionErr)
+			return
+		}
+		defer h.limiter.Release()
+	}
+	if h.streamIdleTimeout > 0 && h.spec.StreamType&StreamTypeClient != 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithCancel(ctx)
+		defer cancel()
+		idle := newIdleTimer(h.streamIdleTimeout, func() {
+			cancel()
+			// Unblock any pending read from the request body.
+			_ = http.NewResponseController(responseWriter).SetReadDeadline(time.Now())
+		})
+		defer idle.Stop()
+		connCloser = &idleHandlerConn{handlerConnCloser: connCloser, idle: idle}
+	}
 	_ = connCloser.Close(h.implementation(ctx, connCloser))
 }
 
+// mismatchedStreamType returns an error if the request uses the Connect
+// protocol's framing for a different stream type than the handler's, as
+// happens when a unary client calls a streaming procedure or vice versa. The
+// gRPC and gRPC-Web protocols frame every stream type the same way, so they
+// don't have this failure mode.
+func (h *Handler) mismatchedStreamType(protocolHandlers []protocolHandler, contentType string) error {
+	var counterpart, calledAs string
+	if codecName, ok := strings.CutPrefix(contentType, connectStreamingContentTypePrefix); ok {
+		if h.spec.StreamType != StreamTypeUnary {
+			return nil
+		}
+		counterpart = connectUnaryContentTypePrefix + codecName
+		calledAs = "streaming"
+	} else if codecName, ok := strings.CutPrefix(contentType, connectUnaryContentTypePrefix); ok {
+		if h.spec.StreamType == StreamTypeUnary {
+			return nil
+		}
+		counterpart = connectStreamingContentTypePrefix + codecName
+		calledAs = "unary"
+	} else {
+		return nil
+	}
+	// Only report a mismatch if the request would have been accepted with the
+	// other framing, so that unrelated content types still get a 415.
+	for _, handler := range protocolHandlers {
+		if _, ok := handler.ContentTypes()[counterpart]; ok {
+			return errorf(
+				CodeUnimplemented,
+				"procedure %s is %s, called as %s",
+				h.spec.Procedure, describeStreamType(h.spec.StreamType), calledAs,
+			)
+		}
+	}
+	return nil
+}
+
+func describeStreamType(streamType StreamType) string {
+	if streamType == StreamTypeUnary {
+		return streamType.String()
+	}
+	return streamType.String() + " streaming"
+}
+
+// reject reports a call rejected before reaching interceptors to the
+// configured observer, if any. If protocol is empty, it's inferred from the
+// request's Content-Type.
+func (h *Handler) reject(request *http.Request, protocol string, err error) {
+	if h.observeRejection == nil {
+		return
+	}
+	contentType := getHeaderCanonical(request.Header, headerContentType)
+	if protocol == "" && request.Method == http.MethodGet {
+		protocol = ProtocolConnect // only Connect supports GET
+	} else if protocol == "" {
+		protocol = protocolFromContentType(canonicalizeContentType(contentType))
+	}
+	h.observeRejection(request.Context(), &Rejection{
+		Spec:          h.spec,
+		Protocol:      protocol,
+		ContentType:   contentType,
+		RequestHeader: request.Header,
+		Err:           err,
+	})
+}
+
 type handlerConfig struct {
 	CompressionPools             map[string]*compressionPool
 	CompressionNames             []string
 	Codecs                       map[string]Codec
+	ContentTypeCodecs            map[string]string
 	CompressMinBytes             int
 	Interceptor                  Interceptor
 	Procedure                    string
@@ -250,8 +428,25 @@ type handlerConfig struct {
 	IdempotencyLevel             IdempotencyLevel
 	BufferPool                   *bufferPool
 	ReadMaxBytes                 int
+	ReadMaxMessages              int
+	ReadMaxEmpty                 int
+	ResponseCompressionAlways    bool
+	CompressResponse             func(any) bool
+	PrettyJSON                   bool
+	AllowedCodecs                map[string]struct{}
+	AllowedRequestCompression    map[string]struct{}
+	JSONDiscardUnknown           *bool
+	BufferBudget                 *bufferBudget
 	SendMaxBytes                 int
 	StreamType                   StreamType
+	Limiter                      *admissionLimiter
+	PeerLimiter                  *peerLimiter
+	ObserveRejection             func(context.Context, *Rejection)
+	StreamIdleTimeout            time.Duration
+	RawRequestBytes              bool
+	ValidateRequest              func(context.Context, Spec, http.Header) error
+	ValidateConstruction         bool
+	RequireProtocol              string
 }
 
 func newHandlerConfig(procedure string, streamType StreamType, options []HandlerOption) *handlerConfig {
@@ -266,12 +461,58 @@ func newHandlerConfig(procedure string, streamType StreamType, options []Handler
 	withProtoBinaryCodec().applyToHandler(&config)
 	withProtoJSONCodecs().applyToHandler(&config)
 	withGzip().applyToHandler(&config)
+	for _, opt := range loadDefaultHandlerOptions() {
+		opt.applyToHandler(&config)
+	}
 	for _, opt := range options {
 		opt.applyToHandler(&config)
 	}
+	if discard := config.JSONDiscardUnknown; discard != nil {
+		for name, codec := range config.Codecs {
+			config.Codecs[name] = withJSONDiscardUnknown(codec, *discard)
+		}
+	}
+	if config.ValidateConstruction {
+		if err := config.validate(); err != nil {
+			panic("connect: invalid handler configuration for " + procedure + ": " + err.Error()) //nolint:forbidigo
+		}
+	}
 	return &config
 }
 
+// validate checks for configurations that would reject every request. Unlike
+// clients, handlers only validate when asked to with WithConstructValidation.
+func (c *handlerConfig) validate() *Error {
+	usable := 0
+	for name := range c.Codecs {
+		if checkCodecAllowed(c.AllowedCodecs, name) == nil {
+			usable++
+		}
+	}
+	if usable == 0 {
+		return errorf(CodeUnknown, "no codec configured")
+	}
+	for contentType, name := range c.ContentTypeCodecs {
+		if _, ok := c.Codecs[name]; !ok {
+			return errorf(CodeUnknown, "content type %q mapped to unknown codec %q", contentType, name)
+		}
+	}
+	switch c.RequireProtocol {
+	case "", ProtocolConnect, ProtocolGRPC, ProtocolGRPCWeb:
+	default:
+		return errorf(CodeUnknown, "unknown required protocol %q", c.RequireProtocol)
+	}
+	return nil
+}
+
+func (c *handlerConfig) newErrorWriter() *ErrorWriter {
+	return &ErrorWriter{
+		bufferPool:                   c.BufferPool,
+		protobuf:                     newReadOnlyCodecs(c.Codecs).Protobuf(),
+		requireConnectProtocolHeader: c.RequireConnectProtocolHeader,
+	}
+}
+
 func (c *handlerConfig) newSpec() Spec {
 	return Spec{
 		Procedure:        c.Procedure,
@@ -293,14 +534,25 @@ func (c *handlerConfig) newProtocolHandlers() []protocolHandler {
 		c.CompressionPools,
 		c.CompressionNames,
 	)
+	acceptCompression := acceptRequestCompression(compressors, c.AllowedRequestCompression)
 	for _, protocol := range protocols {
 		handlers = append(handlers, protocol.NewHandler(&protocolHandlerParams{
 			Spec:                         c.newSpec(),
 			Codecs:                       codecs,
+			ContentTypeCodecs:            c.ContentTypeCodecs,
 			CompressionPools:             compressors,
 			CompressMinBytes:             c.CompressMinBytes,
 			BufferPool:                   c.BufferPool,
 			ReadMaxBytes:                 c.ReadMaxBytes,
+			ReadMaxMessages:              c.ReadMaxMessages,
+			ReadMaxEmpty:                 c.ReadMaxEmpty,
+			ResponseCompressionAlways:    c.ResponseCompressionAlways,
+			CompressResponse:             c.CompressResponse,
+			PrettyJSON:                   c.PrettyJSON,
+			AllowedCodecs:                c.AllowedCodecs,
+			AllowedRequestCompression:    c.AllowedRequestCompression,
+			AcceptCompression:            acceptCompression,
+			BufferBudget:                 c.BufferBudget,
 			SendMaxBytes:                 c.SendMaxBytes,
 			RequireConnectProtocolHeader: c.RequireConnectProtocolHeader,
 			IdempotencyLevel:             c.IdempotencyLevel,
@@ -318,10 +570,18 @@ func newStreamHandler(
 	}
 	protocolHandlers := config.newProtocolHandlers()
 	return &Handler{
-		spec:             config.newSpec(),
-		implementation:   implementation,
-		protocolHandlers: mappedMethodHandlers(protocolHandlers),
-		allowMethod:      sortedAllowMethodValue(protocolHandlers),
-		acceptPost:       sortedAcceptPostValue(protocolHandlers),
+		spec:              config.newSpec(),
+		implementation:    implementation,
+		protocolHandlers:  mappedMethodHandlers(protocolHandlers),
+		allowMethod:       sortedAllowMethodValue(protocolHandlers),
+		acceptPost:        sortedAcceptPostValue(protocolHandlers),
+		limiter:           config.Limiter,
+		peerLimiter:       config.PeerLimiter,
+		observeRejection:  config.ObserveRejection,
+		streamIdleTimeout: config.StreamIdleTimeout,
+		rawRequestBytes:   config.RawRequestBytes,
+		validateRequest:   config.ValidateRequest,
+		errorWriter:       config.newErrorWriter(),
+		requireProtocol:   config.RequireProtocol,
 	}
 }
@@ -16,6 +16,7 @@ package connect_test
 
 import (
 	"bytes"
+	"compress/flate"
 	"context"
 	"encoding/binary"
 	"encoding/json"
@@ -23,15 +24,21 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"net/http/httptest"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	connect "connectrpc.com/connect"
 	"connectrpc.com/connect/internal/assert"
 	pingv1 "connectrpc.com/connect/internal/gen/connect/ping/v1"
 	"connectrpc.com/connect/internal/gen/connect/ping/v1/pingv1connect"
+	"connectrpc.com/connect/internal/memhttp"
 	"connectrpc.com/connect/internal/memhttp/memhttptest"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
 	"google.golang.org/protobuf/reflect/protoreflect"
 	"google.golang.org/protobuf/reflect/protoregistry"
 	"google.golang.org/protobuf/types/dynamicpb"
@@ -285,6 +292,676 @@ func TestHandlerMaliciousPrefix(t *testing.T) {
 	wg.Wait()
 }
 
+func TestHandlerCodecForContentType(t *testing.T) {
+	t.Parallel()
+	mux := http.NewServeMux()
+	mux.Handle(pingv1connect.NewPingServiceHandler(
+		pingServer{},
+		connect.WithCodecForContentType("application/x-protobuf", "proto"),
+		connect.WithCodecForContentType("application/x-unregistered", "unregistered"),
+	))
+	server := memhttptest.NewServer(t, mux)
+	post := func(t *testing.T, procedure, contentType string, body []byte) *http.Response {
+		t.Helper()
+		request, err := http.NewRequestWithContext(
+			context.Background(),
+			http.MethodPost,
+			server.URL()+procedure,
+			bytes.NewReader(body),
+		)
+		assert.Nil(t, err)
+		request.Header.Set("Content-Type", contentType)
+		response, err := server.Client().Do(request)
+		assert.Nil(t, err)
+		t.Cleanup(func() { response.Body.Close() })
+		return response
+	}
+	t.Run("aliased", func(t *testing.T) {
+		t.Parallel()
+		body, err := proto.Marshal(&pingv1.PingRequest{Number: 42})
+		assert.Nil(t, err)
+		response := post(t, pingv1connect.PingServicePingProcedure, "application/X-Protobuf", body)
+		assert.Equal(t, response.StatusCode, http.StatusOK)
+		assert.Equal(t, response.Header.Get("Content-Type"), "application/x-protobuf")
+		responseBody, err := io.ReadAll(response.Body)
+		assert.Nil(t, err)
+		var msg pingv1.PingResponse
+		assert.Nil(t, proto.Unmarshal(responseBody, &msg))
+		assert.Equal(t, msg.GetNumber(), 42)
+	})
+	t.Run("unregistered_codec", func(t *testing.T) {
+		t.Parallel()
+		response := post(t, pingv1connect.PingServicePingProcedure, "application/x-unregistered", nil)
+		assert.Equal(t, response.StatusCode, http.StatusUnsupportedMediaType)
+		assert.False(t, strings.Contains(response.Header.Get("Accept-Post"), "x-unregistered"))
+	})
+	t.Run("streaming", func(t *testing.T) {
+		t.Parallel()
+		response := post(t, pingv1connect.PingServiceSumProcedure, "application/x-protobuf", nil)
+		assert.Equal(t, response.StatusCode, http.StatusUnsupportedMediaType)
+	})
+}
+
+func TestHandlerRejectionObserver(t *testing.T) {
+	t.Parallel()
+	var (
+		mu         sync.Mutex
+		rejections []*connect.Rejection
+	)
+	mux := http.NewServeMux()
+	mux.Handle(pingv1connect.NewPingServiceHandler(
+		successPingServer{},
+		connect.WithRejectionObserver(func(_ context.Context, rejection *connect.Rejection) {
+			mu.Lock()
+			defer mu.Unlock()
+			rejections = append(rejections, rejection)
+		}),
+	))
+	server := memhttptest.NewServer(t, mux)
+	post := func(t *testing.T, header http.Header) *connect.Rejection {
+		t.Helper()
+		request, err := http.NewRequestWithContext(
+			context.Background(),
+			http.MethodPost,
+			server.URL()+pingv1connect.PingServicePingProcedure,
+			strings.NewReader("{}"),
+		)
+		assert.Nil(t, err)
+		request.Header = header
+		response, err := server.Client().Do(request)
+		assert.Nil(t, err)
+		_, _ = io.Copy(io.Discard, response.Body)
+		response.Body.Close()
+		mu.Lock()
+		defer mu.Unlock()
+		if len(rejections) == 0 {
+			return nil
+		}
+		rejection := rejections[0]
+		rejections = rejections[1:]
+		return rejection
+	}
+	t.Run("accepted", func(t *testing.T) {
+		rejection := post(t, http.Header{"Content-Type": []string{"application/json"}})
+		assert.Nil(t, rejection)
+	})
+	t.Run("unsupported_charset", func(t *testing.T) {
+		rejection := post(t, http.Header{"Content-Type": []string{"application/json; charset=shift-jis"}})
+		assert.NotNil(t, rejection)
+		assert.Equal(t, rejection.Protocol, connect.ProtocolConnect)
+		assert.Equal(t, rejection.ContentType, "application/json; charset=shift-jis")
+		assert.Equal(t, rejection.Spec.Procedure, pingv1connect.PingServicePingProcedure)
+		assert.Equal(t, connect.CodeOf(rejection.Err), connect.CodeUnimplemented)
+	})
+	t.Run("unsupported_codec", func(t *testing.T) {
+		rejection := post(t, http.Header{"Content-Type": []string{"application/grpc-web+xml"}})
+		assert.NotNil(t, rejection)
+		assert.Equal(t, rejection.Protocol, connect.ProtocolGRPCWeb)
+		assert.Equal(t, rejection.ContentType, "application/grpc-web+xml")
+	})
+	t.Run("unsupported_compression", func(t *testing.T) {
+		rejection := post(t, http.Header{
+			"Content-Type":  []string{"application/grpc+json"},
+			"Grpc-Encoding": []string{"snappy"},
+		})
+		assert.NotNil(t, rejection)
+		assert.Equal(t, rejection.Protocol, connect.ProtocolGRPC)
+		assert.Equal(t, rejection.ContentType, "application/grpc+json")
+		assert.Equal(t, connect.CodeOf(rejection.Err), connect.CodeUnimplemented)
+		assert.True(t, strings.Contains(rejection.Err.Error(), "snappy"))
+	})
+}
+
+func TestHandlerMarshalToCodec(t *testing.T) {
+	t.Parallel()
+	codec := &writerCodec{}
+	mux := http.NewServeMux()
+	mux.Handle(pingv1connect.NewPingServiceHandler(pingServer{}, connect.WithCodec(codec)))
+	server := memhttptest.NewServer(t, mux)
+	text := strings.Repeat("large response ", 1024)
+
+	t.Run("compressed", func(t *testing.T) {
+		client := pingv1connect.NewPingServiceClient(server.Client(), server.URL())
+		calls := codec.calls.Load()
+		res, err := client.Ping(context.Background(), connect.NewRequest(&pingv1.PingRequest{Text: text}))
+		assert.Nil(t, err)
+		assert.Equal(t, res.Msg.GetText(), text)
+		assert.Equal(t, codec.calls.Load(), calls+1)
+	})
+	t.Run("uncompressed", func(t *testing.T) {
+		body, err := proto.Marshal(&pingv1.PingRequest{Text: text})
+		assert.Nil(t, err)
+		request, err := http.NewRequestWithContext(
+			context.Background(),
+			http.MethodPost,
+			server.URL()+pingv1connect.PingServicePingProcedure,
+			bytes.NewReader(body),
+		)
+		assert.Nil(t, err)
+		request.Header.Set("Content-Type", "application/proto")
+		calls := codec.calls.Load()
+		response, err := server.Client().Do(request)
+		assert.Nil(t, err)
+		defer response.Body.Close()
+		assert.Equal(t, response.StatusCode, http.StatusOK)
+		assert.Equal(t, response.Header.Get("Content-Encoding"), "")
+		responseBody, err := io.ReadAll(response.Body)
+		assert.Nil(t, err)
+		var msg pingv1.PingResponse
+		assert.Nil(t, proto.Unmarshal(responseBody, &msg))
+		assert.Equal(t, msg.GetText(), text)
+		assert.Equal(t, codec.calls.Load(), calls+1)
+	})
+	t.Run("error_before_write", func(t *testing.T) {
+		client := pingv1connect.NewPingServiceClient(server.Client(), server.URL())
+		_, err := client.Ping(context.Background(), connect.NewRequest(&pingv1.PingRequest{Text: "fail"}))
+		assert.Equal(t, connect.CodeOf(err), connect.CodeInternal)
+		assert.True(t, strings.Contains(err.Error(), "refusing to marshal"))
+	})
+	t.Run("grpc", func(t *testing.T) {
+		// Enveloped protocols need the message size up front.
+		client := pingv1connect.NewPingServiceClient(server.Client(), server.URL(), connect.WithGRPC())
+		calls := codec.calls.Load()
+		res, err := client.Ping(context.Background(), connect.NewRequest(&pingv1.PingRequest{Text: text}))
+		assert.Nil(t, err)
+		assert.Equal(t, res.Msg.GetText(), text)
+		assert.Equal(t, codec.calls.Load(), calls)
+	})
+}
+
+func TestHandlerRawRequestBytes(t *testing.T) {
+	t.Parallel()
+	verify := func(ctx context.Context, msg proto.Message) error {
+		want, err := proto.Marshal(msg)
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(connect.RawRequestBytes(ctx), want) {
+			return connect.NewError(connect.CodeUnauthenticated, errors.New("raw bytes mismatch"))
+		}
+		return nil
+	}
+	mux := http.NewServeMux()
+	mux.Handle(pingv1connect.NewPingServiceHandler(
+		&pluggablePingServer{
+			ping: func(_ context.Context, request *connect.Request[pingv1.PingRequest]) (*connect.Response[pingv1.PingResponse], error) {
+				return connect.NewResponse(&pingv1.PingResponse{Number: request.Msg.GetNumber()}), nil
+			},
+			cumSum: func(ctx context.Context, stream *connect.BidiStream[pingv1.CumSumRequest, pingv1.CumSumResponse]) error {
+				for {
+					msg, err := stream.Receive()
+					if errors.Is(err, io.EOF) {
+						return nil
+					} else if err != nil {
+						return err
+					}
+					if err := verify(ctx, msg); err != nil {
+						return err
+					}
+					if err := stream.Send(&pingv1.CumSumResponse{Sum: int64(len(connect.RawRequestBytes(ctx)))}); err != nil {
+						return err
+					}
+				}
+			},
+		},
+		connect.WithRawRequestBytes(),
+		connect.WithInterceptors(connect.UnaryInterceptorFunc(func(next connect.UnaryFunc) connect.UnaryFunc {
+			return func(ctx context.Context, request connect.AnyRequest) (connect.AnyResponse, error) {
+				msg, ok := request.Any().(proto.Message)
+				if !ok {
+					return nil, connect.NewError(connect.CodeInternal, errors.New("not a proto message"))
+				}
+				if err := verify(ctx, msg); err != nil {
+					return nil, err
+				}
+				return next(ctx, request)
+			}
+		})),
+	))
+	server := memhttptest.NewServer(t, mux)
+	for _, opts := range [][]connect.ClientOption{
+		{connect.WithSendGzip(), connect.WithCompressMinBytes(0)},
+		{connect.WithGRPC(), connect.WithSendGzip()},
+	} {
+		client := pingv1connect.NewPingServiceClient(server.Client(), server.URL(), opts...)
+		res, err := client.Ping(context.Background(), connect.NewRequest(&pingv1.PingRequest{Number: 42, Text: "sign me"}))
+		assert.Nil(t, err)
+		assert.Equal(t, res.Msg.GetNumber(), 42)
+
+		stream := client.CumSum(context.Background())
+		for _, number := range []int64{0, 1, 1000} {
+			assert.Nil(t, stream.Send(&pingv1.CumSumRequest{Number: number}))
+			msg, err := stream.Receive()
+			assert.Nil(t, err)
+			want, err := proto.Marshal(&pingv1.CumSumRequest{Number: number})
+			assert.Nil(t, err)
+			assert.Equal(t, msg.GetSum(), int64(len(want)))
+		}
+		assert.Nil(t, stream.CloseRequest())
+		_, err = stream.Receive()
+		assert.ErrorIs(t, err, io.EOF)
+		assert.Nil(t, stream.CloseResponse())
+	}
+	// The bytes are what the client sent, so JSON doesn't match binary Protobuf.
+	client := pingv1connect.NewPingServiceClient(server.Client(), server.URL(), connect.WithProtoJSON())
+	_, err := client.Ping(context.Background(), connect.NewRequest(&pingv1.PingRequest{Number: 42}))
+	assert.Equal(t, connect.CodeOf(err), connect.CodeUnauthenticated)
+	t.Run("disabled", func(t *testing.T) {
+		t.Parallel()
+		mux := http.NewServeMux()
+		mux.Handle(pingv1connect.NewPingServiceHandler(&pluggablePingServer{
+			ping: func(ctx context.Context, _ *connect.Request[pingv1.PingRequest]) (*connect.Response[pingv1.PingResponse], error) {
+				if connect.RawRequestBytes(ctx) != nil {
+					return nil, connect.NewError(connect.CodeInternal, errors.New("unexpected raw bytes"))
+				}
+				return connect.NewResponse(&pingv1.PingResponse{}), nil
+			},
+		}))
+		server := memhttptest.NewServer(t, mux)
+		client := pingv1connect.NewPingServiceClient(server.Client(), server.URL())
+		_, err := client.Ping(context.Background(), connect.NewRequest(&pingv1.PingRequest{Number: 1}))
+		assert.Nil(t, err)
+	})
+}
+
+func TestHandlerGlobalBufferBudget(t *testing.T) {
+	t.Parallel()
+	const budget = 64 * 1024
+	codec := &gatedCodec{entered: make(chan struct{}, 1), release: make(chan struct{})}
+	sharedBudget := connect.WithGlobalBufferBudget(budget)
+	newClient := func() pingv1connect.PingServiceClient {
+		mux := http.NewServeMux()
+		mux.Handle(pingv1connect.NewPingServiceHandler(
+			&pluggablePingServer{
+				ping: func(_ context.Context, request *connect.Request[pingv1.PingRequest]) (*connect.Response[pingv1.PingResponse], error) {
+					res := &pingv1.PingResponse{Number: int64(len(request.Msg.GetText()))}
+					if request.Msg.GetNumber() < 0 {
+						res.Text = strings.Repeat("r", budget)
+					}
+					return connect.NewResponse(res), nil
+				},
+			},
+			sharedBudget,
+			connect.WithCodec(codec),
+		))
+		server := memhttptest.NewServer(t, mux)
+		return pingv1connect.NewPingServiceClient(
+			server.Client(),
+			server.URL(),
+			connect.WithGRPC(),
+			connect.WithAcceptCompression("gzip", nil, nil), // keep responses large
+		)
+	}
+	ping := func(client pingv1connect.PingServiceClient, request *pingv1.PingRequest) error {
+		_, err := client.Ping(context.Background(), connect.NewRequest(request))
+		return err
+	}
+	// The budget is shared by separately constructed handlers.
+	first, second := newClient(), newClient()
+	large := strings.Repeat("a", 40*1024)
+
+	assert.Nil(t, ping(first, &pingv1.PingRequest{Text: large}))
+	err := ping(first, &pingv1.PingRequest{Text: strings.Repeat("a", budget)})
+	assert.Equal(t, connect.CodeOf(err), connect.CodeResourceExhausted)
+	assert.True(t, strings.Contains(err.Error(), "global buffer budget"))
+	// Responses draw from the budget too.
+	err = ping(first, &pingv1.PingRequest{Number: -1})
+	assert.Equal(t, connect.CodeOf(err), connect.CodeResourceExhausted)
+
+	// While one large message is buffered, another doesn't fit.
+	held := make(chan error, 1)
+	go func() {
+		held <- ping(first, &pingv1.PingRequest{Text: "hold" + large})
+	}()
+	<-codec.entered
+	err = ping(second, &pingv1.PingRequest{Text: large})
+	assert.Equal(t, connect.CodeOf(err), connect.CodeResourceExhausted)
+	assert.Nil(t, ping(second, &pingv1.PingRequest{Text: large[:8*1024]}))
+	close(codec.release)
+	assert.Nil(t, <-held)
+	// Once it's released, the budget is available again.
+	assert.Nil(t, ping(second, &pingv1.PingRequest{Text: large}))
+}
+
+func TestHandlerRequestValidator(t *testing.T) {
+	t.Parallel()
+	mux := http.NewServeMux()
+	mux.Handle(pingv1connect.NewPingServiceHandler(
+		&pluggablePingServer{
+			ping: func(_ context.Context, request *connect.Request[pingv1.PingRequest]) (*connect.Response[pingv1.PingResponse], error) {
+				return connect.NewResponse(&pingv1.PingResponse{Number: request.Msg.GetNumber()}), nil
+			},
+		},
+		connect.WithRequestValidator(func(_ context.Context, _ connect.Spec, header http.Header) error {
+			if header.Get("Authorization") == "" {
+				return connect.NewError(connect.CodeUnauthenticated, errors.New("missing credentials"))
+			}
+			return nil
+		}),
+	))
+	server := memhttptest.NewServer(t, mux)
+
+	t.Run("large_invalid_upload", func(t *testing.T) {
+		t.Parallel()
+		// Frame a huge gRPC request by hand, so we can see how much of it the
+		// client ends up sending.
+		const size = 64 << 20
+		prefix := make([]byte, 5)
+		binary.BigEndian.PutUint32(prefix[1:], size)
+		upload := &countingReader{reader: io.MultiReader(
+			bytes.NewReader(prefix),
+			io.LimitReader(zeroReader{}, size),
+		)}
+		request, err := http.NewRequestWithContext(
+			context.Background(),
+			http.MethodPost,
+			server.URL()+pingv1connect.PingServicePingProcedure,
+			upload,
+		)
+		assert.Nil(t, err)
+		request.Header.Set("Content-Type", "application/grpc")
+		request.Header.Set("Te", "trailers")
+		response, err := server.Client().Do(request)
+		assert.Nil(t, err)
+		body, err := io.ReadAll(response.Body)
+		assert.Nil(t, err)
+		assert.Nil(t, response.Body.Close())
+		// Trailers-only response: no body, just the status.
+		assert.Equal(t, response.StatusCode, http.StatusOK)
+		assert.Equal(t, len(body), 0)
+		assert.Equal(t, response.Trailer.Get("Grpc-Status"), "16")
+		assert.Equal(t, response.Trailer.Get("Grpc-Message"), "missing credentials")
+		assert.True(t, upload.read.Load() < size/2)
+	})
+	t.Run("valid", func(t *testing.T) {
+		t.Parallel()
+		client := pingv1connect.NewPingServiceClient(server.Client(), server.URL(), connect.WithGRPC())
+		request := connect.NewRequest(&pingv1.PingRequest{Number: 42})
+		request.Header().Set("Authorization", "Bearer token")
+		response, err := client.Ping(context.Background(), request)
+		assert.Nil(t, err)
+		assert.Equal(t, response.Msg.GetNumber(), 42)
+		// Other protocols are rejected too.
+		client = pingv1connect.NewPingServiceClient(server.Client(), server.URL())
+		_, err = client.Ping(context.Background(), connect.NewRequest(&pingv1.PingRequest{}))
+		assert.Equal(t, connect.CodeOf(err), connect.CodeUnauthenticated)
+	})
+}
+
+func TestHandlerStrictJSON(t *testing.T) {
+	t.Parallel()
+	newServer := func(t *testing.T, options ...connect.HandlerOption) *memhttp.Server {
+		t.Helper()
+		mux := http.NewServeMux()
+		mux.Handle(pingv1connect.NewPingServiceHandler(pingServer{}, options...))
+		return memhttptest.NewServer(t, mux)
+	}
+	post := func(t *testing.T, server *memhttp.Server, body string) (int, string) {
+		t.Helper()
+		request, err := http.NewRequestWithContext(
+			context.Background(),
+			http.MethodPost,
+			server.URL()+pingv1connect.PingServicePingProcedure,
+			strings.NewReader(body),
+		)
+		assert.Nil(t, err)
+		request.Header.Set("Content-Type", "application/json")
+		response, err := server.Client().Do(request)
+		assert.Nil(t, err)
+		defer response.Body.Close()
+		responseBody, err := io.ReadAll(response.Body)
+		assert.Nil(t, err)
+		return response.StatusCode, string(responseBody)
+	}
+	const unknownField = `{"number": "42", "nubmer": "42"}`
+
+	// By default, unknown fields are ignored.
+	lenient := newServer(t)
+	status, _ := post(t, lenient, unknownField)
+	assert.Equal(t, status, http.StatusOK)
+
+	strict := newServer(t, connect.WithStrictJSON())
+	status, body := post(t, strict, `{"number": "42"}`)
+	assert.Equal(t, status, http.StatusOK)
+	assert.Equal(t, body, `{"number":"42"}`)
+	status, body = post(t, strict, unknownField)
+	assert.Equal(t, status, http.StatusBadRequest)
+	var wireErr struct {
+		Code    string `json:"code"`
+		Message string `json:"message"`
+	}
+	assert.Nil(t, json.Unmarshal([]byte(body), &wireErr))
+	assert.Equal(t, wireErr.Code, connect.CodeInvalidArgument.String())
+	assert.True(t, strings.Contains(wireErr.Message, `unknown field "nubmer"`))
+
+	// WithStrictJSON and WithJSONDiscardUnknown set the same configuration, so
+	// the last one wins.
+	status, _ = post(t, newServer(t, connect.WithStrictJSON(), connect.WithJSONDiscardUnknown(true)), unknownField)
+	assert.Equal(t, status, http.StatusOK)
+	status, _ = post(t, newServer(t, connect.WithJSONDiscardUnknown(true), connect.WithStrictJSON()), unknownField)
+	assert.Equal(t, status, http.StatusBadRequest)
+}
+
+func TestJSONDiscardUnknown(t *testing.T) {
+	t.Parallel()
+	const unknownField = `{"number": "42", "nubmer": "42"}`
+	t.Run("handler", func(t *testing.T) {
+		t.Parallel()
+		post := func(t *testing.T, discard bool) int {
+			t.Helper()
+			mux := http.NewServeMux()
+			mux.Handle(pingv1connect.NewPingServiceHandler(pingServer{}, connect.WithJSONDiscardUnknown(discard)))
+			server := memhttptest.NewServer(t, mux)
+			request, err := http.NewRequestWithContext(
+				context.Background(),
+				http.MethodPost,
+				server.URL()+pingv1connect.PingServicePingProcedure,
+				strings.NewReader(unknownField),
+			)
+			assert.Nil(t, err)
+			request.Header.Set("Content-Type", "application/json")
+			response, err := server.Client().Do(request)
+			assert.Nil(t, err)
+			_ = response.Body.Close()
+			return response.StatusCode
+		}
+		assert.Equal(t, post(t, true), http.StatusOK)
+		assert.Equal(t, post(t, false), http.StatusBadRequest)
+	})
+	t.Run("client", func(t *testing.T) {
+		t.Parallel()
+		server := memhttptest.NewServer(t, http.HandlerFunc(func(responseWriter http.ResponseWriter, _ *http.Request) {
+			responseWriter.Header().Set("Content-Type", "application/json")
+			_, _ = io.WriteString(responseWriter, unknownField)
+		}))
+		ping := func(t *testing.T, options ...connect.ClientOption) error {
+			t.Helper()
+			// WithJSONDiscardUnknown applies even when it precedes WithProtoJSON.
+			client := pingv1connect.NewPingServiceClient(
+				server.Client(),
+				server.URL(),
+				append(options, connect.WithProtoJSON())...,
+			)
+			_, err := client.Ping(context.Background(), connect.NewRequest(&pingv1.PingRequest{}))
+			return err
+		}
+		assert.Nil(t, ping(t))
+		assert.Nil(t, ping(t, connect.WithJSONDiscardUnknown(true)))
+		err := ping(t, connect.WithJSONDiscardUnknown(false))
+		assert.NotNil(t, err)
+		assert.True(t, strings.Contains(err.Error(), `unknown field "nubmer"`))
+	})
+}
+
+func TestHandlerPrettyJSON(t *testing.T) {
+	t.Parallel()
+	newServer := func(t *testing.T, options ...connect.HandlerOption) *memhttp.Server {
+		t.Helper()
+		mux := http.NewServeMux()
+		mux.Handle(pingv1connect.NewPingServiceHandler(pingServer{}, options...))
+		return memhttptest.NewServer(t, mux)
+	}
+	post := func(t *testing.T, server *memhttp.Server, query string) string {
+		t.Helper()
+		request, err := http.NewRequestWithContext(
+			context.Background(),
+			http.MethodPost,
+			server.URL()+pingv1connect.PingServicePingProcedure+query,
+			strings.NewReader(`{"number": "42", "text": "hi"}`),
+		)
+		assert.Nil(t, err)
+		request.Header.Set("Content-Type", "application/json")
+		response, err := server.Client().Do(request)
+		assert.Nil(t, err)
+		defer response.Body.Close()
+		assert.Equal(t, response.StatusCode, http.StatusOK)
+		body, err := io.ReadAll(response.Body)
+		assert.Nil(t, err)
+		return string(body)
+	}
+	// protojson deliberately varies its whitespace, so only check for
+	// newlines and indentation.
+	isPretty := func(body string) bool {
+		return strings.HasPrefix(body, "{\n  \"number\":")
+	}
+
+	// Without the option, the query parameter is ignored.
+	assert.False(t, isPretty(post(t, newServer(t), "?pretty=1")))
+
+	server := newServer(t, connect.WithPrettyJSON())
+	assert.False(t, isPretty(post(t, server, "")))
+	pretty := post(t, server, "?pretty=1")
+	assert.True(t, isPretty(pretty))
+	var message pingv1.PingResponse
+	assert.Nil(t, protojson.Unmarshal([]byte(pretty), &message))
+	assert.Equal(t, message.GetNumber(), 42)
+	assert.Equal(t, message.GetText(), "hi")
+}
+
+func TestHandlerAllowedCodecs(t *testing.T) {
+	t.Parallel()
+	mux := http.NewServeMux()
+	mux.Handle(pingv1connect.NewPingServiceHandler(
+		pingServer{},
+		connect.WithConditionalHandlerOptions(func(spec connect.Spec) []connect.HandlerOption {
+			if spec.Procedure == pingv1connect.PingServicePingProcedure {
+				return []connect.HandlerOption{connect.WithAllowedCodecs("proto")}
+			}
+			return nil
+		}),
+	))
+	server := memhttptest.NewServer(t, mux)
+	ping := func(options ...connect.ClientOption) error {
+		client := pingv1connect.NewPingServiceClient(server.Client(), server.URL(), options...)
+		_, err := client.Ping(context.Background(), connect.NewRequest(&pingv1.PingRequest{Number: 1}))
+		return err
+	}
+	sum := func(options ...connect.ClientOption) error {
+		client := pingv1connect.NewPingServiceClient(server.Client(), server.URL(), options...)
+		stream := client.Sum(context.Background())
+		if err := stream.Send(&pingv1.SumRequest{Number: 1}); err != nil {
+			return err
+		}
+		_, err := stream.CloseAndReceive()
+		return err
+	}
+
+	assert.Nil(t, ping())
+	assert.Nil(t, ping(connect.WithGRPC()))
+	err := ping(connect.WithProtoJSON())
+	assert.Equal(t, connect.CodeOf(err), connect.CodeUnimplemented)
+	assert.True(t, strings.Contains(err.Error(), `doesn't accept the "json" codec`))
+	err = ping(connect.WithGRPC(), connect.WithProtoJSON())
+	assert.Equal(t, connect.CodeOf(err), connect.CodeUnimplemented)
+
+	// Other procedures still accept every registered codec.
+	assert.Nil(t, sum(connect.WithProtoJSON()))
+	assert.Nil(t, sum(connect.WithGRPCWeb(), connect.WithProtoJSON()))
+}
+
+func TestHandlerAllowedRequestCompression(t *testing.T) {
+	t.Parallel()
+	const zstd = "zstd" // a stand-in registered under zstd's name
+	decompressor := func() connect.Decompressor {
+		return newDeflateReader(strings.NewReader(""))
+	}
+	compressor := func() connect.Compressor {
+		w, err := flate.NewWriter(io.Discard, flate.DefaultCompression)
+		if err != nil {
+			t.Fatalf("failed to create flate writer: %v", err)
+		}
+		return w
+	}
+	mux := http.NewServeMux()
+	mux.Handle(pingv1connect.NewPingServiceHandler(
+		pingServer{},
+		connect.WithCompression(zstd, decompressor, compressor),
+		connect.WithAllowedRequestCompression("gzip"),
+	))
+	server := memhttptest.NewServer(t, mux)
+	ping := func(options ...connect.ClientOption) (*connect.Response[pingv1.PingResponse], error) {
+		options = append(options, connect.WithAcceptCompression(zstd, decompressor, compressor))
+		client := pingv1connect.NewPingServiceClient(server.Client(), server.URL(), options...)
+		return client.Ping(context.Background(), connect.NewRequest(&pingv1.PingRequest{Text: "compress me"}))
+	}
+
+	res, err := ping()
+	assert.Nil(t, err)
+	assert.Equal(t, res.Header().Get("Accept-Encoding"), "gzip")
+	_, err = ping(connect.WithSendGzip())
+	assert.Nil(t, err)
+	_, err = ping(connect.WithSendCompression(zstd))
+	assert.Equal(t, connect.CodeOf(err), connect.CodeUnimplemented)
+	assert.True(t, strings.Contains(err.Error(), `compression "zstd" not allowed for requests`))
+	_, err = ping(connect.WithGRPC(), connect.WithSendCompression(zstd))
+	assert.Equal(t, connect.CodeOf(err), connect.CodeUnimplemented)
+	_, err = ping(connect.WithGRPC(), connect.WithSendGzip())
+	assert.Nil(t, err)
+}
+
+//nolint:paralleltest // mutates global defaults
+func TestSetDefaultHandlerOptions(t *testing.T) {
+	const compressionName = "deflate"
+	decompressor := func() connect.Decompressor {
+		return newDeflateReader(strings.NewReader(""))
+	}
+	compressor := func() connect.Compressor {
+		w, err := flate.NewWriter(io.Discard, flate.DefaultCompression)
+		if err != nil {
+			t.Fatalf("failed to create flate writer: %v", err)
+		}
+		return w
+	}
+	ping := func(path string, handler http.Handler) error {
+		mux := http.NewServeMux()
+		mux.Handle(path, handler)
+		server := memhttptest.NewServer(t, mux)
+		client := pingv1connect.NewPingServiceClient(
+			server.Client(),
+			server.URL(),
+			connect.WithAcceptCompression(compressionName, decompressor, compressor),
+			connect.WithSendCompression(compressionName),
+		)
+		_, err := client.Ping(context.Background(), connect.NewRequest(&pingv1.PingRequest{Text: "deflate me"}))
+		return err
+	}
+	path, before := pingv1connect.NewPingServiceHandler(pingServer{})
+
+	connect.SetDefaultHandlerOptions(connect.WithCompression(compressionName, decompressor, compressor))
+	t.Cleanup(func() { connect.SetDefaultHandlerOptions() })
+	_, withDefaults := pingv1connect.NewPingServiceHandler(pingServer{})
+	_, overridden := pingv1connect.NewPingServiceHandler(
+		pingServer{},
+		connect.WithCompression(compressionName, nil, nil),
+	)
+
+	assert.Nil(t, ping(path, withDefaults))
+	// Handlers constructed before the defaults were set, or that override
+	// them, don't support the algorithm.
+	assert.NotNil(t, ping(path, before))
+	assert.NotNil(t, ping(path, overridden))
+}
+
 func TestDynamicHandler(t *testing.T) {
 	t.Parallel()
 	initializer := func(spec connect.Spec, msg any) error {
@@ -531,6 +1208,306 @@ type successPingServer struct {
 	pingv1connect.UnimplementedPingServiceHandler
 }
 
+// writerCodec is a binary Protobuf codec that writes marshaled messages in
+// small chunks, as a codec streaming from a database cursor might.
+type writerCodec struct {
+	calls atomic.Int64
+}
+
+func (c *writerCodec) Name() string {
+	return "proto"
+}
+
+func (c *writerCodec) Marshal(message any) ([]byte, error) {
+	protoMessage, ok := message.(proto.Message)
+	if !ok {
+		return nil, fmt.Errorf("not protobuf: %T", message)
+	}
+	return proto.Marshal(protoMessage)
+}
+
+func (c *writerCodec) MarshalTo(writer io.Writer, message any) error {
+	c.calls.Add(1)
+	if msg, ok := message.(*pingv1.PingResponse); ok && msg.GetText() == "fail" {
+		return errors.New("refusing to marshal")
+	}
+	data, err := c.Marshal(message)
+	if err != nil {
+		return err
+	}
+	for len(data) > 0 {
+		chunk := data[:min(len(data), 16)]
+		if _, err := writer.Write(chunk); err != nil {
+			return err
+		}
+		data = data[len(chunk):]
+	}
+	return nil
+}
+
+func (c *writerCodec) Unmarshal(data []byte, message any) error {
+	protoMessage, ok := message.(proto.Message)
+	if !ok {
+		return fmt.Errorf("not protobuf: %T", message)
+	}
+	return proto.Unmarshal(data, protoMessage)
+}
+
 func (successPingServer) Ping(context.Context, *connect.Request[pingv1.PingRequest]) (*connect.Response[pingv1.PingResponse], error) {
 	return &connect.Response[pingv1.PingResponse]{}, nil
 }
+
+// gatedCodec is a Protobuf codec that blocks while unmarshaling requests
+// whose text begins with "hold", until release is closed.
+type gatedCodec struct {
+	entered chan struct{}
+	release chan struct{}
+}
+
+func (c *gatedCodec) Name() string {
+	return "proto"
+}
+
+func (c *gatedCodec) Marshal(message any) ([]byte, error) {
+	protoMessage, ok := message.(proto.Message)
+	if !ok {
+		return nil, fmt.Errorf("not protobuf: %T", message)
+	}
+	return proto.Marshal(protoMessage)
+}
+
+func (c *gatedCodec) Unmarshal(data []byte, message any) error {
+	protoMessage, ok := message.(proto.Message)
+	if !ok {
+		return fmt.Errorf("not protobuf: %T", message)
+	}
+	if err := proto.Unmarshal(data, protoMessage); err != nil {
+		return err
+	}
+	if msg, ok := message.(*pingv1.PingRequest); ok && strings.HasPrefix(msg.GetText(), "hold") {
+		c.entered <- struct{}{}
+		<-c.release
+	}
+	return nil
+}
+
+// countingReader counts the bytes read from the wrapped reader.
+type countingReader struct {
+	reader io.Reader
+	read   atomic.Int64
+}
+
+func (r *countingReader) Read(data []byte) (int, error) {
+	n, err := r.reader.Read(data)
+	r.read.Add(int64(n))
+	return n, err
+}
+
+type zeroReader struct{}
+
+func (zeroReader) Read(data []byte) (int, error) {
+	clear(data)
+	return len(data), nil
+}
+
+func TestHandlerSendAfterClientDisconnect(t *testing.T) {
+	t.Parallel()
+	for _, protocol := range []struct {
+		name    string
+		http1   bool
+		tcp     bool
+		options []connect.ClientOption
+	}{
+		{name: "connect"},
+		{name: "connect_tcp", tcp: true},
+		{name: "grpcweb_tcp", tcp: true, options: []connect.ClientOption{connect.WithGRPCWeb()}},
+		{name: "connect_http1", http1: true},
+		{name: "grpc", options: []connect.ClientOption{connect.WithGRPC()}},
+		{name: "grpcweb", options: []connect.ClientOption{connect.WithGRPCWeb()}},
+		{name: "grpcweb_http1", http1: true, options: []connect.ClientOption{connect.WithGRPCWeb()}},
+	} {
+		protocol := protocol
+		t.Run(protocol.name, func(t *testing.T) {
+			t.Parallel()
+			type result struct {
+				err         error
+				sinceCancel time.Duration
+				ctxDone     bool
+			}
+			var canceledAt atomic.Int64
+			results := make(chan result, 1)
+			mux := http.NewServeMux()
+			mux.Handle(pingv1connect.NewPingServiceHandler(&pluggablePingServer{
+				countUp: func(ctx context.Context, _ *connect.Request[pingv1.CountUpRequest], stream *connect.ServerStream[pingv1.CountUpResponse]) error {
+					// Keep producing until the client goes away.
+					for i := int64(1); ; i++ {
+						if err := stream.Send(&pingv1.CountUpResponse{Number: i}); err != nil {
+							res := result{err: err, sinceCancel: time.Since(time.Unix(0, canceledAt.Load()))}
+							select {
+							case <-ctx.Done():
+								res.ctxDone = true
+							case <-time.After(time.Second):
+							}
+							results <- res
+							return err
+						}
+					}
+				},
+			}))
+			var client pingv1connect.PingServiceClient
+			if protocol.tcp {
+				server := httptest.NewServer(mux)
+				t.Cleanup(server.Close)
+				client = pingv1connect.NewPingServiceClient(server.Client(), server.URL, protocol.options...)
+			} else {
+				server := memhttptest.NewServer(t, mux)
+				httpClient := server.Client()
+				if protocol.http1 {
+					httpClient = &http.Client{Transport: server.TransportHTTP1()}
+				}
+				client = pingv1connect.NewPingServiceClient(httpClient, server.URL(), protocol.options...)
+			}
+			ctx, cancel := context.WithCancel(context.Background())
+			stream, err := client.CountUp(ctx, connect.NewRequest(&pingv1.CountUpRequest{}))
+			assert.Nil(t, err)
+			for i := 0; i < 3; i++ {
+				assert.True(t, stream.Receive())
+			}
+			canceledAt.Store(time.Now().UnixNano())
+			cancel()
+			assert.Nil(t, stream.Close())
+			select {
+			case res := <-results:
+				assert.Equal(t, connect.CodeOf(res.err), connect.CodeCanceled, assert.Sprintf("%v", res.err))
+				assert.True(t, res.sinceCancel < time.Second, assert.Sprintf("Send took %v to notice", res.sinceCancel))
+				assert.True(t, res.ctxDone)
+			case <-time.After(5 * time.Second):
+				t.Fatal("Send didn't observe the disconnect")
+			}
+		})
+	}
+}
+
+func TestHandlerStreamTypeMismatch(t *testing.T) {
+	t.Parallel()
+	mux := http.NewServeMux()
+	mux.Handle(pingv1connect.NewPingServiceHandler(pingServer{}))
+	server := memhttptest.NewServer(t, mux)
+	t.Run("unary_client", func(t *testing.T) {
+		t.Parallel()
+		for _, codec := range []connect.ClientOption{connect.WithProtoJSON(), connect.WithSendGzip()} {
+			client := connect.NewClient[pingv1.CountUpRequest, pingv1.CountUpResponse](
+				server.Client(),
+				server.URL()+pingv1connect.PingServiceCountUpProcedure,
+				codec,
+			)
+			_, err := client.CallUnary(context.Background(), connect.NewRequest(&pingv1.CountUpRequest{Number: 1}))
+			assert.Equal(t, connect.CodeOf(err), connect.CodeUnimplemented)
+			assert.True(t, strings.Contains(
+				err.Error(),
+				"procedure /connect.ping.v1.PingService/CountUp is server streaming, called as unary",
+			), assert.Sprintf("error: %v", err))
+		}
+	})
+	t.Run("streaming_client", func(t *testing.T) {
+		t.Parallel()
+		client := connect.NewClient[pingv1.PingRequest, pingv1.PingResponse](
+			server.Client(),
+			server.URL()+pingv1connect.PingServicePingProcedure,
+		)
+		stream, err := client.CallServerStream(context.Background(), connect.NewRequest(&pingv1.PingRequest{}))
+		assert.Nil(t, err)
+		assert.False(t, stream.Receive())
+		assert.Equal(t, connect.CodeOf(stream.Err()), connect.CodeUnimplemented)
+		assert.True(t, strings.Contains(
+			stream.Err().Error(),
+			"procedure /connect.ping.v1.PingService/Ping is unary, called as streaming",
+		), assert.Sprintf("error: %v", stream.Err()))
+		assert.Nil(t, stream.Close())
+	})
+	t.Run("unrelated_content_type", func(t *testing.T) {
+		t.Parallel()
+		request, err := http.NewRequestWithContext(
+			context.Background(),
+			http.MethodPost,
+			server.URL()+pingv1connect.PingServiceCountUpProcedure,
+			strings.NewReader("{}"),
+		)
+		assert.Nil(t, err)
+		request.Header.Set("Content-Type", "application/xml")
+		response, err := server.Client().Do(request)
+		assert.Nil(t, err)
+		defer response.Body.Close()
+		assert.Equal(t, response.StatusCode, http.StatusUnsupportedMediaType)
+	})
+}
+
+func TestHandlerConstructValidation(t *testing.T) {
+	t.Parallel()
+	newHandler := func(options ...connect.HandlerOption) (panicked any) {
+		defer func() { panicked = recover() }()
+		pingv1connect.NewPingServiceHandler(pingServer{}, options...)
+		return nil
+	}
+	t.Run("no_codec", func(t *testing.T) {
+		t.Parallel()
+		// Without validation, the misconfiguration surfaces only once calls
+		// arrive.
+		assert.Nil(t, newHandler(connect.WithAllowedCodecs("xml")))
+		panicked := newHandler(connect.WithAllowedCodecs("xml"), connect.WithConstructValidation())
+		message, ok := panicked.(string)
+		assert.True(t, ok, assert.Sprintf("panicked with %v", panicked))
+		assert.True(t, strings.Contains(message, "no codec configured"), assert.Sprintf("message: %s", message))
+	})
+	t.Run("unknown_content_type_codec", func(t *testing.T) {
+		t.Parallel()
+		panicked := newHandler(
+			connect.WithCodecForContentType("application/x-custom", "xml"),
+			connect.WithConstructValidation(),
+		)
+		message, ok := panicked.(string)
+		assert.True(t, ok, assert.Sprintf("panicked with %v", panicked))
+		assert.True(t, strings.Contains(message, `unknown codec "xml"`), assert.Sprintf("message: %s", message))
+	})
+	t.Run("unknown_required_protocol", func(t *testing.T) {
+		t.Parallel()
+		panicked := newHandler(connect.WithRequireProtocol("grpc-web"), connect.WithConstructValidation())
+		message, ok := panicked.(string)
+		assert.True(t, ok, assert.Sprintf("panicked with %v", panicked))
+		assert.True(t, strings.Contains(message, `unknown required protocol "grpc-web"`), assert.Sprintf("message: %s", message))
+	})
+	t.Run("valid", func(t *testing.T) {
+		t.Parallel()
+		assert.Nil(t, newHandler(connect.WithAllowedCodecs("proto"), connect.WithConstructValidation()))
+	})
+}
+
+func TestHandlerRequireProtocol(t *testing.T) {
+	t.Parallel()
+	var rejections atomic.Int64
+	mux := http.NewServeMux()
+	mux.Handle(pingv1connect.NewPingServiceHandler(
+		pingServer{},
+		connect.WithRequireProtocol(connect.ProtocolGRPC),
+		connect.WithRejectionObserver(func(_ context.Context, rejection *connect.Rejection) {
+			if rejection.Protocol == connect.ProtocolConnect {
+				rejections.Add(1)
+			}
+		}),
+	))
+	server := memhttptest.NewServer(t, mux)
+	ping := func(options ...connect.ClientOption) error {
+		client := pingv1connect.NewPingServiceClient(server.Client(), server.URL(), options...)
+		_, err := client.Ping(context.Background(), connect.NewRequest(&pingv1.PingRequest{Number: 1}))
+		return err
+	}
+
+	assert.Nil(t, ping(connect.WithGRPC()))
+	err := ping()
+	assert.Equal(t, connect.CodeOf(err), connect.CodeUnimplemented)
+	assert.True(t, strings.Contains(err.Error(), "requires the grpc protocol, called with connect"), assert.Sprintf("error: %v", err))
+	assert.Equal(t, rejections.Load(), 1)
+	err = ping(connect.WithGRPCWeb())
+	assert.Equal(t, connect.CodeOf(err), connect.CodeUnimplemented)
+	assert.True(t, strings.Contains(err.Error(), "called with grpcweb"), assert.Sprintf("error: %v", err))
+}
@@ -0,0 +1,309 @@
+// Copyright 2021-2024 The Connect Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package connect
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"strconv"
+	"sync"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+)
+
+// IdempotencyKeyHeader is the request header clients use to identify retries
+// of the same logical call to handlers using [NewIdempotencyInterceptor].
+const IdempotencyKeyHeader = "Idempotency-Key"
+
+// IdempotencyResult is the outcome of a unary call, as recorded by
+// [NewIdempotencyInterceptor]. Exactly one of Response and Err is non-nil.
+type IdempotencyResult struct {
+	Response AnyResponse
+	Err      error
+	// RequestDigest is a SHA-256 digest of the request message's deterministic
+	// Protobuf encoding. It's nil if the request message isn't a Protobuf
+	// message. Stores must persist it along with the result.
+	RequestDigest []byte
+}
+
+// An IdempotencyStore records the results of calls made with an idempotency
+// key. Keys passed to the store are already scoped to a procedure and to the
+// scope returned by [WithIdempotencyScope], if any. Stores must be safe to use
+// concurrently.
+type IdempotencyStore interface {
+	// Load returns the result stored for the key, if any. Expired results
+	// must not be returned.
+	Load(ctx context.Context, key string) (*IdempotencyResult, bool, error)
+	// Store records the result for the key. The store should retain the result
+	// for at least ttl.
+	Store(ctx context.Context, key string, result *IdempotencyResult, ttl time.Duration) error
+}
+
+// NewMemoryIdempotencyStore returns an [IdempotencyStore] that keeps results
+// in process memory. It's suitable for services with a single replica, and
+// for tests.
+func NewMemoryIdempotencyStore() IdempotencyStore {
+	return &memoryIdempotencyStore{entries: make(map[string]memoryIdempotencyEntry)}
+}
+
+// An IdempotencyOption configures the interceptor returned by
+// [NewIdempotencyInterceptor].
+type IdempotencyOption interface {
+	applyToIdempotency(*idempotencyConfig)
+}
+
+// WithIdempotencyScope partitions idempotency keys by an additional scope
+// derived from each request, such as the authenticated user or tenant. A
+// recorded result is only replayed to requests with the same procedure,
+// idempotency key, and scope, so callers can't see each other's results by
+// reusing or guessing keys.
+func WithIdempotencyScope(scope func(AnyRequest) string) IdempotencyOption {
+	return &idempotencyScopeOption{Scope: scope}
+}
+
+// NewIdempotencyInterceptor constructs a handler interceptor that deduplicates
+// retried unary calls. If a request carries an [IdempotencyKeyHeader] that
+// was seen within the last ttl for the same procedure, the handler isn't
+// called again: the interceptor returns the recorded response or error
+// instead. Concurrent duplicates wait for the first call to finish and then
+// share its result.
+//
+// By default, keys are scoped only to the procedure, so any caller that sends
+// the same key receives the recorded result, regardless of who made the
+// original call. Services with more than one caller should use
+// [WithIdempotencyScope] to keep callers apart. Retries must also send the
+// same request message: if a Protobuf request message differs from the one
+// recorded for its key, the call fails with [CodeInvalidArgument] without
+// running the handler.
+//
+// Calls that fail because their context was canceled or timed out aren't
+// recorded, so retrying them runs the handler again. Requests without the
+// header, streaming calls, and clients are unaffected. If the store is nil, an
+// in-memory store is used.
+//
+// If loading from the store fails, the call fails with [CodeInternal] without
+// running the handler. If storing a result fails, the handler has already run,
+// so the interceptor still returns its result; since nothing was recorded, a
+// retry with the same key runs the handler again. Stores should report their
+// own failures, for example by logging them.
+func NewIdempotencyInterceptor(store IdempotencyStore, ttl time.Duration, options ...IdempotencyOption) Interceptor {
+	if store == nil {
+		store = NewMemoryIdempotencyStore()
+	}
+	var config idempotencyConfig
+	for _, opt := range options {
+		opt.applyToIdempotency(&config)
+	}
+	return &idempotencyInterceptor{
+		store:    store,
+		ttl:      ttl,
+		scope:    config.Scope,
+		inflight: make(map[string]chan struct{}),
+	}
+}
+
+type idempotencyConfig struct {
+	Scope func(AnyRequest) string
+}
+
+type idempotencyScopeOption struct {
+	Scope func(AnyRequest) string
+}
+
+func (o *idempotencyScopeOption) applyToIdempotency(config *idempotencyConfig) {
+	config.Scope = o.Scope
+}
+
+type idempotencyInterceptor struct {
+	store IdempotencyStore
+	ttl   time.Duration
+	scope func(AnyRequest) string
+
+	mu       sync.Mutex
+	inflight map[string]chan struct{} // closed when the call finishes
+}
+
+func (i *idempotencyInterceptor) WrapUnary(next UnaryFunc) UnaryFunc {
+	return func(ctx context.Context, request AnyRequest) (AnyResponse, error) {
+		spec := request.Spec()
+		idempotencyKey := request.Header().Get(IdempotencyKeyHeader)
+		if spec.IsClient || idempotencyKey == "" {
+			return next(ctx, request)
+		}
+		var scope string
+		if i.scope != nil {
+			scope = i.scope(request)
+		}
+		// Length-prefix the scope, since it may contain anything.
+		key := spec.Procedure + "\x00" + strconv.Itoa(len(scope)) + "\x00" + scope + idempotencyKey
+		for {
+			done, wait := i.begin(key)
+			if wait {
+				select {
+				case <-done:
+					continue
+				case <-ctx.Done():
+					return nil, wrapIfContextError(ctx.Err())
+				}
+			}
+			return i.call(ctx, key, request, next, done)
+		}
+	}
+}
+
+func (i *idempotencyInterceptor) WrapStreamingClient(next StreamingClientFunc) StreamingClientFunc {
+	return next
+}
+
+func (i *idempotencyInterceptor) WrapStreamingHandler(next StreamingHandlerFunc) StreamingHandlerFunc {
+	return next
+}
+
+// begin marks the key as in flight. If another call with the same key is
+// already in flight, begin instead returns a channel that's closed when that
+// call finishes.
+func (i *idempotencyInterceptor) begin(key string) (chan struct{}, bool) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if done, ok := i.inflight[key]; ok {
+		return done, true
+	}
+	done := make(chan struct{})
+	i.inflight[key] = done
+	return done, false
+}
+
+func (i *idempotencyInterceptor) call(
+	ctx context.Context,
+	key string,
+	request AnyRequest,
+	next UnaryFunc,
+	done chan struct{},
+) (AnyResponse, error) {
+	defer func() {
+		i.mu.Lock()
+		delete(i.inflight, key)
+		close(done)
+		i.mu.Unlock()
+	}()
+	// Check the store only once the key is in flight, so a call finishing
+	// concurrently can't slip past us.
+	prior, ok, err := i.store.Load(ctx, key)
+	if err != nil {
+		return nil, errorf(CodeInternal, "load idempotency key: %w", err)
+	}
+	digest := idempotencyRequestDigest(request)
+	if ok {
+		if prior.RequestDigest != nil && digest != nil && !bytes.Equal(prior.RequestDigest, digest) {
+			return nil, errorf(CodeInvalidArgument, "%s was reused with a different request", IdempotencyKeyHeader)
+		}
+		return replayIdempotencyResult(prior)
+	}
+	response, err := next(ctx, request)
+	if code := CodeOf(err); code == CodeCanceled || code == CodeDeadlineExceeded {
+		return response, err
+	}
+	// Store copies, so that later interceptors mutating the response or error
+	// don't change what's replayed.
+	result := &IdempotencyResult{Err: cloneIdempotencyError(err), RequestDigest: digest}
+	if err == nil {
+		result.Response = response.clone()
+	}
+	// The handler's side effects have already happened, so a failure to record
+	// them mustn't hide its result from the client.
+	_ = i.store.Store(ctx, key, result, i.ttl)
+	return response, err
+}
+
+// idempotencyRequestDigest returns a digest of the request message, or nil if
+// the message isn't a Protobuf message.
+func idempotencyRequestDigest(request AnyRequest) []byte {
+	msg, ok := request.Any().(proto.Message)
+	if !ok {
+		return nil
+	}
+	data, err := proto.MarshalOptions{Deterministic: true}.Marshal(msg)
+	if err != nil {
+		return nil
+	}
+	digest := sha256.Sum256(data)
+	return digest[:]
+}
+
+func replayIdempotencyResult(result *IdempotencyResult) (AnyResponse, error) {
+	if result.Err != nil {
+		// Concurrent duplicates share the stored result, so each gets its own
+		// copy of the error.
+		return nil, cloneIdempotencyError(result.Err)
+	}
+	if result.Response == nil {
+		return nil, errorf(CodeInternal, "stored idempotency result has neither response nor error")
+	}
+	return result.Response.clone(), nil
+}
+
+// cloneIdempotencyError copies err if it's an *Error. Other errors can't be
+// modified through the error interface, so they're returned as-is.
+func cloneIdempotencyError(err error) error {
+	if connectErr, ok := err.(*Error); ok { //nolint:errorlint // wrapped errors aren't copied
+		return connectErr.clone()
+	}
+	return err
+}
+
+type memoryIdempotencyEntry struct {
+	result  *IdempotencyResult
+	expires time.Time
+}
+
+type memoryIdempotencyStore struct {
+	mu        sync.Mutex
+	entries   map[string]memoryIdempotencyEntry
+	lastSweep time.Time
+}
+
+func (s *memoryIdempotencyStore) Load(_ context.Context, key string) (*IdempotencyResult, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entry, ok := s.entries[key]
+	if !ok {
+		return nil, false, nil
+	}
+	if time.Now().After(entry.expires) {
+		delete(s.entries, key)
+		return nil, false, nil
+	}
+	return entry.result, true, nil
+}
+
+func (s *memoryIdempotencyStore) Store(_ context.Context, key string, result *IdempotencyResult, ttl time.Duration) error {
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// Keys are rarely retried, so most entries are never loaded again.
+	// Periodically sweep expired entries to bound memory use.
+	if now.Sub(s.lastSweep) > ttl {
+		for k, entry := range s.entries {
+			if now.After(entry.expires) {
+				delete(s.entries, k)
+			}
+		}
+		s.lastSweep = now
+	}
+	s.entries[key] = memoryIdempotencyEntry{result: result, expires: now.Add(ttl)}
+	return nil
+}
@@ -0,0 +1,249 @@
+// Copyright 2021-2024 The Connect Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package connect_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	connect "connectrpc.com/connect"
+	"connectrpc.com/connect/internal/assert"
+	pingv1 "connectrpc.com/connect/internal/gen/connect/ping/v1"
+	"connectrpc.com/connect/internal/gen/connect/ping/v1/pingv1connect"
+	"connectrpc.com/connect/internal/memhttp/memhttptest"
+)
+
+func TestIdempotencyInterceptor(t *testing.T) {
+	t.Parallel()
+	var calls atomic.Int64
+	mux := http.NewServeMux()
+	mux.Handle(pingv1connect.NewPingServiceHandler(
+		&pluggablePingServer{
+			ping: func(_ context.Context, request *connect.Request[pingv1.PingRequest]) (*connect.Response[pingv1.PingResponse], error) {
+				number := calls.Add(1)
+				if request.Msg.GetNumber() < 0 {
+					return nil, connect.NewError(connect.CodeFailedPrecondition, errors.New("insufficient funds"))
+				}
+				time.Sleep(time.Duration(request.Msg.GetNumber()) * time.Millisecond)
+				return connect.NewResponse(&pingv1.PingResponse{Number: number}), nil
+			},
+			countUp: func(_ context.Context, _ *connect.Request[pingv1.CountUpRequest], _ *connect.ServerStream[pingv1.CountUpResponse]) error {
+				calls.Add(1)
+				return nil
+			},
+		},
+		connect.WithInterceptors(connect.NewIdempotencyInterceptor(nil, time.Minute)),
+	))
+	server := memhttptest.NewServer(t, mux)
+	client := pingv1connect.NewPingServiceClient(server.Client(), server.URL())
+	ping := func(t *testing.T, key string, number int64) (*connect.Response[pingv1.PingResponse], error) {
+		t.Helper()
+		request := connect.NewRequest(&pingv1.PingRequest{Number: number})
+		if key != "" {
+			request.Header().Set(connect.IdempotencyKeyHeader, key)
+		}
+		return client.Ping(context.Background(), request)
+	}
+
+	t.Run("replay", func(t *testing.T) {
+		calls.Store(0)
+		first, err := ping(t, "replay", 0)
+		assert.Nil(t, err)
+		second, err := ping(t, "replay", 0)
+		assert.Nil(t, err)
+		assert.Equal(t, second.Msg.GetNumber(), first.Msg.GetNumber())
+		assert.Equal(t, calls.Load(), 1)
+		_, err = ping(t, "other", 0)
+		assert.Nil(t, err)
+		assert.Equal(t, calls.Load(), 2)
+	})
+	t.Run("different_request", func(t *testing.T) {
+		calls.Store(0)
+		_, err := ping(t, "different", 1)
+		assert.Nil(t, err)
+		_, err = ping(t, "different", 2)
+		assert.Equal(t, connect.CodeOf(err), connect.CodeInvalidArgument)
+		assert.Equal(t, calls.Load(), 1)
+	})
+	t.Run("no_key", func(t *testing.T) {
+		calls.Store(0)
+		for i := 0; i < 2; i++ {
+			_, err := ping(t, "", 0)
+			assert.Nil(t, err)
+		}
+		assert.Equal(t, calls.Load(), 2)
+	})
+	t.Run("error", func(t *testing.T) {
+		calls.Store(0)
+		for i := 0; i < 2; i++ {
+			_, err := ping(t, "error", -1)
+			assert.Equal(t, connect.CodeOf(err), connect.CodeFailedPrecondition)
+		}
+		assert.Equal(t, calls.Load(), 1)
+	})
+	t.Run("concurrent", func(t *testing.T) {
+		calls.Store(0)
+		var wg sync.WaitGroup
+		numbers := make([]int64, 4)
+		for i := range numbers {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				res, err := ping(t, "concurrent", 20)
+				assert.Nil(t, err)
+				numbers[i] = res.Msg.GetNumber()
+			}(i)
+		}
+		wg.Wait()
+		assert.Equal(t, calls.Load(), 1)
+		for _, number := range numbers {
+			assert.Equal(t, number, numbers[0])
+		}
+	})
+	t.Run("streaming", func(t *testing.T) {
+		calls.Store(0)
+		for i := 0; i < 2; i++ {
+			request := connect.NewRequest(&pingv1.CountUpRequest{})
+			request.Header().Set(connect.IdempotencyKeyHeader, "streaming")
+			stream, err := client.CountUp(context.Background(), request)
+			assert.Nil(t, err)
+			for stream.Receive() {
+			}
+			assert.Nil(t, stream.Close())
+		}
+		assert.Equal(t, calls.Load(), 2)
+	})
+}
+
+func TestIdempotencyInterceptorScope(t *testing.T) {
+	t.Parallel()
+	const tenantHeader = "Tenant"
+	var calls atomic.Int64
+	mux := http.NewServeMux()
+	mux.Handle(pingv1connect.NewPingServiceHandler(
+		&pluggablePingServer{
+			ping: func(_ context.Context, request *connect.Request[pingv1.PingRequest]) (*connect.Response[pingv1.PingResponse], error) {
+				calls.Add(1)
+				return connect.NewResponse(&pingv1.PingResponse{Text: request.Header().Get(tenantHeader)}), nil
+			},
+		},
+		connect.WithInterceptors(connect.NewIdempotencyInterceptor(nil, time.Minute, connect.WithIdempotencyScope(
+			func(request connect.AnyRequest) string {
+				return request.Header().Get(tenantHeader)
+			},
+		))),
+	))
+	server := memhttptest.NewServer(t, mux)
+	client := pingv1connect.NewPingServiceClient(server.Client(), server.URL())
+	ping := func(tenant string) string {
+		request := connect.NewRequest(&pingv1.PingRequest{})
+		request.Header().Set(connect.IdempotencyKeyHeader, "shared")
+		request.Header().Set(tenantHeader, tenant)
+		res, err := client.Ping(context.Background(), request)
+		assert.Nil(t, err)
+		return res.Msg.GetText()
+	}
+
+	assert.Equal(t, ping("acme"), "acme")
+	assert.Equal(t, ping("initech"), "initech")
+	assert.Equal(t, ping("acme"), "acme")
+	assert.Equal(t, calls.Load(), 2)
+}
+
+func TestIdempotencyInterceptorReplaysCopies(t *testing.T) {
+	t.Parallel()
+	// Interceptors outside the idempotency interceptor may annotate errors, so
+	// each replay must get its own copy of the stored error.
+	annotate := connect.UnaryInterceptorFunc(func(next connect.UnaryFunc) connect.UnaryFunc {
+		return func(ctx context.Context, request connect.AnyRequest) (connect.AnyResponse, error) {
+			response, err := next(ctx, request)
+			var connectErr *connect.Error
+			if errors.As(err, &connectErr) {
+				connectErr.Meta().Add("Attempt", "1")
+			}
+			return response, err
+		}
+	})
+	mux := http.NewServeMux()
+	mux.Handle(pingv1connect.NewPingServiceHandler(
+		&pluggablePingServer{
+			ping: func(context.Context, *connect.Request[pingv1.PingRequest]) (*connect.Response[pingv1.PingResponse], error) {
+				return nil, connect.NewError(connect.CodeFailedPrecondition, errors.New("insufficient funds"))
+			},
+		},
+		connect.WithInterceptors(annotate, connect.NewIdempotencyInterceptor(nil, time.Minute)),
+	))
+	server := memhttptest.NewServer(t, mux)
+	client := pingv1connect.NewPingServiceClient(server.Client(), server.URL())
+	for i := 0; i < 3; i++ {
+		request := connect.NewRequest(&pingv1.PingRequest{})
+		request.Header().Set(connect.IdempotencyKeyHeader, "copies")
+		_, err := client.Ping(context.Background(), request)
+		var connectErr *connect.Error
+		assert.True(t, errors.As(err, &connectErr))
+		assert.Equal(t, connectErr.Code(), connect.CodeFailedPrecondition)
+		assert.Equal(t, connectErr.Meta().Values("Attempt"), []string{"1"})
+	}
+}
+
+func TestIdempotencyInterceptorStoreFailure(t *testing.T) {
+	t.Parallel()
+	var calls atomic.Int64
+	store := &failingIdempotencyStore{IdempotencyStore: connect.NewMemoryIdempotencyStore()}
+	mux := http.NewServeMux()
+	mux.Handle(pingv1connect.NewPingServiceHandler(
+		&pluggablePingServer{
+			ping: func(context.Context, *connect.Request[pingv1.PingRequest]) (*connect.Response[pingv1.PingResponse], error) {
+				return connect.NewResponse(&pingv1.PingResponse{Number: calls.Add(1)}), nil
+			},
+		},
+		connect.WithInterceptors(connect.NewIdempotencyInterceptor(store, time.Minute)),
+	))
+	server := memhttptest.NewServer(t, mux)
+	client := pingv1connect.NewPingServiceClient(server.Client(), server.URL())
+	ping := func() (*connect.Response[pingv1.PingResponse], error) {
+		request := connect.NewRequest(&pingv1.PingRequest{})
+		request.Header().Set(connect.IdempotencyKeyHeader, "store-failure")
+		return client.Ping(context.Background(), request)
+	}
+
+	// The handler ran, so the client gets its result even though it wasn't
+	// recorded.
+	res, err := ping()
+	assert.Nil(t, err)
+	assert.Equal(t, res.Msg.GetNumber(), 1)
+	assert.Equal(t, store.failures.Load(), 1)
+	// Nothing was recorded, so a retry runs the handler again.
+	res, err = ping()
+	assert.Nil(t, err)
+	assert.Equal(t, res.Msg.GetNumber(), 2)
+}
+
+// failingIdempotencyStore fails every Store.
+type failingIdempotencyStore struct {
+	connect.IdempotencyStore
+
+	failures atomic.Int64
+}
+
+func (s *failingIdempotencyStore) Store(context.Context, string, *connect.IdempotencyResult, time.Duration) error {
+	s.failures.Add(1)
+	return errors.New("store unavailable")
+}
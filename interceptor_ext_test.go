@@ -16,7 +16,9 @@ package connect_test
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"io"
 	"net/http"
 	"sync/atomic"
 	"testing"
@@ -235,6 +237,51 @@ func TestInterceptorFuncAccessingHTTPMethod(t *testing.T) {
 	assert.Equal(t, int32(2), handlerChecker.count.Load())
 }
 
+func TestStreamingClientInterceptorReadsTrailersAfterEOF(t *testing.T) {
+	t.Parallel()
+	mux := http.NewServeMux()
+	mux.Handle(pingv1connect.NewPingServiceHandler(&pluggablePingServer{
+		countUp: func(_ context.Context, request *connect.Request[pingv1.CountUpRequest], stream *connect.ServerStream[pingv1.CountUpResponse]) error {
+			for i := int64(1); i <= request.Msg.GetNumber(); i++ {
+				if err := stream.Send(&pingv1.CountUpResponse{Number: i}); err != nil {
+					return err
+				}
+			}
+			stream.ResponseTrailer().Set("X-Rows-Scanned", fmt.Sprint(request.Msg.GetNumber()))
+			return nil
+		},
+	}))
+	server := memhttptest.NewServer(t, mux)
+	for _, protocol := range []struct {
+		name string
+		opts []connect.ClientOption
+	}{
+		{name: "connect"},
+		{name: "grpc", opts: []connect.ClientOption{connect.WithGRPC()}},
+		{name: "grpcweb", opts: []connect.ClientOption{connect.WithGRPCWeb()}},
+	} {
+		protocol := protocol
+		t.Run(protocol.name, func(t *testing.T) {
+			t.Parallel()
+			interceptor := &trailerRecordingInterceptor{key: "X-Rows-Scanned"}
+			client := pingv1connect.NewPingServiceClient(
+				server.Client(),
+				server.URL(),
+				append(protocol.opts, connect.WithInterceptors(interceptor))...,
+			)
+			stream, err := client.CountUp(context.Background(), connect.NewRequest(&pingv1.CountUpRequest{Number: 3}))
+			assert.Nil(t, err)
+			for stream.Receive() {
+			}
+			assert.Nil(t, stream.Err())
+			assert.Equal(t, interceptor.atEOF.Load(), "3")
+			assert.Nil(t, stream.Close())
+			assert.Equal(t, interceptor.atClose.Load(), "3")
+			assert.Equal(t, stream.ResponseTrailer().Get("X-Rows-Scanned"), "3")
+		})
+	}
+}
+
 // headerInterceptor makes it easier to write interceptors that inspect or
 // mutate HTTP headers. It applies the same logic to unary and streaming
 // procedures, wrapping the send or receive side of the stream as appropriate.
@@ -390,3 +437,46 @@ func (h *httpMethodChecker) WrapStreamingHandler(handlerFunc connect.StreamingHa
 		return handlerFunc(ctx, conn)
 	}
 }
+
+// trailerRecordingInterceptor records a response trailer seen by a streaming
+// client interceptor, both when Receive first returns io.EOF and when the
+// response is closed.
+type trailerRecordingInterceptor struct {
+	key     string
+	atEOF   atomic.Value
+	atClose atomic.Value
+}
+
+func (i *trailerRecordingInterceptor) WrapUnary(next connect.UnaryFunc) connect.UnaryFunc {
+	return next
+}
+
+func (i *trailerRecordingInterceptor) WrapStreamingHandler(next connect.StreamingHandlerFunc) connect.StreamingHandlerFunc {
+	return next
+}
+
+func (i *trailerRecordingInterceptor) WrapStreamingClient(next connect.StreamingClientFunc) connect.StreamingClientFunc {
+	return func(ctx context.Context, spec connect.Spec) connect.StreamingClientConn {
+		return &trailerRecordingClientConn{StreamingClientConn: next(ctx, spec), interceptor: i}
+	}
+}
+
+type trailerRecordingClientConn struct {
+	connect.StreamingClientConn
+
+	interceptor *trailerRecordingInterceptor
+}
+
+func (c *trailerRecordingClientConn) Receive(msg any) error {
+	err := c.StreamingClientConn.Receive(msg)
+	if errors.Is(err, io.EOF) {
+		c.interceptor.atEOF.CompareAndSwap(nil, c.ResponseTrailer().Get(c.interceptor.key))
+	}
+	return err
+}
+
+func (c *trailerRecordingClientConn) CloseResponse() error {
+	err := c.StreamingClientConn.CloseResponse()
+	c.interceptor.atClose.CompareAndSwap(nil, c.ResponseTrailer().Get(c.interceptor.key))
+	return err
+}
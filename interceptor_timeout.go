@@ -0,0 +1,253 @@
+// Copyright 2021-2024 The Connect Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package connect
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"runtime/debug"
+	"sync"
+	"time"
+)
+
+// withInterceptorTimeout bounds the time each of the interceptors composed
+// into interceptor may spend on a call. Chains are flattened, so every
+// interceptor supplied by the user gets its own budget.
+func withInterceptorTimeout(interceptor Interceptor, timeout time.Duration) Interceptor {
+	flat := flattenInterceptors(interceptor, nil)
+	timed := make([]Interceptor, len(flat))
+	for i, inner := range flat {
+		timed[i] = &timeoutInterceptor{
+			interceptor: inner,
+			position:    i + 1,
+			timeout:     timeout,
+		}
+	}
+	if len(timed) == 1 {
+		return timed[0]
+	}
+	return newChain(timed)
+}
+
+// flattenInterceptors appends the interceptors composed into interceptor to
+// dst, in the order the user supplied them.
+func flattenInterceptors(interceptor Interceptor, dst []Interceptor) []Interceptor {
+	composed, ok := interceptor.(*chain)
+	if !ok {
+		return append(dst, interceptor)
+	}
+	// Chains store their interceptors in reverse.
+	for i := len(composed.interceptors) - 1; i >= 0; i-- {
+		dst = flattenInterceptors(composed.interceptors[i], dst)
+	}
+	return dst
+}
+
+type interceptorBudgetKey struct{}
+
+// interceptorBudget tracks the time a single interceptor spends on a call.
+// Time spent in the next function, which runs the rest of the chain and the
+// RPC itself, doesn't count against the budget.
+type interceptorBudget struct {
+	mu        sync.Mutex
+	timer     *time.Timer
+	remaining time.Duration
+	resumed   time.Time
+	inNext    int
+	expired   bool
+}
+
+func newInterceptorBudget(timeout time.Duration, onExpire func()) *interceptorBudget {
+	budget := &interceptorBudget{
+		remaining: timeout,
+		resumed:   time.Now(),
+	}
+	budget.timer = time.AfterFunc(timeout, func() {
+		budget.mu.Lock()
+		defer budget.mu.Unlock()
+		if budget.inNext > 0 || budget.expired {
+			return
+		}
+		budget.expired = true
+		onExpire()
+	})
+	return budget
+}
+
+// Pause stops the clock while the interceptor waits on next.
+func (b *interceptorBudget) Pause() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.inNext == 0 {
+		b.timer.Stop()
+		b.remaining -= time.Since(b.resumed)
+	}
+	b.inNext++
+}
+
+// Resume restarts the clock once next returns.
+func (b *interceptorBudget) Resume() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.inNext--
+	if b.inNext == 0 && !b.expired {
+		b.resumed = time.Now()
+		b.timer.Reset(max(b.remaining, 0))
+	}
+}
+
+func (b *interceptorBudget) Stop() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.timer.Stop()
+}
+
+// timeoutInterceptor runs an interceptor in its own goroutine, abandoning it
+// with CodeDeadlineExceeded if it exceeds its budget.
+type timeoutInterceptor struct {
+	interceptor Interceptor
+	position    int // one-based, in the order supplied to WithInterceptors
+	timeout     time.Duration
+}
+
+func (i *timeoutInterceptor) WrapUnary(next UnaryFunc) UnaryFunc {
+	wrapped := i.interceptor.WrapUnary(func(ctx context.Context, request AnyRequest) (AnyResponse, error) {
+		if budget, ok := ctx.Value(interceptorBudgetKey{}).(*interceptorBudget); ok {
+			budget.Pause()
+			defer budget.Resume()
+		}
+		return next(ctx, request)
+	})
+	return func(ctx context.Context, request AnyRequest) (AnyResponse, error) {
+		var (
+			response AnyResponse
+			err      error
+		)
+		cancel, timeoutErr := i.run(ctx, func(ctx context.Context) {
+			response, err = wrapped(ctx, request)
+		})
+		cancel()
+		if timeoutErr != nil {
+			return nil, timeoutErr
+		}
+		return response, err
+	}
+}
+
+func (i *timeoutInterceptor) WrapStreamingClient(next StreamingClientFunc) StreamingClientFunc {
+	wrapped := i.interceptor.WrapStreamingClient(func(ctx context.Context, spec Spec) StreamingClientConn {
+		if budget, ok := ctx.Value(interceptorBudgetKey{}).(*interceptorBudget); ok {
+			budget.Pause()
+			defer budget.Resume()
+		}
+		return next(ctx, spec)
+	})
+	return func(ctx context.Context, spec Spec) StreamingClientConn {
+		var conn StreamingClientConn
+		cancel, timeoutErr := i.run(ctx, func(ctx context.Context) {
+			conn = wrapped(ctx, spec)
+		})
+		if timeoutErr != nil {
+			cancel()
+			return &errorClientConn{spec: spec, header: make(http.Header), err: timeoutErr}
+		}
+		// The stream keeps using the interceptor's context, so release it only
+		// once the stream is closed.
+		return &timeoutClientConn{StreamingClientConn: conn, cancel: cancel}
+	}
+}
+
+func (i *timeoutInterceptor) WrapStreamingHandler(next StreamingHandlerFunc) StreamingHandlerFunc {
+	return i.interceptor.WrapStreamingHandler(next)
+}
+
+// run calls the interceptor in a separate goroutine and waits for it to
+// return, for its budget to expire, or for ctx to be done. It returns a
+// non-nil error only if the interceptor was abandoned. Panics in the
+// interceptor are propagated to the caller as an *interceptorPanic, which
+// keeps the stack trace of the original panic.
+//
+// Streams keep using the interceptor's context after it returns, so it's up to
+// the caller to release the context with the returned cancel func once the
+// call is finished.
+func (i *timeoutInterceptor) run(ctx context.Context, call func(context.Context)) (func(), error) {
+	ctx, cancelCause := context.WithCancelCause(ctx)
+	cancel := func() { cancelCause(nil) }
+	timeoutErr := errorf(
+		CodeDeadlineExceeded,
+		"interceptor %d (%T) exceeded timeout of %v",
+		i.position, i.interceptor, i.timeout,
+	)
+	budget := newInterceptorBudget(i.timeout, func() { cancelCause(timeoutErr) })
+	done := make(chan *interceptorPanic, 1)
+	go func() {
+		defer func() {
+			if panicked := recover(); panicked != nil {
+				done <- &interceptorPanic{value: panicked, stack: debug.Stack()}
+				return
+			}
+			done <- nil
+		}()
+		call(context.WithValue(ctx, interceptorBudgetKey{}, budget))
+	}()
+	select {
+	case panicked := <-done:
+		budget.Stop()
+		if panicked != nil {
+			cancel()
+			panic(panicked) //nolint:forbidigo
+		}
+		return cancel, nil
+	case <-ctx.Done():
+		budget.Stop()
+		if context.Cause(ctx) == error(timeoutErr) {
+			return cancel, timeoutErr
+		}
+		cancel()
+		return cancel, wrapIfContextError(ctx.Err())
+	}
+}
+
+// interceptorPanic carries a panic out of the goroutine running an
+// interceptor. Panicking again on the caller's goroutine loses the original
+// stack trace, so it's recorded alongside the panic's value.
+type interceptorPanic struct {
+	value any
+	stack []byte
+}
+
+func (p *interceptorPanic) Error() string {
+	return fmt.Sprintf("%v [recovered from interceptor]\n\n%s", p.value, p.stack)
+}
+
+func (p *interceptorPanic) Unwrap() error {
+	err, _ := p.value.(error)
+	return err
+}
+
+// timeoutClientConn releases the interceptor's context once the stream is
+// closed.
+type timeoutClientConn struct {
+	StreamingClientConn
+
+	cancel func()
+}
+
+func (c *timeoutClientConn) CloseResponse() error {
+	err := c.StreamingClientConn.CloseResponse()
+	c.cancel()
+	return err
+}
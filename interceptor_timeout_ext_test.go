@@ -0,0 +1,178 @@
+// Copyright 2021-2024 The Connect Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package connect_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	connect "connectrpc.com/connect"
+	"connectrpc.com/connect/internal/assert"
+	pingv1 "connectrpc.com/connect/internal/gen/connect/ping/v1"
+	"connectrpc.com/connect/internal/gen/connect/ping/v1/pingv1connect"
+	"connectrpc.com/connect/internal/memhttp/memhttptest"
+)
+
+func TestInterceptorTimeout(t *testing.T) {
+	t.Parallel()
+	const timeout = 50 * time.Millisecond
+	mux := http.NewServeMux()
+	mux.Handle(pingv1connect.NewPingServiceHandler(&pluggablePingServer{
+		ping: func(ctx context.Context, request *connect.Request[pingv1.PingRequest]) (*connect.Response[pingv1.PingResponse], error) {
+			if request.Msg.GetText() == "slow" {
+				time.Sleep(3 * timeout)
+			}
+			return connect.NewResponse(&pingv1.PingResponse{Number: request.Msg.GetNumber()}), nil
+		},
+		countUp: func(_ context.Context, _ *connect.Request[pingv1.CountUpRequest], stream *connect.ServerStream[pingv1.CountUpResponse]) error {
+			return stream.Send(&pingv1.CountUpResponse{Number: 1})
+		},
+	}))
+	server := memhttptest.NewServer(t, mux)
+	passthrough := connect.UnaryInterceptorFunc(func(next connect.UnaryFunc) connect.UnaryFunc {
+		return next
+	})
+	newClient := func(interceptor connect.Interceptor) pingv1connect.PingServiceClient {
+		return pingv1connect.NewPingServiceClient(
+			server.Client(),
+			server.URL(),
+			connect.WithInterceptorTimeout(timeout),
+			connect.WithInterceptors(passthrough, interceptor),
+		)
+	}
+
+	t.Run("hanging_unary", func(t *testing.T) {
+		t.Parallel()
+		canceled := make(chan struct{})
+		client := newClient(&hangingInterceptor{hang: func(ctx context.Context) {
+			<-ctx.Done()
+			close(canceled)
+		}})
+		start := time.Now()
+		_, err := client.Ping(context.Background(), connect.NewRequest(&pingv1.PingRequest{}))
+		assert.Equal(t, connect.CodeOf(err), connect.CodeDeadlineExceeded)
+		assert.True(t, strings.Contains(err.Error(), "interceptor 2 (*connect_test.hangingInterceptor)"))
+		assert.True(t, time.Since(start) < 10*timeout)
+		select {
+		case <-canceled:
+		case <-time.After(time.Second):
+			t.Fatal("hanging interceptor's context wasn't canceled")
+		}
+	})
+	t.Run("hanging_stream", func(t *testing.T) {
+		t.Parallel()
+		client := newClient(&hangingInterceptor{hang: func(ctx context.Context) {
+			<-ctx.Done()
+		}})
+		stream, err := client.CountUp(context.Background(), connect.NewRequest(&pingv1.CountUpRequest{Number: 1}))
+		assert.Equal(t, connect.CodeOf(err), connect.CodeDeadlineExceeded)
+		assert.Nil(t, stream)
+	})
+	t.Run("slow_rpc", func(t *testing.T) {
+		t.Parallel()
+		client := newClient(&hangingInterceptor{hang: func(context.Context) {}})
+		response, err := client.Ping(
+			context.Background(),
+			connect.NewRequest(&pingv1.PingRequest{Number: 42, Text: "slow"}),
+		)
+		assert.Nil(t, err)
+		assert.Equal(t, response.Msg.GetNumber(), 42)
+		stream, err := client.CountUp(context.Background(), connect.NewRequest(&pingv1.CountUpRequest{Number: 1}))
+		assert.Nil(t, err)
+		assert.True(t, stream.Receive())
+		assert.False(t, stream.Receive())
+		assert.Nil(t, stream.Err())
+	})
+	t.Run("stream_context_released", func(t *testing.T) {
+		t.Parallel()
+		contexts := make(chan context.Context, 1)
+		client := newClient(&hangingInterceptor{hang: func(ctx context.Context) {
+			contexts <- ctx
+		}})
+		stream, err := client.CountUp(context.Background(), connect.NewRequest(&pingv1.CountUpRequest{Number: 1}))
+		assert.Nil(t, err)
+		interceptorCtx := <-contexts
+		assert.True(t, stream.Receive())
+		assert.Nil(t, interceptorCtx.Err())
+		assert.Nil(t, stream.Close())
+		select {
+		case <-interceptorCtx.Done():
+		case <-time.After(time.Second):
+			t.Fatal("interceptor's context wasn't released after the stream closed")
+		}
+	})
+	t.Run("panic", func(t *testing.T) {
+		t.Parallel()
+		errPanic := errors.New("interceptor bug")
+		client := newClient(&hangingInterceptor{hang: func(context.Context) {
+			panic(errPanic)
+		}})
+		panicked := func() (recovered any) {
+			defer func() { recovered = recover() }()
+			_, _ = client.Ping(context.Background(), connect.NewRequest(&pingv1.PingRequest{}))
+			return nil
+		}()
+		err, ok := panicked.(error)
+		assert.True(t, ok, assert.Sprintf("recovered %T", panicked))
+		assert.ErrorIs(t, err, errPanic)
+		// The original goroutine's stack is kept.
+		assert.True(t, strings.Contains(err.Error(), "hangingInterceptor"), assert.Sprintf("error: %v", err))
+	})
+	t.Run("caller_canceled", func(t *testing.T) {
+		t.Parallel()
+		release := make(chan struct{})
+		t.Cleanup(func() { close(release) })
+		client := pingv1connect.NewPingServiceClient(
+			server.Client(),
+			server.URL(),
+			connect.WithInterceptorTimeout(time.Minute),
+			connect.WithInterceptors(&hangingInterceptor{hang: func(context.Context) {
+				<-release // ignores the context entirely
+			}}),
+		)
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		_, err := client.Ping(ctx, connect.NewRequest(&pingv1.PingRequest{}))
+		assert.Equal(t, connect.CodeOf(err), connect.CodeDeadlineExceeded)
+		assert.False(t, strings.Contains(err.Error(), "interceptor"))
+	})
+}
+
+// hangingInterceptor calls hang before continuing with the call.
+type hangingInterceptor struct {
+	hang func(context.Context)
+}
+
+func (i *hangingInterceptor) WrapUnary(next connect.UnaryFunc) connect.UnaryFunc {
+	return func(ctx context.Context, request connect.AnyRequest) (connect.AnyResponse, error) {
+		i.hang(ctx)
+		return next(ctx, request)
+	}
+}
+
+func (i *hangingInterceptor) WrapStreamingClient(next connect.StreamingClientFunc) connect.StreamingClientFunc {
+	return func(ctx context.Context, spec connect.Spec) connect.StreamingClientConn {
+		i.hang(ctx)
+		return next(ctx, spec)
+	}
+}
+
+func (i *hangingInterceptor) WrapStreamingHandler(next connect.StreamingHandlerFunc) connect.StreamingHandlerFunc {
+	return next
+}
@@ -0,0 +1,101 @@
+// Copyright 2021-2024 The Connect Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package connect
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+)
+
+// messageCountTrailer carries the number of messages a handler sent on a
+// server or bidirectional stream.
+const messageCountTrailer = "Connect-Message-Count"
+
+// VerifyMessageCount checks the message count sent by handlers configured
+// with [WithSendMessageCountTrailer] against the number of messages the
+// client received. Call it after the stream's Receive method returns false,
+// passing the stream's response trailers:
+//
+//	var received int
+//	for stream.Receive() {
+//		received++
+//	}
+//	if err := stream.Err(); err != nil {
+//		return err
+//	}
+//	if err := connect.VerifyMessageCount(stream.ResponseTrailer(), received); err != nil {
+//		return err // the stream was truncated
+//	}
+//
+// It returns an error with [CodeDataLoss] if the counts don't match or the
+// trailer is malformed, and nil if the server didn't send a count.
+func VerifyMessageCount(trailer http.Header, received int) error {
+	value := trailer.Get(messageCountTrailer)
+	if value == "" {
+		return nil
+	}
+	sent, err := strconv.Atoi(value)
+	if err != nil || sent < 0 {
+		return errorf(CodeDataLoss, "invalid %s trailer %q", messageCountTrailer, value)
+	}
+	if sent != received {
+		return errorf(CodeDataLoss, "server sent %d messages, received %d", sent, received)
+	}
+	return nil
+}
+
+// messageCountInterceptor sets a trailer with the number of messages each
+// server and bidirectional stream sent.
+type messageCountInterceptor struct{}
+
+func (i *messageCountInterceptor) WrapUnary(next UnaryFunc) UnaryFunc {
+	return next
+}
+
+func (i *messageCountInterceptor) WrapStreamingClient(next StreamingClientFunc) StreamingClientFunc {
+	return next
+}
+
+func (i *messageCountInterceptor) WrapStreamingHandler(next StreamingHandlerFunc) StreamingHandlerFunc {
+	return func(ctx context.Context, conn StreamingHandlerConn) error {
+		if conn.Spec().StreamType&StreamTypeServer == 0 {
+			return next(ctx, conn)
+		}
+		counted := &countingHandlerConn{StreamingHandlerConn: conn}
+		err := next(ctx, counted)
+		conn.ResponseTrailer().Set(messageCountTrailer, strconv.Itoa(counted.sent))
+		return err
+	}
+}
+
+// countingHandlerConn counts the messages sent successfully. Streams don't
+// support concurrent calls to Send, so the count isn't synchronized.
+type countingHandlerConn struct {
+	StreamingHandlerConn
+
+	sent int
+}
+
+func (c *countingHandlerConn) Send(msg any) error {
+	if err := c.StreamingHandlerConn.Send(msg); err != nil {
+		return err
+	}
+	if msg != nil {
+		// Sending nil only flushes the response headers.
+		c.sent++
+	}
+	return nil
+}
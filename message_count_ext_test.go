@@ -0,0 +1,95 @@
+// Copyright 2021-2024 The Connect Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package connect_test
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	connect "connectrpc.com/connect"
+	"connectrpc.com/connect/internal/assert"
+	pingv1 "connectrpc.com/connect/internal/gen/connect/ping/v1"
+	"connectrpc.com/connect/internal/gen/connect/ping/v1/pingv1connect"
+	"connectrpc.com/connect/internal/memhttp/memhttptest"
+)
+
+func TestSendMessageCountTrailer(t *testing.T) {
+	t.Parallel()
+	const number = 5
+	mux := http.NewServeMux()
+	mux.Handle(pingv1connect.NewPingServiceHandler(
+		pingServer{},
+		connect.WithSendMessageCountTrailer(),
+	))
+	server := memhttptest.NewServer(t, mux)
+	uncounted := http.NewServeMux()
+	uncounted.Handle(pingv1connect.NewPingServiceHandler(pingServer{}))
+	uncountedServer := memhttptest.NewServer(t, uncounted)
+	countUp := func(t *testing.T, client pingv1connect.PingServiceClient) (http.Header, int) {
+		t.Helper()
+		stream, err := client.CountUp(context.Background(), connect.NewRequest(&pingv1.CountUpRequest{Number: number}))
+		assert.Nil(t, err)
+		var received int
+		for stream.Receive() {
+			received++
+		}
+		assert.Nil(t, stream.Err())
+		assert.Nil(t, stream.Close())
+		return stream.ResponseTrailer(), received
+	}
+
+	for _, protocol := range []struct {
+		name   string
+		option connect.ClientOption
+	}{
+		{name: "connect", option: connect.WithClientOptions()},
+		{name: "grpc", option: connect.WithGRPC()},
+		{name: "grpcweb", option: connect.WithGRPCWeb()},
+	} {
+		protocol := protocol
+		t.Run(protocol.name, func(t *testing.T) {
+			t.Parallel()
+			client := pingv1connect.NewPingServiceClient(server.Client(), server.URL(), protocol.option)
+			trailer, received := countUp(t, client)
+			assert.Equal(t, received, number)
+			assert.Equal(t, trailer.Get("Connect-Message-Count"), "5")
+			assert.Nil(t, connect.VerifyMessageCount(trailer, received))
+			// A client that lost a message detects the truncation.
+			err := connect.VerifyMessageCount(trailer, received-1)
+			assert.Equal(t, connect.CodeOf(err), connect.CodeDataLoss)
+			assert.Equal(t, err.Error(), "data_loss: server sent 5 messages, received 4")
+		})
+	}
+	t.Run("unary", func(t *testing.T) {
+		t.Parallel()
+		client := pingv1connect.NewPingServiceClient(server.Client(), server.URL())
+		res, err := client.Ping(context.Background(), connect.NewRequest(&pingv1.PingRequest{}))
+		assert.Nil(t, err)
+		assert.Equal(t, res.Trailer().Get("Connect-Message-Count"), "")
+	})
+	t.Run("not_sent", func(t *testing.T) {
+		t.Parallel()
+		client := pingv1connect.NewPingServiceClient(uncountedServer.Client(), uncountedServer.URL())
+		trailer, received := countUp(t, client)
+		assert.Nil(t, connect.VerifyMessageCount(trailer, received-1))
+	})
+	t.Run("malformed", func(t *testing.T) {
+		t.Parallel()
+		trailer := http.Header{"Connect-Message-Count": []string{"many"}}
+		err := connect.VerifyMessageCount(trailer, number)
+		assert.Equal(t, connect.CodeOf(err), connect.CodeDataLoss)
+	})
+}
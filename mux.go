@@ -0,0 +1,140 @@
+// Copyright 2021-2024 The Connect Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package connect
+
+import (
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// A Mux routes requests to handlers by procedure. Like [http.ServeMux], it
+// accepts the paths and handlers returned by generated constructors, but it
+// can also route every procedure sharing a prefix to a single handler. This
+// makes it possible to build transparent proxies and gateways that forward
+// whole packages or services without registering each method.
+//
+// Exact registrations always take precedence over prefixes: a request for
+// "/acme.proxy.v1.FooService/Bar" is routed to the handler registered for
+// that procedure, then to the one registered for "/acme.proxy.v1.FooService/",
+// and only then to the handler with the longest matching prefix. Requests
+// that don't match any registration receive a 404.
+//
+// Requests whose paths aren't clean, because they contain "." or ".."
+// elements or repeated slashes, also receive a 404 without being matched.
+// Otherwise, a path like "/acme.proxy.v1.FooService/../../acme.internal.v1.AdminService/Delete"
+// would match a prefix handler and be forwarded unchanged.
+//
+// A Mux is safe for concurrent use. The zero value is ready to use.
+type Mux struct {
+	mu       sync.RWMutex
+	exact    map[string]http.Handler
+	prefixes []muxPrefix // sorted longest first
+}
+
+type muxPrefix struct {
+	prefix  string
+	handler http.Handler
+}
+
+// NewMux constructs an empty Mux.
+func NewMux() *Mux {
+	return &Mux{}
+}
+
+// Handle registers a handler for a procedure ("/acme.foo.v1.FooService/Bar")
+// or a service ("/acme.foo.v1.FooService/"), as returned by generated
+// handler constructors. Registering the same path twice replaces the
+// previous handler.
+func (m *Mux) Handle(path string, handler http.Handler) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.exact == nil {
+		m.exact = make(map[string]http.Handler)
+	}
+	m.exact[path] = handler
+}
+
+// HandlePrefix registers a handler for every procedure whose fully-qualified
+// name starts with prefix. For example, a prefix of "acme.proxy.v1." routes
+// all procedures of all services in the acme.proxy.v1 package to handler. A
+// leading slash is optional.
+//
+// The handler receives the request unmodified: the full procedure name is
+// available from the request's URL path, and the body hasn't been read or
+// decompressed, so it can be forwarded as-is (for example, with
+// [httputil.ReverseProxy]).
+//
+// [httputil.ReverseProxy]: https://pkg.go.dev/net/http/httputil#ReverseProxy
+func (m *Mux) HandlePrefix(prefix string, handler http.Handler) {
+	if !strings.HasPrefix(prefix, "/") {
+		prefix = "/" + prefix
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i := range m.prefixes {
+		if m.prefixes[i].prefix == prefix {
+			m.prefixes[i].handler = handler
+			return
+		}
+	}
+	m.prefixes = append(m.prefixes, muxPrefix{prefix: prefix, handler: handler})
+	sort.SliceStable(m.prefixes, func(i, j int) bool {
+		return len(m.prefixes[i].prefix) > len(m.prefixes[j].prefix)
+	})
+}
+
+// ServeHTTP implements [http.Handler].
+func (m *Mux) ServeHTTP(responseWriter http.ResponseWriter, request *http.Request) {
+	if handler := m.handler(request.URL.Path); handler != nil {
+		handler.ServeHTTP(responseWriter, request)
+		return
+	}
+	http.NotFound(responseWriter, request)
+}
+
+func (m *Mux) handler(path string) http.Handler {
+	if !isCleanPath(path) {
+		return nil
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if handler, ok := m.exact[path]; ok {
+		return handler
+	}
+	if slash := strings.LastIndexByte(path, '/'); slash > 0 {
+		if handler, ok := m.exact[path[:slash+1]]; ok {
+			return handler
+		}
+	}
+	for _, prefix := range m.prefixes {
+		if strings.HasPrefix(path, prefix.prefix) {
+			return prefix.handler
+		}
+	}
+	return nil
+}
+
+// isCleanPath reports whether p is a rooted path without "." or ".." elements
+// or repeated slashes. A trailing slash is allowed.
+func isCleanPath(p string) bool {
+	cleaned := path.Clean(p)
+	if strings.HasSuffix(p, "/") && cleaned != "/" {
+		cleaned += "/"
+	}
+	return cleaned == p && strings.HasPrefix(p, "/")
+}
@@ -0,0 +1,121 @@
+// Copyright 2021-2024 The Connect Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package connect_test
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+
+	connect "connectrpc.com/connect"
+	"connectrpc.com/connect/internal/assert"
+	pingv1 "connectrpc.com/connect/internal/gen/connect/ping/v1"
+	"connectrpc.com/connect/internal/gen/connect/ping/v1/pingv1connect"
+	"connectrpc.com/connect/internal/memhttp/memhttptest"
+)
+
+//nolint:paralleltest // subtests share the routed log
+func TestMuxPrefix(t *testing.T) {
+	t.Parallel()
+	var (
+		mu     sync.Mutex
+		routed []string
+	)
+	// echo is a minimal transparent handler: it records the procedure and
+	// replies with the raw request body.
+	echo := func(name string) http.Handler {
+		return http.HandlerFunc(func(responseWriter http.ResponseWriter, request *http.Request) {
+			body, err := io.ReadAll(request.Body)
+			if err != nil {
+				http.Error(responseWriter, err.Error(), http.StatusBadRequest)
+				return
+			}
+			mu.Lock()
+			routed = append(routed, name+" "+request.URL.Path)
+			mu.Unlock()
+			responseWriter.Header().Set("Content-Type", request.Header.Get("Content-Type"))
+			_, _ = responseWriter.Write(body)
+		})
+	}
+	mux := connect.NewMux()
+	mux.Handle(pingv1connect.NewPingServiceHandler(pingServer{}))
+	mux.HandlePrefix("connect.ping.v1.", echo("package"))
+	mux.HandlePrefix("/connect.ping.v1.Proxied", echo("service"))
+	server := memhttptest.NewServer(t, mux)
+	call := func(t *testing.T, procedure string) (*connect.Response[pingv1.PingRequest], error) {
+		t.Helper()
+		client := connect.NewClient[pingv1.PingRequest, pingv1.PingRequest](
+			server.Client(),
+			server.URL()+procedure,
+		)
+		return client.CallUnary(context.Background(), connect.NewRequest(&pingv1.PingRequest{Number: 42, Text: "proxied"}))
+	}
+	takeRouted := func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		taken := routed
+		routed = nil
+		return taken
+	}
+
+	t.Run("exact_wins", func(t *testing.T) {
+		client := pingv1connect.NewPingServiceClient(server.Client(), server.URL())
+		response, err := client.Ping(context.Background(), connect.NewRequest(&pingv1.PingRequest{Number: 42}))
+		assert.Nil(t, err)
+		assert.Equal(t, response.Msg.GetNumber(), 42)
+		assert.Equal(t, len(takeRouted()), 0)
+	})
+	t.Run("prefix", func(t *testing.T) {
+		response, err := call(t, "/connect.ping.v1.OtherService/Echo")
+		assert.Nil(t, err)
+		assert.Equal(t, response.Msg.GetNumber(), 42)
+		assert.Equal(t, response.Msg.GetText(), "proxied")
+		assert.Equal(t, takeRouted(), []string{"package /connect.ping.v1.OtherService/Echo"})
+	})
+	t.Run("longest_prefix", func(t *testing.T) {
+		_, err := call(t, "/connect.ping.v1.ProxiedService/Echo")
+		assert.Nil(t, err)
+		assert.Equal(t, takeRouted(), []string{"service /connect.ping.v1.ProxiedService/Echo"})
+	})
+	t.Run("unclean_path", func(t *testing.T) {
+		for _, procedure := range []string{
+			"/connect.ping.v1.OtherService/../../connect.other.v1.AdminService/Delete",
+			"/connect.ping.v1.OtherService/./Echo",
+			"//connect.ping.v1.OtherService/Echo",
+		} {
+			request, err := http.NewRequestWithContext(
+				context.Background(),
+				http.MethodPost,
+				server.URL()+procedure,
+				strings.NewReader("{}"),
+			)
+			assert.Nil(t, err)
+			request.Header.Set("Content-Type", "application/json")
+			response, err := server.Client().Do(request)
+			assert.Nil(t, err)
+			_ = response.Body.Close()
+			assert.Equal(t, response.StatusCode, http.StatusNotFound, assert.Sprintf(procedure))
+		}
+		assert.Equal(t, len(takeRouted()), 0)
+	})
+	t.Run("unmatched", func(t *testing.T) {
+		_, err := call(t, "/connect.other.v1.OtherService/Echo")
+		assert.Equal(t, connect.CodeOf(err), connect.CodeUnimplemented)
+		assert.Equal(t, len(takeRouted()), 0)
+	})
+}
@@ -17,8 +17,12 @@ package connect
 import (
 	"compress/gzip"
 	"context"
+	"crypto/tls"
 	"io"
+	"net"
 	"net/http"
+	"sync"
+	"time"
 )
 
 // A ClientOption configures a [Client].
@@ -52,10 +56,174 @@ func WithAcceptCompression(
 ) ClientOption {
 	return &compressionOption{
 		Name:            name,
-		CompressionPool: newCompressionPool(newDecompressor, newCompressor),
+		CompressionPool: newCompressionPool(name, newDecompressor, newCompressor),
 	}
 }
 
+// WithTLSConfig configures the client to use connect's default HTTP transport
+// with the supplied TLS configuration. The transport is a copy of
+// [http.DefaultTransport], so it keeps the standard library's proxy,
+// keepalive, and timeout settings and negotiates HTTP/2 over TLS. This covers
+// most custom TLS needs, like trusting a private certificate authority or
+// presenting client certificates, without building an [http.Client] by hand.
+//
+// WithTLSConfig is mutually exclusive with a custom HTTPClient: pass nil or
+// [http.DefaultClient] to [NewClient] (or to generated client constructors).
+// Calls made by clients constructed with another HTTPClient fail with
+// [CodeUnknown].
+//
+// Clients constructed with the same option share a connection pool, so
+// passing a single WithTLSConfig to a generated client constructor reuses
+// connections across all of the service's procedures.
+func WithTLSConfig(config *tls.Config) ClientOption {
+	transport := newDefaultTransport()
+	transport.TLSClientConfig = config.Clone()
+	return &tlsConfigOption{
+		Config:     transport.TLSClientConfig,
+		HTTPClient: &http.Client{Transport: transport},
+	}
+}
+
+// WithDialer configures the client to use connect's default HTTP transport
+// (see [WithTLSConfig]) with connections opened by the supplied dialer. This
+// exposes socket-level tuning, like a Control func that sets socket options,
+// without losing the transport's proxy, keepalive, and HTTP/2 settings. The
+// standard library already disables Nagle's algorithm (sets TCP_NODELAY) on
+// the TCP connections it dials, so latency-sensitive clients only need a
+// custom dialer to change other settings.
+//
+// Like WithTLSConfig, WithDialer is mutually exclusive with a custom
+// HTTPClient, and clients constructed with the same option share a connection
+// pool. WithDialer and WithTLSConfig may be combined, in any order, to use a
+// single transport with both the dialer and the TLS configuration.
+func WithDialer(dialer *net.Dialer) ClientOption {
+	transport := newDefaultTransport()
+	transport.DialContext = dialer.DialContext
+	return &dialerOption{
+		Dialer:     dialer,
+		HTTPClient: &http.Client{Transport: transport},
+		withTLS:    make(map[*tlsConfigOption]*http.Client),
+	}
+}
+
+// WithAuthority configures the client to send the supplied authority in the
+// Host header (in HTTP/1.1) or the :authority pseudo-header (in HTTP/2), while
+// still connecting to the host in the URL. This is useful when connecting to a
+// fixed IP address behind an ingress or load balancer that routes requests by
+// virtual host.
+//
+// WithAuthority doesn't change the server name used for TLS: to send a
+// different SNI value or verify the server's certificate against the
+// authority, set ServerName in the client's [tls.Config]. Setting a Host
+// header on an individual request takes precedence over this option.
+func WithAuthority(authority string) ClientOption {
+	return &authorityOption{Authority: authority}
+}
+
+// WithClientMetadata identifies the calling service on every request, so
+// servers can attribute traffic. The name and version are sent in the
+// X-Client-Name and X-Client-Version headers, alongside the default
+// User-Agent. Empty values aren't sent.
+//
+// Headers set on individual requests take precedence: if a request already
+// has a value for either header, the client leaves it untouched.
+func WithClientMetadata(name, version string) ClientOption {
+	return &clientMetadataOption{Name: name, Version: version}
+}
+
+// WithInterceptorTimeout bounds the time each of the client's interceptors may
+// spend on a single call, protecting the client from interceptors that hang
+// (for example, while refreshing an auth token). Time an interceptor spends
+// waiting for the next function, which runs the rest of the chain and the RPC
+// itself, doesn't count against its timeout.
+//
+// If an interceptor exceeds the timeout, the call fails with
+// [CodeDeadlineExceeded] and an error message naming the interceptor's type
+// and position in the chain. The interceptor's context is canceled, but the
+// client doesn't wait for it to return. For streaming calls, only the
+// interceptor's StreamingClientFunc is bounded, not the methods of the
+// connection it returns.
+//
+// Each interceptor runs on its own goroutine. If one panics, the panic is
+// propagated to the caller's goroutine as an error that includes the original
+// value and stack trace; if the value is an error, it's available with
+// [errors.As] and [errors.Is].
+//
+// Setting the timeout to zero, the default, disables it. The timeout applies
+// regardless of whether it's configured before or after [WithInterceptors].
+func WithInterceptorTimeout(timeout time.Duration) ClientOption {
+	return &interceptorTimeoutOption{Timeout: timeout}
+}
+
+// WithResponseHeaderTimeout bounds the time the client waits for response
+// headers after it finishes sending a request, independent of the call's
+// deadline. This detects servers that accept a connection and then hang: if
+// the headers don't arrive in time, the call fails with [CodeUnavailable].
+//
+// The timer starts once the transport has finished writing the request,
+// including its body, so time spent dialing, in the TLS handshake, or
+// uploading a large request doesn't count against it. For client and
+// bidirectional streaming calls, the body is complete only once the client
+// closes its side of the stream, since servers may legitimately delay their
+// headers until they've received every request message. The client learns
+// that the request was written from the WroteRequest hook in
+// [net/http/httptrace], which the standard library's transports and
+// golang.org/x/net/http2 call; with HTTPClients that don't, the timeout has no
+// effect.
+//
+// Setting the timeout to zero, the default, disables it.
+func WithResponseHeaderTimeout(timeout time.Duration) ClientOption {
+	return &responseHeaderTimeoutOption{Timeout: timeout}
+}
+
+// WithTooManyRequestsAsResourceExhausted makes the client report HTTP 429
+// responses that don't carry a Connect or gRPC error, typically sent by proxies
+// and rate limiters in front of the server, with [CodeResourceExhausted]. By
+// default, the client follows the gRPC specification's mapping of HTTP status
+// codes and reports them with [CodeUnavailable], which retry policies usually
+// treat as safe to retry. Errors sent by the server itself are unaffected.
+func WithTooManyRequestsAsResourceExhausted() ClientOption {
+	return &tooManyRequestsAsResourceExhaustedOption{}
+}
+
+// WithEndpointResolver configures the client to call resolve before each call
+// to determine the server's base URL, which is useful when the server's
+// address comes from a service discovery system rather than DNS. The base URL
+// has the same form as the one passed to generated client constructors, for
+// example "https://10.0.0.12:8443", and the procedure path is appended to it;
+// the URL passed to the constructor is then used only to determine the
+// procedure. Errors returned by resolve fail the call with
+// [CodeUnavailable].
+//
+// Connect calls resolve once per call, including once per retry made by an
+// interceptor, and doesn't cache the results: caching and refreshing
+// addresses are the resolver's responsibility. Interceptors observe the
+// procedure's fixed [Peer], since the endpoint is resolved after they run.
+func WithEndpointResolver(resolve func(context.Context) (string, error)) ClientOption {
+	return &endpointResolverOption{Resolve: resolve}
+}
+
+// WithFollowRelocations configures the client to follow relocations sent by
+// servers with [NewRelocationError]: when a unary call fails with a
+// relocation, the client re-issues it to the new location. The client follows
+// at most maxHops relocations per call, returning the last relocation error
+// once it runs out, which guards against relocation loops. Interceptors
+// observe a single call, however many relocations the client follows.
+//
+// Relocations are only followed to the same origin, or to hosts listed in
+// allowedHosts (compared with the URL's host, including any port). The client
+// never follows a relocation from https to http. When a relocation moves the
+// call to a different host than the original, the client doesn't send the
+// Authorization, Cookie, and Proxy-Authorization headers there. Relocations
+// that aren't allowed aren't followed: the call fails with the relocation
+// error.
+//
+// Streaming calls can't be replayed once messages have been sent, so they
+// never follow relocations.
+func WithFollowRelocations(maxHops int, allowedHosts ...string) ClientOption {
+	return &followRelocationsOption{MaxHops: maxHops, Hosts: allowedHosts}
+}
+
 // WithClientOptions composes multiple ClientOptions into one.
 func WithClientOptions(options ...ClientOption) ClientOption {
 	return &clientOptionsOption{options}
@@ -77,7 +245,7 @@ func WithGRPCWeb() ClientOption {
 // lowerCamelCase, zero values are omitted, missing required fields are errors,
 // enums are emitted as strings, etc.
 func WithProtoJSON() ClientOption {
-	return WithCodec(&protoJSONCodec{codecNameJSON})
+	return WithCodec(&protoJSONCodec{name: codecNameJSON})
 }
 
 // WithSendCompression configures the client to use the specified algorithm to
@@ -127,15 +295,67 @@ func WithCompression(
 ) HandlerOption {
 	return &compressionOption{
 		Name:            name,
-		CompressionPool: newCompressionPool(newDecompressor, newCompressor),
+		CompressionPool: newCompressionPool(name, newDecompressor, newCompressor),
 	}
 }
 
+// WithResponseCompressionAlways configures the Handler to compress responses
+// with the first algorithm in the client's accept-encoding list that the
+// handler supports, ignoring the request's own compression. By default,
+// handlers respond with the same compression the client used for the request
+// and only consult the accept-encoding list for uncompressed requests. (Unlike
+// some gRPC servers, handlers compress responses to uncompressed requests by
+// default.) If the client doesn't advertise a supported algorithm, this
+// option has no effect.
+//
+// Responses smaller than the WithCompressMinBytes threshold are still sent
+// uncompressed.
+func WithResponseCompressionAlways() HandlerOption {
+	return &responseCompressionAlwaysOption{}
+}
+
+// WithResponseCompressionPredicate configures the Handler to call compress
+// with each outgoing response message, before compressing it with the
+// negotiated algorithm. If compress returns false, the message is sent
+// uncompressed. This lets a single method mix messages that are already
+// compressed, like images, with messages that compress well. For streaming
+// responses, the decision is made separately for each message, and each
+// message's envelope records whether it's compressed; clients decode streams
+// that mix compressed and uncompressed messages.
+//
+// The predicate can only disable compression: it has no effect if the client
+// and handler haven't negotiated a compression algorithm, and messages smaller
+// than the WithCompressMinBytes threshold are still sent uncompressed.
+func WithResponseCompressionPredicate(compress func(message any) bool) HandlerOption {
+	return &responseCompressionPredicateOption{Compress: compress}
+}
+
 // WithHandlerOptions composes multiple HandlerOptions into one.
 func WithHandlerOptions(options ...HandlerOption) HandlerOption {
 	return &handlerOptionsOption{options}
 }
 
+// SetDefaultHandlerOptions sets options applied to every Handler constructed
+// afterwards, before the options passed to the Handler's constructor. This
+// lets a process establish baseline codecs, compression algorithms, and
+// interceptors in one place rather than repeating them for every handler.
+// Because options passed to constructors are applied later, they can override
+// the defaults; default interceptors wrap any interceptors supplied to the
+// constructor.
+//
+// Defaults are global, mutable state, so use them with care. Handlers capture
+// the defaults when they're constructed, so changing the defaults doesn't
+// affect existing handlers; to avoid confusion, set them once, early in main,
+// before constructing any handlers. Libraries shouldn't call
+// SetDefaultHandlerOptions. Each call replaces the previous defaults, and
+// calling it with no options clears them. SetDefaultHandlerOptions is safe to
+// call concurrently with handler construction.
+func SetDefaultHandlerOptions(options ...HandlerOption) {
+	defaultHandlerOptions.Lock()
+	defer defaultHandlerOptions.Unlock()
+	defaultHandlerOptions.options = append([]HandlerOption(nil), options...)
+}
+
 // WithRecover adds an interceptor that recovers from panics. The supplied
 // function receives the context, [Spec], request headers, and the recovered
 // value (which may be nil). It must return an error to send back to the
@@ -154,6 +374,147 @@ func WithRecover(handle func(context.Context, Spec, http.Header, any) error) Han
 	return WithInterceptors(&recoverHandlerInterceptor{handle: handle})
 }
 
+// WithSendMessageCountTrailer adds an interceptor that sends the number of
+// messages each server and bidirectional stream sent in the
+// Connect-Message-Count trailer, so clients can detect truncated streams
+// with [VerifyMessageCount]. The count includes every message sent by the
+// handler and by interceptors added after this option. It has no effect on
+// unary and client streaming procedures.
+func WithSendMessageCountTrailer() HandlerOption {
+	return WithInterceptors(&messageCountInterceptor{})
+}
+
+// WithErrorCorrelationID tags errors sent to clients with a correlation ID,
+// so that client-side error reports can be joined with server logs. When a
+// handler returns an error, correlationID is called with the call's context;
+// it may return an ID found in the context, like a request ID added by
+// middleware or an earlier interceptor, or generate a new one. The ID is sent
+// in the supplied header (as error metadata, see [Error.Meta]) and, for the
+// Connect protocol, in the correlationId field of the JSON error body.
+//
+// The option is implemented as an interceptor, so correlationID sees values
+// added to the context by interceptors registered before it. Errors returned
+// before interceptors run, like invalid requests, aren't tagged. If
+// correlationID returns an empty string, the error is sent unchanged.
+func WithErrorCorrelationID(header string, correlationID func(context.Context) string) HandlerOption {
+	return WithInterceptors(&correlationIDInterceptor{
+		header:        header,
+		correlationID: correlationID,
+	})
+}
+
+// WithMaxConcurrent limits the number of calls served concurrently. Once the
+// limit is reached, new calls wait for a running call to finish. Calls whose
+// context ends while waiting fail with [CodeCanceled] or
+// [CodeDeadlineExceeded], so pairing this option with client or server
+// timeouts sheds load rather than queueing indefinitely. Use [AdmissionWait]
+// to observe how long a call waited.
+//
+// The limit is shared by every handler constructed with the same option, so
+// passing a single WithMaxConcurrent to a generated service constructor limits
+// the service as a whole. Setting the limit to zero or less disables it.
+//
+// By default, handlers don't limit concurrency.
+func WithMaxConcurrent(limit int) HandlerOption {
+	return &maxConcurrentOption{Limiter: newAdmissionLimiter(limit)}
+}
+
+// WithPerPeerConcurrency limits the number of calls served concurrently for
+// each peer, so that a single client opening many concurrent calls or
+// streams can't starve the others. Calls beyond a peer's limit fail
+// immediately with [CodeResourceExhausted], while other peers proceed. A
+// call's slot is released when the call completes, including when it's
+// canceled or the handler panics. Rejected calls are reported to any
+// [WithRejectionObserver].
+//
+// Peers are identified by the string key returns. If key is nil, peers are
+// identified by the host portion of [Peer].Addr. To identify peers by
+// credentials instead, such as an API key header, supply a function that
+// extracts them from the request headers.
+//
+// Like WithMaxConcurrent, the limits are shared by every handler constructed
+// with the same option. Setting the limit to zero or less disables it, which
+// is the default.
+func WithPerPeerConcurrency(limit int, key func(peer Peer, header http.Header) string) HandlerOption {
+	return &perPeerConcurrencyOption{Limiter: newPeerLimiter(limit, key)}
+}
+
+// WithGlobalBufferBudget caps the total size of messages buffered at once by
+// all the handlers constructed with the same option. Each message a handler
+// receives in an enveloped stream (any streaming call, or any call using the
+// gRPC or gRPC-Web protocols) draws its size from the budget until it's
+// unmarshaled, and each message it sends draws from the budget until the
+// client has accepted the data. Messages that would exceed the remaining
+// budget fail with [CodeResourceExhausted] rather than waiting, so a process
+// serving many concurrent streams sheds load instead of running out of
+// memory.
+//
+// Like WithMaxConcurrent, the budget is shared by every handler constructed
+// with the same option, so passing a single WithGlobalBufferBudget to each of
+// a process's service constructors limits the process as a whole. The budget
+// is coarse: it doesn't account for decompression or for memory allocated by
+// codecs. Setting the budget to zero or less disables it, which is the
+// default.
+func WithGlobalBufferBudget(maxBytes int64) HandlerOption {
+	return &bufferBudgetOption{Budget: newBufferBudget(maxBytes)}
+}
+
+// WithCodecForContentType configures the Handler to accept unary Connect
+// requests with a non-standard Content-Type, decoding them with the named
+// codec. For example, WithCodecForContentType("application/x-protobuf",
+// "proto") lets legacy clients POST binary Protobuf without the standard
+// "application/proto" Content-Type. Responses to such requests echo the
+// aliased Content-Type.
+//
+// The codec must be registered with the handler, either by default or with
+// [WithCodec]; aliases for unregistered codecs are ignored. Aliases don't
+// apply to streaming procedures or to the gRPC and gRPC-Web protocols, which
+// frame messages differently.
+func WithCodecForContentType(contentType, codecName string) HandlerOption {
+	return &codecForContentTypeOption{ContentType: contentType, CodecName: codecName}
+}
+
+// WithRejectionObserver configures the Handler to call observe for each call
+// it rejects before running any interceptors. Interceptors never see these
+// calls, so this is the only way to log or count them. Rejections include the
+// inferred protocol and the request's Content-Type, which helps diagnose
+// clients that can't interoperate with the handler.
+//
+// The observer runs after the response has been written, and must be safe to
+// call concurrently.
+func WithRejectionObserver(observe func(context.Context, *Rejection)) HandlerOption {
+	return &rejectionObserverOption{Observe: observe}
+}
+
+// WithRequestValidator configures the Handler to call validate with each
+// request's headers before reading any of the request body or running any
+// interceptors. If validate returns an error, the Handler responds with it
+// immediately, without reading the body: gRPC-Web clients get a trailers-only
+// response, gRPC clients get the response headers followed immediately by the
+// error in the trailers, and Connect clients get an ordinary error response.
+// The request body is closed rather than drained, so a client uploading a
+// large, invalid request learns of the error promptly instead of sending the
+// whole body first. Rejected calls are reported to any
+// [WithRejectionObserver].
+//
+// Errors that aren't [*Error]s are treated as CodeUnknown. The validator must
+// be safe to call concurrently.
+func WithRequestValidator(validate func(ctx context.Context, spec Spec, header http.Header) error) HandlerOption {
+	return &requestValidatorOption{Validate: validate}
+}
+
+// WithRawRequestBytes configures the Handler to retain a copy of the raw,
+// decompressed bytes of each request message, which interceptors and
+// handlers can retrieve with [RawRequestBytes]. This is useful for verifying
+// signatures over the request body, which must be computed from the bytes on
+// the wire rather than from a re-encoded message.
+//
+// Retaining raw bytes costs an extra copy of each message, so it's disabled
+// by default.
+func WithRawRequestBytes() HandlerOption {
+	return &rawRequestBytesOption{}
+}
+
 // WithRequireConnectProtocolHeader configures the Handler to require requests
 // using the Connect RPC protocol to include the Connect-Protocol-Version
 // header. This ensures that HTTP proxies and net/http middleware can easily
@@ -166,6 +527,53 @@ func WithRequireConnectProtocolHeader() HandlerOption {
 	return &requireConnectProtocolHeaderOption{}
 }
 
+// WithRequireProtocol configures the Handler to accept only the named
+// protocol: [ProtocolConnect], [ProtocolGRPC], or [ProtocolGRPCWeb]. Requests
+// using another protocol are rejected with CodeUnimplemented, written in that
+// protocol's format so clients see a clear error. This is useful for services
+// behind a gateway that only supports a single protocol.
+//
+// Handlers constructed with an unknown protocol reject every request, or
+// panic at construction with [WithConstructValidation].
+func WithRequireProtocol(protocol string) HandlerOption {
+	return &requireProtocolOption{Protocol: protocol}
+}
+
+// WithAllowedCodecs restricts the Handler to requests encoded with the named
+// codecs, rejecting others with CodeUnimplemented. The codecs must also be
+// registered, either by default or with [WithCodec]: WithAllowedCodecs narrows
+// the registered set rather than replacing it. Allowing "json" also allows
+// JSON with an explicit charset.
+//
+// Combined with [WithConditionalHandlerOptions], this lets a service accept
+// JSON for most procedures while restricting performance-sensitive ones to
+// binary Protobuf:
+//
+//	connect.WithConditionalHandlerOptions(func(spec connect.Spec) []connect.HandlerOption {
+//		if spec.StreamType == connect.StreamTypeBidi {
+//			return []connect.HandlerOption{connect.WithAllowedCodecs("proto")}
+//		}
+//		return nil
+//	})
+//
+// Repeated WithAllowedCodecs options replace each other.
+func WithAllowedCodecs(names ...string) HandlerOption {
+	return &allowedCodecsOption{Names: names}
+}
+
+// WithAllowedRequestCompression restricts the Handler to requests compressed
+// with the named algorithms, rejecting others with CodeUnimplemented before
+// decompressing them. Uncompressed requests are always accepted. Like
+// [WithAllowedCodecs], it narrows the compressors registered with
+// [WithCompression] rather than replacing them, and only the allowed names
+// are advertised to clients. Responses may still use any registered
+// compressor the client accepts.
+//
+// Repeated WithAllowedRequestCompression options replace each other.
+func WithAllowedRequestCompression(names ...string) HandlerOption {
+	return &allowedRequestCompressionOption{Names: names}
+}
+
 // WithConditionalHandlerOptions allows procedures in the same service to have
 // different configurations: for example, one procedure may need a much larger
 // WithReadMaxBytes setting than the others.
@@ -230,13 +638,75 @@ func WithCodec(codec Codec) Option {
 	return &codecOption{Codec: codec}
 }
 
+// WithConstructValidation checks the configuration when a client or handler
+// is constructed, and panics if it's unusable, so that mistakes are caught at
+// startup rather than on the first call. For example, a handler whose
+// [WithAllowedCodecs] names no registered codec would otherwise reject every
+// request, and a client without a codec would return the same error from
+// every call.
+//
+// By default, clients report configuration errors from each call, and
+// handlers don't validate their configuration.
+func WithConstructValidation() Option {
+	return &constructValidationOption{}
+}
+
+// WithStrictJSON configures the Handler to reject JSON requests containing
+// fields that aren't in the method's input message schema. By default,
+// handlers ignore unknown fields so that clients and servers aren't forced to
+// use exactly the same version of the schema; that's usually what you want,
+// but it lets typos and stale clients go unnoticed. Strict handlers respond
+// with CodeInvalidArgument and an error naming the offending field.
+//
+// WithStrictJSON is shorthand for WithJSONDiscardUnknown(false). Both set the
+// same configuration, so if a handler is given both options, the one that
+// appears last wins. Like [WithJSONDiscardUnknown], it only applies to the
+// default JSON codecs and doesn't affect binary Protobuf or custom codecs.
+func WithStrictJSON() HandlerOption {
+	return &jsonDiscardUnknownOption{Discard: false}
+}
+
+// WithJSONDiscardUnknown controls whether the default JSON codecs ignore
+// fields that aren't in the message schema. Discarding unknown fields, the
+// default, lets clients and servers evolve their schemas independently, which
+// is useful during migrations. Rejecting them catches client bugs, like typos
+// in field names, early: handlers respond with CodeInvalidArgument and an
+// error naming the offending field. Clients that reject unknown fields fail
+// to decode responses from servers with newer versions of the schema, so
+// strict clients are mostly useful in tests.
+//
+// WithJSONDiscardUnknown applies to the default JSON codecs regardless of
+// where it appears among the options, including the codec configured by
+// [WithProtoJSON]. It doesn't affect binary Protobuf or custom codecs. For
+// handlers, [WithStrictJSON] is equivalent to WithJSONDiscardUnknown(false);
+// if both are used, the one that appears last wins.
+func WithJSONDiscardUnknown(discard bool) Option {
+	return &jsonDiscardUnknownOption{Discard: discard}
+}
+
+// WithPrettyJSON configures the Handler to indent JSON responses to Connect
+// protocol requests that include the "pretty=1" query parameter, which makes
+// responses easier to read in API explorers and other developer tools. Other
+// requests still get compact JSON, so enabling this option doesn't slow down
+// ordinary clients.
+//
+// Pretty-printing only applies to the default JSON codecs. Binary Protobuf
+// responses, gRPC and gRPC-Web responses, and custom codecs registered under
+// the "json" names aren't affected.
+func WithPrettyJSON() HandlerOption {
+	return &prettyJSONOption{}
+}
+
 // WithCompressMinBytes sets a minimum size threshold for compression:
 // regardless of compressor configuration, messages smaller than the configured
 // minimum are sent uncompressed.
 //
-// The default minimum is zero. Setting a minimum compression threshold may
-// improve overall performance, because the CPU cost of compressing very small
-// messages usually isn't worth the small reduction in network I/O.
+// The default minimum is zero, which compresses every message once a
+// compression algorithm has been negotiated, including empty messages. (Empty
+// messages grow slightly when compressed, but peers decode them correctly.)
+// Setting a minimum compression threshold may improve overall performance,
+// because the CPU cost of compressing very small messages usually isn't worth
+// the small reduction in network I/O.
 func WithCompressMinBytes(minBytes int) Option {
 	return &compressMinBytesOption{Min: minBytes}
 }
@@ -258,6 +728,47 @@ func WithReadMaxBytes(maxBytes int) Option {
 	return &readMaxBytesOption{Max: maxBytes}
 }
 
+// WithStreamIdleTimeout aborts streaming calls when the other party hasn't sent
+// a message within the timeout. The timer restarts each time a message is
+// received, so long-lived streams stay open as long as the peer keeps sending,
+// even if only heartbeats. For handlers, WithStreamIdleTimeout applies to client
+// and bidirectional streams. For clients, it applies to server and
+// bidirectional streams. Receiving from an idle stream fails with
+// [CodeDeadlineExceeded], and the stream's context is canceled.
+//
+// The idle timeout is independent of the call's overall deadline. Setting it
+// to zero, the default, disables it.
+func WithStreamIdleTimeout(timeout time.Duration) Option {
+	return &streamIdleTimeoutOption{Timeout: timeout}
+}
+
+// WithReadMaxMessages limits the number of messages the other party can send
+// in a single streaming call. For handlers, WithReadMaxMessages limits the
+// number of messages in client and bidirectional streams. For clients, it
+// limits the number of messages in server and bidirectional streams. Once the
+// limit is exceeded, receiving fails with [CodeResourceExhausted]. Every
+// message counts, including empty ones, so this bounds per-call work even when
+// each message is well under the WithReadMaxBytes limit.
+//
+// Setting WithReadMaxMessages to zero allows any number of messages, which is
+// the default for both clients and handlers.
+func WithReadMaxMessages(maxMessages int) Option {
+	return &readMaxMessagesOption{Max: maxMessages}
+}
+
+// WithReadMaxEmptyMessages limits the number of consecutive empty messages the
+// other party can send in a streaming call. A peer that floods a stream with
+// zero-length frames costs almost nothing to send them but keeps the receiving
+// loop busy; once more than maxEmpty empty messages arrive in a row,
+// receiving fails with [CodeResourceExhausted]. Any non-empty message resets
+// the count, so streams that occasionally send empty messages keep working.
+//
+// Setting WithReadMaxEmptyMessages to zero allows any number of empty
+// messages, which is the default for both clients and handlers.
+func WithReadMaxEmptyMessages(maxEmpty int) Option {
+	return &readMaxEmptyMessagesOption{Max: maxEmpty}
+}
+
 // WithSendMaxBytes prevents sending messages too large for the client/handler
 // to handle without significant performance overhead. For handlers, WithSendMaxBytes
 // limits the size of a message that the handler can respond with. For clients,
@@ -351,7 +862,18 @@ func WithInterceptors(interceptors ...Interceptor) Option {
 	return &interceptorsOption{interceptors}
 }
 
-// WithOptions composes multiple Options into one.
+// WithOptions composes multiple Options into one. The options are applied in
+// order, to clients and handlers alike, so a single WithOptions can define a
+// preset shared by many clients and handlers:
+//
+//	var houseStyle = connect.WithOptions(
+//		connect.WithInterceptors(logging, metrics),
+//		connect.WithCompressMinBytes(1024),
+//		connect.WithReadMaxBytes(4<<20),
+//	)
+//
+// Options supplied after the preset are applied after its options, so they
+// can override its settings.
 func WithOptions(options ...Option) Option {
 	return &optionsOption{options}
 }
@@ -419,6 +941,16 @@ func (o *codecOption) applyToHandler(config *handlerConfig) {
 	config.Codecs[o.Codec.Name()] = o.Codec
 }
 
+type constructValidationOption struct{}
+
+func (o *constructValidationOption) applyToClient(config *clientConfig) {
+	config.ValidateConstruction = true
+}
+
+func (o *constructValidationOption) applyToHandler(config *handlerConfig) {
+	config.ValidateConstruction = true
+}
+
 type compressionOption struct {
 	Name            string
 	CompressionPool *compressionPool
@@ -476,6 +1008,42 @@ func (o *readMaxBytesOption) applyToHandler(config *handlerConfig) {
 	config.ReadMaxBytes = o.Max
 }
 
+type streamIdleTimeoutOption struct {
+	Timeout time.Duration
+}
+
+func (o *streamIdleTimeoutOption) applyToClient(config *clientConfig) {
+	config.StreamIdleTimeout = o.Timeout
+}
+
+func (o *streamIdleTimeoutOption) applyToHandler(config *handlerConfig) {
+	config.StreamIdleTimeout = o.Timeout
+}
+
+type readMaxMessagesOption struct {
+	Max int
+}
+
+func (o *readMaxMessagesOption) applyToClient(config *clientConfig) {
+	config.ReadMaxMessages = o.Max
+}
+
+func (o *readMaxMessagesOption) applyToHandler(config *handlerConfig) {
+	config.ReadMaxMessages = o.Max
+}
+
+type readMaxEmptyMessagesOption struct {
+	Max int
+}
+
+func (o *readMaxEmptyMessagesOption) applyToClient(config *clientConfig) {
+	config.ReadMaxEmpty = o.Max
+}
+
+func (o *readMaxEmptyMessagesOption) applyToHandler(config *handlerConfig) {
+	config.ReadMaxEmpty = o.Max
+}
+
 type sendMaxBytesOption struct {
 	Max int
 }
@@ -498,12 +1066,259 @@ func (o *handlerOptionsOption) applyToHandler(config *handlerConfig) {
 	}
 }
 
+type codecForContentTypeOption struct {
+	ContentType string
+	CodecName   string
+}
+
+func (o *codecForContentTypeOption) applyToHandler(config *handlerConfig) {
+	if config.ContentTypeCodecs == nil {
+		config.ContentTypeCodecs = make(map[string]string)
+	}
+	config.ContentTypeCodecs[canonicalizeContentType(o.ContentType)] = o.CodecName
+}
+
+type endpointResolverOption struct {
+	Resolve func(context.Context) (string, error)
+}
+
+func (o *endpointResolverOption) applyToClient(config *clientConfig) {
+	config.EndpointResolver = o.Resolve
+}
+
+type followRelocationsOption struct {
+	MaxHops int
+	Hosts   []string
+}
+
+func (o *followRelocationsOption) applyToClient(config *clientConfig) {
+	config.MaxRelocations = o.MaxHops
+	config.RelocationHosts = o.Hosts
+}
+
+type authorityOption struct {
+	Authority string
+}
+
+func (o *authorityOption) applyToClient(config *clientConfig) {
+	config.Authority = o.Authority
+}
+
+type clientMetadataOption struct {
+	Name    string
+	Version string
+}
+
+func (o *clientMetadataOption) applyToClient(config *clientConfig) {
+	config.ClientName = o.Name
+	config.ClientVersion = o.Version
+}
+
+type interceptorTimeoutOption struct {
+	Timeout time.Duration
+}
+
+func (o *interceptorTimeoutOption) applyToClient(config *clientConfig) {
+	config.InterceptorTimeout = o.Timeout
+}
+
+type responseHeaderTimeoutOption struct {
+	Timeout time.Duration
+}
+
+func (o *responseHeaderTimeoutOption) applyToClient(config *clientConfig) {
+	config.ResponseHeaderTimeout = o.Timeout
+}
+
+type tooManyRequestsAsResourceExhaustedOption struct{}
+
+func (o *tooManyRequestsAsResourceExhaustedOption) applyToClient(config *clientConfig) {
+	config.TooManyRequestsCode = CodeResourceExhausted
+}
+
+// newDefaultTransport returns a copy of http.DefaultTransport, falling back to
+// a minimal transport if it's been replaced.
+func newDefaultTransport() *http.Transport {
+	if defaultTransport, ok := http.DefaultTransport.(*http.Transport); ok {
+		return defaultTransport.Clone()
+	}
+	return &http.Transport{ForceAttemptHTTP2: true}
+}
+
+type tlsConfigOption struct {
+	Config     *tls.Config
+	HTTPClient *http.Client
+}
+
+func (o *tlsConfigOption) applyToClient(config *clientConfig) {
+	config.TLSConfig = o
+}
+
+type dialerOption struct {
+	Dialer     *net.Dialer
+	HTTPClient *http.Client
+
+	mu      sync.Mutex
+	withTLS map[*tlsConfigOption]*http.Client
+}
+
+func (o *dialerOption) applyToClient(config *clientConfig) {
+	config.Dialer = o
+}
+
+// newTransportClient returns the HTTP client for the transport configured by
+// WithTLSConfig and WithDialer, or nil if neither was used. Clients
+// constructed with the same options share an HTTP client, and so share a
+// connection pool.
+func newTransportClient(tlsConfig *tlsConfigOption, dialer *dialerOption) *http.Client {
+	switch {
+	case tlsConfig == nil && dialer == nil:
+		return nil
+	case dialer == nil:
+		return tlsConfig.HTTPClient
+	case tlsConfig == nil:
+		return dialer.HTTPClient
+	}
+	dialer.mu.Lock()
+	defer dialer.mu.Unlock()
+	if client, ok := dialer.withTLS[tlsConfig]; ok {
+		return client
+	}
+	transport := newDefaultTransport()
+	transport.DialContext = dialer.Dialer.DialContext
+	transport.TLSClientConfig = tlsConfig.Config
+	client := &http.Client{Transport: transport}
+	dialer.withTLS[tlsConfig] = client
+	return client
+}
+
+type rejectionObserverOption struct {
+	Observe func(context.Context, *Rejection)
+}
+
+func (o *rejectionObserverOption) applyToHandler(config *handlerConfig) {
+	config.ObserveRejection = o.Observe
+}
+
+type bufferBudgetOption struct {
+	Budget *bufferBudget
+}
+
+func (o *bufferBudgetOption) applyToHandler(config *handlerConfig) {
+	config.BufferBudget = o.Budget
+}
+
+type maxConcurrentOption struct {
+	Limiter *admissionLimiter
+}
+
+func (o *maxConcurrentOption) applyToHandler(config *handlerConfig) {
+	config.Limiter = o.Limiter
+}
+
+type perPeerConcurrencyOption struct {
+	Limiter *peerLimiter
+}
+
+func (o *perPeerConcurrencyOption) applyToHandler(config *handlerConfig) {
+	config.PeerLimiter = o.Limiter
+}
+
+type responseCompressionAlwaysOption struct{}
+
+func (o *responseCompressionAlwaysOption) applyToHandler(config *handlerConfig) {
+	config.ResponseCompressionAlways = true
+}
+
+type allowedCodecsOption struct {
+	Names []string
+}
+
+func (o *allowedCodecsOption) applyToHandler(config *handlerConfig) {
+	config.AllowedCodecs = make(map[string]struct{}, len(o.Names))
+	for _, name := range o.Names {
+		config.AllowedCodecs[name] = struct{}{}
+	}
+}
+
+type allowedRequestCompressionOption struct {
+	Names []string
+}
+
+func (o *allowedRequestCompressionOption) applyToHandler(config *handlerConfig) {
+	config.AllowedRequestCompression = make(map[string]struct{}, len(o.Names))
+	for _, name := range o.Names {
+		config.AllowedRequestCompression[name] = struct{}{}
+	}
+}
+
+//nolint:gochecknoglobals
+var defaultHandlerOptions struct {
+	sync.RWMutex
+
+	options []HandlerOption
+}
+
+func loadDefaultHandlerOptions() []HandlerOption {
+	defaultHandlerOptions.RLock()
+	defer defaultHandlerOptions.RUnlock()
+	return defaultHandlerOptions.options
+}
+
+type jsonDiscardUnknownOption struct {
+	Discard bool
+}
+
+func (o *jsonDiscardUnknownOption) applyToClient(config *clientConfig) {
+	config.JSONDiscardUnknown = &o.Discard
+}
+
+func (o *jsonDiscardUnknownOption) applyToHandler(config *handlerConfig) {
+	config.JSONDiscardUnknown = &o.Discard
+}
+
+type prettyJSONOption struct{}
+
+func (o *prettyJSONOption) applyToHandler(config *handlerConfig) {
+	config.PrettyJSON = true
+}
+
+type responseCompressionPredicateOption struct {
+	Compress func(any) bool
+}
+
+func (o *responseCompressionPredicateOption) applyToHandler(config *handlerConfig) {
+	config.CompressResponse = o.Compress
+}
+
+type requestValidatorOption struct {
+	Validate func(context.Context, Spec, http.Header) error
+}
+
+func (o *requestValidatorOption) applyToHandler(config *handlerConfig) {
+	config.ValidateRequest = o.Validate
+}
+
+type rawRequestBytesOption struct{}
+
+func (o *rawRequestBytesOption) applyToHandler(config *handlerConfig) {
+	config.RawRequestBytes = true
+}
+
 type requireConnectProtocolHeaderOption struct{}
 
 func (o *requireConnectProtocolHeaderOption) applyToHandler(config *handlerConfig) {
 	config.RequireConnectProtocolHeader = true
 }
 
+type requireProtocolOption struct {
+	Protocol string
+}
+
+func (o *requireProtocolOption) applyToHandler(config *handlerConfig) {
+	config.RequireProtocol = o.Protocol
+}
+
 type idempotencyOption struct {
 	idempotencyLevel IdempotencyLevel
 }
@@ -615,6 +1430,7 @@ func withGzip() Option {
 	return &compressionOption{
 		Name: compressionGzip,
 		CompressionPool: newCompressionPool(
+			compressionGzip,
 			func() Decompressor { return &gzip.Reader{} },
 			func() Compressor { return gzip.NewWriter(io.Discard) },
 		),
@@ -627,8 +1443,8 @@ func withProtoBinaryCodec() Option {
 
 func withProtoJSONCodecs() HandlerOption {
 	return WithHandlerOptions(
-		WithCodec(&protoJSONCodec{codecNameJSON}),
-		WithCodec(&protoJSONCodec{codecNameJSONCharsetUTF8}),
+		WithCodec(&protoJSONCodec{name: codecNameJSON}),
+		WithCodec(&protoJSONCodec{name: codecNameJSONCharsetUTF8}),
 	)
 }
 
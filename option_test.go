@@ -0,0 +1,78 @@
+// Copyright 2021-2024 The Connect Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package connect
+
+import (
+	"context"
+	"testing"
+
+	"connectrpc.com/connect/internal/assert"
+)
+
+func TestWithOptions(t *testing.T) {
+	t.Parallel()
+	var calls []string
+	newInterceptor := func(name string) Interceptor {
+		return UnaryInterceptorFunc(func(next UnaryFunc) UnaryFunc {
+			return func(ctx context.Context, request AnyRequest) (AnyResponse, error) {
+				calls = append(calls, name)
+				return next(ctx, request)
+			}
+		})
+	}
+	preset := WithOptions(
+		WithInterceptors(newInterceptor("first")),
+		WithCompressMinBytes(1024),
+		WithReadMaxBytes(100),
+		WithReadMaxBytes(200), // later options win
+		WithOptions(WithSendMaxBytes(300)),
+	)
+	call := func(t *testing.T, interceptor Interceptor) {
+		t.Helper()
+		assert.NotNil(t, interceptor)
+		unary := interceptor.WrapUnary(func(context.Context, AnyRequest) (AnyResponse, error) {
+			return nil, nil //nolint: nilnil
+		})
+		_, err := unary(context.Background(), NewRequest(&struct{}{}))
+		assert.Nil(t, err)
+	}
+
+	t.Run("client", func(t *testing.T) {
+		calls = nil
+		config, err := newClientConfig("http://localhost/service/method", []ClientOption{
+			preset,
+			WithInterceptors(newInterceptor("second")),
+			WithCompressMinBytes(2048), // overrides the preset
+		})
+		assert.Nil(t, err)
+		assert.Equal(t, config.CompressMinBytes, 2048)
+		assert.Equal(t, config.ReadMaxBytes, 200)
+		assert.Equal(t, config.SendMaxBytes, 300)
+		call(t, config.Interceptor)
+		assert.Equal(t, calls, []string{"first", "second"})
+	})
+	t.Run("handler", func(t *testing.T) {
+		calls = nil
+		config := newHandlerConfig("/service/method", StreamTypeUnary, []HandlerOption{
+			WithInterceptors(newInterceptor("second")),
+			preset,
+		})
+		assert.Equal(t, config.CompressMinBytes, 1024)
+		assert.Equal(t, config.ReadMaxBytes, 200)
+		assert.Equal(t, config.SendMaxBytes, 300)
+		call(t, config.Interceptor)
+		assert.Equal(t, calls, []string{"second", "first"})
+	})
+}
@@ -0,0 +1,80 @@
+// Copyright 2021-2024 The Connect Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package connect
+
+import (
+	"net"
+	"net/http"
+	"sync"
+)
+
+// peerLimiter caps the number of concurrent calls from each peer. Like
+// admissionLimiter, it's shared by all the handlers configured with the same
+// WithPerPeerConcurrency option.
+type peerLimiter struct {
+	limit int
+	key   func(Peer, http.Header) string
+
+	mu     sync.Mutex
+	active map[string]int
+}
+
+func newPeerLimiter(limit int, key func(Peer, http.Header) string) *peerLimiter {
+	if limit <= 0 {
+		return nil
+	}
+	if key == nil {
+		key = peerHost
+	}
+	return &peerLimiter{
+		limit:  limit,
+		key:    key,
+		active: make(map[string]int),
+	}
+}
+
+// Acquire claims a slot for the peer without waiting. On success, it returns
+// the peer's key, which must be passed to Release.
+func (l *peerLimiter) Acquire(peer Peer, header http.Header) (string, error) {
+	key := l.key(peer, header)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.active[key] >= l.limit {
+		return "", errorf(CodeResourceExhausted, "peer exceeded %d concurrent calls", l.limit)
+	}
+	l.active[key]++
+	return key, nil
+}
+
+// Release frees a slot acquired with Acquire.
+func (l *peerLimiter) Release(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.active[key] <= 1 {
+		// Don't let the map grow with every peer ever seen.
+		delete(l.active, key)
+		return
+	}
+	l.active[key]--
+}
+
+// peerHost keys peers by host, so that a client can't evade the limit by
+// opening more connections.
+func peerHost(peer Peer, _ http.Header) string {
+	if host, _, err := net.SplitHostPort(peer.Addr); err == nil {
+		return host
+	}
+	return peer.Addr
+}
@@ -0,0 +1,110 @@
+// Copyright 2021-2024 The Connect Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package connect_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+
+	connect "connectrpc.com/connect"
+	"connectrpc.com/connect/internal/assert"
+	pingv1 "connectrpc.com/connect/internal/gen/connect/ping/v1"
+	"connectrpc.com/connect/internal/gen/connect/ping/v1/pingv1connect"
+	"connectrpc.com/connect/internal/memhttp/memhttptest"
+)
+
+func TestPerPeerConcurrency(t *testing.T) {
+	t.Parallel()
+	const (
+		limit     = 2
+		apiKey    = "Api-Key"
+		textBlock = "block"
+		textPanic = "panic"
+	)
+	started := make(chan struct{}, limit)
+	unblock := make(chan struct{})
+	mux := http.NewServeMux()
+	mux.Handle(pingv1connect.NewPingServiceHandler(
+		&pluggablePingServer{
+			ping: func(ctx context.Context, request *connect.Request[pingv1.PingRequest]) (*connect.Response[pingv1.PingResponse], error) {
+				switch request.Msg.GetText() {
+				case textBlock:
+					started <- struct{}{}
+					select {
+					case <-unblock:
+					case <-ctx.Done():
+						return nil, ctx.Err()
+					}
+				case textPanic:
+					panic(textPanic)
+				}
+				return connect.NewResponse(&pingv1.PingResponse{}), nil
+			},
+		},
+		connect.WithRecover(func(context.Context, connect.Spec, http.Header, any) error {
+			return connect.NewError(connect.CodeInternal, errors.New(textPanic))
+		}),
+		connect.WithPerPeerConcurrency(limit, func(_ connect.Peer, header http.Header) string {
+			return header.Get(apiKey)
+		}),
+	))
+	finished := make(chan struct{}, 16)
+	server := memhttptest.NewServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mux.ServeHTTP(w, r)
+		finished <- struct{}{}
+	}))
+	client := pingv1connect.NewPingServiceClient(server.Client(), server.URL())
+	ping := func(ctx context.Context, peer, text string) error {
+		request := connect.NewRequest(&pingv1.PingRequest{Text: text})
+		request.Header().Set(apiKey, peer)
+		_, err := client.Ping(ctx, request)
+		return err
+	}
+
+	// Fill peer a's slots: one call until it's canceled, one until unblocked.
+	ctx, cancel := context.WithCancel(context.Background())
+	canceled := make(chan error, 1)
+	go func() { canceled <- ping(ctx, "a", textBlock) }()
+	unblocked := make(chan error, 1)
+	go func() { unblocked <- ping(context.Background(), "a", textBlock) }()
+	for i := 0; i < limit; i++ {
+		<-started
+	}
+
+	err := ping(context.Background(), "a", "")
+	assert.Equal(t, connect.CodeOf(err), connect.CodeResourceExhausted)
+	// Other peers proceed.
+	assert.Nil(t, ping(context.Background(), "b", ""))
+	assert.Equal(t, connect.CodeOf(ping(context.Background(), "b", textPanic)), connect.CodeInternal)
+	assert.Nil(t, ping(context.Background(), "b", ""))
+	assert.Nil(t, ping(context.Background(), "b", ""))
+
+	// Canceled and completed calls release their slots.
+	cancel()
+	assert.Equal(t, connect.CodeOf(<-canceled), connect.CodeCanceled)
+	close(unblock)
+	assert.Nil(t, <-unblocked)
+	// Handlers release slots just after the client sees the call end, so wait
+	// for the calls so far (two blocked and one rejected from peer a, and four
+	// from peer b) to finish.
+	for i := 0; i < limit+5; i++ {
+		<-finished
+	}
+	for i := 0; i < limit+1; i++ {
+		assert.Nil(t, ping(context.Background(), "a", ""))
+	}
+}
@@ -24,6 +24,7 @@ import (
 	"net/url"
 	"sort"
 	"strings"
+	"time"
 )
 
 // The names of the Connect, gRPC, and gRPC-Web protocols (as exposed by
@@ -42,6 +43,8 @@ const (
 	headerUserAgent       = "User-Agent"
 	headerTrailer         = "Trailer"
 	headerDate            = "Date"
+	headerClientName      = "X-Client-Name"
+	headerClientVersion   = "X-Client-Version"
 
 	discardLimit = 1024 * 1024 * 4 // 4MiB
 )
@@ -76,10 +79,20 @@ type protocol interface {
 type protocolHandlerParams struct {
 	Spec                         Spec
 	Codecs                       readOnlyCodecs
+	ContentTypeCodecs            map[string]string // aliased Content-Type to codec name
 	CompressionPools             readOnlyCompressionPools
 	CompressMinBytes             int
 	BufferPool                   *bufferPool
 	ReadMaxBytes                 int
+	ReadMaxMessages              int
+	ReadMaxEmpty                 int
+	ResponseCompressionAlways    bool
+	CompressResponse             func(any) bool // nil compresses every response message
+	PrettyJSON                   bool
+	AllowedCodecs                map[string]struct{} // nil allows every registered codec
+	AllowedRequestCompression    map[string]struct{} // nil allows every registered compressor
+	AcceptCompression            string              // advertised request compressors
+	BufferBudget                 *bufferBudget
 	SendMaxBytes                 int
 	RequireConnectProtocolHeader bool
 	IdempotencyLevel             IdempotencyLevel
@@ -88,6 +101,9 @@ type protocolHandlerParams struct {
 // Handler is the server side of a protocol. HTTP handlers typically support
 // multiple protocols, codecs, and compressors.
 type protocolHandler interface {
+	// Protocol is the protocol's name, as exposed by [Peer.Protocol].
+	Protocol() string
+
 	// Methods is the set of HTTP methods the protocol can handle.
 	Methods() map[string]struct{}
 
@@ -108,8 +124,10 @@ type protocolHandler interface {
 	// be concerned with the content type/payload specifically.
 	CanHandlePayload(*http.Request, string) bool
 
-	// NewConn constructs a HandlerConn for the message exchange.
-	NewConn(http.ResponseWriter, *http.Request) (handlerConnCloser, bool)
+	// NewConn constructs a HandlerConn for the message exchange. If it returns
+	// an error, negotiation failed and the error has already been sent to the
+	// client.
+	NewConn(http.ResponseWriter, *http.Request) (handlerConnCloser, error)
 }
 
 // ClientParams are the arguments provided to a Protocol's NewClient method,
@@ -117,23 +135,41 @@ type protocolHandler interface {
 // Protocol implementations should take care to use the supplied Spec rather
 // than constructing their own, since new fields may have been added.
 type protocolClientParams struct {
-	CompressionName  string
-	CompressionPools readOnlyCompressionPools
-	Codec            Codec
-	CompressMinBytes int
-	HTTPClient       HTTPClient
-	URL              *url.URL
-	BufferPool       *bufferPool
-	ReadMaxBytes     int
-	SendMaxBytes     int
-	EnableGet        bool
-	GetURLMaxBytes   int
-	GetUseFallback   bool
+	CompressionName       string
+	CompressionPools      readOnlyCompressionPools
+	Codec                 Codec
+	CompressMinBytes      int
+	HTTPClient            HTTPClient
+	URL                   *url.URL
+	BufferPool            *bufferPool
+	ReadMaxBytes          int
+	ReadMaxMessages       int
+	ReadMaxEmpty          int
+	SendMaxBytes          int
+	EnableGet             bool
+	GetURLMaxBytes        int
+	GetUseFallback        bool
+	Authority             string        // overrides the URL's host in the Host header
+	ClientName            string        // sent in X-Client-Name unless already set
+	ClientVersion         string        // sent in X-Client-Version unless already set
+	ResponseHeaderTimeout time.Duration // zero waits for headers until the call's deadline
+	TooManyRequestsCode   Code          // zero maps bare HTTP 429 responses to CodeUnavailable
 	// The gRPC family of protocols always needs access to a Protobuf codec to
 	// marshal and unmarshal errors.
 	Protobuf Codec
 }
 
+// writeClientMetadata sets the headers configured with WithClientMetadata,
+// leaving any values already in the header untouched.
+func (p *protocolClientParams) writeClientMetadata(header http.Header) {
+	if p.ClientName != "" && getHeaderCanonical(header, headerClientName) == "" {
+		header[headerClientName] = []string{p.ClientName}
+	}
+	if p.ClientVersion != "" && getHeaderCanonical(header, headerClientVersion) == "" {
+		header[headerClientVersion] = []string{p.ClientVersion}
+	}
+}
+
 // Client is the client side of a protocol. HTTP clients typically use a single
 // protocol, codec, and compressor to send requests.
 type protocolClient interface {
@@ -192,6 +228,18 @@ func (hc *errorTranslatingHandlerConnCloser) getHTTPMethod() string {
 	return http.MethodPost
 }
 
+func (hc *errorTranslatingHandlerConnCloser) overrideCompression(override compressionOverride) {
+	if overrider, ok := hc.handlerConnCloser.(compressionOverrider); ok {
+		overrider.overrideCompression(override)
+	}
+}
+
+// compressionOverrider is implemented by handler conns that support
+// Response.SetCompression.
+type compressionOverrider interface {
+	overrideCompression(compressionOverride)
+}
+
 // errorTranslatingClientConn wraps a StreamingClientConn to make sure that we always
 // return coded errors from clients.
 //
@@ -299,9 +347,15 @@ func discard(reader io.Reader) (int64, error) {
 // negotiateCompression determines and validates the request compression and
 // response compression using the available compressors and protocol-specific
 // Content-Encoding and Accept-Encoding headers.
+//
+// By default, responses use the same compression as the request, falling back
+// to the first supported algorithm in accept if the request is uncompressed.
+// If preferAccept is true, the response always uses the first supported
+// algorithm in accept, regardless of the request's compression.
 func negotiateCompression( //nolint:nonamedreturns
 	availableCompressors readOnlyCompressionPools,
 	sent, accept string,
+	preferAccept bool,
 ) (requestCompression, responseCompression string, clientVisibleErr *Error) {
 	requestCompression = compressionIdentity
 	if sent != "" && sent != compressionIdentity {
@@ -328,7 +382,7 @@ func negotiateCompression( //nolint:nonamedreturns
 	responseCompression = requestCompression
 	// If we're not already planning to compress the response, check whether the
 	// client requested a compression algorithm we support.
-	if responseCompression == compressionIdentity && accept != "" {
+	if (responseCompression == compressionIdentity || preferAccept) && accept != "" {
 		for _, name := range strings.FieldsFunc(accept, isCommaOrSpace) {
 			if availableCompressors.Contains(name) {
 				// We found a mutually supported compression algorithm. Unlike standard
@@ -358,6 +412,31 @@ func flushResponseWriter(w http.ResponseWriter) {
 	}
 }
 
+// flushResponse flushes w, returning an error if the client has gone away.
+// Writers that don't support flushing are ignored.
+func flushResponse(ctx context.Context, w http.ResponseWriter) error {
+	err := http.NewResponseController(w).Flush()
+	if err == nil || errors.Is(err, http.ErrNotSupported) {
+		return nil
+	}
+	return wrapIfClientDisconnected(ctx, err)
+}
+
+// protocolFromContentType guesses the protocol a client is using from a
+// canonicalized Content-Type, even if no handler supports it.
+func protocolFromContentType(contentType string) string {
+	switch {
+	case strings.HasPrefix(contentType, grpcWebContentTypeDefault):
+		return ProtocolGRPCWeb
+	case strings.HasPrefix(contentType, grpcContentTypeDefault):
+		return ProtocolGRPC
+	case strings.HasPrefix(contentType, connectUnaryContentTypePrefix):
+		return ProtocolConnect
+	default:
+		return ""
+	}
+}
+
 func canonicalizeContentType(contentType string) string {
 	// Typically, clients send Content-Type in canonical form, without
 	// parameters. In those cases, we'd like to avoid parsing and
@@ -422,3 +501,56 @@ func httpToCode(httpCode int) Code {
 		return CodeUnknown
 	}
 }
+
+// checkRequestCompressionAllowed returns an error if a procedure restricted to
+// the allowed compressors receives a request compressed with a different one.
+// A nil set allows every compressor, and uncompressed requests are always
+// allowed.
+func checkRequestCompressionAllowed(allowed map[string]struct{}, name, accept string) *Error {
+	if allowed == nil || name == "" || name == compressionIdentity {
+		return nil
+	}
+	if _, ok := allowed[name]; ok {
+		return nil
+	}
+	return errorf(
+		CodeUnimplemented,
+		"compression %q not allowed for requests: allowed encodings are %v",
+		name, accept,
+	)
+}
+
+// acceptRequestCompression returns the comma-separated names of the
+// registered compressors that requests may use, in order of preference.
+func acceptRequestCompression(pools readOnlyCompressionPools, allowed map[string]struct{}) string {
+	names := pools.CommaSeparatedNames()
+	if allowed == nil {
+		return names
+	}
+	accepted := make([]string, 0, len(allowed))
+	for _, name := range strings.Split(names, ",") {
+		if _, ok := allowed[name]; ok {
+			accepted = append(accepted, name)
+		}
+	}
+	return strings.Join(accepted, ",")
+}
+
+// checkCodecAllowed returns an error if a procedure restricted to the allowed
+// codecs receives a request encoded with a different one. A nil set allows
+// every codec.
+func checkCodecAllowed(allowed map[string]struct{}, name string) *Error {
+	if allowed == nil {
+		return nil
+	}
+	if _, ok := allowed[name]; ok {
+		return nil
+	}
+	if name == codecNameJSONCharsetUTF8 {
+		// Allowing JSON allows it with an explicit charset, too.
+		if _, ok := allowed[codecNameJSON]; ok {
+			return nil
+		}
+	}
+	return errorf(CodeUnimplemented, "procedure doesn't accept the %q codec", name)
+}
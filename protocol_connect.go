@@ -57,6 +57,7 @@ const (
 	connectUnaryCompressionQueryParameter = "compression"
 	connectUnaryConnectQueryParameter     = "connect"
 	connectUnaryConnectQueryValue         = "v" + connectProtocolVersion
+	connectPrettyQueryParameter           = "pretty"
 )
 
 // defaultConnectUserAgent returns a User-Agent string similar to those used in gRPC.
@@ -83,6 +84,13 @@ func (*protocolConnect) NewHandler(params *protocolHandlerParams) protocolHandle
 		}
 		contentTypes[canonicalizeContentType(connectStreamingContentTypePrefix+name)] = struct{}{}
 	}
+	if params.Spec.StreamType == StreamTypeUnary {
+		for contentType, name := range params.ContentTypeCodecs {
+			if params.Codecs.Get(name) != nil {
+				contentTypes[contentType] = struct{}{}
+			}
+		}
+	}
 
 	return &connectHandler{
 		protocolHandlerParams: *params,
@@ -106,6 +114,10 @@ type connectHandler struct {
 	accept  map[string]struct{}
 }
 
+func (h *connectHandler) Protocol() string {
+	return ProtocolConnect
+}
+
 func (h *connectHandler) Methods() map[string]struct{} {
 	return h.methods
 }
@@ -149,7 +161,7 @@ func (h *connectHandler) CanHandlePayload(request *http.Request, contentType str
 func (h *connectHandler) NewConn(
 	responseWriter http.ResponseWriter,
 	request *http.Request,
-) (handlerConnCloser, bool) {
+) (handlerConnCloser, error) {
 	ctx := request.Context()
 	query := request.URL.Query()
 	// We need to parse metadata before entering the interceptor stack; we'll
@@ -170,6 +182,7 @@ func (h *connectHandler) NewConn(
 		h.CompressionPools,
 		contentEncoding,
 		acceptEncoding,
+		h.ResponseCompressionAlways,
 	)
 	if failed == nil {
 		failed = checkServerStreamsCanFlush(h.Spec, responseWriter)
@@ -202,6 +215,9 @@ func (h *connectHandler) NewConn(
 			h.Spec.StreamType,
 			contentType,
 		)
+		if alias, ok := h.ContentTypeCodecs[contentType]; ok && h.Spec.StreamType == StreamTypeUnary {
+			codecName = alias
+		}
 	}
 
 	codec := h.Codecs.Get(codecName)
@@ -210,6 +226,17 @@ func (h *connectHandler) NewConn(
 	if failed == nil && codec == nil {
 		failed = errorf(CodeInvalidArgument, "invalid message encoding: %q", codecName)
 	}
+	if failed == nil {
+		failed = checkCodecAllowed(h.AllowedCodecs, codecName)
+	}
+	if failed == nil {
+		failed = checkRequestCompressionAllowed(h.AllowedRequestCompression, requestCompression, h.AcceptCompression)
+	}
+	if jsonCodec, ok := codec.(*protoJSONCodec); ok && h.PrettyJSON && query.Get(connectPrettyQueryParameter) == "1" {
+		pretty := *jsonCodec
+		pretty.pretty = true
+		codec = &pretty
+	}
 
 	// Write any remaining headers here:
 	// (1) any writes to the stream will implicitly send the headers, so we
@@ -231,7 +258,7 @@ func (h *connectHandler) NewConn(
 			header[connectStreamingHeaderCompression] = []string{responseCompression}
 		}
 	}
-	header[acceptCompressionHeader] = []string{h.CompressionPools.CommaSeparatedNames()}
+	header[acceptCompressionHeader] = []string{h.AcceptCompression}
 
 	var conn handlerConnCloser
 	peer := Peer{
@@ -247,11 +274,12 @@ func (h *connectHandler) NewConn(
 			responseWriter: responseWriter,
 			marshaler: connectUnaryMarshaler{
 				ctx:              ctx,
-				sender:           writeSender{writer: responseWriter},
+				sender:           writeSender{ctx: ctx, writer: responseWriter},
 				codec:            codec,
 				compressMinBytes: h.CompressMinBytes,
 				compressionName:  responseCompression,
 				compressionPool:  h.CompressionPools.Get(responseCompression),
+				compressMessage:  h.CompressResponse,
 				bufferPool:       h.BufferPool,
 				header:           responseWriter.Header(),
 				sendMaxBytes:     h.SendMaxBytes,
@@ -263,6 +291,7 @@ func (h *connectHandler) NewConn(
 				compressionPool: h.CompressionPools.Get(requestCompression),
 				bufferPool:      h.BufferPool,
 				readMaxBytes:    h.ReadMaxBytes,
+				rawBytes:        rawRequestBytesFromContext(ctx),
 			},
 			responseTrailer: make(http.Header),
 		}
@@ -275,12 +304,14 @@ func (h *connectHandler) NewConn(
 			marshaler: connectStreamingMarshaler{
 				envelopeWriter: envelopeWriter{
 					ctx:              ctx,
-					sender:           writeSender{responseWriter},
+					sender:           writeSender{ctx: ctx, writer: responseWriter},
 					codec:            codec,
 					compressMinBytes: h.CompressMinBytes,
 					compressionPool:  h.CompressionPools.Get(responseCompression),
+					compressMessage:  h.CompressResponse,
 					bufferPool:       h.BufferPool,
 					sendMaxBytes:     h.SendMaxBytes,
+					budget:           h.BufferBudget,
 				},
 			},
 			unmarshaler: connectStreamingUnmarshaler{
@@ -291,6 +322,10 @@ func (h *connectHandler) NewConn(
 					compressionPool: h.CompressionPools.Get(requestCompression),
 					bufferPool:      h.BufferPool,
 					readMaxBytes:    h.ReadMaxBytes,
+					readMaxMessages: h.ReadMaxMessages,
+					readMaxEmpty:    h.ReadMaxEmpty,
+					budget:          h.BufferBudget,
+					rawBytes:        rawRequestBytesFromContext(ctx),
 				},
 			},
 			responseTrailer: make(http.Header),
@@ -301,9 +336,9 @@ func (h *connectHandler) NewConn(
 	if failed != nil {
 		// Negotiation failed, so we can't establish a stream.
 		_ = conn.Close(failed)
-		return nil, false
+		return nil, failed
 	}
-	return conn, true
+	return conn, nil
 }
 
 type connectClient struct {
@@ -322,6 +357,7 @@ func (c *connectClient) WriteRequestHeader(streamType StreamType, header http.He
 	if getHeaderCanonical(header, headerUserAgent) == "" {
 		header[headerUserAgent] = []string{defaultConnectUserAgent}
 	}
+	c.writeClientMetadata(header)
 	header[connectHeaderProtocolVersion] = []string{connectProtocolVersion}
 	header[headerContentType] = []string{
 		connectContentTypeFromCodecName(streamType, c.Codec.Name()),
@@ -361,6 +397,11 @@ func (c *connectClient) NewConn(
 		}
 	}
 	duplexCall := newDuplexHTTPCall(ctx, c.HTTPClient, c.URL, spec, header)
+	if c.Authority != "" {
+		duplexCall.request.Host = c.Authority
+	}
+	duplexCall.tooManyRequestsCode = c.TooManyRequestsCode
+	duplexCall.SetResponseHeaderTimeout(c.ResponseHeaderTimeout)
 	var conn streamingClientConn
 	if spec.StreamType == StreamTypeUnary {
 		unaryConn := &connectUnaryClientConn{
@@ -388,6 +429,7 @@ func (c *connectClient) NewConn(
 				codec:        c.Codec,
 				bufferPool:   c.BufferPool,
 				readMaxBytes: c.ReadMaxBytes,
+				streamBody:   true,
 			},
 			responseHeader:  make(http.Header),
 			responseTrailer: make(http.Header),
@@ -424,11 +466,13 @@ func (c *connectClient) NewConn(
 			},
 			unmarshaler: connectStreamingUnmarshaler{
 				envelopeReader: envelopeReader{
-					ctx:          ctx,
-					reader:       duplexCall,
-					codec:        c.Codec,
-					bufferPool:   c.BufferPool,
-					readMaxBytes: c.ReadMaxBytes,
+					ctx:             ctx,
+					reader:          duplexCall,
+					codec:           c.Codec,
+					bufferPool:      c.BufferPool,
+					readMaxBytes:    c.ReadMaxBytes,
+					readMaxMessages: c.ReadMaxMessages,
+					readMaxEmpty:    c.ReadMaxEmpty,
 				},
 			},
 			responseHeader:  make(http.Header),
@@ -514,6 +558,7 @@ func (cc *connectUnaryClientConn) validateResponse(response *http.Response) *Err
 	if err := connectValidateUnaryResponseContentType(
 		cc.marshaler.codec.Name(),
 		cc.duplexCall.Method(),
+		cc.duplexCall.httpToCode,
 		response.StatusCode,
 		response.Status,
 		getHeaderCanonical(response.Header, headerContentType),
@@ -547,13 +592,13 @@ func (cc *connectUnaryClientConn) validateResponse(response *http.Response) *Err
 		var wireErr connectWireError
 		if err := unmarshaler.UnmarshalFunc(&wireErr, json.Unmarshal); err != nil {
 			return NewError(
-				httpToCode(response.StatusCode),
+				cc.duplexCall.httpToCode(response.StatusCode),
 				errors.New(response.Status),
 			)
 		}
 		if wireErr.Code == 0 {
 			// code not set? default to one implied by HTTP status
-			wireErr.Code = httpToCode(response.StatusCode)
+			wireErr.Code = cc.duplexCall.httpToCode(response.StatusCode)
 		}
 		serverErr := wireErr.asError()
 		if serverErr == nil {
@@ -599,6 +644,7 @@ func (cc *connectStreamingClientConn) RequestHeader() http.Header {
 }
 
 func (cc *connectStreamingClientConn) CloseRequest() error {
+	cc.marshaler.releaseCompressor()
 	return cc.duplexCall.CloseWrite()
 }
 
@@ -655,7 +701,7 @@ func (cc *connectStreamingClientConn) onRequestSend(fn func(*http.Request)) {
 
 func (cc *connectStreamingClientConn) validateResponse(response *http.Response) *Error {
 	if response.StatusCode != http.StatusOK {
-		return errorf(httpToCode(response.StatusCode), "HTTP status %v", response.Status)
+		return errorf(cc.duplexCall.httpToCode(response.StatusCode), "HTTP status %v", response.Status)
 	}
 	if err := connectValidateStreamResponseContentType(
 		cc.codec.Name(),
@@ -757,6 +803,10 @@ func (hc *connectUnaryHandlerConn) getHTTPMethod() string {
 	return hc.request.Method
 }
 
+func (hc *connectUnaryHandlerConn) overrideCompression(override compressionOverride) {
+	hc.marshaler.override = override
+}
+
 func (hc *connectUnaryHandlerConn) mergeResponseHeader(err error) {
 	header := hc.responseWriter.Header()
 	if hc.request.Method == http.MethodGet {
@@ -807,11 +857,13 @@ func (hc *connectStreamingHandlerConn) RequestHeader() http.Header {
 }
 
 func (hc *connectStreamingHandlerConn) Send(msg any) error {
-	defer flushResponseWriter(hc.responseWriter)
 	if err := hc.marshaler.Marshal(msg); err != nil {
+		flushResponseWriter(hc.responseWriter)
 		return err
 	}
-	return nil // must be a literal nil: nil *Error is a non-nil error
+	// Flush errors are the first sign that the client has disconnected, so
+	// report them rather than continuing to buffer messages.
+	return flushResponse(hc.request.Context(), hc.responseWriter)
 }
 
 func (hc *connectStreamingHandlerConn) ResponseHeader() http.Header {
@@ -824,6 +876,7 @@ func (hc *connectStreamingHandlerConn) ResponseTrailer() http.Header {
 
 func (hc *connectStreamingHandlerConn) Close(err error) error {
 	defer flushResponseWriter(hc.responseWriter)
+	defer hc.marshaler.releaseCompressor()
 	if err := hc.marshaler.MarshalEndStream(err, hc.responseTrailer); err != nil {
 		_ = hc.request.Body.Close()
 		return err
@@ -920,6 +973,8 @@ type connectUnaryMarshaler struct {
 	compressMinBytes int
 	compressionName  string
 	compressionPool  *compressionPool
+	compressMessage  func(any) bool // nil compresses every message
+	override         compressionOverride
 	bufferPool       *bufferPool
 	header           http.Header
 	sendMaxBytes     int
@@ -930,6 +985,27 @@ func (m *connectUnaryMarshaler) Marshal(message any) *Error {
 	if message == nil {
 		return m.write(nil)
 	}
+	// Unary calls have just one message, so it's safe to stop compressing
+	// entirely.
+	switch m.override {
+	case compressionOverrideForce:
+		m.compressMinBytes = 0
+	case compressionOverrideSkip:
+		m.compressionPool = nil
+	default:
+		if m.compressMessage != nil && m.compressionPool != nil && !m.compressMessage(message) {
+			m.compressionPool = nil
+		}
+	}
+	if writer, ok := m.codec.(marshalWriter); ok {
+		// Writing directly to the network is only possible if we don't need to
+		// know the message size up front.
+		sender, isWriteSender := m.sender.(writeSender)
+		sizeUnneeded := m.sendMaxBytes <= 0 && (m.compressionPool == nil || m.compressMinBytes <= 0)
+		if isWriteSender && sizeUnneeded {
+			return m.marshalTo(writer, sender.writer, message)
+		}
+	}
 	var data []byte
 	var err error
 	if appender, ok := m.codec.(marshalAppender); ok {
@@ -939,7 +1015,7 @@ func (m *connectUnaryMarshaler) Marshal(message any) *Error {
 		data, err = m.codec.Marshal(message)
 	}
 	if err != nil {
-		return errorf(CodeInternal, "marshal message: %w", err)
+		return errorf(CodeInternal, "marshal message: %w", err).withEncoding(m.codec, m.compressionPool)
 	}
 	uncompressed := bytes.NewBuffer(data)
 	defer m.bufferPool.Put(uncompressed)
@@ -952,7 +1028,7 @@ func (m *connectUnaryMarshaler) Marshal(message any) *Error {
 	compressed := m.bufferPool.Get()
 	defer m.bufferPool.Put(compressed)
 	if err := m.compressionPool.Compress(compressed, uncompressed); err != nil {
-		return err
+		return err.withEncoding(m.codec, m.compressionPool)
 	}
 	if m.sendMaxBytes > 0 && compressed.Len() > m.sendMaxBytes {
 		return NewError(CodeResourceExhausted, fmt.Errorf("compressed message size %d exceeds sendMaxBytes %d", compressed.Len(), m.sendMaxBytes))
@@ -961,6 +1037,49 @@ func (m *connectUnaryMarshaler) Marshal(message any) *Error {
 	return m.write(compressed.Bytes())
 }
 
+func (m *connectUnaryMarshaler) marshalTo(codec marshalWriter, dst io.Writer, message any) *Error {
+	counter := &countingWriter{writer: dst}
+	if m.compressionPool == nil {
+		if err := codec.MarshalTo(counter, message); err != nil {
+			return m.marshalToError(err, counter)
+		}
+		m.wroteHeader = true
+		return nil
+	}
+	setHeaderCanonical(m.header, connectUnaryHeaderCompression, m.compressionName)
+	compressor, err := m.compressionPool.getCompressor(counter)
+	if err != nil {
+		delHeaderCanonical(m.header, connectUnaryHeaderCompression)
+		return errorf(CodeInternal, "get compressor: %w", err).withEncoding(m.codec, m.compressionPool)
+	}
+	if err := codec.MarshalTo(compressor, message); err != nil {
+		// Don't flush a partial message when returning the compressor to the
+		// pool.
+		compressor.Reset(io.Discard)
+		_ = m.compressionPool.putCompressor(compressor)
+		if counter.n == 0 {
+			delHeaderCanonical(m.header, connectUnaryHeaderCompression)
+		}
+		return m.marshalToError(err, counter)
+	}
+	if err := m.compressionPool.putCompressor(compressor); err != nil {
+		m.wroteHeader = counter.n > 0
+		return errorf(CodeInternal, "compress: %w", err).withEncoding(m.codec, m.compressionPool)
+	}
+	m.wroteHeader = true
+	return nil
+}
+
+func (m *connectUnaryMarshaler) marshalToError(err error, counter *countingWriter) *Error {
+	// Once any data has been written, the error can't be sent to the client.
+	m.wroteHeader = counter.n > 0
+	err = wrapIfContextError(err)
+	if connectErr, ok := asError(err); ok {
+		return connectErr
+	}
+	return errorf(CodeInternal, "marshal message: %w", err).withEncoding(m.codec, m.compressionPool)
+}
+
 func (m *connectUnaryMarshaler) write(data []byte) *Error {
 	m.wroteHeader = true
 	payload := bytes.NewReader(data)
@@ -1004,7 +1123,7 @@ func (m *connectUnaryRequestMarshaler) marshalWithGet(message any) *Error {
 	if message != nil {
 		data, err = m.stableCodec.MarshalStable(message)
 		if err != nil {
-			return errorf(CodeInternal, "marshal message stable: %w", err)
+			return errorf(CodeInternal, "marshal message stable: %w", err).withEncoding(m.codec, m.compressionPool)
 		}
 	}
 	isTooBig := m.sendMaxBytes > 0 && len(data) > m.sendMaxBytes
@@ -1038,7 +1157,7 @@ func (m *connectUnaryRequestMarshaler) marshalWithGet(message any) *Error {
 	compressed := m.bufferPool.Get()
 	defer m.bufferPool.Put(compressed)
 	if err := m.compressionPool.Compress(compressed, uncompressed); err != nil {
-		return err
+		return err.withEncoding(m.codec, m.compressionPool)
 	}
 	if m.sendMaxBytes > 0 && compressed.Len() > m.sendMaxBytes {
 		return NewError(CodeResourceExhausted, fmt.Errorf("compressed message size %d exceeds sendMaxBytes %d", compressed.Len(), m.sendMaxBytes))
@@ -1090,12 +1209,70 @@ type connectUnaryUnmarshaler struct {
 	bufferPool      *bufferPool
 	alreadyRead     bool
 	readMaxBytes    int
+	rawBytes        *rawRequestBytes // nil unless retaining raw messages
+	streamBody      bool             // decode directly from reader if the codec supports it
 }
 
 func (u *connectUnaryUnmarshaler) Unmarshal(message any) *Error {
+	if codec, ok := u.codec.(unmarshalReader); ok && u.streamBody && u.rawBytes == nil {
+		return u.unmarshalFrom(codec, message)
+	}
 	return u.UnmarshalFunc(message, u.codec.Unmarshal)
 }
 
+// unmarshalFrom decodes the message directly from the body (decompressing it
+// on the fly, if necessary), so large messages are never buffered in full.
+// Like UnmarshalFunc, it enforces readMaxBytes on both the body and the
+// decompressed message.
+func (u *connectUnaryUnmarshaler) unmarshalFrom(codec unmarshalReader, message any) *Error {
+	if u.alreadyRead {
+		return NewError(CodeInternal, io.EOF)
+	}
+	u.alreadyRead = true
+	body := &meteredReader{reader: u.reader}
+	reader := io.Reader(body)
+	if u.readMaxBytes > 0 && int64(u.readMaxBytes) < math.MaxInt64 {
+		reader = io.LimitReader(body, int64(u.readMaxBytes)+1)
+	}
+	pool := u.compressionPool
+	if pool != nil {
+		// Empty bodies aren't compressed, even if the headers say otherwise.
+		var first [1]byte
+		n, _ := io.ReadFull(reader, first[:])
+		if n == 0 {
+			pool = nil
+		}
+		reader = io.MultiReader(bytes.NewReader(first[:n]), reader)
+	}
+	var failed *Error
+	if pool != nil {
+		failed = pool.DecompressInto(codec, message, reader, int64(u.readMaxBytes))
+	} else if err := codec.UnmarshalFrom(reader, message); err != nil {
+		failed = errorf(CodeInvalidArgument, "unmarshal message: %w", err)
+	}
+	// Codecs may stop reading before EOF, so read the rest of the body to
+	// enforce readMaxBytes and allow connection re-use.
+	_, _ = io.Copy(io.Discard, reader)
+	if u.readMaxBytes > 0 && body.bytesRead > int64(u.readMaxBytes) {
+		discardedBytes, err := io.Copy(io.Discard, u.reader)
+		if err != nil {
+			return errorf(CodeResourceExhausted, "message is larger than configured max %d - unable to determine message size: %w", u.readMaxBytes, err)
+		}
+		return errorf(CodeResourceExhausted, "message size %d is larger than configured max %d", body.bytesRead+discardedBytes, u.readMaxBytes)
+	}
+	if body.err != nil {
+		err := wrapIfContextDone(u.ctx, body.err)
+		if connectErr, ok := asError(err); ok {
+			return connectErr
+		}
+		return errorf(CodeUnknown, "read message: %w", err)
+	}
+	if failed != nil {
+		return failed.withEncoding(u.codec, pool)
+	}
+	return nil
+}
+
 func (u *connectUnaryUnmarshaler) UnmarshalFunc(message any, unmarshal func([]byte, any) error) *Error {
 	if u.alreadyRead {
 		return NewError(CodeInternal, io.EOF)
@@ -1129,12 +1306,13 @@ func (u *connectUnaryUnmarshaler) UnmarshalFunc(message any, unmarshal func([]by
 		decompressed := u.bufferPool.Get()
 		defer u.bufferPool.Put(decompressed)
 		if err := u.compressionPool.Decompress(decompressed, data, int64(u.readMaxBytes)); err != nil {
-			return err
+			return err.withEncoding(u.codec, u.compressionPool)
 		}
 		data = decompressed
 	}
+	u.rawBytes.record(data.Bytes())
 	if err := unmarshal(data.Bytes(), message); err != nil {
-		return errorf(CodeInvalidArgument, "unmarshal message: %w", err)
+		return errorf(CodeInvalidArgument, "unmarshal message: %w", err).withEncoding(u.codec, u.compressionPool)
 	}
 	return nil
 }
@@ -1201,9 +1379,10 @@ func (d *connectWireDetail) getInner() (proto.Message, error) {
 }
 
 type connectWireError struct {
-	Code    Code                 `json:"code"`
-	Message string               `json:"message,omitempty"`
-	Details []*connectWireDetail `json:"details,omitempty"`
+	Code          Code                 `json:"code"`
+	Message       string               `json:"message,omitempty"`
+	CorrelationID string               `json:"correlationId,omitempty"`
+	Details       []*connectWireDetail `json:"details,omitempty"`
 }
 
 func newConnectWireError(err error) *connectWireError {
@@ -1214,6 +1393,7 @@ func newConnectWireError(err error) *connectWireError {
 	if connectErr, ok := asError(err); ok {
 		wire.Code = connectErr.Code()
 		wire.Message = connectErr.Message()
+		wire.CorrelationID = connectErr.correlationID
 		if len(connectErr.details) > 0 {
 			wire.Details = make([]*connectWireDetail, len(connectErr.details))
 			for i, detail := range connectErr.details {
@@ -1350,6 +1530,7 @@ func queryValueReader(data string, base64Encoded bool) io.Reader {
 func connectValidateUnaryResponseContentType(
 	requestCodecName string,
 	httpMethod string,
+	statusToCode func(int) Code,
 	statusCode int,
 	statusMsg string,
 	responseContentType string,
@@ -1364,7 +1545,7 @@ func connectValidateUnaryResponseContentType(
 			return nil
 		}
 		return NewError(
-			httpToCode(statusCode),
+			statusToCode(statusCode),
 			errors.New(statusMsg),
 		)
 	}
@@ -17,11 +17,15 @@ package connect
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"net/http"
 	"strings"
 	"testing"
+	"testing/iotest"
 	"time"
 
 	"connectrpc.com/connect/internal/assert"
@@ -270,6 +274,7 @@ func TestConnectValidateUnaryResponseContentType(t *testing.T) {
 			err := connectValidateUnaryResponseContentType(
 				testCase.codecName,
 				httpMethod,
+				httpToCode,
 				testCase.statusCode,
 				http.StatusText(testCase.statusCode),
 				testCase.responseContentType,
@@ -364,3 +369,102 @@ func TestConnectValidateStreamResponseContentType(t *testing.T) {
 		})
 	}
 }
+
+func TestConnectUnaryUnmarshalFrom(t *testing.T) {
+	t.Parallel()
+	payload := bytes.Repeat([]byte("0123456789abcdef"), 1<<16) // 1 MiB
+	gzip, ok := withGzip().(*compressionOption)
+	assert.True(t, ok)
+	newUnmarshaler := func(codec Codec, body []byte, pool *compressionPool, readMaxBytes int) *connectUnaryUnmarshaler {
+		return &connectUnaryUnmarshaler{
+			ctx:             context.Background(),
+			reader:          bytes.NewReader(body),
+			codec:           codec,
+			compressionPool: pool,
+			bufferPool:      newBufferPool(),
+			readMaxBytes:    readMaxBytes,
+			streamBody:      true,
+		}
+	}
+	t.Run("uncompressed", func(t *testing.T) {
+		t.Parallel()
+		codec := &digestCodec{}
+		var digest [sha256.Size]byte
+		assert.Nil(t, newUnmarshaler(codec, payload, nil, 0).Unmarshal(&digest))
+		assert.Equal(t, digest, sha256.Sum256(payload))
+		assert.Equal(t, codec.streamed, 1)
+	})
+	t.Run("compressed", func(t *testing.T) {
+		t.Parallel()
+		codec := &digestCodec{}
+		var digest [sha256.Size]byte
+		assert.Nil(t, newUnmarshaler(codec, gzipBytes(t, payload), gzip.CompressionPool, 0).Unmarshal(&digest))
+		assert.Equal(t, digest, sha256.Sum256(payload))
+		assert.Equal(t, codec.streamed, 1)
+	})
+	t.Run("empty", func(t *testing.T) {
+		t.Parallel()
+		var digest [sha256.Size]byte
+		assert.Nil(t, newUnmarshaler(&digestCodec{}, nil, gzip.CompressionPool, 0).Unmarshal(&digest))
+		assert.Equal(t, digest, sha256.Sum256(nil))
+	})
+	t.Run("read_max_bytes", func(t *testing.T) {
+		t.Parallel()
+		err := newUnmarshaler(&digestCodec{}, payload, nil, len(payload)-1).Unmarshal(&[sha256.Size]byte{})
+		assert.NotNil(t, err)
+		assert.Equal(t, err.Code(), CodeResourceExhausted)
+		assert.Equal(t, err.Message(), fmt.Sprintf("message size %d is larger than configured max %d", len(payload), len(payload)-1))
+		compressed := gzipBytes(t, payload)
+		err = newUnmarshaler(&digestCodec{}, compressed, gzip.CompressionPool, len(compressed)-1).Unmarshal(&[sha256.Size]byte{})
+		assert.NotNil(t, err)
+		assert.Equal(t, err.Code(), CodeResourceExhausted)
+		err = newUnmarshaler(&digestCodec{}, compressed, gzip.CompressionPool, len(payload)-1).Unmarshal(&[sha256.Size]byte{})
+		assert.NotNil(t, err)
+		assert.Equal(t, err.Code(), CodeResourceExhausted)
+		assert.True(t, strings.Contains(err.Message(), "after gzip decompression"), assert.Sprintf("message: %s", err.Message()))
+		var digest [sha256.Size]byte
+		assert.Nil(t, newUnmarshaler(&digestCodec{}, compressed, gzip.CompressionPool, len(payload)).Unmarshal(&digest))
+		assert.Equal(t, digest, sha256.Sum256(payload))
+	})
+	t.Run("read_error", func(t *testing.T) {
+		t.Parallel()
+		unmarshaler := newUnmarshaler(&digestCodec{}, nil, nil, 0)
+		unmarshaler.reader = io.MultiReader(bytes.NewReader(payload), iotest.ErrReader(errors.New("connection reset")))
+		err := unmarshaler.Unmarshal(&[sha256.Size]byte{})
+		assert.NotNil(t, err)
+		assert.Equal(t, err.Code(), CodeUnknown)
+		assert.True(t, strings.HasPrefix(err.Message(), "read message:"), assert.Sprintf("message: %s", err.Message()))
+	})
+}
+
+func BenchmarkConnectUnaryUnmarshal(b *testing.B) {
+	payload := bytes.Repeat([]byte("0123456789abcdef"), 1<<18) // 4 MiB
+	compressed := gzipBytes(b, payload)
+	gzip, ok := withGzip().(*compressionOption)
+	assert.True(b, ok)
+	for _, codec := range []Codec{bufferedCodec{&digestCodec{}}, &digestCodec{}} {
+		name := "streamed"
+		if _, ok := codec.(bufferedCodec); ok {
+			name = "buffered"
+		}
+		b.Run(name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				// A fresh buffer pool per response, so the benchmark reports the
+				// memory needed to decode one large response.
+				unmarshaler := &connectUnaryUnmarshaler{
+					ctx:             context.Background(),
+					reader:          bytes.NewReader(compressed),
+					codec:           codec,
+					compressionPool: gzip.CompressionPool,
+					bufferPool:      newBufferPool(),
+					streamBody:      true,
+				}
+				var digest [sha256.Size]byte
+				if err := unmarshaler.Unmarshal(&digest); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -116,6 +116,13 @@ type grpcHandler struct {
 	accept map[string]struct{}
 }
 
+func (g *grpcHandler) Protocol() string {
+	if g.web {
+		return ProtocolGRPCWeb
+	}
+	return ProtocolGRPC
+}
+
 func (g *grpcHandler) Methods() map[string]struct{} {
 	return grpcAllowedMethods
 }
@@ -146,7 +153,7 @@ func (g *grpcHandler) CanHandlePayload(_ *http.Request, contentType string) bool
 func (g *grpcHandler) NewConn(
 	responseWriter http.ResponseWriter,
 	request *http.Request,
-) (handlerConnCloser, bool) {
+) (handlerConnCloser, error) {
 	ctx := request.Context()
 	// We need to parse metadata before entering the interceptor stack; we'll
 	// send the error to the client later on.
@@ -154,10 +161,18 @@ func (g *grpcHandler) NewConn(
 		g.CompressionPools,
 		getHeaderCanonical(request.Header, grpcHeaderCompression),
 		getHeaderCanonical(request.Header, grpcHeaderAcceptCompression),
+		g.ResponseCompressionAlways,
 	)
 	if failed == nil {
 		failed = checkServerStreamsCanFlush(g.Spec, responseWriter)
 	}
+	codecName := grpcCodecFromContentType(g.web, getHeaderCanonical(request.Header, headerContentType))
+	if failed == nil {
+		failed = checkCodecAllowed(g.AllowedCodecs, codecName)
+	}
+	if failed == nil {
+		failed = checkRequestCompressionAllowed(g.AllowedRequestCompression, requestCompression, g.AcceptCompression)
+	}
 
 	// Write any remaining headers here:
 	// (1) any writes to the stream will implicitly send the headers, so we
@@ -168,12 +183,11 @@ func (g *grpcHandler) NewConn(
 	// skip the normalization in Header.Set.
 	header := responseWriter.Header()
 	header[headerContentType] = []string{getHeaderCanonical(request.Header, headerContentType)}
-	header[grpcHeaderAcceptCompression] = []string{g.CompressionPools.CommaSeparatedNames()}
+	header[grpcHeaderAcceptCompression] = []string{g.AcceptCompression}
 	if responseCompression != compressionIdentity {
 		header[grpcHeaderCompression] = []string{responseCompression}
 	}
 
-	codecName := grpcCodecFromContentType(g.web, getHeaderCanonical(request.Header, headerContentType))
 	codec := g.Codecs.Get(codecName) // handler.go guarantees this is not nil
 	protocolName := ProtocolGRPC
 	if g.web {
@@ -191,12 +205,14 @@ func (g *grpcHandler) NewConn(
 		marshaler: grpcMarshaler{
 			envelopeWriter: envelopeWriter{
 				ctx:              ctx,
-				sender:           writeSender{writer: responseWriter},
+				sender:           writeSender{ctx: ctx, writer: responseWriter},
 				compressionPool:  g.CompressionPools.Get(responseCompression),
+				compressMessage:  g.CompressResponse,
 				codec:            codec,
 				compressMinBytes: g.CompressMinBytes,
 				bufferPool:       g.BufferPool,
 				sendMaxBytes:     g.SendMaxBytes,
+				budget:           g.BufferBudget,
 			},
 		},
 		responseWriter:  responseWriter,
@@ -211,6 +227,10 @@ func (g *grpcHandler) NewConn(
 				compressionPool: g.CompressionPools.Get(requestCompression),
 				bufferPool:      g.BufferPool,
 				readMaxBytes:    g.ReadMaxBytes,
+				readMaxMessages: g.ReadMaxMessages,
+				readMaxEmpty:    g.ReadMaxEmpty,
+				budget:          g.BufferBudget,
+				rawBytes:        rawRequestBytesFromContext(ctx),
 			},
 			web: g.web,
 		},
@@ -218,9 +238,9 @@ func (g *grpcHandler) NewConn(
 	if failed != nil {
 		// Negotiation failed, so we can't establish a stream.
 		_ = conn.Close(failed)
-		return nil, false
+		return nil, failed
 	}
-	return conn, true
+	return conn, nil
 }
 
 type grpcClient struct {
@@ -247,6 +267,7 @@ func (g *grpcClient) WriteRequestHeader(_ StreamType, header http.Header) {
 		// both.
 		header[headerXUserAgent] = []string{defaultGrpcUserAgent}
 	}
+	g.writeClientMetadata(header)
 	header[headerContentType] = []string{grpcContentTypeFromCodecName(g.web, g.Codec.Name())}
 	// gRPC handles compression on a per-message basis, so we don't want to
 	// compress the whole stream. By default, http.Client will ask the server
@@ -255,9 +276,13 @@ func (g *grpcClient) WriteRequestHeader(_ StreamType, header http.Header) {
 	if g.CompressionName != "" && g.CompressionName != compressionIdentity {
 		header[grpcHeaderCompression] = []string{g.CompressionName}
 	}
-	if acceptCompression := g.CompressionPools.CommaSeparatedNames(); acceptCompression != "" {
-		header[grpcHeaderAcceptCompression] = []string{acceptCompression}
+	// Some strict servers reject requests without Grpc-Accept-Encoding, so we
+	// send it even if we've disabled compression.
+	acceptCompression := g.CompressionPools.CommaSeparatedNames()
+	if acceptCompression == "" {
+		acceptCompression = compressionIdentity
 	}
+	header[grpcHeaderAcceptCompression] = []string{acceptCompression}
 	if !g.web {
 		// The gRPC-HTTP2 specification requires this - it flushes out proxies that
 		// don't support HTTP trailers.
@@ -281,6 +306,11 @@ func (g *grpcClient) NewConn(
 		spec,
 		header,
 	)
+	if g.Authority != "" {
+		duplexCall.request.Host = g.Authority
+	}
+	duplexCall.tooManyRequestsCode = g.TooManyRequestsCode
+	duplexCall.SetResponseHeaderTimeout(g.ResponseHeaderTimeout)
 	conn := &grpcClientConn{
 		spec:             spec,
 		peer:             g.Peer(),
@@ -301,11 +331,13 @@ func (g *grpcClient) NewConn(
 		},
 		unmarshaler: grpcUnmarshaler{
 			envelopeReader: envelopeReader{
-				ctx:          ctx,
-				reader:       duplexCall,
-				codec:        g.Codec,
-				bufferPool:   g.BufferPool,
-				readMaxBytes: g.ReadMaxBytes,
+				ctx:             ctx,
+				reader:          duplexCall,
+				codec:           g.Codec,
+				bufferPool:      g.BufferPool,
+				readMaxBytes:    g.ReadMaxBytes,
+				readMaxMessages: g.ReadMaxMessages,
+				readMaxEmpty:    g.ReadMaxEmpty,
 			},
 		},
 		responseHeader:  make(http.Header),
@@ -362,6 +394,7 @@ func (cc *grpcClientConn) RequestHeader() http.Header {
 }
 
 func (cc *grpcClientConn) CloseRequest() error {
+	cc.marshaler.releaseCompressor()
 	return cc.duplexCall.CloseWrite()
 }
 
@@ -441,6 +474,7 @@ func (cc *grpcClientConn) onRequestSend(fn func(*http.Request)) {
 func (cc *grpcClientConn) validateResponse(response *http.Response) *Error {
 	if err := grpcValidateResponse(
 		response,
+		cc.duplexCall.httpToCode,
 		cc.responseHeader,
 		cc.compressionPools,
 		cc.unmarshaler.web,
@@ -487,16 +521,22 @@ func (hc *grpcHandlerConn) RequestHeader() http.Header {
 	return hc.request.Header
 }
 
+func (hc *grpcHandlerConn) overrideCompression(override compressionOverride) {
+	hc.marshaler.override = override
+}
+
 func (hc *grpcHandlerConn) Send(msg any) error {
-	defer flushResponseWriter(hc.responseWriter)
 	if !hc.wroteToBody {
 		mergeHeaders(hc.responseWriter.Header(), hc.responseHeader)
 		hc.wroteToBody = true
 	}
 	if err := hc.marshaler.Marshal(msg); err != nil {
+		flushResponseWriter(hc.responseWriter)
 		return err
 	}
-	return nil // must be a literal nil: nil *Error is a non-nil error
+	// Flush errors are the first sign that the client has disconnected, so
+	// report them rather than continuing to buffer messages.
+	return flushResponse(hc.request.Context(), hc.responseWriter)
 }
 
 func (hc *grpcHandlerConn) ResponseHeader() http.Header {
@@ -521,6 +561,7 @@ func (hc *grpcHandlerConn) Close(err error) (retErr error) {
 		}
 	}()
 	defer flushResponseWriter(hc.responseWriter)
+	defer hc.marshaler.releaseCompressor()
 	// If we haven't written the headers yet, do so.
 	if !hc.wroteToBody {
 		mergeHeaders(hc.responseWriter.Header(), hc.responseHeader)
@@ -648,13 +689,14 @@ func (u *grpcUnmarshaler) WebTrailer() http.Header {
 
 func grpcValidateResponse(
 	response *http.Response,
+	statusToCode func(int) Code,
 	header http.Header,
 	availableCompressors readOnlyCompressionPools,
 	web bool,
 	codecName string,
 ) *Error {
 	if response.StatusCode != http.StatusOK {
-		return errorf(httpToCode(response.StatusCode), "HTTP status %v", response.Status)
+		return errorf(statusToCode(response.StatusCode), "HTTP status %v", response.Status)
 	}
 	if err := grpcValidateResponseContentType(
 		web,
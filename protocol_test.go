@@ -41,6 +41,40 @@ func TestCanonicalizeContentType(t *testing.T) {
 	}
 }
 
+func TestNegotiateCompression(t *testing.T) {
+	t.Parallel()
+	pool := newCompressionPool(compressionGzip, nil, func() Compressor { return nil })
+	pools := newReadOnlyCompressionPools(
+		map[string]*compressionPool{compressionGzip: pool, "br": pool},
+		[]string{"br", compressionGzip},
+	)
+	tests := []struct {
+		name         string
+		sent         string
+		accept       string
+		preferAccept bool
+		wantRequest  string
+		wantResponse string
+	}{
+		{name: "uncompressed", accept: "br", wantRequest: compressionIdentity, wantResponse: "br"},
+		{name: "no accept", sent: compressionGzip, wantRequest: compressionGzip, wantResponse: compressionGzip},
+		{name: "match request", sent: compressionGzip, accept: "br", wantRequest: compressionGzip, wantResponse: compressionGzip},
+		{name: "prefer accept", sent: compressionGzip, accept: "br", preferAccept: true, wantRequest: compressionGzip, wantResponse: "br"},
+		{name: "prefer unsupported accept", sent: compressionGzip, accept: "zstd", preferAccept: true, wantRequest: compressionGzip, wantResponse: compressionGzip},
+		{name: "prefer accept uncompressed", accept: "zstd, gzip", preferAccept: true, wantRequest: compressionIdentity, wantResponse: compressionGzip},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			request, response, err := negotiateCompression(pools, tt.sent, tt.accept, tt.preferAccept)
+			assert.Nil(t, err)
+			assert.Equal(t, request, tt.wantRequest)
+			assert.Equal(t, response, tt.wantResponse)
+		})
+	}
+}
+
 func BenchmarkCanonicalizeContentType(b *testing.B) {
 	b.Run("simple", func(b *testing.B) {
 		for i := 0; i < b.N; i++ {
@@ -0,0 +1,69 @@
+// Copyright 2021-2024 The Connect Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package connect
+
+import (
+	"bytes"
+	"context"
+)
+
+type rawRequestBytesContextKey struct{}
+
+// RawRequestBytes returns the raw bytes of the message most recently
+// received by a handler configured with [WithRawRequestBytes]. The bytes are
+// exactly what the codec unmarshaled: they've been decompressed, but are
+// otherwise as the client sent them. This makes it possible to verify
+// signatures or HMACs over the canonical request body without re-encoding
+// the decoded message.
+//
+// In unary interceptors, RawRequestBytes returns the request's bytes. In
+// streaming interceptors, call it after each successful Receive to get the
+// bytes of the message just received. The returned slice isn't modified by
+// later calls to Receive.
+//
+// If the option isn't enabled, no message has been received yet, or the
+// context doesn't belong to a handler invocation, RawRequestBytes returns
+// nil.
+func RawRequestBytes(ctx context.Context) []byte {
+	raw, ok := ctx.Value(rawRequestBytesContextKey{}).(*rawRequestBytes)
+	if !ok {
+		return nil
+	}
+	return raw.data
+}
+
+// rawRequestBytes holds a copy of the most recently received message. It's
+// attached to the handler's context when WithRawRequestBytes is enabled, and
+// updated by the unmarshalers.
+type rawRequestBytes struct {
+	data []byte
+}
+
+func rawRequestBytesFromContext(ctx context.Context) *rawRequestBytes {
+	raw, _ := ctx.Value(rawRequestBytesContextKey{}).(*rawRequestBytes)
+	return raw
+}
+
+// record saves a copy of data. It's a no-op on a nil receiver, so
+// unmarshalers can call it unconditionally.
+func (r *rawRequestBytes) record(data []byte) {
+	if r == nil {
+		return
+	}
+	r.data = bytes.Clone(data)
+	if r.data == nil {
+		r.data = []byte{}
+	}
+}
@@ -0,0 +1,92 @@
+// Copyright 2021-2024 The Connect Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package connect
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+)
+
+// relocationHeader carries the full URL of a procedure's new location on
+// errors created by NewRelocationError.
+const relocationHeader = "Connect-Relocated-To"
+
+// NewRelocationError returns an error telling clients that the procedure has
+// moved to url, the full URL of its new location (for example,
+// "https://new.example.com/acme.foo.v1.FooService/Bar"). The error has
+// CodeUnimplemented and carries the URL in the Connect-Relocated-To metadata
+// key, so servers in other languages can send relocations by setting the
+// same header.
+//
+// Clients configured with [WithFollowRelocations] transparently re-issue unary
+// calls to the new location. Other clients see an ordinary CodeUnimplemented
+// error.
+func NewRelocationError(url string) *Error {
+	err := NewError(CodeUnimplemented, fmt.Errorf("procedure relocated to %s", url))
+	err.Meta().Set(relocationHeader, url)
+	return err
+}
+
+// relocate returns a protocol client for the new location named by a
+// relocation error, along with the new URL. It reports false if err isn't a
+// relocation, the new location isn't a valid URL, or the client isn't allowed
+// to follow it from the current URL.
+func (c *Client[Req, Res]) relocate(current *url.URL, err error) (protocolClient, *url.URL, bool) {
+	var connectErr *Error
+	if !errors.As(err, &connectErr) || connectErr.Code() != CodeUnimplemented || connectErr.meta == nil {
+		return nil, nil, false
+	}
+	target := connectErr.meta.Get(relocationHeader)
+	if target == "" {
+		return nil, nil, false
+	}
+	url, urlErr := parseRequestURL(target)
+	if urlErr != nil || !c.relocationAllowed(current, url) {
+		return nil, nil, false
+	}
+	params := c.protocolParams
+	params.URL = url
+	relocated, protocolErr := c.config.Protocol.NewClient(&params)
+	if protocolErr != nil {
+		return nil, nil, false
+	}
+	return relocated, url, true
+}
+
+// relocationAllowed reports whether the client may follow a relocation from
+// one URL to another. Relocations may stay on the same origin or move to one
+// of the hosts allowed by WithFollowRelocations, but never downgrade from
+// https to http.
+func (c *Client[Req, Res]) relocationAllowed(from, to *url.URL) bool {
+	if from.Scheme == "https" && to.Scheme != "https" {
+		return false
+	}
+	if from.Host == to.Host {
+		return from.Scheme == to.Scheme || to.Scheme == "https"
+	}
+	return slices.Contains(c.config.RelocationHosts, to.Host)
+}
+
+// stripCredentials removes the headers that carry credentials, so they're
+// not replayed to a different host. net/http does the same when it follows
+// redirects across domains.
+func stripCredentials(header http.Header) {
+	delete(header, "Authorization")
+	delete(header, "Cookie")
+	delete(header, "Proxy-Authorization")
+}
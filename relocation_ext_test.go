@@ -0,0 +1,184 @@
+// Copyright 2021-2024 The Connect Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package connect_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	connect "connectrpc.com/connect"
+	"connectrpc.com/connect/internal/assert"
+	pingv1 "connectrpc.com/connect/internal/gen/connect/ping/v1"
+	"connectrpc.com/connect/internal/gen/connect/ping/v1/pingv1connect"
+	"connectrpc.com/connect/internal/memhttp/memhttptest"
+)
+
+func TestFollowRelocations(t *testing.T) {
+	t.Parallel()
+	var (
+		baseURL    string
+		loopCalls  atomic.Int64
+		newCallers atomic.Int64
+	)
+	mux := http.NewServeMux()
+	mux.Handle(pingv1connect.NewPingServiceHandler(&pluggablePingServer{
+		ping: func(_ context.Context, request *connect.Request[pingv1.PingRequest]) (*connect.Response[pingv1.PingResponse], error) {
+			if request.Header().Get("X-Caller") != "" {
+				newCallers.Add(1)
+			}
+			return connect.NewResponse(&pingv1.PingResponse{Number: request.Msg.Number}), nil
+		},
+	}))
+	mux.Handle("/legacy"+pingv1connect.PingServicePingProcedure, connect.NewUnaryHandler(
+		"/legacy"+pingv1connect.PingServicePingProcedure,
+		func(context.Context, *connect.Request[pingv1.PingRequest]) (*connect.Response[pingv1.PingResponse], error) {
+			return nil, connect.NewRelocationError(baseURL + pingv1connect.PingServicePingProcedure)
+		},
+	))
+	mux.Handle("/loop"+pingv1connect.PingServicePingProcedure, connect.NewUnaryHandler(
+		"/loop"+pingv1connect.PingServicePingProcedure,
+		func(context.Context, *connect.Request[pingv1.PingRequest]) (*connect.Response[pingv1.PingResponse], error) {
+			loopCalls.Add(1)
+			return nil, connect.NewRelocationError(baseURL + "/loop" + pingv1connect.PingServicePingProcedure)
+		},
+	))
+	server := memhttptest.NewServer(t, mux)
+	baseURL = server.URL()
+	ping := func(prefix string, options ...connect.ClientOption) (*connect.Response[pingv1.PingResponse], error) {
+		client := pingv1connect.NewPingServiceClient(server.Client(), server.URL()+prefix, options...)
+		request := connect.NewRequest(&pingv1.PingRequest{Number: 42})
+		request.Header().Set("X-Caller", "test")
+		return client.Ping(context.Background(), request)
+	}
+
+	t.Run("disabled", func(t *testing.T) {
+		t.Parallel()
+		_, err := ping("/legacy")
+		assert.Equal(t, connect.CodeOf(err), connect.CodeUnimplemented)
+		var connectErr *connect.Error
+		assert.True(t, errors.As(err, &connectErr))
+		assert.Equal(t, connectErr.Meta().Get("Connect-Relocated-To"), baseURL+pingv1connect.PingServicePingProcedure)
+	})
+	for _, protocol := range []struct {
+		name   string
+		option connect.ClientOption
+	}{
+		{name: "connect", option: connect.WithClientOptions()},
+		{name: "grpc", option: connect.WithGRPC()},
+		{name: "grpcweb", option: connect.WithGRPCWeb()},
+	} {
+		protocol := protocol
+		t.Run(protocol.name, func(t *testing.T) {
+			t.Parallel()
+			res, err := ping("/legacy", protocol.option, connect.WithFollowRelocations(1))
+			assert.Nil(t, err)
+			assert.Equal(t, res.Msg.Number, 42)
+		})
+	}
+	t.Run("loop", func(t *testing.T) {
+		t.Parallel()
+		_, err := ping("/loop", connect.WithFollowRelocations(2))
+		assert.Equal(t, connect.CodeOf(err), connect.CodeUnimplemented)
+		assert.Equal(t, loopCalls.Load(), 3)
+	})
+	t.Cleanup(func() {
+		// Every followed relocation kept the caller's headers.
+		assert.Equal(t, newCallers.Load(), 3)
+	})
+}
+
+func TestFollowRelocationsAcrossHosts(t *testing.T) {
+	t.Parallel()
+	// The in-memory server answers for any host, so the relocation target
+	// host is only a name.
+	const otherHost = "relocated.example.com"
+	var credentials atomic.Int64
+	mux := http.NewServeMux()
+	mux.Handle(pingv1connect.NewPingServiceHandler(&pluggablePingServer{
+		ping: func(_ context.Context, request *connect.Request[pingv1.PingRequest]) (*connect.Response[pingv1.PingResponse], error) {
+			for _, key := range []string{"Authorization", "Cookie", "Proxy-Authorization"} {
+				if request.Header().Get(key) != "" {
+					credentials.Add(1)
+				}
+			}
+			return connect.NewResponse(&pingv1.PingResponse{Number: request.Msg.Number}), nil
+		},
+	}))
+	relocateTo := func(target string) http.Handler {
+		return connect.NewUnaryHandler(
+			pingv1connect.PingServicePingProcedure,
+			func(context.Context, *connect.Request[pingv1.PingRequest]) (*connect.Response[pingv1.PingResponse], error) {
+				return nil, connect.NewRelocationError(target)
+			},
+		)
+	}
+	mux.Handle("/cross"+pingv1connect.PingServicePingProcedure, relocateTo("http://"+otherHost+pingv1connect.PingServicePingProcedure))
+	mux.Handle("/downgrade"+pingv1connect.PingServicePingProcedure, relocateTo("http://"+otherHost+pingv1connect.PingServicePingProcedure))
+	server := memhttptest.NewServer(t, mux)
+	ping := func(t *testing.T, baseURL string, options ...connect.ClientOption) error {
+		t.Helper()
+		client := pingv1connect.NewPingServiceClient(server.Client(), baseURL, options...)
+		request := connect.NewRequest(&pingv1.PingRequest{Number: 42})
+		request.Header().Set("Authorization", "Bearer secret")
+		request.Header().Set("Cookie", "session=secret")
+		request.Header().Set("Proxy-Authorization", "Basic secret")
+		_, err := client.Ping(context.Background(), request)
+		return err
+	}
+
+	t.Run("refused", func(t *testing.T) {
+		t.Parallel()
+		err := ping(t, server.URL()+"/cross", connect.WithFollowRelocations(1))
+		assert.Equal(t, connect.CodeOf(err), connect.CodeUnimplemented)
+		assert.True(t, strings.Contains(err.Error(), "procedure relocated to"), assert.Sprintf("error: %v", err))
+	})
+	t.Run("allowed_host", func(t *testing.T) {
+		t.Parallel()
+		err := ping(t, server.URL()+"/cross", connect.WithFollowRelocations(1, otherHost))
+		assert.Nil(t, err)
+	})
+	t.Run("https_downgrade", func(t *testing.T) {
+		t.Parallel()
+		// The client's URL is https, but the transport dials the in-memory
+		// server in plaintext, so the first call still reaches it.
+		client := pingv1connect.NewPingServiceClient(
+			&http.Client{Transport: &schemeRewritingTransport{base: server.Transport()}},
+			"https://"+strings.TrimPrefix(server.URL(), "http://")+"/downgrade",
+			connect.WithFollowRelocations(1, otherHost),
+		)
+		_, err := client.Ping(context.Background(), connect.NewRequest(&pingv1.PingRequest{}))
+		assert.Equal(t, connect.CodeOf(err), connect.CodeUnimplemented)
+		assert.True(t, strings.Contains(err.Error(), "procedure relocated to"), assert.Sprintf("error: %v", err))
+	})
+	t.Cleanup(func() {
+		// Credentials never reached the other host.
+		assert.Equal(t, credentials.Load(), 0)
+	})
+}
+
+// schemeRewritingTransport sends https requests over plaintext HTTP.
+type schemeRewritingTransport struct {
+	base http.RoundTripper
+}
+
+func (t *schemeRewritingTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	request = request.Clone(request.Context())
+	request.URL.Scheme = "http"
+	return t.base.RoundTrip(request)
+}
@@ -0,0 +1,155 @@
+// Copyright 2021-2024 The Connect Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package connect
+
+import (
+	"context"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/anypb"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+// retryInfoTypeName is the fully-qualified name of google.rpc.RetryInfo, the
+// standard error detail for retry hints. We encode it by hand rather than
+// depending on the generated googleapis types.
+const retryInfoTypeName = "google.rpc.RetryInfo"
+
+// NewRetryHintInterceptor constructs a handler interceptor that tells clients
+// how long to wait before retrying transient failures. When a handler returns
+// an error with [CodeUnavailable] or [CodeResourceExhausted], the interceptor
+// calls delay with the error; if delay returns true, it attaches a
+// google.rpc.RetryInfo detail with the returned delay to the error. Details
+// are sent to clients by every protocol, so clients using any protocol (and
+// any gRPC or Connect implementation that understands RetryInfo) receive the
+// hint. Go clients can read it with [RetryDelay].
+//
+// Errors that already carry a RetryInfo detail are left unchanged. The
+// interceptor has no effect on clients.
+func NewRetryHintInterceptor(delay func(err error) (time.Duration, bool)) Interceptor {
+	return &retryHintInterceptor{delay: delay}
+}
+
+// RetryDelay returns the delay from the google.rpc.RetryInfo detail attached
+// to err, if any. It reports false if err isn't an [*Error] or doesn't have a
+// valid RetryInfo detail.
+func RetryDelay(err error) (time.Duration, bool) {
+	connectErr, ok := asError(err)
+	if !ok {
+		return 0, false
+	}
+	for _, detail := range connectErr.Details() {
+		if detail.Type() != retryInfoTypeName {
+			continue
+		}
+		if delay, ok := unmarshalRetryInfo(detail.Bytes()); ok {
+			return delay, true
+		}
+	}
+	return 0, false
+}
+
+type retryHintInterceptor struct {
+	delay func(error) (time.Duration, bool)
+}
+
+func (i *retryHintInterceptor) WrapUnary(next UnaryFunc) UnaryFunc {
+	return func(ctx context.Context, request AnyRequest) (AnyResponse, error) {
+		response, err := next(ctx, request)
+		if err != nil && !request.Spec().IsClient {
+			err = i.addHint(err)
+		}
+		return response, err
+	}
+}
+
+func (i *retryHintInterceptor) WrapStreamingClient(next StreamingClientFunc) StreamingClientFunc {
+	return next
+}
+
+func (i *retryHintInterceptor) WrapStreamingHandler(next StreamingHandlerFunc) StreamingHandlerFunc {
+	return func(ctx context.Context, conn StreamingHandlerConn) error {
+		err := next(ctx, conn)
+		if err != nil {
+			err = i.addHint(err)
+		}
+		return err
+	}
+}
+
+func (i *retryHintInterceptor) addHint(err error) error {
+	connectErr, ok := asError(err)
+	if !ok {
+		return err
+	}
+	if code := connectErr.Code(); code != CodeUnavailable && code != CodeResourceExhausted {
+		return err
+	}
+	if _, ok := RetryDelay(connectErr); ok {
+		return err
+	}
+	delay, ok := i.delay(err)
+	if !ok {
+		return err
+	}
+	clone := connectErr.clone()
+	clone.AddDetail(newRetryInfoDetail(delay))
+	return clone
+}
+
+func newRetryInfoDetail(delay time.Duration) *ErrorDetail {
+	// RetryInfo has a single field: google.protobuf.Duration retry_delay = 1.
+	duration, _ := proto.Marshal(durationpb.New(delay))
+	value := protowire.AppendTag(nil, 1, protowire.BytesType)
+	value = protowire.AppendBytes(value, duration)
+	return &ErrorDetail{pbAny: &anypb.Any{
+		TypeUrl: defaultAnyResolverPrefix + retryInfoTypeName,
+		Value:   value,
+	}}
+}
+
+func unmarshalRetryInfo(value []byte) (time.Duration, bool) {
+	var duration *durationpb.Duration
+	for len(value) > 0 {
+		number, typ, n := protowire.ConsumeTag(value)
+		if n < 0 {
+			return 0, false
+		}
+		value = value[n:]
+		if number == 1 && typ == protowire.BytesType {
+			field, n := protowire.ConsumeBytes(value)
+			if n < 0 {
+				return 0, false
+			}
+			value = value[n:]
+			duration = &durationpb.Duration{}
+			if err := proto.Unmarshal(field, duration); err != nil {
+				return 0, false
+			}
+			continue
+		}
+		n = protowire.ConsumeFieldValue(number, typ, value)
+		if n < 0 {
+			return 0, false
+		}
+		value = value[n:]
+	}
+	if duration == nil || duration.CheckValid() != nil {
+		return 0, false
+	}
+	return duration.AsDuration(), true
+}
@@ -0,0 +1,137 @@
+// Copyright 2021-2024 The Connect Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package connect_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	connect "connectrpc.com/connect"
+	"connectrpc.com/connect/internal/assert"
+	pingv1 "connectrpc.com/connect/internal/gen/connect/ping/v1"
+	"connectrpc.com/connect/internal/gen/connect/ping/v1/pingv1connect"
+	"connectrpc.com/connect/internal/memhttp/memhttptest"
+)
+
+func TestRetryHintInterceptor(t *testing.T) {
+	t.Parallel()
+	const delay = 1500 * time.Millisecond
+	codes := map[string]connect.Code{
+		"unavailable": connect.CodeUnavailable,
+		"exhausted":   connect.CodeResourceExhausted,
+		"internal":    connect.CodeInternal,
+		"declined":    connect.CodeUnavailable,
+	}
+	mux := http.NewServeMux()
+	mux.Handle(pingv1connect.NewPingServiceHandler(
+		&pluggablePingServer{
+			ping: func(_ context.Context, request *connect.Request[pingv1.PingRequest]) (*connect.Response[pingv1.PingResponse], error) {
+				return nil, connect.NewError(codes[request.Msg.GetText()], errors.New(request.Msg.GetText()))
+			},
+			countUp: func(context.Context, *connect.Request[pingv1.CountUpRequest], *connect.ServerStream[pingv1.CountUpResponse]) error {
+				return connect.NewError(connect.CodeUnavailable, errors.New("unavailable"))
+			},
+		},
+		connect.WithInterceptors(connect.NewRetryHintInterceptor(func(err error) (time.Duration, bool) {
+			return delay, err.Error() != "unavailable: declined"
+		})),
+	))
+	server := memhttptest.NewServer(t, mux)
+	for _, protocol := range []struct {
+		name   string
+		option connect.ClientOption
+	}{
+		{name: "connect", option: connect.WithProtoJSON()},
+		{name: "grpc", option: connect.WithGRPC()},
+		{name: "grpcweb", option: connect.WithGRPCWeb()},
+	} {
+		protocol := protocol
+		t.Run(protocol.name, func(t *testing.T) {
+			t.Parallel()
+			client := pingv1connect.NewPingServiceClient(server.Client(), server.URL(), protocol.option)
+			ping := func(text string) error {
+				_, err := client.Ping(context.Background(), connect.NewRequest(&pingv1.PingRequest{Text: text}))
+				return err
+			}
+
+			err := ping("unavailable")
+			assert.Equal(t, connect.CodeOf(err), connect.CodeUnavailable)
+			got, ok := connect.RetryDelay(err)
+			assert.True(t, ok)
+			assert.Equal(t, got, delay)
+			var connectErr *connect.Error
+			assert.True(t, errors.As(err, &connectErr))
+			assert.Equal(t, len(connectErr.Details()), 1)
+			assert.Equal(t, connectErr.Details()[0].Type(), "google.rpc.RetryInfo")
+
+			got, ok = connect.RetryDelay(ping("exhausted"))
+			assert.True(t, ok)
+			assert.Equal(t, got, delay)
+
+			_, ok = connect.RetryDelay(ping("internal"))
+			assert.False(t, ok)
+			_, ok = connect.RetryDelay(ping("declined"))
+			assert.False(t, ok)
+
+			stream, err := client.CountUp(context.Background(), connect.NewRequest(&pingv1.CountUpRequest{Number: 1}))
+			assert.Nil(t, err)
+			assert.False(t, stream.Receive())
+			got, ok = connect.RetryDelay(stream.Err())
+			assert.True(t, ok)
+			assert.Equal(t, got, delay)
+			assert.Nil(t, stream.Close())
+		})
+	}
+}
+
+func TestRetryHintInterceptorSharedError(t *testing.T) {
+	t.Parallel()
+	// Handlers often return package-level sentinel errors. The interceptor
+	// must not mutate them, or concurrent calls race and accumulate details.
+	sentinel := connect.NewError(connect.CodeUnavailable, errors.New("overloaded"))
+	mux := http.NewServeMux()
+	mux.Handle(pingv1connect.NewPingServiceHandler(
+		&pluggablePingServer{
+			ping: func(context.Context, *connect.Request[pingv1.PingRequest]) (*connect.Response[pingv1.PingResponse], error) {
+				return nil, sentinel
+			},
+		},
+		connect.WithInterceptors(connect.NewRetryHintInterceptor(func(error) (time.Duration, bool) {
+			return time.Second, true
+		})),
+	))
+	server := memhttptest.NewServer(t, mux)
+	client := pingv1connect.NewPingServiceClient(server.Client(), server.URL())
+	var wg sync.WaitGroup
+	errs := make([]error, 32)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, errs[i] = client.Ping(context.Background(), connect.NewRequest(&pingv1.PingRequest{}))
+		}(i)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		var connectErr *connect.Error
+		assert.True(t, errors.As(err, &connectErr))
+		assert.Equal(t, len(connectErr.Details()), 1)
+	}
+	assert.Equal(t, len(sentinel.Details()), 0)
+}
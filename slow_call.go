@@ -0,0 +1,202 @@
+// Copyright 2021-2024 The Connect Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package connect
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const defaultSlowCallThreshold = 500 * time.Millisecond
+
+// SlowCall describes a completed RPC reported by the interceptor returned from
+// [NewSlowCallInterceptor].
+type SlowCall struct {
+	Spec          Spec
+	Peer          Peer
+	RequestHeader http.Header
+	// Duration is the end-to-end latency of the call. For streaming RPCs, it
+	// covers the whole stream: handlers measure until the implementation
+	// returns, and clients measure until CloseResponse.
+	Duration time.Duration
+	// Err is the error the call failed with, if any.
+	Err error
+}
+
+// A SlowCallOption configures the interceptor returned by
+// [NewSlowCallInterceptor].
+type SlowCallOption interface {
+	applyToSlowCall(*slowCallConfig)
+}
+
+// WithSlowCallThreshold sets the latency at or above which calls are reported.
+//
+// The default threshold is 500 milliseconds. Setting the threshold to zero
+// reports every call.
+func WithSlowCallThreshold(threshold time.Duration) SlowCallOption {
+	return &slowCallThresholdOption{Threshold: threshold}
+}
+
+// WithSlowCallErrors controls whether failed calls are reported regardless of
+// their latency. By default, they are.
+func WithSlowCallErrors(report bool) SlowCallOption {
+	return &slowCallErrorsOption{Report: report}
+}
+
+// NewSlowCallInterceptor constructs an interceptor that calls report for RPCs
+// that are slower than a threshold or that fail, and ignores all other calls.
+// This lets high-throughput services log or record every slow or failed call
+// in full detail without paying for a log line per call.
+//
+// The decision to report is made once the call completes, so nothing is
+// buffered for fast, successful calls. The interceptor may be used with both
+// clients and handlers, and report must be safe to call concurrently.
+func NewSlowCallInterceptor(report func(context.Context, *SlowCall), options ...SlowCallOption) Interceptor {
+	config := slowCallConfig{
+		Threshold:    defaultSlowCallThreshold,
+		ReportErrors: true,
+	}
+	for _, opt := range options {
+		opt.applyToSlowCall(&config)
+	}
+	return &slowCallInterceptor{config: config, report: report}
+}
+
+type slowCallConfig struct {
+	Threshold    time.Duration
+	ReportErrors bool
+}
+
+type slowCallThresholdOption struct {
+	Threshold time.Duration
+}
+
+func (o *slowCallThresholdOption) applyToSlowCall(config *slowCallConfig) {
+	config.Threshold = o.Threshold
+}
+
+type slowCallErrorsOption struct {
+	Report bool
+}
+
+func (o *slowCallErrorsOption) applyToSlowCall(config *slowCallConfig) {
+	config.ReportErrors = o.Report
+}
+
+type slowCallInterceptor struct {
+	config slowCallConfig
+	report func(context.Context, *SlowCall)
+}
+
+func (i *slowCallInterceptor) WrapUnary(next UnaryFunc) UnaryFunc {
+	return func(ctx context.Context, request AnyRequest) (AnyResponse, error) {
+		start := time.Now()
+		response, err := next(ctx, request)
+		i.maybeReport(ctx, request.Spec(), request.Peer(), request.Header(), time.Since(start), err)
+		return response, err
+	}
+}
+
+func (i *slowCallInterceptor) WrapStreamingClient(next StreamingClientFunc) StreamingClientFunc {
+	return func(ctx context.Context, spec Spec) StreamingClientConn {
+		return &slowCallClientConn{
+			StreamingClientConn: next(ctx, spec),
+			ctx:                 ctx,
+			interceptor:         i,
+			start:               time.Now(),
+		}
+	}
+}
+
+func (i *slowCallInterceptor) WrapStreamingHandler(next StreamingHandlerFunc) StreamingHandlerFunc {
+	return func(ctx context.Context, conn StreamingHandlerConn) error {
+		start := time.Now()
+		err := next(ctx, conn)
+		i.maybeReport(ctx, conn.Spec(), conn.Peer(), conn.RequestHeader(), time.Since(start), err)
+		return err
+	}
+}
+
+func (i *slowCallInterceptor) maybeReport(
+	ctx context.Context,
+	spec Spec,
+	peer Peer,
+	header http.Header,
+	duration time.Duration,
+	err error,
+) {
+	if duration < i.config.Threshold && (err == nil || !i.config.ReportErrors) {
+		return
+	}
+	i.report(ctx, &SlowCall{
+		Spec:          spec,
+		Peer:          peer,
+		RequestHeader: header,
+		Duration:      duration,
+		Err:           err,
+	})
+}
+
+// slowCallClientConn measures a client stream from its creation until
+// CloseResponse, remembering the first error the server sent.
+type slowCallClientConn struct {
+	StreamingClientConn
+
+	ctx         context.Context //nolint:containedctx
+	interceptor *slowCallInterceptor
+	start       time.Time
+
+	mu  sync.Mutex
+	err error
+
+	reportOnce sync.Once
+}
+
+func (c *slowCallClientConn) Receive(msg any) error {
+	err := c.StreamingClientConn.Receive(msg)
+	if err != nil && !errors.Is(err, io.EOF) {
+		c.mu.Lock()
+		if c.err == nil {
+			c.err = err
+		}
+		c.mu.Unlock()
+	}
+	return err
+}
+
+func (c *slowCallClientConn) CloseResponse() error {
+	closeErr := c.StreamingClientConn.CloseResponse()
+	c.reportOnce.Do(func() {
+		c.mu.Lock()
+		err := c.err
+		c.mu.Unlock()
+		if err == nil {
+			err = closeErr
+		}
+		c.interceptor.maybeReport(
+			c.ctx,
+			c.Spec(),
+			c.Peer(),
+			c.RequestHeader(),
+			time.Since(c.start),
+			err,
+		)
+	})
+	return closeErr
+}
@@ -0,0 +1,135 @@
+// Copyright 2021-2024 The Connect Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package connect_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	connect "connectrpc.com/connect"
+	"connectrpc.com/connect/internal/assert"
+	pingv1 "connectrpc.com/connect/internal/gen/connect/ping/v1"
+	"connectrpc.com/connect/internal/gen/connect/ping/v1/pingv1connect"
+	"connectrpc.com/connect/internal/memhttp/memhttptest"
+)
+
+func TestSlowCallInterceptor(t *testing.T) {
+	t.Parallel()
+	const threshold = 20 * time.Millisecond
+	var (
+		mu       sync.Mutex
+		reported []*connect.SlowCall
+	)
+	record := func(_ context.Context, call *connect.SlowCall) {
+		mu.Lock()
+		defer mu.Unlock()
+		reported = append(reported, call)
+	}
+	drain := func() []*connect.SlowCall {
+		mu.Lock()
+		defer mu.Unlock()
+		calls := reported
+		reported = nil
+		return calls
+	}
+	mux := http.NewServeMux()
+	mux.Handle(pingv1connect.NewPingServiceHandler(
+		&pluggablePingServer{
+			ping: func(_ context.Context, request *connect.Request[pingv1.PingRequest]) (*connect.Response[pingv1.PingResponse], error) {
+				if request.Msg.GetNumber() < 0 {
+					return nil, connect.NewError(connect.CodeInvalidArgument, errors.New("negative"))
+				}
+				time.Sleep(time.Duration(request.Msg.GetNumber()) * time.Millisecond)
+				return connect.NewResponse(&pingv1.PingResponse{}), nil
+			},
+			countUp: func(_ context.Context, _ *connect.Request[pingv1.CountUpRequest], stream *connect.ServerStream[pingv1.CountUpResponse]) error {
+				for i := 0; i < 2; i++ {
+					time.Sleep(threshold)
+					if err := stream.Send(&pingv1.CountUpResponse{Number: int64(i)}); err != nil {
+						return err
+					}
+				}
+				return nil
+			},
+		},
+		connect.WithInterceptors(connect.NewSlowCallInterceptor(record, connect.WithSlowCallThreshold(threshold))),
+	))
+	server := memhttptest.NewServer(t, mux)
+	client := pingv1connect.NewPingServiceClient(server.Client(), server.URL())
+	ping := func(t *testing.T, number int64) {
+		t.Helper()
+		_, _ = client.Ping(context.Background(), connect.NewRequest(&pingv1.PingRequest{Number: number}))
+	}
+
+	t.Run("fast", func(t *testing.T) {
+		ping(t, 0)
+		assert.Equal(t, len(drain()), 0)
+	})
+	t.Run("slow", func(t *testing.T) {
+		ping(t, 2*threshold.Milliseconds())
+		calls := drain()
+		assert.Equal(t, len(calls), 1)
+		assert.Equal(t, calls[0].Spec.Procedure, pingv1connect.PingServicePingProcedure)
+		assert.True(t, calls[0].Duration >= 2*threshold)
+		assert.Nil(t, calls[0].Err)
+	})
+	t.Run("error", func(t *testing.T) {
+		ping(t, -1)
+		calls := drain()
+		assert.Equal(t, len(calls), 1)
+		assert.Equal(t, connect.CodeOf(calls[0].Err), connect.CodeInvalidArgument)
+	})
+	t.Run("stream", func(t *testing.T) {
+		// Each message is fast, but the stream as a whole is slow.
+		stream, err := client.CountUp(context.Background(), connect.NewRequest(&pingv1.CountUpRequest{}))
+		assert.Nil(t, err)
+		for stream.Receive() {
+		}
+		assert.Nil(t, stream.Err())
+		assert.Nil(t, stream.Close())
+		calls := drain()
+		assert.Equal(t, len(calls), 1)
+		assert.Equal(t, calls[0].Spec.StreamType, connect.StreamTypeServer)
+		assert.True(t, calls[0].Duration >= 2*threshold)
+	})
+	t.Run("client", func(t *testing.T) {
+		var clientCalls []*connect.SlowCall
+		client := pingv1connect.NewPingServiceClient(
+			server.Client(),
+			server.URL(),
+			connect.WithInterceptors(connect.NewSlowCallInterceptor(
+				func(_ context.Context, call *connect.SlowCall) { clientCalls = append(clientCalls, call) },
+				connect.WithSlowCallThreshold(threshold),
+				connect.WithSlowCallErrors(false),
+			)),
+		)
+		_, err := client.Ping(context.Background(), connect.NewRequest(&pingv1.PingRequest{Number: -1}))
+		assert.NotNil(t, err)
+		assert.Equal(t, len(clientCalls), 0)
+		stream, err := client.CountUp(context.Background(), connect.NewRequest(&pingv1.CountUpRequest{}))
+		assert.Nil(t, err)
+		for stream.Receive() {
+		}
+		assert.Nil(t, stream.Close())
+		assert.Equal(t, len(clientCalls), 1)
+		assert.True(t, clientCalls[0].Spec.IsClient)
+		assert.True(t, clientCalls[0].Duration >= 2*threshold)
+		drain()
+	})
+}
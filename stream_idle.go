@@ -0,0 +1,105 @@
+// Copyright 2021-2024 The Connect Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package connect
+
+import (
+	"errors"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// idleTimer calls onIdle if it isn't reset within the timeout. Streams
+// configured with WithStreamIdleTimeout reset it whenever they receive a
+// message.
+type idleTimer struct {
+	timeout time.Duration
+	timer   *time.Timer
+	fired   atomic.Bool
+	mu      sync.Mutex // serializes Reset and Stop
+}
+
+func newIdleTimer(timeout time.Duration, onIdle func()) *idleTimer {
+	idle := &idleTimer{timeout: timeout}
+	idle.timer = time.AfterFunc(timeout, func() {
+		idle.fired.Store(true)
+		onIdle()
+	})
+	return idle
+}
+
+func (t *idleTimer) Reset() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.fired.Load() {
+		return
+	}
+	t.timer.Reset(t.timeout)
+}
+
+func (t *idleTimer) Stop() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.timer.Stop()
+}
+
+// Wrap replaces errors caused by the timer firing with a clearer error.
+func (t *idleTimer) Wrap(err error) error {
+	if err == nil || errors.Is(err, io.EOF) || !t.fired.Load() {
+		return err
+	}
+	return errorf(CodeDeadlineExceeded, "stream idle: no message received for %v", t.timeout)
+}
+
+// idleHandlerConn resets the idle timer each time the handler receives a
+// message.
+type idleHandlerConn struct {
+	handlerConnCloser
+
+	idle *idleTimer
+}
+
+func (c *idleHandlerConn) Receive(msg any) error {
+	err := c.handlerConnCloser.Receive(msg)
+	if err == nil {
+		c.idle.Reset()
+	}
+	return c.idle.Wrap(err)
+}
+
+// idleClientConn resets the idle timer each time the client receives a
+// message, and stops it once the response is closed.
+type idleClientConn struct {
+	StreamingClientConn
+
+	idle   *idleTimer
+	cancel func()
+}
+
+func (c *idleClientConn) Receive(msg any) error {
+	err := c.StreamingClientConn.Receive(msg)
+	if err == nil {
+		c.idle.Reset()
+	}
+	return c.idle.Wrap(err)
+}
+
+func (c *idleClientConn) CloseResponse() error {
+	c.idle.Stop()
+	err := c.StreamingClientConn.CloseResponse()
+	c.cancel()
+	return c.idle.Wrap(err)
+}
@@ -0,0 +1,119 @@
+// Copyright 2021-2024 The Connect Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package connect_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	connect "connectrpc.com/connect"
+	"connectrpc.com/connect/internal/assert"
+	pingv1 "connectrpc.com/connect/internal/gen/connect/ping/v1"
+	"connectrpc.com/connect/internal/gen/connect/ping/v1/pingv1connect"
+	"connectrpc.com/connect/internal/memhttp/memhttptest"
+)
+
+func TestStreamIdleTimeout(t *testing.T) {
+	t.Parallel()
+	const idleTimeout = 50 * time.Millisecond
+	t.Run("handler", func(t *testing.T) {
+		t.Parallel()
+		handlerErr := make(chan error, 1)
+		mux := http.NewServeMux()
+		mux.Handle(pingv1connect.NewPingServiceHandler(
+			&pluggablePingServer{
+				cumSum: func(_ context.Context, stream *connect.BidiStream[pingv1.CumSumRequest, pingv1.CumSumResponse]) error {
+					for {
+						if _, err := stream.Receive(); err != nil {
+							if errors.Is(err, io.EOF) {
+								err = nil
+							}
+							handlerErr <- err
+							return err
+						}
+						if err := stream.Send(&pingv1.CumSumResponse{}); err != nil {
+							return err
+						}
+					}
+				},
+			},
+			connect.WithStreamIdleTimeout(idleTimeout),
+		))
+		server := memhttptest.NewServer(t, mux)
+		client := pingv1connect.NewPingServiceClient(server.Client(), server.URL())
+
+		// Heartbeats keep the stream alive well past the idle timeout.
+		stream := client.CumSum(context.Background())
+		for i := 0; i < 6; i++ {
+			assert.Nil(t, stream.Send(&pingv1.CumSumRequest{}))
+			_, err := stream.Receive()
+			assert.Nil(t, err)
+			time.Sleep(idleTimeout / 5)
+		}
+		assert.Nil(t, stream.CloseRequest())
+		assert.Nil(t, <-handlerErr)
+		assert.Nil(t, stream.CloseResponse())
+
+		// A stalled client is cut off.
+		stream = client.CumSum(context.Background())
+		assert.Nil(t, stream.Send(&pingv1.CumSumRequest{}))
+		_, err := stream.Receive()
+		assert.Nil(t, err)
+		err = <-handlerErr
+		assert.Equal(t, connect.CodeOf(err), connect.CodeDeadlineExceeded)
+		assert.True(t, strings.Contains(err.Error(), "stream idle"))
+		_, err = stream.Receive()
+		assert.Equal(t, connect.CodeOf(err), connect.CodeDeadlineExceeded)
+		assert.Nil(t, stream.CloseRequest())
+		assert.Nil(t, stream.CloseResponse())
+	})
+	t.Run("client", func(t *testing.T) {
+		t.Parallel()
+		mux := http.NewServeMux()
+		mux.Handle(pingv1connect.NewPingServiceHandler(&pluggablePingServer{
+			countUp: func(ctx context.Context, _ *connect.Request[pingv1.CountUpRequest], stream *connect.ServerStream[pingv1.CountUpResponse]) error {
+				for i := 0; i < 3; i++ {
+					if err := stream.Send(&pingv1.CountUpResponse{Number: int64(i)}); err != nil {
+						return err
+					}
+					time.Sleep(idleTimeout / 5)
+				}
+				<-ctx.Done() // stall
+				return ctx.Err()
+			},
+		}))
+		server := memhttptest.NewServer(t, mux)
+		client := pingv1connect.NewPingServiceClient(
+			server.Client(),
+			server.URL(),
+			connect.WithStreamIdleTimeout(idleTimeout),
+		)
+		stream, err := client.CountUp(context.Background(), connect.NewRequest(&pingv1.CountUpRequest{}))
+		assert.Nil(t, err)
+		var received int
+		for stream.Receive() {
+			received++
+		}
+		assert.Equal(t, received, 3)
+		assert.Equal(t, connect.CodeOf(stream.Err()), connect.CodeDeadlineExceeded)
+		assert.True(t, strings.Contains(stream.Err().Error(), "stream idle"))
+		_ = stream.Close()
+	})
+}
@@ -0,0 +1,173 @@
+// Copyright 2021-2024 The Connect Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package connect
+
+import (
+	"context"
+	"time"
+)
+
+// A StreamMessageRateOption configures the interceptor returned by
+// [NewStreamMessageRateLimiter].
+type StreamMessageRateOption interface {
+	applyToStreamMessageRate(*streamMessageRateConfig)
+}
+
+// WithStreamMessageBurst sets the number of messages a stream may receive in
+// a burst before throttling begins. The default burst is one second's worth
+// of messages.
+func WithStreamMessageBurst(burst int) StreamMessageRateOption {
+	return &streamMessageBurstOption{Burst: burst}
+}
+
+// WithStreamMessageMaxThrottle aborts streams that have been throttled
+// continuously for longer than the supplied duration. A well-behaved client
+// occasionally lets the limiter catch up, but a client flooding the stream
+// keeps it throttled indefinitely; once the throttle outlasts maxThrottle,
+// receiving fails with [CodeResourceExhausted].
+//
+// By default, streams are throttled indefinitely and never aborted.
+func WithStreamMessageMaxThrottle(maxThrottle time.Duration) StreamMessageRateOption {
+	return &streamMessageMaxThrottleOption{MaxThrottle: maxThrottle}
+}
+
+// NewStreamMessageRateLimiter constructs a handler interceptor that limits
+// the rate at which each client and bidirectional stream receives messages to
+// msgsPerSec. Each stream has its own limit. Once a stream exhausts its burst,
+// Receive waits until the rate allows another message, which applies
+// backpressure to the client through HTTP flow control. To abort flooding
+// clients rather than slowing them down indefinitely, use
+// [WithStreamMessageMaxThrottle].
+//
+// Waiting respects the stream's context: if it's canceled while a Receive is
+// throttled, Receive returns immediately with the context's error. The
+// interceptor has no effect on unary calls or on clients, and it's a no-op if
+// msgsPerSec isn't positive.
+func NewStreamMessageRateLimiter(msgsPerSec int, options ...StreamMessageRateOption) Interceptor {
+	config := streamMessageRateConfig{
+		Rate:  msgsPerSec,
+		Burst: msgsPerSec,
+	}
+	for _, opt := range options {
+		opt.applyToStreamMessageRate(&config)
+	}
+	if config.Burst < 1 {
+		config.Burst = 1
+	}
+	return &streamMessageRateInterceptor{config: config}
+}
+
+type streamMessageRateConfig struct {
+	Rate        int
+	Burst       int
+	MaxThrottle time.Duration
+}
+
+type streamMessageBurstOption struct {
+	Burst int
+}
+
+func (o *streamMessageBurstOption) applyToStreamMessageRate(config *streamMessageRateConfig) {
+	config.Burst = o.Burst
+}
+
+type streamMessageMaxThrottleOption struct {
+	MaxThrottle time.Duration
+}
+
+func (o *streamMessageMaxThrottleOption) applyToStreamMessageRate(config *streamMessageRateConfig) {
+	config.MaxThrottle = o.MaxThrottle
+}
+
+type streamMessageRateInterceptor struct {
+	config streamMessageRateConfig
+}
+
+func (i *streamMessageRateInterceptor) WrapUnary(next UnaryFunc) UnaryFunc {
+	return next
+}
+
+func (i *streamMessageRateInterceptor) WrapStreamingClient(next StreamingClientFunc) StreamingClientFunc {
+	return next
+}
+
+func (i *streamMessageRateInterceptor) WrapStreamingHandler(next StreamingHandlerFunc) StreamingHandlerFunc {
+	if i.config.Rate <= 0 {
+		return next
+	}
+	return func(ctx context.Context, conn StreamingHandlerConn) error {
+		if conn.Spec().StreamType&StreamTypeClient == 0 {
+			return next(ctx, conn)
+		}
+		return next(ctx, &rateLimitedHandlerConn{
+			StreamingHandlerConn: conn,
+			ctx:                  ctx,
+			config:               &i.config,
+			tokens:               float64(i.config.Burst),
+			last:                 time.Now(),
+		})
+	}
+}
+
+// rateLimitedHandlerConn throttles Receive with a token bucket. Streams don't
+// support concurrent calls to Receive, so the bucket isn't synchronized.
+type rateLimitedHandlerConn struct {
+	StreamingHandlerConn
+
+	ctx            context.Context //nolint:containedctx
+	config         *streamMessageRateConfig
+	tokens         float64
+	last           time.Time
+	throttledSince time.Time // zero unless the previous Receive was throttled
+}
+
+func (c *rateLimitedHandlerConn) Receive(msg any) error {
+	if err := c.wait(); err != nil {
+		return err
+	}
+	return c.StreamingHandlerConn.Receive(msg)
+}
+
+func (c *rateLimitedHandlerConn) wait() error {
+	now := time.Now()
+	rate := float64(c.config.Rate)
+	c.tokens = min(c.tokens+now.Sub(c.last).Seconds()*rate, float64(c.config.Burst))
+	c.last = now
+	c.tokens--
+	if c.tokens >= 0 {
+		c.throttledSince = time.Time{}
+		return nil
+	}
+	delay := time.Duration(-c.tokens / rate * float64(time.Second))
+	if c.throttledSince.IsZero() {
+		c.throttledSince = now
+	}
+	if maxThrottle := c.config.MaxThrottle; maxThrottle > 0 && now.Add(delay).Sub(c.throttledSince) > maxThrottle {
+		c.tokens++ // the message won't be received
+		return errorf(
+			CodeResourceExhausted,
+			"stream exceeded %d messages per second for more than %v",
+			c.config.Rate, maxThrottle,
+		)
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-c.ctx.Done():
+		return wrapIfContextError(c.ctx.Err())
+	case <-timer.C:
+		return nil
+	}
+}
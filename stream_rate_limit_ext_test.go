@@ -0,0 +1,137 @@
+// Copyright 2021-2024 The Connect Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package connect_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+
+	connect "connectrpc.com/connect"
+	"connectrpc.com/connect/internal/assert"
+	pingv1 "connectrpc.com/connect/internal/gen/connect/ping/v1"
+	"connectrpc.com/connect/internal/gen/connect/ping/v1/pingv1connect"
+	"connectrpc.com/connect/internal/memhttp/memhttptest"
+)
+
+func TestStreamMessageRateLimiter(t *testing.T) {
+	t.Parallel()
+	const rate = 50
+	newClient := func(t *testing.T, rate int, handlerErr chan<- error, options ...connect.StreamMessageRateOption) pingv1connect.PingServiceClient {
+		t.Helper()
+		mux := http.NewServeMux()
+		mux.Handle(pingv1connect.NewPingServiceHandler(
+			&pluggablePingServer{
+				ping: func(_ context.Context, request *connect.Request[pingv1.PingRequest]) (*connect.Response[pingv1.PingResponse], error) {
+					return connect.NewResponse(&pingv1.PingResponse{Number: request.Msg.GetNumber()}), nil
+				},
+				sum: func(_ context.Context, stream *connect.ClientStream[pingv1.SumRequest]) (*connect.Response[pingv1.SumResponse], error) {
+					var sum int64
+					for stream.Receive() {
+						sum += stream.Msg().GetNumber()
+					}
+					handlerErr <- stream.Err()
+					if err := stream.Err(); err != nil {
+						return nil, err
+					}
+					return connect.NewResponse(&pingv1.SumResponse{Sum: sum}), nil
+				},
+			},
+			connect.WithInterceptors(connect.NewStreamMessageRateLimiter(rate, options...)),
+		))
+		server := memhttptest.NewServer(t, mux)
+		return pingv1connect.NewPingServiceClient(server.Client(), server.URL())
+	}
+	flood := func(ctx context.Context, client pingv1connect.PingServiceClient, messages int) (*connect.Response[pingv1.SumResponse], error) {
+		stream := client.Sum(ctx)
+		for i := 0; i < messages; i++ {
+			if err := stream.Send(&pingv1.SumRequest{Number: 1}); err != nil {
+				break // the handler gave up, so the error is in the response
+			}
+		}
+		return stream.CloseAndReceive()
+	}
+
+	t.Run("throttle", func(t *testing.T) {
+		t.Parallel()
+		handlerErr := make(chan error, 1)
+		client := newClient(t, rate, handlerErr, connect.WithStreamMessageBurst(1))
+		start := time.Now()
+		response, err := flood(context.Background(), client, 21)
+		assert.Nil(t, err)
+		assert.Nil(t, <-handlerErr)
+		assert.Equal(t, response.Msg.GetSum(), 21)
+		// After the first message, each one waits for 1/rate seconds. Allow for
+		// coarse timers.
+		assert.True(t, time.Since(start) >= 20*time.Second/rate*9/10)
+	})
+	t.Run("burst", func(t *testing.T) {
+		t.Parallel()
+		handlerErr := make(chan error, 1)
+		client := newClient(t, rate, handlerErr)
+		start := time.Now()
+		response, err := flood(context.Background(), client, rate)
+		assert.Nil(t, err)
+		assert.Nil(t, <-handlerErr)
+		assert.Equal(t, response.Msg.GetSum(), rate)
+		assert.True(t, time.Since(start) < time.Second/2)
+	})
+	t.Run("abort", func(t *testing.T) {
+		t.Parallel()
+		handlerErr := make(chan error, 1)
+		client := newClient(
+			t,
+			rate,
+			handlerErr,
+			connect.WithStreamMessageBurst(1),
+			connect.WithStreamMessageMaxThrottle(100*time.Millisecond),
+		)
+		_, err := flood(context.Background(), client, 100)
+		assert.Equal(t, connect.CodeOf(err), connect.CodeResourceExhausted)
+		assert.Equal(t, connect.CodeOf(<-handlerErr), connect.CodeResourceExhausted)
+	})
+	t.Run("canceled", func(t *testing.T) {
+		t.Parallel()
+		handlerErr := make(chan error, 1)
+		// With a rate of one message per second, the second Receive waits for
+		// a full second unless it notices the cancellation.
+		client := newClient(t, 1, handlerErr, connect.WithStreamMessageBurst(1))
+		ctx, cancel := context.WithCancel(context.Background())
+		stream := client.Sum(ctx)
+		assert.Nil(t, stream.Send(&pingv1.SumRequest{Number: 1}))
+		assert.Nil(t, stream.Send(&pingv1.SumRequest{Number: 1}))
+		cancel()
+		_, err := stream.CloseAndReceive()
+		assert.Equal(t, connect.CodeOf(err), connect.CodeCanceled)
+		select {
+		case err := <-handlerErr:
+			assert.NotNil(t, err)
+			assert.False(t, errors.Is(err, io.EOF))
+		case <-time.After(time.Second / 2):
+			t.Fatal("throttled Receive didn't respect cancellation")
+		}
+	})
+	t.Run("unary", func(t *testing.T) {
+		t.Parallel()
+		client := newClient(t, rate, nil, connect.WithStreamMessageBurst(1))
+		for i := 0; i < rate; i++ {
+			_, err := client.Ping(context.Background(), connect.NewRequest(&pingv1.PingRequest{}))
+			assert.Nil(t, err)
+		}
+	})
+}